@@ -0,0 +1,321 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2020  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/go-connections/nat"
+)
+
+// labels of the containers, networks and volumes of the stacks
+const (
+	stackLabel     = "cc.arduino.connector.stack"
+	serviceLabel   = "cc.arduino.connector.service"
+	stackHashLabel = "cc.arduino.connector.config-hash"
+	dependsLabel   = "cc.arduino.connector.depends-on"
+)
+
+// stackDefaultNetwork is the network of the services that don't list any,
+// it's created when a service needs it
+const stackDefaultNetwork = "default"
+
+// stackNamePattern is the syntax of the names of the stacks and of their
+// services, networks and volumes, that become part of docker object names
+var stackNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// StackSpec describes an application of several containers, like a compose
+// file does: its services, the networks that connect them and the volumes
+// where they keep their data
+type StackSpec struct {
+	Name     string                   `json:"name"`
+	Services map[string]*StackService `json:"services"`
+	Networks map[string]*StackNetwork `json:"networks,omitempty"`
+	Volumes  map[string]*StackVolume  `json:"volumes,omitempty"`
+}
+
+// StackService is a container of a stack. Ports are published as
+// [ip:]host:container[/proto], Volumes are mounted as source:target[:ro]
+// where source is a volume of the stack or an absolute path of the host.
+// Restart is the restart policy of docker: no, always, unless-stopped or
+// on-failure[:max-retries]. The services start after their DependsOn.
+type StackService struct {
+	Image       string            `json:"image"`
+	Command     []string          `json:"command,omitempty"`
+	Environment []string          `json:"environment,omitempty"`
+	Ports       []string          `json:"ports,omitempty"`
+	Volumes     []string          `json:"volumes,omitempty"`
+	Networks    []string          `json:"networks,omitempty"`
+	DependsOn   []string          `json:"depends_on,omitempty"`
+	Restart     string            `json:"restart,omitempty"`
+	Privileged  bool              `json:"privileged,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+}
+
+// StackNetwork is a network of a stack, bridge unless Driver says otherwise
+type StackNetwork struct {
+	Driver string            `json:"driver,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// StackVolume is a named volume of a stack, local unless Driver says otherwise
+type StackVolume struct {
+	Driver string            `json:"driver,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// stackObjectName is the docker name of a service, network or volume
+func stackObjectName(stack, name string) string {
+	return stack + "_" + name
+}
+
+// networks returns the networks of a service
+func (svc *StackService) networks() []string {
+	if len(svc.Networks) == 0 {
+		return []string{stackDefaultNetwork}
+	}
+	return svc.Networks
+}
+
+// Validate checks that the stack is consistent and that its services can be
+// started in order
+func (spec *StackSpec) Validate() error {
+	if !stackNamePattern.MatchString(spec.Name) {
+		return fmt.Errorf("invalid stack name '%s'", spec.Name)
+	}
+	if len(spec.Services) == 0 {
+		return fmt.Errorf("the stack has no services")
+	}
+	for name := range spec.Networks {
+		if !stackNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid network name '%s'", name)
+		}
+	}
+	for name := range spec.Volumes {
+		if !stackNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid volume name '%s'", name)
+		}
+	}
+	for name, svc := range spec.Services {
+		if !stackNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid service name '%s'", name)
+		}
+		if svc == nil || svc.Image == "" {
+			return fmt.Errorf("service %s: missing image", name)
+		}
+		if _, _, err := nat.ParsePortSpecs(svc.Ports); err != nil {
+			return fmt.Errorf("service %s: %s", name, err)
+		}
+		if _, err := restartPolicy(svc.Restart); err != nil {
+			return fmt.Errorf("service %s: %s", name, err)
+		}
+		for _, net := range svc.networks() {
+			if _, ok := spec.Networks[net]; !ok && net != stackDefaultNetwork {
+				return fmt.Errorf("service %s: undefined network %s", name, net)
+			}
+		}
+		for _, vol := range svc.Volumes {
+			parts := strings.Split(vol, ":")
+			if len(parts) < 2 || len(parts) > 3 || parts[1] == "" {
+				return fmt.Errorf("service %s: invalid volume '%s'", name, vol)
+			}
+			if _, ok := spec.Volumes[parts[0]]; !ok && !strings.HasPrefix(parts[0], "/") {
+				return fmt.Errorf("service %s: undefined volume %s", name, parts[0])
+			}
+		}
+		for _, dep := range svc.DependsOn {
+			if _, ok := spec.Services[dep]; !ok || dep == name {
+				return fmt.Errorf("service %s: invalid dependency %s", name, dep)
+			}
+		}
+	}
+	_, err := spec.order()
+	return err
+}
+
+// order returns the services in the order they start: every service comes
+// after its dependencies
+func (spec *StackSpec) order() ([]string, error) {
+	deps := map[string][]string{}
+	for name, svc := range spec.Services {
+		deps[name] = svc.DependsOn
+	}
+	return dependencyOrder(deps)
+}
+
+// dependencyOrder sorts the names so that every one comes after its
+// dependencies, alphabetically when the order doesn't matter
+func dependencyOrder(deps map[string][]string) ([]string, error) {
+	names := []string{}
+	for name := range deps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	order := []string{}
+	state := map[string]int{} // 1 visiting, 2 done
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case 1:
+			return fmt.Errorf("circular dependency: %s", strings.Join(append(path, name), " -> "))
+		case 2:
+			return nil
+		}
+		state[name] = 1
+		sorted := append([]string{}, deps[name]...)
+		sort.Strings(sorted)
+		for _, dep := range sorted {
+			if _, ok := deps[dep]; !ok {
+				continue
+			}
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = 2
+		order = append(order, name)
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// restartPolicy parses the restart policy of a service
+func restartPolicy(policy string) (container.RestartPolicy, error) {
+	parts := strings.SplitN(policy, ":", 2)
+	res := container.RestartPolicy{Name: parts[0]}
+	switch parts[0] {
+	case "", "no":
+		res.Name = "no"
+	case "always", "unless-stopped":
+	case "on-failure":
+		if len(parts) == 2 {
+			retries, err := strconv.Atoi(parts[1])
+			if err != nil || retries < 0 {
+				return res, fmt.Errorf("invalid restart policy '%s'", policy)
+			}
+			res.MaximumRetryCount = retries
+		}
+		return res, nil
+	default:
+		return res, fmt.Errorf("invalid restart policy '%s'", policy)
+	}
+	if len(parts) == 2 {
+		return res, fmt.Errorf("invalid restart policy '%s'", policy)
+	}
+	return res, nil
+}
+
+// serviceHash identifies the configuration of a service: the container of
+// the service is recreated when it changes
+func serviceHash(svc *StackService) string {
+	data, err := json.Marshal(svc)
+	if err != nil {
+		panic(err) // Means that something went really wrong
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// containerConfig returns the configuration of the container of a service.
+// It's connected to its first network when it's created, to the others
+// returned in extraNetworks after.
+func (spec *StackSpec) containerConfig(name string) (*container.Config, *container.HostConfig, *network.NetworkingConfig, []string, error) {
+	svc := spec.Services[name]
+	exposed, bindings, err := nat.ParsePortSpecs(svc.Ports)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	restart, err := restartPolicy(svc.Restart)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	labels := map[string]string{}
+	for k, v := range svc.Labels {
+		labels[k] = v
+	}
+	labels[stackLabel] = spec.Name
+	labels[serviceLabel] = name
+	labels[stackHashLabel] = serviceHash(svc)
+	labels[dependsLabel] = strings.Join(svc.DependsOn, ",")
+
+	config := &container.Config{
+		Image:        svc.Image,
+		Cmd:          svc.Command,
+		Env:          svc.Environment,
+		ExposedPorts: exposed,
+		Labels:       labels,
+	}
+	host := &container.HostConfig{
+		PortBindings:  bindings,
+		RestartPolicy: restart,
+		Privileged:    svc.Privileged,
+	}
+	for _, vol := range svc.Volumes {
+		if !strings.HasPrefix(vol, "/") {
+			vol = stackObjectName(spec.Name, vol)
+		}
+		host.Binds = append(host.Binds, vol)
+	}
+
+	networks := svc.networks()
+	endpoint := func() *network.EndpointSettings {
+		return &network.EndpointSettings{Aliases: []string{name}}
+	}
+	networking := &network.NetworkingConfig{EndpointsConfig: map[string]*network.EndpointSettings{
+		stackObjectName(spec.Name, networks[0]): endpoint(),
+	}}
+	host.NetworkMode = container.NetworkMode(stackObjectName(spec.Name, networks[0]))
+	extra := []string{}
+	for _, net := range networks[1:] {
+		extra = append(extra, stackObjectName(spec.Name, net))
+	}
+	return config, host, networking, extra, nil
+}
+
+// usedNetworks returns the networks of the stack used by at least a service
+func (spec *StackSpec) usedNetworks() []string {
+	used := map[string]bool{}
+	for _, svc := range spec.Services {
+		for _, net := range svc.networks() {
+			used[net] = true
+		}
+	}
+	res := []string{}
+	for net := range used {
+		res = append(res, net)
+	}
+	sort.Strings(res)
+	return res
+}
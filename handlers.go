@@ -20,6 +20,10 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -41,184 +45,203 @@ import (
 	"golang.org/x/crypto/ssh/terminal"
 )
 
-// StatusEvent replies with the current status of the arduino-connector
-func (status *Status) StatusEvent(client mqtt.Client, msg mqtt.Message) {
-	status.Publish()
+// SelfUpdateRequest are the parameters of /update
+type SelfUpdateRequest struct {
+	URL       string `json:"url"`
+	Signature string `json:"signature"`
+	Token     string `json:"token"`
 }
 
-// UpdateEvent handles the connector autoupdate
+// SelfUpdate handles the connector autoupdate
 // Any URL must be signed with Arduino private key
-func (status *Status) UpdateEvent(client mqtt.Client, msg mqtt.Message) {
-	var info struct {
-		URL       string `json:"url"`
-		Signature string `json:"signature"`
-		Token     string `json:"token"`
-	}
-	err := json.Unmarshal(msg.Payload(), &info)
-	if err != nil {
-		status.Error("/update", errors.Wrapf(err, "unmarshal %s", msg.Payload()))
-		return
-	}
+func (status *Status) SelfUpdate(ctx context.Context, job *JobHandle, info SelfUpdateRequest) error {
 	executablePath, _ := os.Executable()
 	name := filepath.Join(os.TempDir(), filepath.Base(executablePath))
-	err = downloadFile(name, info.URL, info.Token)
+	job.Log("Downloading " + info.URL)
+	err := downloadFile(ctx, name, info.URL, info.Token)
 	if err != nil {
-		return
+		return errors.Wrapf(err, "download file %s", info.URL)
 	}
-	err = downloadFile(name+".sig", info.URL+".sig", info.Token)
+	err = downloadFile(ctx, name+".sig", info.URL+".sig", info.Token)
 	if err != nil {
-		status.Error("/update", errors.Wrap(err, "no signature file "+info.URL+".sig"))
-		return
+		return errors.Wrap(err, "no signature file "+info.URL+".sig")
 	}
 	// check the signature
+	job.Log("Checking the signature")
 	err = checkGPGSig(name, name+".sig")
 	if err != nil {
-		status.Error("/update", errors.Wrap(err, "wrong signature "+info.URL+".sig"))
-		return
+		return errors.Wrap(err, "wrong signature "+info.URL+".sig")
 	}
 	// chmod it
 	err = os.Chmod(name, 0755)
 	if err != nil {
-		status.Error("/update", errors.Wrapf(err, "chmod 755 %s", name))
-		return
+		return errors.Wrapf(err, "chmod 755 %s", name)
 	}
 	err = os.Rename(executablePath, executablePath+".old")
 	if err != nil {
-		return
+		return errors.Wrapf(err, "rename %s", executablePath)
 	}
 	// copy it over existing binary
 	err = copyFileAndRemoveOriginal(name, executablePath)
 	if err != nil {
 		// rollback
-		err = os.Rename(executablePath+".old", executablePath)
-		if err != nil {
-			return
+		if errRollback := os.Rename(executablePath+".old", executablePath); errRollback != nil {
+			return errors.Wrapf(errRollback, "restore %s", executablePath)
 		}
-		status.Error("/update", errors.Wrap(err, "error copying itself from "+name+" to "+executablePath))
-		return
+		return errors.Wrap(err, "error copying itself from "+name+" to "+executablePath)
 	}
 	err = os.Chmod(executablePath, 0755)
 	if err != nil {
-		return
+		return errors.Wrapf(err, "chmod 755 %s", executablePath)
 	}
 	err = os.Remove(executablePath + ".old")
 	if err != nil {
-		return
+		return errors.Wrapf(err, "remove %s", executablePath+".old")
 	}
+	job.Log("Restarting")
 	// leap of faith: kill itself, systemd should respawn the process
 	os.Exit(0)
+	return nil
 }
 
-// UploadEvent receives the url and name of the sketch binary, then it
+// UploadRequest are the parameters of /upload
+type UploadRequest struct {
+	ID            string            `json:"id"`
+	URL           string            `json:"url"`
+	Name          string            `json:"name"`
+	Token         string            `json:"token"`
+	RestartPolicy *RestartPolicy    `json:"restart_policy"`
+	Environment   map[string]string `json:"environment"`
+}
+
+// Upload receives the url and name of the sketch binary, then it
 // - downloads the binary,
 // - chmods +x it
 // - executes redirecting stdout and sterr to a proper logger
-func (status *Status) UploadEvent(client mqtt.Client, msg mqtt.Message) {
-	var info struct {
-		ID    string `json:"id"`
-		URL   string `json:"url"`
-		Name  string `json:"name"`
-		Token string `json:"token"`
-	}
-	err := json.Unmarshal(msg.Payload(), &info)
-	if err != nil {
-		status.Error("/upload", errors.Wrapf(err, "unmarshal %s", msg.Payload()))
-		return
-	}
-
+func (status *Status) Upload(ctx context.Context, job *JobHandle, info UploadRequest) (string, error) {
+	var err error
 	if info.ID == "" {
 		info.ID = info.Name
 	}
 
+	if info.RestartPolicy != nil {
+		if err = info.RestartPolicy.Validate(); err != nil {
+			return "", badRequest(err)
+		}
+	}
+
 	// Stop and delete if existing
 	var sketch SketchStatus
-	if sketch, ok := status.Sketches[info.ID]; ok {
-		err = applyAction(sketch, "STOP", status)
+	if old, ok := status.Sketch(info.ID); ok {
+		var oldPID int
+		status.UpdateSketch(old, func(old *SketchStatus) {
+			// the new binary inherits the restart policy of the old one
+			sketch.RestartPolicy = old.RestartPolicy
+			old.DesiredState = "STOPPED"
+			oldPID = old.PID
+		})
+		job.Log(fmt.Sprintf("Stopping the running sketch (pid %d)", oldPID))
+		err = applyAction(old, "STOP", status)
 		if err != nil {
-			status.Error("/upload", errors.Wrapf(err, "stop pid %d", sketch.PID))
-			return
+			return "", errors.Wrapf(err, "stop pid %d", oldPID)
 		}
 
 		sketchFolder, errFolder := getSketchFolder(status)
 		if errFolder != nil {
-			return
+			return "", errors.Wrap(errFolder, "sketch folder")
 		}
-		sketchPath := filepath.Join(sketchFolder, sketch.Name)
+		sketchPath := filepath.Join(sketchFolder, old.Name)
 
 		if _, err = os.Stat(sketchPath); !os.IsNotExist(err) {
 			err = os.Remove(sketchPath)
 			if err != nil {
-				status.Error("/upload", errors.Wrapf(err, "remove %s", sketch.Name))
-				return
+				return "", errors.Wrapf(err, "remove %s", old.Name)
 			}
 		}
 	}
 
 	folder, err := getSketchFolder(status)
 	if err != nil {
-		status.Error("/upload", errors.Wrapf(err, "create sketch folder %s", info.ID))
-		return
+		return "", errors.Wrapf(err, "create sketch folder %s", info.ID)
 	}
 
 	// download the binary
 	name := filepath.Join(folder, info.Name)
-	err = downloadFile(name, info.URL, info.Token)
+	job.Log("Downloading " + info.URL)
+	err = downloadFile(ctx, name, info.URL, info.Token)
 	if err != nil {
-		status.Error("/upload", errors.Wrapf(err, "download file %s", info.URL))
-		return
+		return "", errors.Wrapf(err, "download file %s", info.URL)
 	}
 
 	// download the binary sig
 	sigName := filepath.Join(folder, info.Name+".sig")
-	err = downloadFile(sigName, info.URL+".sig", info.Token)
+	err = downloadFile(ctx, sigName, info.URL+".sig", info.Token)
 	if err != nil {
-		status.Error("/upload", errors.Wrapf(err, "download file signature %s", info.URL+".sig"))
-		return
+		return "", errors.Wrapf(err, "download file signature %s", info.URL+".sig")
 	}
 	sigFile, err := ioutil.ReadFile(sigName)
 	if err != nil {
-		status.Error("/upload", errors.Wrapf(err, "open file signature %s", info.URL))
-		return
+		return "", errors.Wrapf(err, "open file signature %s", info.URL)
 	}
 
 	binFile, err := ioutil.ReadFile(name)
 	if err != nil {
-		status.Error("/upload", errors.Wrapf(err, "open file for file signature %s", info.URL))
-		return
+		return "", errors.Wrapf(err, "open file for file signature %s", info.URL)
 	}
 
+	job.Log("Checking the signature")
 	err = verifyBinary(binFile, sigFile, status.config.SignatureKey)
 	if err != nil {
-		status.Error("/upload", errors.Wrapf(err, "signature do not match %s", info.URL))
-		return
+		return "", errors.Wrapf(err, "signature do not match %s", info.URL)
 	}
 
 	// chmod it
 	err = os.Chmod(name, 0700)
 	if err != nil {
-		status.Error("/upload", errors.Wrapf(err, "chmod 700 %s", name))
-		return
+		return "", errors.Wrapf(err, "chmod 700 %s", name)
 	}
 
 	sketch.ID = info.ID
 	sketch.Name = info.Name
-	// save ID-Name to a sort of DB
-	insertSketchInDB(sketch.Name, sketch.ID, status)
+	sketch.DesiredState = "RUNNING"
+	sketch.environment = info.Environment
+	if info.RestartPolicy != nil {
+		sketch.RestartPolicy = *info.RestartPolicy
+	}
+
+	// save the sketch in the DB
+	db, err := getSketchDB(status)
+	if err != nil {
+		return "", errors.Wrap(err, "open sketch db")
+	}
+	hash := sha256.Sum256(binFile)
+	err = db.Put(SketchRecord{
+		ID:            sketch.ID,
+		Name:          sketch.Name,
+		BinaryHash:    hex.EncodeToString(hash[:]),
+		Signature:     base64.StdEncoding.EncodeToString(sigFile),
+		UploadedAt:    time.Now(),
+		RestartPolicy: sketch.RestartPolicy,
+		DesiredState:  sketch.DesiredState,
+		Environment:   sketch.environment,
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "save sketch %s", sketch.ID)
+	}
 
 	// spawn process
 	pid, _, _, err := spawnProcess(name, &sketch, status)
 	if err != nil {
-		status.Error("/upload", errors.Wrapf(err, "spawn %s", name))
-		return
+		return "", errors.Wrapf(err, "spawn %s", name)
 	}
 
-	status.Info("/upload", "Sketch started with PID "+strconv.Itoa(pid))
-
-	sketch.PID = pid
-	sketch.Status = "RUNNING"
+	status.UpdateSketch(&sketch, func(sketch *SketchStatus) {
+		sketch.Status = "RUNNING"
+	})
 
 	status.Set(info.ID, &sketch)
 	status.Publish()
+	job.Log("Sketch started with PID " + strconv.Itoa(pid))
 
 	// go func(stdout io.ReadCloser) {
 	// 	in := bufio.NewScanner(stdout)
@@ -228,17 +251,24 @@ func (status *Status) UploadEvent(client mqtt.Client, msg mqtt.Message) {
 	// 		}
 	// 	}
 	// }(stdout)
+
+	return "Sketch started with PID " + strconv.Itoa(pid), nil
+}
+
+// getDataFolder returns the folder where the connector keeps its data
+func getDataFolder(config Config) (string, error) {
+	if config.SketchesPath != "" {
+		return config.SketchesPath, nil
+	}
+	return osext.ExecutableFolder()
 }
 
 func getSketchFolder(status *Status) (string, error) {
 	// create folder if it doesn't exist
-	folder, err := osext.ExecutableFolder()
+	folder, err := getDataFolder(status.config)
 	if err != nil {
 		return "", err
 	}
-	if status.config.SketchesPath != "" {
-		folder = status.config.SketchesPath
-	}
 
 	folder = filepath.Join(folder, "sketches")
 	if _, err = os.Stat(folder); os.IsNotExist(err) {
@@ -260,101 +290,65 @@ func getSketchDBFolder(status *Status) (string, error) {
 	return folder, err
 }
 
-func getSketchDB(status *Status) (string, error) {
-	// create folder if it doesn't exist
-	folder, err := getSketchDBFolder(status)
-	if err != nil {
-		return "", err
-	}
-	db := filepath.Join(folder, "db")
-	return db, err
+// SketchRequest are the parameters of /sketch
+type SketchRequest struct {
+	ID            string
+	Name          string
+	Action        string
+	RestartPolicy *RestartPolicy `json:"restart_policy"`
 }
 
-func insertSketchInDB(name string, id string, status *Status) {
-	// create folder if it doesn't exist
-	db, err := getSketchDB(status)
-	if err != nil {
-		return
-	}
-
-	var c []SketchBinding
-	raw, errRead := ioutil.ReadFile(db)
-	if errRead != nil {
-		return
-	}
-	err = json.Unmarshal(raw, &c)
-	if err != nil {
-		return
+// SketchAction starts, stops or deletes a sketch
+func (status *Status) SketchAction(info SketchRequest) (string, error) {
+	if info.ID == "" {
+		info.ID = info.Name
 	}
 
-	for _, element := range c {
-		if element.ID == id && element.Name == name {
-			return
+	if sketch, ok := status.Sketch(info.ID); ok {
+		if info.RestartPolicy != nil {
+			if err := info.RestartPolicy.Validate(); err != nil {
+				return "", badRequest(err)
+			}
 		}
-	}
-	c = append(c, SketchBinding{ID: id, Name: name})
-	data, _ := json.Marshal(c)
-	err = ioutil.WriteFile(db, data, 0600)
-	if err != nil {
-		return
-	}
-}
 
-func getSketchIDFromDB(name string, status *Status) (string, error) {
-	// create folder if it doesn't exist
-	db, err := getSketchDB(status)
-	if err != nil {
-		return "", errors.New("Can't open DB")
-	}
-	var c []SketchBinding
-	raw, errRead := ioutil.ReadFile(db)
-	if errRead != nil {
-		return "", errRead
-	}
-	err = json.Unmarshal(raw, &c)
-	if err != nil {
-		return "", err
-	}
+		status.UpdateSketch(sketch, func(sketch *SketchStatus) {
+			if info.RestartPolicy != nil {
+				sketch.RestartPolicy = *info.RestartPolicy
+			}
+			switch info.Action {
+			case "START":
+				sketch.DesiredState = "RUNNING"
+				sketch.RestartCount = 0
+			case "STOP":
+				sketch.DesiredState = "STOPPED"
+			}
+		})
 
-	for _, element := range c {
-		if element.Name == name {
-			return element.ID, nil
+		err := applyAction(sketch, info.Action, status)
+		if err != nil {
+			return "", errors.Wrapf(err, "applying %s to %s", info.Action, info.Name)
 		}
-	}
-	return "", errors.New("No matching sketch")
-}
-
-// SketchEvent listens to commands to start and stop sketches
-func (status *Status) SketchEvent(client mqtt.Client, msg mqtt.Message) {
-	var info struct {
-		ID     string
-		Name   string
-		Action string
-	}
-	err := json.Unmarshal(msg.Payload(), &info)
-	if err != nil {
-		status.Error("/sketch", errors.Wrapf(err, "unmarshal %s", msg.Payload()))
-		return
-	}
-
-	if info.ID == "" {
-		info.ID = info.Name
-	}
 
-	if sketch, ok := status.Sketches[info.ID]; ok {
-		err := applyAction(sketch, info.Action, status)
+		if info.Action == "DELETE" {
+			var db *SketchDB
+			if db, err = getSketchDB(status); err == nil {
+				err = db.Delete(info.ID)
+			}
+		} else {
+			err = saveSketchState(sketch, status)
+		}
 		if err != nil {
-			status.Error("/sketch", errors.Wrapf(err, "applying %s to %s", info.Action, info.Name))
-			return
+			fmt.Println(err)
 		}
-		status.Info("/sketch", "successfully performed "+info.Action+" on sketch "+info.ID)
 
-		status.Set(info.ID, sketch)
+		if info.Action != "DELETE" {
+			status.Set(info.ID, sketch)
+		}
 		status.Publish()
-		return
+		return "successfully performed " + info.Action + " on sketch " + info.ID, nil
 	}
 
-	status.Error("/sketch", errors.New("sketch "+info.ID+" not found"))
+	return "", notFound(errors.New("sketch " + info.ID + " not found"))
 }
 
 func natsCloudCB(s *Status) nats.MsgHandler {
@@ -363,24 +357,15 @@ func natsCloudCB(s *Status) nats.MsgHandler {
 
 		updateMessage := fmt.Sprintf("{\"state\": {\"reported\": { \"%s\": %s}}}", thingName, string(m.Data))
 
-		if s.messagesSent > 1000 {
-			fmt.Println("rate limiting: " + strconv.Itoa(s.messagesSent))
-			introducedDelay := time.Duration(s.messagesSent/1000) * time.Second
-			if introducedDelay > 20*time.Second {
-				introducedDelay = 20 * time.Second
-			}
-			time.Sleep(introducedDelay)
-		}
-		s.messagesSent++
-		s.mqttClient.Publish("$aws/things/"+s.id+"/shadow/update", 1, false, updateMessage)
-		if debugMqtt {
-			fmt.Println("MQTT OUT: $aws/things/"+s.id+"/shadow/update", updateMessage)
+		if !s.canPublish() {
+			return
 		}
+		_ = s.publish(classShadow, "/shadow/update", 1, updateMessage, coalesceNone)
 	}
 }
 
 // downloadfile substitute a file with something that downloads from an url
-func downloadFile(filepath, url, token string) error {
+func downloadFile(ctx context.Context, filepath, url, token string) error {
 	// Create the file - remove the existing one if it exists
 	if _, err := os.Stat(filepath); err == nil {
 		err := os.Remove(filepath)
@@ -395,7 +380,7 @@ func downloadFile(filepath, url, token string) error {
 	defer out.Close()
 	// Get the data
 	client := http.Client{}
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return err
 	}
@@ -420,6 +405,16 @@ func downloadFile(filepath, url, token string) error {
 	return nil
 }
 
+// subscribeSketchesStdin forwards the /stdin topic to the running sketches,
+// whose subscriptions are lost when the connection drops
+func subscribeSketchesStdin(client mqtt.Client, status *Status) {
+	for _, sketch := range status.SketchList() {
+		if current := status.ReadSketch(sketch); current.PID != 0 && current.pty != nil {
+			client.Subscribe(status.topicPertinence+"/stdin", 1, stdInCB(current.pty, status))
+		}
+	}
+}
+
 func stdInCB(pty *os.File, status *Status) mqtt.MessageHandler {
 	return func(client mqtt.Client, msg mqtt.Message) {
 		if len(msg.Payload()) > 0 {
@@ -520,11 +515,11 @@ func checkForLibrariesMissingError(filepath string, sketch *SketchStatus, status
 		addIntelLibrariesToLdPath()
 		fmt.Println("Missing library!")
 		library := extractLibrary(err)
-		status.Info("/upload", "Downloading needed libraries")
+		status.Info("/upload", "", "Downloading needed libraries")
 		if err := downloadDylibDependencies(library, status); err != nil {
-			status.Error("/upload", err)
+			status.Error("/upload", "", err)
 		}
-		status.Error("/upload", errors.New("Missing libraries, install them and relaunch the sketch"))
+		status.Error("/upload", "", errors.New("Missing libraries, install them and relaunch the sketch"))
 	}
 }
 
@@ -547,7 +542,9 @@ func checkSketchForMissingDisplayEnvVariable(errorString string, filepath string
 		if err != nil {
 			return
 		}
-		sketch.Status = "RUNNING"
+		status.UpdateSketch(sketch, func(sketch *SketchStatus) {
+			sketch.Status = "RUNNING"
+		})
 	}
 }
 
@@ -588,6 +585,13 @@ func setupDisplay(usermode bool) error {
 // spawn Process creates a new process from a file
 func spawnProcess(filepath string, sketch *SketchStatus, status *Status) (int, io.ReadCloser, io.ReadCloser, error) {
 	cmd := exec.Command(filepath)
+	environment := status.ReadSketch(sketch).environment
+	if len(environment) > 0 {
+		cmd.Env = os.Environ()
+		for key, value := range environment {
+			cmd.Env = append(cmd.Env, key+"="+value)
+		}
+	}
 	stdout, err := cmd.StdoutPipe()
 	stderr, err := cmd.StderrPipe()
 	var stderrBuf bytes.Buffer
@@ -605,11 +609,14 @@ func spawnProcess(filepath string, sketch *SketchStatus, status *Status) (int, i
 		return 0, stdout, stderr, err
 	}
 
-	sketch.pty = f
-	if status.mqttClient != nil {
-		go status.mqttClient.Subscribe("$aws/things/"+status.id+"/stdin", 1, stdInCB(f, status))
+	status.UpdateSketch(sketch, func(sketch *SketchStatus) {
+		sketch.pty = f
+	})
+	if client := status.client(); client != nil {
+		go client.Subscribe(status.topicPertinence+"/stdin", 1, stdInCB(f, status))
 	}
 
+	output := newOutputTail(sketchOutputLines)
 	go func() {
 		for {
 			temp := make([]byte, 1000)
@@ -619,6 +626,7 @@ func spawnProcess(filepath string, sketch *SketchStatus, status *Status) (int, i
 			}
 			if len > 0 {
 				//fmt.Println(string(temp[:len]))
+				_, _ = output.Write(temp[:len])
 				status.Raw("/stdout", string(temp[:len]))
 				checkForLibrariesMissingError(filepath, sketch, status, string(temp))
 				checkSketchForMissingDisplayEnvVariable(string(temp), filepath, sketch, status)
@@ -629,60 +637,71 @@ func spawnProcess(filepath string, sketch *SketchStatus, status *Status) (int, i
 	//logSketchStdoutStderr(cmd, stdout, stderr, sketch)
 
 	// keep track of sketch life (and isgnal if it ends abruptly)
+	pid := cmd.Process.Pid
+	startedAt := time.Now()
+	status.UpdateSketch(sketch, func(sketch *SketchStatus) {
+		sketch.PID = pid
+		sketch.StartedAt = &startedAt
+		sketch.StoppedAt = nil
+	})
 	go func() {
-		err = cmd.Wait()
-		if err != nil {
-			return
+		errWait := cmd.Wait()
+		if errWait != nil {
+			fmt.Println(fmt.Sprint(errWait) + ": " + stderrBuf.String())
 		}
 		//if we get here signal that the sketch has died
-		if err = applyAction(sketch, "STOP", status); err != nil {
-			fmt.Println(err)
-			return
-		}
-
-		if err != nil {
-			fmt.Println(fmt.Sprint(err) + ": " + stderrBuf.String())
-		}
-		fmt.Println("sketch exited ")
+		sketchExited(sketch, pid, cmd.ProcessState, output.Lines(), status)
 	}()
 
-	return cmd.Process.Pid, stdout, stderr, err
+	return pid, stdout, stderr, err
 }
 
 func applyAction(sketch *SketchStatus, action string, status *Status) error {
-	process, err := os.FindProcess(sketch.PID)
-	if err != nil && sketch.PID != 0 {
+	current := status.ReadSketch(sketch)
+	process, err := os.FindProcess(current.PID)
+	if err != nil && current.PID != 0 {
 		fmt.Println("exit because of error")
 		return err
 	}
 
 	switch action {
 	case "START":
-		if sketch.PID != 0 {
+		if current.PID != 0 {
 			err = process.Signal(syscall.SIGCONT)
 		} else {
 			folder, errFolder := getSketchFolder(status)
 			if errFolder != nil {
 				return errFolder
 			}
-			name := filepath.Join(folder, sketch.Name)
-			sketch.PID, _, _, err = spawnProcess(name, sketch, status)
+			name := filepath.Join(folder, current.Name)
+			_, _, _, err = spawnProcess(name, sketch, status)
 		}
 		if err != nil {
 			return err
 		}
-		sketch.Status = "RUNNING"
+		status.UpdateSketch(sketch, func(sketch *SketchStatus) {
+			sketch.Status = "RUNNING"
+		})
 
 	case "STOP":
 		fmt.Println("stop called")
-		if sketch.PID != 0 && err == nil && process.Pid != 0 {
+		var pid int
+		// reset the PID before killing, so that the supervisor doesn't take the exit for a crash
+		status.UpdateSketch(sketch, func(sketch *SketchStatus) {
+			pid = sketch.PID
+			sketch.PID = 0
+			sketch.Status = "STOPPED"
+		})
+		if pid != current.PID {
+			// started or stopped by someone else in the meantime
+			process, err = os.FindProcess(pid)
+		}
+		if pid != 0 && err == nil && process.Pid != 0 {
 			fmt.Println("kill called")
 			err = process.Kill()
 		} else {
 			err = nil
 		}
-		sketch.PID = 0
-		sketch.Status = "STOPPED"
 
 	case "DELETE":
 		err = applyAction(sketch, "STOP", status)
@@ -695,15 +714,17 @@ func applyAction(sketch *SketchStatus, action string, status *Status) error {
 		if errSketch != nil {
 			return errSketch
 		}
-		err = os.Remove(filepath.Join(sketchFolder, sketch.Name))
+		err = os.Remove(filepath.Join(sketchFolder, current.Name))
 		if err != nil {
 			fmt.Println("error deleting sketch")
 		}
-		status.Sketches[sketch.ID] = nil
+		status.Remove(current.ID)
 
 	case "PAUSE":
 		err = process.Signal(syscall.SIGTSTP)
-		sketch.Status = "PAUSED"
+		status.UpdateSketch(sketch, func(sketch *SketchStatus) {
+			sketch.Status = "PAUSED"
+		})
 	}
 	return err
 }
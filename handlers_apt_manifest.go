@@ -0,0 +1,162 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2020  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/arduino/arduino-connector/packaging"
+	"github.com/pkg/errors"
+)
+
+// manifestFile is the file of the data folder where the last applied
+// manifest is saved
+const manifestFile = "package-manifest.json"
+
+// AptManifestRequest are the parameters of /apt/manifest/apply: the
+// manifest, and if it must only be compared with the system
+type AptManifestRequest struct {
+	PackageManifest
+	DryRun bool `json:"dry_run"`
+}
+
+func (s *Status) manifestPath() (string, error) {
+	folder, err := getDataFolder(s.config)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(folder, manifestFile), nil
+}
+
+// AptManifestPlan returns the changes that applying the manifest would make
+func (s *Status) AptManifestPlan(manifest PackageManifest) (*ManifestPlan, error) {
+	if err := manifest.Validate(); err != nil {
+		return nil, badRequest(err)
+	}
+	return planManifest(s.packages, manifest)
+}
+
+// AptManifestApply starts a job bringing the system to the state of the
+// manifest, publishing its progress on progressTopic. The plan is computed
+// when the job starts; the manifest is saved, whatever the outcome, for the
+// following drift checks.
+func (s *Status) AptManifestApply(manifest PackageManifest, progressTopic string) (*Job, error) {
+	if err := manifest.Validate(); err != nil {
+		return nil, badRequest(err)
+	}
+	path, err := s.manifestPath()
+	if err != nil {
+		return nil, err
+	}
+	return s.startPackageJob("manifest", "Applying manifest", nil, progressTopic, func(ctx context.Context, progress packaging.ProgressFunc) ([]byte, error) {
+		plan, err := planManifest(s.packages, manifest)
+		if err != nil {
+			return nil, err
+		}
+		out, err := applyManifestPlan(ctx, progress, s.packages, plan)
+
+		record := &ManifestRecord{Manifest: manifest, AppliedAt: time.Now()}
+		if err != nil {
+			record.Error = err.Error()
+		}
+		s.manifestLock.Lock()
+		defer s.manifestLock.Unlock()
+		if errSave := writeManifestRecord(path, record); errSave != nil {
+			fmt.Println("Saving the package manifest:", errSave)
+		}
+		return out, err
+	}), nil
+}
+
+// AptManifest returns the last applied manifest and its last drift check
+func (s *Status) AptManifest() (*ManifestRecord, error) {
+	path, err := s.manifestPath()
+	if err != nil {
+		return nil, err
+	}
+	s.manifestLock.Lock()
+	defer s.manifestLock.Unlock()
+	record, err := readManifestRecord(path)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, notFound(errors.New("no manifest has been applied"))
+	}
+	return record, nil
+}
+
+// AptManifestCheck compares the system with the last applied manifest and
+// saves the drift found. The record is published on /packages/manifest/drift
+// if the system drifted, or if it doesn't drift anymore.
+func (s *Status) AptManifestCheck() (*ManifestRecord, error) {
+	path, err := s.manifestPath()
+	if err != nil {
+		return nil, err
+	}
+	s.manifestLock.Lock()
+	defer s.manifestLock.Unlock()
+	record, err := readManifestRecord(path)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, notFound(errors.New("no manifest has been applied"))
+	}
+	plan, err := planManifest(s.packages, record.Manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	drifted := record.Drift != nil
+	now := time.Now()
+	record.CheckedAt = &now
+	record.Drift = nil
+	if !plan.Empty() {
+		record.Drift = plan
+		fmt.Println("The packages drifted from the manifest:", describeDrift(plan))
+	}
+	s.acquireWritableFs()
+	err = writeManifestRecord(path, record)
+	s.releaseWritableFs()
+	if err != nil {
+		return nil, err
+	}
+
+	if record.Drift != nil || drifted {
+		if data, err := json.Marshal(record); err == nil {
+			s.Notify("/packages/manifest/drift", string(data))
+		}
+	}
+	return record, nil
+}
+
+// watchManifestDrift checks the drift from the last applied manifest every
+// interval
+func (s *Status) watchManifestDrift(interval time.Duration) {
+	for range time.Tick(interval) {
+		if _, err := s.AptManifestCheck(); err != nil && errorKind(err) != errorNotFound {
+			fmt.Println("Checking the package manifest:", err)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/arduino/arduino-connector/testharness"
+	apt "github.com/arduino/go-apt-client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAptManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := newTestConnector(t, Config{SketchesPath: dir})
+	defer c.Close()
+	c.packages.AddPackage("curl", "7.58.0-2ubuntu3", "installed")
+	c.packages.AddPackage("git", "1:2.17.1-1ubuntu0.4", "installed")
+	c.packages.AddVersion("git", "1:2.17.1-1ubuntu0.5", "http://archive.ubuntu.com/ubuntu bionic-updates/main amd64 Packages")
+	c.packages.AddPackage("nano", "2.9.3-2", "installed")
+	c.packages.AddPackage("vim", "2:8.0.1453-1ubuntu1", "not-installed")
+	drift := c.Subscribe(t, "/packages/manifest/drift")
+
+	var reply Reply
+	assert.NoError(t, json.Unmarshal([]byte(c.Request(t, "/apt/manifest/get", `{}`)), &reply))
+	assert.Equal(t, "error", reply.Status)
+	assert.NoError(t, json.Unmarshal([]byte(c.Request(t, "/apt/manifest/apply", `{"packages": ["vim"], "absent": ["vim"]}`)), &reply))
+	assert.Equal(t, "error", reply.Status)
+	assert.Contains(t, reply.Error, "package vim is both wanted and absent")
+
+	manifest := `{
+		"repositories": [{"Enabled": true, "URI": "https://download.docker.com/linux/ubuntu", "Distribution": "bionic", "Components": "stable"}],
+		"packages": ["curl", "vim", "git=1:2.17.1-1ubuntu0.5"],
+		"absent": ["nano", "emacs"]`
+
+	var plan ManifestPlan
+	decodeReply(t, c.Request(t, "/apt/manifest/apply", manifest+`, "dry_run": true}`), &plan)
+	if assert.Len(t, plan.Repositories, 1) {
+		assert.Equal(t, "https://download.docker.com/linux/ubuntu", plan.Repositories[0].URI)
+	}
+	assert.Equal(t, []string{"vim", "git=1:2.17.1-1ubuntu0.5"}, plan.Install)
+	assert.Equal(t, []string{"nano"}, plan.Remove)
+	assert.Equal(t, "not-installed", c.packages.Package("vim").Status)
+
+	var out CommandOutput
+	decodeReply(t, c.Request(t, "/apt/manifest/apply", manifest+`}`), &out)
+	assert.Contains(t, out.Output, "Configure repository deb https://download.docker.com/linux/ubuntu bionic stable\n")
+	assert.Contains(t, out.Output, "Setting up vim")
+	assert.Contains(t, out.Output, "Removing nano")
+	assert.Equal(t, "installed", c.packages.Package("vim").Status)
+	assert.Equal(t, "1:2.17.1-1ubuntu0.5", c.packages.Package("git").Version)
+	assert.Equal(t, "config-files", c.packages.Package("nano").Status)
+	repos, err := c.packages.Repositories()
+	assert.NoError(t, err)
+	assert.True(t, repos.Contains(&apt.Repository{URI: "https://download.docker.com/linux/ubuntu", Distribution: "bionic", Components: "stable"}))
+
+	var job Job
+	decodeReply(t, c.Request(t, "/packages/jobs/get", `{"id": "`+out.JobID+`"}`), &job)
+	assert.Equal(t, "manifest", job.Operation)
+	assert.Equal(t, jobSucceeded, job.State)
+
+	var record ManifestRecord
+	decodeReply(t, c.Request(t, "/apt/manifest/check", `{}`), &record)
+	assert.Equal(t, []string{"curl", "vim", "git=1:2.17.1-1ubuntu0.5"}, record.Manifest.Packages)
+	assert.Empty(t, record.Error)
+	assert.NotNil(t, record.CheckedAt)
+	assert.Nil(t, record.Drift)
+
+	// nano is installed again behind the back of the manifest
+	decodeReply(t, c.Request(t, "/apt/install", `{"packages": ["nano"]}`), &out)
+	var checked ManifestRecord
+	decodeReply(t, c.Request(t, "/apt/manifest/check", `{}`), &checked)
+	if assert.NotNil(t, checked.Drift) {
+		assert.Equal(t, []string{"nano"}, checked.Drift.Remove)
+		assert.Empty(t, checked.Drift.Install)
+	}
+	select {
+	case msg := <-drift:
+		var published ManifestRecord
+		decodeEvent(t, msg, &published)
+		if assert.NotNil(t, published.Drift) {
+			assert.Equal(t, []string{"nano"}, published.Drift.Remove)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no drift published")
+	}
+
+	var saved ManifestRecord
+	decodeReply(t, c.Request(t, "/apt/manifest/get", `{}`), &saved)
+	assert.Equal(t, checked.Drift, saved.Drift)
+}
+
+func TestPlanManifestRepositories(t *testing.T) {
+	pm := testharness.NewPackages()
+	disabled := &apt.Repository{Enabled: false, URI: "http://ppa.launchpad.net/test/ubuntu", Distribution: "bionic", Components: "main"}
+	assert.NoError(t, pm.AddRepository(disabled))
+
+	enabled := *disabled
+	enabled.Enabled = true
+	manifest := PackageManifest{Repositories: []*apt.Repository{&enabled}}
+	plan, err := planManifest(pm, manifest)
+	assert.NoError(t, err)
+	assert.Equal(t, []*apt.Repository{&enabled}, plan.Repositories)
+
+	_, err = applyManifestPlan(context.Background(), nil, pm, plan)
+	assert.NoError(t, err)
+	repos, err := pm.Repositories()
+	assert.NoError(t, err)
+	if assert.Len(t, repos, 1) {
+		assert.True(t, repos[0].Enabled)
+	}
+	assert.Equal(t, []string{"AddRepository", "Repositories", "Repositories", "EditRepository", "CheckForUpdates", "Repositories"}, pm.Calls())
+
+	plan, err = planManifest(pm, manifest)
+	assert.NoError(t, err)
+	assert.True(t, plan.Empty())
+}
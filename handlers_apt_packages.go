@@ -19,38 +19,87 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
+	"strings"
 
+	"github.com/arduino/arduino-connector/packaging"
 	apt "github.com/arduino/go-apt-client"
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
-// AptGetEvent sends the status for a specific package
-func (s *Status) AptGetEvent(client mqtt.Client, msg mqtt.Message) {
-	var params struct {
-		Package string `json:"package"`
-	}
-	err := json.Unmarshal(msg.Payload(), &params)
-	if err != nil {
-		s.Error("/apt/get", fmt.Errorf("Unmarshal '%s': %s", msg.Payload(), err))
-		return
-	}
+// AptGetRequest are the parameters of /apt/get
+type AptGetRequest struct {
+	Package string `json:"package"`
+}
 
-	// Get package from system
-	var res []*apt.Package
-	res, err = apt.Search(params.Package)
+// AptPackagesRequest are the parameters of the commands that act on a list
+// of packages, a package can be pinned to a version as name=version
+type AptPackagesRequest struct {
+	Packages []string `json:"packages"`
+}
+
+// AptListRequest are the parameters of /apt/list
+type AptListRequest struct {
+	Search string `json:"search"`
+	Page   int    `json:"page"`
+}
 
+// PackageInfo is a package with the policies that apply to it: if it's held
+// at its version and, with apt, the pins matching its name. /apt/get also
+// reports the versions that can be installed.
+type PackageInfo struct {
+	*apt.Package
+	Held     bool                       `json:"held,omitempty"`
+	Pins     []AptPin                   `json:"pins,omitempty"`
+	Versions []packaging.PackageVersion `json:"versions,omitempty"`
+}
+
+// AptPackagesResponse is the reply to /apt/get. With apt it also reports
+// the configuration of unattended-upgrades.
+type AptPackagesResponse struct {
+	Packages           []*PackageInfo      `json:"packages"`
+	UnattendedUpgrades *UnattendedUpgrades `json:"unattended_upgrades,omitempty"`
+}
+
+// AptListResponse is a page of the packages, the reply to /apt/list
+type AptListResponse struct {
+	Packages           []*PackageInfo      `json:"packages"`
+	Page               int                 `json:"page"`
+	Pages              int                 `json:"pages"`
+	TotalItems         int                 `json:"total_items"`
+	UnattendedUpgrades *UnattendedUpgrades `json:"unattended_upgrades,omitempty"`
+}
+
+// CommandOutput is the reply of the commands that run an external program
+type CommandOutput struct {
+	Output string `json:"output"`
+	JobID  string `json:"job_id,omitempty"`
+}
+
+// AptGet returns the status for a specific package
+func (s *Status) AptGet(params AptGetRequest) (*AptPackagesResponse, error) {
+	// Get package from system
+	res, err := s.packages.Search(params.Package)
 	if err != nil {
-		s.Error("/apt/get", fmt.Errorf("Retrieving package data: %s", err))
-		return
+		return nil, fmt.Errorf("Retrieving package data: %s", err)
+	}
+
+	// the package manager may know versions of a package that isn't
+	// installed, they can be installed by pinning the package to them
+	var notInstalled []packaging.PackageVersion
+	if len(res) == 0 {
+		if notInstalled, err = s.packages.Versions(params.Package); err != nil {
+			return nil, fmt.Errorf("Retrieving versions of %s: %s", params.Package, err)
+		}
+		if len(notInstalled) > 0 {
+			res = []*apt.Package{{Name: params.Package, Status: "not-installed"}}
+		}
 	}
 
 	//If package is upgradable set the status to "upgradable"
-	allUpdates, err := apt.ListUpgradable()
+	allUpdates, err := s.packages.ListUpgradable()
 	if err != nil {
-		s.Error("/apt/get", fmt.Errorf("Retrieving package: %s", err))
-		return
+		return nil, fmt.Errorf("Retrieving package: %s", err)
 	}
 
 	for _, update := range allUpdates {
@@ -62,53 +111,37 @@ func (s *Status) AptGetEvent(client mqtt.Client, msg mqtt.Message) {
 		}
 	}
 
-	// Prepare response payload
-	type response struct {
-		Packages []*apt.Package `json:"packages"`
-	}
-	info := response{
-		Packages: res,
-	}
-
-	// Send result
-	data, err := json.Marshal(info)
+	packages, unattended, err := s.packagesInfo(res)
 	if err != nil {
-		s.Error("/apt/get", fmt.Errorf("Json marshal result: %s", err))
-		return
+		return nil, err
 	}
-
-	//var out bytes.Buffer
-	//json.Indent(&out, data, "", "  ")
-	//fmt.Println(string(out.Bytes()))
-
-	s.Info("/apt/get", string(data)+"\n")
+	for _, info := range packages {
+		if notInstalled != nil {
+			info.Versions = notInstalled
+			continue
+		}
+		if info.Versions, err = s.packages.Versions(info.Name); err != nil {
+			return nil, fmt.Errorf("Retrieving versions of %s: %s", info.Name, err)
+		}
+	}
+	return &AptPackagesResponse{Packages: packages, UnattendedUpgrades: unattended}, nil
 }
 
-// AptListEvent sends a list of available packages and their status
-func (s *Status) AptListEvent(client mqtt.Client, msg mqtt.Message) {
+// AptList returns a page of the available packages and their status
+func (s *Status) AptList(params AptListRequest) (*AptListResponse, error) {
 	const itemsPerPage = 30
 
-	var params struct {
-		Search string `json:"search"`
-		Page   int    `json:"page"`
-	}
-	err := json.Unmarshal(msg.Payload(), &params)
-	if err != nil {
-		s.Error("/apt/list", fmt.Errorf("Unmarshal '%s': %s", msg.Payload(), err))
-		return
-	}
-
 	// Get packages from system
 	var all []*apt.Package
+	var err error
 	if params.Search == "" {
-		all, err = apt.ListUpgradable()
+		all, err = s.packages.ListUpgradable()
 	} else {
-		all, err = apt.Search("*" + params.Search + "*")
+		all, err = s.packages.Search("*" + params.Search + "*")
 	}
 
 	if err != nil {
-		s.Error("/apt/list", fmt.Errorf("Retrieving packages: %s", err))
-		return
+		return nil, fmt.Errorf("Retrieving packages: %s", err)
 	}
 
 	// Paginate data
@@ -125,10 +158,9 @@ func (s *Status) AptListEvent(client mqtt.Client, msg mqtt.Message) {
 	}
 
 	// On upgradable packages set the status to "upgradable"
-	allUpdates, err := apt.ListUpgradable()
+	allUpdates, err := s.packages.ListUpgradable()
 	if err != nil {
-		s.Error("/apt/list", fmt.Errorf("Retrieving packages: %s", err))
-		return
+		return nil, fmt.Errorf("Retrieving packages: %s", err)
 	}
 
 	for _, update := range allUpdates {
@@ -140,121 +172,102 @@ func (s *Status) AptListEvent(client mqtt.Client, msg mqtt.Message) {
 		}
 	}
 
-	// Prepare response payload
-	type response struct {
-		Packages   []*apt.Package `json:"packages"`
-		Page       int            `json:"page"`
-		Pages      int            `json:"pages"`
-		TotalItems int            `json:"total_items"`
-	}
-	info := response{
-		Packages:   all,
-		Page:       params.Page,
-		Pages:      pages,
-		TotalItems: total,
-	}
-
-	// Send result
-	data, err := json.Marshal(info)
+	packages, unattended, err := s.packagesInfo(all)
 	if err != nil {
-		s.Error("/apt/list", fmt.Errorf("Json marshal result: %s", err))
-		return
+		return nil, err
 	}
-
-	//var out bytes.Buffer
-	//json.Indent(&out, data, "", "  ")
-	//fmt.Println(string(out.Bytes()))
-
-	s.Info("/apt/list", string(data)+"\n")
+	return &AptListResponse{
+		Packages:           packages,
+		Page:               params.Page,
+		Pages:              pages,
+		TotalItems:         total,
+		UnattendedUpgrades: unattended,
+	}, nil
 }
 
-// AptInstallEvent installs new packages
-func (s *Status) AptInstallEvent(client mqtt.Client, msg mqtt.Message) {
-	var params struct {
-		Packages []string `json:"packages"`
-	}
-	err := json.Unmarshal(msg.Payload(), &params)
+// packagesInfo adds to the packages the policies that apply to them and,
+// with apt, returns the configuration of unattended-upgrades
+func (s *Status) packagesInfo(packs []*apt.Package) ([]*PackageInfo, *UnattendedUpgrades, error) {
+	held, err := s.packages.Held()
 	if err != nil {
-		s.Error("/apt/install", fmt.Errorf("Unmarshal '%s': %s", msg.Payload(), err))
-		return
-	}
-
-	toInstall := []*apt.Package{}
-	for _, p := range params.Packages {
-		toInstall = append(toInstall, &apt.Package{Name: p})
+		return nil, nil, fmt.Errorf("Retrieving held packages: %s", err)
 	}
-	out, err := apt.Install(toInstall...)
-	if err != nil {
-		s.Error("/apt/install", fmt.Errorf("Running installer: %s\nOutput:\n%s", err, out))
-		return
+	var pins []AptPin
+	var unattended *UnattendedUpgrades
+	if m, ok := s.packages.(*aptPackageManager); ok {
+		if pins, err = readAptPins(m.root); err != nil {
+			return nil, nil, fmt.Errorf("Retrieving pins: %s", err)
+		}
+		if unattended, err = readUnattendedUpgrades(m.root); err != nil {
+			return nil, nil, fmt.Errorf("Retrieving unattended-upgrades configuration: %s", err)
+		}
 	}
-	s.InfoCommandOutput("/apt/install", out)
-}
 
-// AptUpdateEvent checks repositories for updates on installed packages
-func (s *Status) AptUpdateEvent(client mqtt.Client, msg mqtt.Message) {
-	out, err := apt.CheckForUpdates()
-	if err != nil {
-		s.Error("/apt/update", fmt.Errorf("Checking for updates: %s\nOutput:\n%s", err, out))
-		return
+	res := []*PackageInfo{}
+	for _, pack := range packs {
+		info := &PackageInfo{Package: pack}
+		for _, name := range held {
+			if name == pack.Name {
+				info.Held = true
+			}
+		}
+		for _, pin := range pins {
+			if pin.Matches(pack.Name) {
+				info.Pins = append(info.Pins, pin)
+			}
+		}
+		res = append(res, info)
 	}
-	s.InfoCommandOutput("/apt/update", out)
+	return res, unattended, nil
 }
 
-// AptUpgradeEvent installs upgrade for specified packages (or for all
-// upgradable packages if none are specified)
-func (s *Status) AptUpgradeEvent(client mqtt.Client, msg mqtt.Message) {
-	var params struct {
-		Packages []string `json:"packages"`
-	}
-	err := json.Unmarshal(msg.Payload(), &params)
-	if err != nil {
-		s.Error("/apt/upgrade", fmt.Errorf("Unmarshal '%s': %s", msg.Payload(), err))
-		return
+func toPackages(names []string) []*apt.Package {
+	packs := []*apt.Package{}
+	for _, p := range names {
+		// name=version pins the package to a version
+		nameVersion := strings.SplitN(p, "=", 2)
+		pack := &apt.Package{Name: nameVersion[0]}
+		if len(nameVersion) == 2 {
+			pack.Version = nameVersion[1]
+		}
+		packs = append(packs, pack)
 	}
+	return packs
+}
 
-	toUpgrade := []*apt.Package{}
-	for _, p := range params.Packages {
-		toUpgrade = append(toUpgrade, &apt.Package{Name: p})
-	}
+// AptInstall starts a job installing new packages, publishing its progress
+// on progressTopic
+func (s *Status) AptInstall(params AptPackagesRequest, progressTopic string) *Job {
+	toInstall := toPackages(params.Packages)
+	return s.startPackageJob("install", "Running installer", params.Packages, progressTopic, func(ctx context.Context, progress packaging.ProgressFunc) ([]byte, error) {
+		return s.packages.Install(ctx, progress, toInstall...)
+	})
+}
 
-	if len(toUpgrade) == 0 {
-		out, err := apt.UpgradeAll()
-		if err != nil {
-			s.Error("/apt/upgrade", fmt.Errorf("Upgrading all packages: %s\nOutput:\n%s", err, out))
-			return
-		}
-		s.InfoCommandOutput("/apt/upgrade", out)
-	} else {
-		out, err := apt.Upgrade(toUpgrade...)
-		if err != nil {
-			s.Error("/apt/upgrade", fmt.Errorf("Upgrading %+v: %s\nOutput:\n%s", params, err, out))
-			return
-		}
-		s.InfoCommandOutput("/apt/upgrade", out)
-	}
+// AptUpdate starts a job checking repositories for updates on installed packages
+func (s *Status) AptUpdate(progressTopic string) *Job {
+	return s.startPackageJob("update", "Checking for updates", nil, progressTopic, s.packages.CheckForUpdates)
 }
 
-// AptRemoveEvent deinstall the specified packages
-func (s *Status) AptRemoveEvent(client mqtt.Client, msg mqtt.Message) {
-	var params struct {
-		Packages []string `json:"packages"`
-	}
-	err := json.Unmarshal(msg.Payload(), &params)
-	if err != nil {
-		s.Error("/apt/remove", fmt.Errorf("Unmarshal '%s': %s", msg.Payload(), err))
-		return
+// AptUpgrade starts a job installing upgrades for specified packages (or for
+// all upgradable packages if none are specified)
+func (s *Status) AptUpgrade(params AptPackagesRequest, progressTopic string) *Job {
+	if len(params.Packages) == 0 {
+		return s.startPackageJob("upgrade", "Upgrading all packages", nil, progressTopic, s.packages.UpgradeAll)
 	}
 
-	toRemove := []*apt.Package{}
-	for _, p := range params.Packages {
-		toRemove = append(toRemove, &apt.Package{Name: p})
-	}
+	toUpgrade := toPackages(params.Packages)
+	description := fmt.Sprintf("Upgrading %s", strings.Join(params.Packages, " "))
+	return s.startPackageJob("upgrade", description, params.Packages, progressTopic, func(ctx context.Context, progress packaging.ProgressFunc) ([]byte, error) {
+		return s.packages.Upgrade(ctx, progress, toUpgrade...)
+	})
+}
 
-	out, err := apt.Remove(toRemove...)
-	if err != nil {
-		s.Error("/apt/remove", fmt.Errorf("Removing %+v: %s\nOutput:\n%s", params, err, out))
-		return
-	}
-	s.InfoCommandOutput("/apt/remove", out)
+// AptRemove starts a job deinstalling the specified packages
+func (s *Status) AptRemove(params AptPackagesRequest, progressTopic string) *Job {
+	toRemove := toPackages(params.Packages)
+	description := fmt.Sprintf("Removing %s", strings.Join(params.Packages, " "))
+	return s.startPackageJob("remove", description, params.Packages, progressTopic, func(ctx context.Context, progress packaging.ProgressFunc) ([]byte, error) {
+		return s.packages.Remove(ctx, progress, toRemove...)
+	})
 }
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAptPackages(t *testing.T) {
+	c := newTestConnector(t, Config{})
+	defer c.Close()
+	c.packages.AddPackage("curl", "7.58.0-2ubuntu3", "installed")
+	c.packages.AddPackage("git", "1:2.17.1-1ubuntu0.4", "installed")
+	c.packages.AddPackage("vim", "2:8.0.1453-1ubuntu1", "not-installed")
+	c.packages.AddUpgrade("git", "1:2.17.1-1ubuntu0.5")
+
+	var get AptPackagesResponse
+	decodeReply(t, c.Request(t, "/apt/get", `{"package": "git"}`), &get)
+	if assert.Len(t, get.Packages, 1) {
+		assert.Equal(t, "upgradable", get.Packages[0].Status)
+		assert.Equal(t, "1:2.17.1-1ubuntu0.4", get.Packages[0].Version)
+	}
+
+	// /apt/* are aliases of /packages/*
+	var list AptListResponse
+	decodeReply(t, c.Request(t, "/packages/list", `{"search": "i"}`), &list)
+	assert.Equal(t, 1, list.Pages)
+	assert.Equal(t, 2, list.TotalItems)
+	if assert.Len(t, list.Packages, 2) {
+		assert.Equal(t, "git", list.Packages[0].Name)
+		assert.Equal(t, "vim", list.Packages[1].Name)
+		assert.Equal(t, "not-installed", list.Packages[1].Status)
+	}
+
+	var out CommandOutput
+	decodeReply(t, c.Request(t, "/packages/install", `{"packages": ["vim"]}`), &out)
+	assert.Contains(t, out.Output, "Setting up vim")
+	assert.Equal(t, "installed", c.packages.Package("vim").Status)
+
+	decodeReply(t, c.Request(t, "/apt/upgrade", `{}`), &out)
+	assert.Equal(t, "1:2.17.1-1ubuntu0.5", c.packages.Package("git").Version)
+	decodeReply(t, c.Request(t, "/apt/list", `{}`), &list)
+	assert.Equal(t, 0, list.TotalItems)
+
+	decodeReply(t, c.Request(t, "/apt/remove", `{"packages": ["curl"]}`), &out)
+	assert.Equal(t, "config-files", c.packages.Package("curl").Status)
+	assert.Equal(t, []string{"Search", "ListUpgradable", "Held", "Versions", "Search", "ListUpgradable", "Held", "Install", "UpgradeAll", "ListUpgradable", "ListUpgradable", "Held", "Remove"}, c.packages.Calls())
+}
+
+func TestAptPackageVersions(t *testing.T) {
+	c := newTestConnector(t, Config{})
+	defer c.Close()
+	c.packages.AddPackage("docker-ce", "5:19.03.13~3-0~ubuntu-bionic", "installed")
+	c.packages.AddVersion("docker-ce", "5:19.03.12~3-0~ubuntu-bionic", "https://download.docker.com/linux/ubuntu bionic/stable amd64 Packages")
+	c.packages.AddVersion("docker-ce", "5:19.03.13~3-0~ubuntu-bionic", "https://download.docker.com/linux/ubuntu bionic/stable amd64 Packages")
+	c.packages.AddUpgrade("docker-ce", "5:20.10.0~3-0~ubuntu-bionic")
+
+	var get AptPackagesResponse
+	decodeReply(t, c.Request(t, "/apt/get", `{"package": "docker-ce"}`), &get)
+	if assert.Len(t, get.Packages, 1) && assert.Len(t, get.Packages[0].Versions, 3) {
+		versions := get.Packages[0].Versions
+		assert.Equal(t, "5:19.03.12~3-0~ubuntu-bionic", versions[0].Version)
+		assert.Equal(t, []string{"https://download.docker.com/linux/ubuntu bionic/stable amd64 Packages"}, versions[0].Origins)
+		assert.True(t, versions[1].Installed)
+		assert.False(t, versions[1].Candidate)
+		assert.Equal(t, "5:20.10.0~3-0~ubuntu-bionic", versions[2].Version)
+		assert.True(t, versions[2].Candidate)
+	}
+
+	// list doesn't report the versions
+	var list AptListResponse
+	decodeReply(t, c.Request(t, "/apt/list", `{"search": "docker"}`), &list)
+	if assert.Len(t, list.Packages, 1) {
+		assert.Empty(t, list.Packages[0].Versions)
+	}
+
+	var out CommandOutput
+	decodeReply(t, c.Request(t, "/apt/install", `{"packages": ["docker-ce=5:19.03.12~3-0~ubuntu-bionic"]}`), &out)
+	assert.Equal(t, "Setting up docker-ce (5:19.03.12~3-0~ubuntu-bionic) ...\n", out.Output)
+	assert.Equal(t, "5:19.03.12~3-0~ubuntu-bionic", c.packages.Package("docker-ce").Version)
+
+	decodeReply(t, c.Request(t, "/apt/upgrade", `{"packages": ["docker-ce=5:19.03.13~3-0~ubuntu-bionic"]}`), &out)
+	assert.Equal(t, "5:19.03.13~3-0~ubuntu-bionic", c.packages.Package("docker-ce").Version)
+
+	var reply Reply
+	assert.NoError(t, json.Unmarshal([]byte(c.Request(t, "/apt/install", `{"packages": ["docker-ce=1.0"]}`)), &reply))
+	assert.Equal(t, "error", reply.Status)
+	assert.Contains(t, reply.Error, "Version '1.0' for 'docker-ce' was not found")
+}
+
+func TestAptGetNotInstalled(t *testing.T) {
+	c := newTestConnector(t, Config{})
+	defer c.Close()
+	c.packages.AddVersion("docker-ce", "5:19.03.12~3-0~ubuntu-bionic", "https://download.docker.com/linux/ubuntu bionic/stable amd64 Packages")
+	c.packages.AddVersion("docker-ce", "5:19.03.13~3-0~ubuntu-bionic", "https://download.docker.com/linux/ubuntu bionic/stable amd64 Packages")
+
+	var get AptPackagesResponse
+	decodeReply(t, c.Request(t, "/apt/get", `{"package": "docker-ce"}`), &get)
+	if assert.Len(t, get.Packages, 1) && assert.Len(t, get.Packages[0].Versions, 2) {
+		assert.Equal(t, "docker-ce", get.Packages[0].Name)
+		assert.Equal(t, "not-installed", get.Packages[0].Status)
+		assert.False(t, get.Packages[0].Versions[0].Installed)
+		assert.True(t, get.Packages[0].Versions[1].Candidate)
+	}
+
+	// unknown packages aren't reported
+	decodeReply(t, c.Request(t, "/apt/get", `{"package": "missing"}`), &get)
+	assert.Empty(t, get.Packages)
+}
+
+func TestAptHold(t *testing.T) {
+	c := newTestConnector(t, Config{})
+	defer c.Close()
+	c.packages.AddPackage("docker-ce", "5:19.03.13~3-0~ubuntu-bionic", "installed")
+	c.packages.AddPackage("git", "1:2.17.1-1ubuntu0.4", "installed")
+	c.packages.AddUpgrade("docker-ce", "5:20.10.0~3-0~ubuntu-bionic")
+	c.packages.AddUpgrade("git", "1:2.17.1-1ubuntu0.5")
+
+	var out CommandOutput
+	decodeReply(t, c.Request(t, "/apt/hold", `{"packages": ["docker-ce"]}`), &out)
+	assert.Equal(t, "docker-ce set on hold.\n", out.Output)
+
+	var get AptPackagesResponse
+	decodeReply(t, c.Request(t, "/apt/get", `{"package": "docker-ce"}`), &get)
+	if assert.Len(t, get.Packages, 1) {
+		assert.True(t, get.Packages[0].Held)
+	}
+	assert.Nil(t, get.UnattendedUpgrades)
+
+	decodeReply(t, c.Request(t, "/packages/upgrade", `{}`), &out)
+	assert.Contains(t, out.Output, "kept back")
+	assert.Equal(t, "5:19.03.13~3-0~ubuntu-bionic", c.packages.Package("docker-ce").Version)
+	assert.Equal(t, "1:2.17.1-1ubuntu0.5", c.packages.Package("git").Version)
+
+	decodeReply(t, c.Request(t, "/apt/unhold", `{"packages": ["docker-ce"]}`), &out)
+	assert.Equal(t, "Canceled hold on docker-ce.\n", out.Output)
+	var unheld AptPackagesResponse
+	decodeReply(t, c.Request(t, "/apt/get", `{"package": "docker-ce"}`), &unheld)
+	if assert.Len(t, unheld.Packages, 1) {
+		assert.False(t, unheld.Packages[0].Held)
+	}
+
+	// pins exist only with apt
+	var reply Reply
+	assert.NoError(t, json.Unmarshal([]byte(c.Request(t, "/apt/pins/list", `{}`)), &reply))
+	assert.Equal(t, "error", reply.Status)
+}
+
+func TestAptPackagesErrors(t *testing.T) {
+	c := newTestConnector(t, Config{})
+	defer c.Close()
+
+	var reply Reply
+	resp := c.Request(t, "/apt/install", `{"packages": ["missing"]}`)
+	assert.NoError(t, json.Unmarshal([]byte(resp), &reply))
+	assert.Equal(t, "error", reply.Status)
+	assert.Contains(t, reply.Error, "Unable to locate package missing")
+
+	c.packages.Fail("CheckForUpdates", errors.New("network is unreachable"))
+	resp = c.Request(t, "/apt/update", `{}`)
+	assert.NoError(t, json.Unmarshal([]byte(resp), &reply))
+	assert.Equal(t, "error", reply.Status)
+	assert.Contains(t, reply.Error, "network is unreachable")
+}
+
+func TestAptPackageJobs(t *testing.T) {
+	c := newTestConnector(t, Config{})
+	defer c.Close()
+	c.packages.AddPackage("vim", "2:8.0.1453-1ubuntu1", "not-installed")
+	progress := c.Subscribe(t, "/apt/install/progress")
+
+	var out CommandOutput
+	decodeReply(t, c.Request(t, "/apt/install", `{"packages": ["vim"]}`), &out)
+	assert.NotEmpty(t, out.JobID)
+	var last PackageJobProgress
+	for last.State != jobSucceeded {
+		select {
+		case msg := <-progress:
+			assert.NoError(t, json.Unmarshal([]byte(msg), &last))
+			assert.Equal(t, out.JobID, last.ID)
+			if last.Line != "" {
+				assert.Equal(t, "Setting up vim (2:8.0.1453-1ubuntu1) ...", last.Line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no progress received")
+		}
+	}
+	assert.Equal(t, 100.0, last.Percent)
+
+	var job Job
+	decodeReply(t, c.Request(t, "/packages/jobs/get", `{"id": "`+out.JobID+`"}`), &job)
+	assert.Equal(t, jobSucceeded, job.State)
+	assert.Equal(t, "install", job.Operation)
+	assert.Equal(t, jobsPackages, job.Category)
+	assert.Equal(t, "vim", job.Target)
+	assert.Equal(t, []string{"Setting up vim (2:8.0.1453-1ubuntu1) ..."}, job.Log)
+	assert.NotNil(t, job.FinishedAt)
+
+	c.packages.Hang("CheckForUpdates", true)
+	decodeReply(t, c.Request(t, "/apt/update", `{"async": true}`), &job)
+	assert.Equal(t, jobRunning, job.State)
+	var jobs []Job
+	decodeReply(t, c.Request(t, "/apt/jobs/list", `{}`), &jobs)
+	if assert.Len(t, jobs, 2) {
+		assert.Equal(t, out.JobID, jobs[0].ID)
+		assert.Equal(t, job.ID, jobs[1].ID)
+	}
+
+	decodeReply(t, c.Request(t, "/apt/jobs/cancel", `{"id": "`+job.ID+`"}`), &job)
+	assert.Equal(t, jobCancelling, job.State)
+	for start := time.Now(); job.State == jobCancelling && time.Since(start) < 5*time.Second; {
+		decodeReply(t, c.Request(t, "/apt/jobs/get", `{"id": "`+job.ID+`"}`), &job)
+	}
+	assert.Equal(t, jobCancelled, job.State)
+	assert.Equal(t, "cancelled", job.Error)
+
+	var reply Reply
+	assert.NoError(t, json.Unmarshal([]byte(c.Request(t, "/apt/jobs/cancel", `{"id": "`+job.ID+`"}`)), &reply))
+	assert.Equal(t, "error", reply.Status)
+	assert.Contains(t, reply.Error, "already cancelled")
+	assert.NoError(t, json.Unmarshal([]byte(c.Request(t, "/apt/jobs/get", `{"id": "missing"}`)), &reply))
+	assert.Equal(t, "error", reply.Status)
+}
@@ -0,0 +1,113 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2020  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AptPinRequest are the parameters of /apt/pins/remove
+type AptPinRequest struct {
+	Package string `json:"package"`
+}
+
+// AptHold keeps the specified packages at their installed version
+func (s *Status) AptHold(params AptPackagesRequest) (*CommandOutput, error) {
+	out, err := s.packages.Hold(toPackages(params.Packages)...)
+	if err != nil {
+		return nil, fmt.Errorf("Holding %s: %s\nOutput:\n%s", strings.Join(params.Packages, " "), err, out)
+	}
+	return &CommandOutput{Output: string(out)}, nil
+}
+
+// AptUnhold lets the specified packages be upgraded again
+func (s *Status) AptUnhold(params AptPackagesRequest) (*CommandOutput, error) {
+	out, err := s.packages.Unhold(toPackages(params.Packages)...)
+	if err != nil {
+		return nil, fmt.Errorf("Unholding %s: %s\nOutput:\n%s", strings.Join(params.Packages, " "), err, out)
+	}
+	return &CommandOutput{Output: string(out)}, nil
+}
+
+// aptRoot returns the apt configuration folder, pins and unattended-upgrades
+// are available only when the package manager is apt
+func (s *Status) aptRoot() (string, error) {
+	m, ok := s.packages.(*aptPackageManager)
+	if !ok {
+		return "", badRequest(fmt.Errorf("not available with the %s package manager", s.packages.Name()))
+	}
+	return m.root, nil
+}
+
+// AptPins returns the pins of the apt preferences
+func (s *Status) AptPins() ([]AptPin, error) {
+	root, err := s.aptRoot()
+	if err != nil {
+		return nil, err
+	}
+	return readAptPins(root)
+}
+
+// AptPinSet pins the versions of a package, replacing the pin of the same
+// package set before
+func (s *Status) AptPinSet(pin AptPin) error {
+	root, err := s.aptRoot()
+	if err != nil {
+		return err
+	}
+	if err = pin.Validate(); err != nil {
+		return badRequest(err)
+	}
+	return writeAptPin(root, pin)
+}
+
+// AptPinRemove removes the pin of a package set with AptPinSet
+func (s *Status) AptPinRemove(params AptPinRequest) error {
+	root, err := s.aptRoot()
+	if err != nil {
+		return err
+	}
+	err = removeAptPin(root, params.Package)
+	if err == errAptPinNotFound {
+		return notFound(fmt.Errorf("no pin of %s managed by the connector", params.Package))
+	}
+	return err
+}
+
+// AptUnattendedUpgrades returns the configuration of unattended-upgrades
+func (s *Status) AptUnattendedUpgrades() (*UnattendedUpgrades, error) {
+	root, err := s.aptRoot()
+	if err != nil {
+		return nil, err
+	}
+	return readUnattendedUpgrades(root)
+}
+
+// AptUnattendedUpgradesSet configures unattended-upgrades
+func (s *Status) AptUnattendedUpgradesSet(params UnattendedUpgrades) error {
+	root, err := s.aptRoot()
+	if err != nil {
+		return err
+	}
+	if err = params.Validate(); err != nil {
+		return badRequest(err)
+	}
+	return writeUnattendedUpgrades(root, params)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAptPins(t *testing.T) {
+	root := newAptRoot(t)
+	defer os.RemoveAll(root)
+	assert.NoError(t, os.Mkdir(filepath.Join(root, "preferences.d"), 0755))
+	existing := "Package: *\nPin: release a=bionic-backports\nPin-Priority: 100\n\nPackage: linux-image-* /^linux-headers/\nPin: version 4.15.*\nPin-Priority: 1001\n"
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "preferences.d", "backports"), []byte(existing), 0644))
+	c := newTestConnector(t, Config{AptRoot: root})
+	defer c.Close()
+
+	resp := c.Request(t, "/apt/pins/set", `{"package": "docker-ce", "pin": "version 5:19.03.*", "priority": 1001}`)
+	assert.Contains(t, resp, `"ok"`)
+
+	var pins []AptPin
+	decodeReply(t, c.Request(t, "/apt/pins/list", `{}`), &pins)
+	// like apt, the files are read in alphabetical order
+	if assert.Len(t, pins, 3) {
+		assert.Equal(t, "docker-ce", pins[0].Package)
+		assert.Equal(t, "version 5:19.03.*", pins[0].Pin)
+		assert.Equal(t, 1001, pins[0].Priority)
+		assert.True(t, pins[0].Managed)
+		assert.Equal(t, AptPin{Package: "*", Pin: "release a=bionic-backports", Priority: 100, File: filepath.Join(root, "preferences.d", "backports")}, pins[1])
+		assert.True(t, pins[2].Matches("linux-headers-generic"))
+	}
+
+	var reply Reply
+	assert.NoError(t, json.Unmarshal([]byte(c.Request(t, "/apt/pins/set", `{"package": "vim", "pin": "latest"}`)), &reply))
+	assert.Equal(t, "error", reply.Status)
+	assert.Contains(t, reply.Error, "invalid pin")
+
+	assert.Contains(t, c.Request(t, "/apt/pins/remove", `{"package": "docker-ce"}`), `"ok"`)
+	decodeReply(t, c.Request(t, "/apt/pins/list", `{}`), &pins)
+	assert.Len(t, pins, 2)
+	assert.NoError(t, json.Unmarshal([]byte(c.Request(t, "/apt/pins/remove", `{"package": "*"}`)), &reply))
+	assert.Equal(t, "error", reply.Status)
+	assert.Contains(t, reply.Error, "no pin of * managed by the connector")
+}
+
+func TestAptUnattendedUpgrades(t *testing.T) {
+	root := newAptRoot(t)
+	defer os.RemoveAll(root)
+	assert.NoError(t, os.Mkdir(filepath.Join(root, "apt.conf.d"), 0755))
+	defaults := `Unattended-Upgrade::Allowed-Origins {
+	"${distro_id}:${distro_codename}-security";
+};
+Unattended-Upgrade::Origins-Pattern {
+	"origin=Ubuntu,archive=${distro_codename}-security";
+};
+`
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "apt.conf.d", "50unattended-upgrades"), []byte(defaults), 0644))
+	periodic := "APT::Periodic::Update-Package-Lists \"1\";\nAPT::Periodic::Unattended-Upgrade \"1\";\n"
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "apt.conf.d", "20auto-upgrades"), []byte(periodic), 0644))
+	c := newTestConnector(t, Config{AptRoot: root})
+	defer c.Close()
+
+	var unattended UnattendedUpgrades
+	decodeReply(t, c.Request(t, "/apt/unattended/get", `{}`), &unattended)
+	assert.Equal(t, UnattendedUpgrades{Enabled: true, Origins: []string{"origin=Ubuntu,archive=${distro_codename}-security"}}, unattended)
+
+	resp := c.Request(t, "/apt/unattended/set", `{"enabled": true, "origins": ["origin=Docker"], "reboot": true, "reboot_time": "03:30"}`)
+	assert.Contains(t, resp, `"ok"`)
+	decodeReply(t, c.Request(t, "/apt/unattended/get", `{}`), &unattended)
+	assert.Equal(t, UnattendedUpgrades{Enabled: true, Origins: []string{"origin=Docker"}, Reboot: true, RebootTime: "03:30"}, unattended)
+
+	var reply Reply
+	assert.NoError(t, json.Unmarshal([]byte(c.Request(t, "/apt/unattended/set", `{"reboot": true, "reboot_time": "3am"}`)), &reply))
+	assert.Equal(t, "error", reply.Status)
+	assert.Contains(t, reply.Error, "invalid reboot time")
+}
@@ -19,87 +19,142 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
+	"time"
 
 	apt "github.com/arduino/go-apt-client"
-	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
 )
 
-// AptRepositoryListEvent sends a list of available repositories
-func (s *Status) AptRepositoryListEvent(client mqtt.Client, msg mqtt.Message) {
-	all, err := apt.ParseAPTConfigFolder("/etc/apt")
-	if err != nil {
-		s.Error("/apt/repos/list", fmt.Errorf("Retrieving repositories: %s", err))
-		return
-	}
+// AptRepositoryRequest are the parameters of /apt/repos/add and
+// /apt/repos/remove. SignedBy is the fingerprint of a key of
+// /apt/keys/list that signs the repository added.
+type AptRepositoryRequest struct {
+	Repository *apt.Repository `json:"repository"`
+	SignedBy   string          `json:"signed_by,omitempty"`
+}
 
-	data, err := json.Marshal(all)
+// AptKeyAddRequest are the parameters of /apt/keys/add: the key, ASCII
+// armored or downloaded from URL, and its expected fingerprint
+type AptKeyAddRequest struct {
+	Fingerprint string `json:"fingerprint"`
+	Key         string `json:"key,omitempty"`
+	URL         string `json:"url,omitempty"`
+}
+
+// AptKeyRequest are the parameters of /apt/keys/remove
+type AptKeyRequest struct {
+	Fingerprint string `json:"fingerprint"`
+}
+
+// AptRepositoryEditRequest are the parameters of /apt/repos/edit
+type AptRepositoryEditRequest struct {
+	OldRepository *apt.Repository `json:"old_repository"`
+	NewRepository *apt.Repository `json:"new_repository"`
+}
+
+// AptRepositoryList returns the available repositories
+func (s *Status) AptRepositoryList() (apt.RepositoryList, error) {
+	all, err := s.packages.Repositories()
 	if err != nil {
-		s.Error("/apt/repos/list", fmt.Errorf("Json marshal result: %s", err))
-		return
+		return nil, fmt.Errorf("Retrieving repositories: %s", err)
 	}
-
-	s.SendInfo(s.topicPertinence+"/apt/repos/list", string(data))
+	return all, nil
 }
 
-// AptRepositoryAddEvent adds a repository to the apt configuration
-func (s *Status) AptRepositoryAddEvent(client mqtt.Client, msg mqtt.Message) {
-	var params struct {
-		Repository *apt.Repository `json:"repository"`
+// AptRepositoryAdd adds a repository to the apt configuration
+func (s *Status) AptRepositoryAdd(params AptRepositoryRequest) error {
+	if params.Repository == nil {
+		return badRequest(errors.New("missing repository"))
+	}
+	if params.SignedBy != "" {
+		root, err := s.aptRoot()
+		if err != nil {
+			return err
+		}
+		key, err := findAptKey(root, params.SignedBy)
+		if err == errAptKeyNotFound {
+			return notFound(fmt.Errorf("no key with fingerprint %s, add it with /apt/keys/add", params.SignedBy))
+		}
+		if err != nil {
+			return err
+		}
+		params.Repository.Options = withSignedBy(params.Repository.Options, key.File)
 	}
-	err := json.Unmarshal(msg.Payload(), &params)
+	err := s.packages.AddRepository(params.Repository)
 	if err != nil {
-		s.Error("/apt/repos/add", fmt.Errorf("Unmarshal '%s': %s", msg.Payload(), err))
-		return
+		return fmt.Errorf("Adding repository '%s': %s", params.Repository.APTConfigLine(), err)
 	}
+	return nil
+}
 
-	err = apt.AddRepository(params.Repository, "/etc/apt")
+// AptRepositoryRemove removes a repository from the apt configuration
+func (s *Status) AptRepositoryRemove(params AptRepositoryRequest) error {
+	if params.Repository == nil {
+		return badRequest(errors.New("missing repository"))
+	}
+	err := s.packages.RemoveRepository(params.Repository)
 	if err != nil {
-		s.Error("/apt/repos/add", fmt.Errorf("Adding repository '%s': %s", msg.Payload(), err))
-		return
+		return fmt.Errorf("Removing repository '%s': %s", params.Repository.APTConfigLine(), err)
 	}
-
-	s.SendInfo(s.topicPertinence+"/apt/repos/add", "OK")
+	return nil
 }
 
-// AptRepositoryRemoveEvent removes a repository from the apt configuration
-func (s *Status) AptRepositoryRemoveEvent(client mqtt.Client, msg mqtt.Message) {
-	var params struct {
-		Repository *apt.Repository `json:"repository"`
+// AptRepositoryEdit modifies a repository definition in the apt configuration
+func (s *Status) AptRepositoryEdit(params AptRepositoryEditRequest) error {
+	if params.OldRepository == nil || params.NewRepository == nil {
+		return badRequest(errors.New("missing old_repository or new_repository"))
 	}
-	err := json.Unmarshal(msg.Payload(), &params)
+	err := s.packages.EditRepository(params.OldRepository, params.NewRepository)
 	if err != nil {
-		s.Error("/apt/repos/remove", fmt.Errorf("Unmarshal '%s': %s", msg.Payload(), err))
-		return
+		return fmt.Errorf("Changing repository '%s': %s", params.OldRepository.APTConfigLine(), err)
 	}
+	return nil
+}
 
-	err = apt.RemoveRepository(params.Repository, "/etc/apt")
+// AptKeys returns the keys of the keyrings folder of the apt configuration
+func (s *Status) AptKeys() ([]AptKey, error) {
+	root, err := s.aptRoot()
 	if err != nil {
-		s.Error("/apt/repos/remove", fmt.Errorf("Removing repository '%s': %s", msg.Payload(), err))
-		return
+		return nil, err
 	}
-
-	s.SendInfo(s.topicPertinence+"/apt/repos/remove", "OK")
+	return readAptKeys(root)
 }
 
-// AptRepositoryEditEvent modifies a repository definition in the apt configuration
-func (s *Status) AptRepositoryEditEvent(client mqtt.Client, msg mqtt.Message) {
-	var params struct {
-		OldRepository *apt.Repository `json:"old_repository"`
-		NewRepository *apt.Repository `json:"new_repository"`
+// AptKeyAdd saves a key in the keyrings folder, if its fingerprint matches
+func (s *Status) AptKeyAdd(params AptKeyAddRequest) (*AptKey, error) {
+	root, err := s.aptRoot()
+	if err != nil {
+		return nil, err
 	}
-	err := json.Unmarshal(msg.Payload(), &params)
+	if (params.Key == "") == (params.URL == "") {
+		return nil, badRequest(errors.New("either key or url is required"))
+	}
+	data := []byte(params.Key)
+	if params.URL != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if data, err = downloadAptKey(ctx, params.URL); err != nil {
+			return nil, err
+		}
+	}
+	key, err := writeAptKey(root, data, params.Fingerprint)
 	if err != nil {
-		s.Error("/apt/repos/edit", fmt.Errorf("Unmarshal '%s': %s", msg.Payload(), err))
-		return
+		return nil, badRequest(err)
 	}
+	return key, nil
+}
 
-	err = apt.EditRepository(params.OldRepository, params.NewRepository, "/etc/apt")
+// AptKeyRemove removes a key from the keyrings folder
+func (s *Status) AptKeyRemove(params AptKeyRequest) error {
+	root, err := s.aptRoot()
 	if err != nil {
-		s.Error("/apt/repos/edit", fmt.Errorf("Changing repository '%s': %s", msg.Payload(), err))
-		return
+		return err
 	}
-
-	s.SendInfo(s.topicPertinence+"/apt/repos/edit", "OK")
+	err = removeAptKey(root, params.Fingerprint)
+	if err == errAptKeyNotFound {
+		return notFound(fmt.Errorf("no key with fingerprint %s", params.Fingerprint))
+	}
+	return err
 }
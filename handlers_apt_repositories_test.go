@@ -1,67 +1,71 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
-	"time"
 
 	apt "github.com/arduino/go-apt-client"
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
 )
 
-func TestAptList(t *testing.T) {
-	ui := NewMqttTestClientLocal()
-	defer ui.Close()
-
-	s := NewStatus(program{}.Config, nil, nil, "")
-	s.mqttClient = mqtt.NewClient(mqtt.NewClientOptions().AddBroker("tcp://localhost:1883").SetClientID("arduino-connector"))
-	if token := s.mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		log.Fatal(token.Error())
+// newAptRoot creates an apt configuration folder with a single repository
+func newAptRoot(t *testing.T) string {
+	root, err := ioutil.TempDir("", "apt")
+	if err != nil {
+		t.Fatal(err)
 	}
-	defer s.mqttClient.Disconnect(100)
-
-	subscribeTopic(s.mqttClient, "0", "/apt/repos/list/post", s, s.AptRepositoryListEvent, false)
-
-	resp := ui.MqttSendAndReceiveTimeout(t, "/apt/repos/list", "{}", 1*time.Second)
-
-	assert.NotEmpty(t, resp)
+	if err := os.Mkdir(filepath.Join(root, "sources.list.d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	sources := "deb http://archive.ubuntu.com/ubuntu/ bionic main restricted\n"
+	if err := ioutil.WriteFile(filepath.Join(root, "sources.list"), []byte(sources), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return root
 }
 
-func TestAptAddError(t *testing.T) {
-	ui := NewMqttTestClientLocal()
-	defer ui.Close()
-
-	s := NewStatus(program{}.Config, nil, nil, "")
-	s.mqttClient = mqtt.NewClient(mqtt.NewClientOptions().AddBroker("tcp://localhost:1883").SetClientID("arduino-connector"))
-	if token := s.mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		log.Fatal(token.Error())
+func TestAptList(t *testing.T) {
+	root := newAptRoot(t)
+	defer os.RemoveAll(root)
+	c := newTestConnector(t, Config{AptRoot: root})
+	defer c.Close()
+
+	resp := c.Request(t, "/apt/repos/list", "{}")
+
+	var all apt.RepositoryList
+	decodeReply(t, resp, &all)
+	if assert.Len(t, all, 1) {
+		assert.Equal(t, "http://archive.ubuntu.com/ubuntu/", all[0].URI)
+		assert.Equal(t, "bionic", all[0].Distribution)
 	}
-	defer s.mqttClient.Disconnect(100)
+}
 
-	subscribeTopic(s.mqttClient, "0", "/apt/repos/add/post", s, s.AptRepositoryAddEvent, true)
+func TestAptAddError(t *testing.T) {
+	c := newTestConnector(t, Config{LegacyReplies: true})
+	defer c.Close()
 
-	resp := ui.MqttSendAndReceiveTimeout(t, "/apt/repos/add", "{test}", 1*time.Second)
+	resp := c.Request(t, "/apt/repos/add", "{test}")
 
 	assert.True(t, strings.HasPrefix(resp, "ERROR"))
 	assert.True(t, strings.Contains(resp, "Unmarshal"))
 }
 
 func TestAptAdd(t *testing.T) {
-	ui := NewMqttTestClientLocal()
-	defer ui.Close()
-
-	s := NewStatus(program{}.Config, nil, nil, "")
-	s.mqttClient = mqtt.NewClient(mqtt.NewClientOptions().AddBroker("tcp://localhost:1883").SetClientID("arduino-connector"))
-	if token := s.mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		log.Fatal(token.Error())
-	}
-	defer s.mqttClient.Disconnect(100)
-
-	subscribeTopic(s.mqttClient, "0", "/apt/repos/add/post", s, s.AptRepositoryAddEvent, true)
+	root := newAptRoot(t)
+	defer os.RemoveAll(root)
+	c := newTestConnector(t, Config{LegacyReplies: true, AptRoot: root})
+	defer c.Close()
 
 	var params struct {
 		Repository *apt.Repository `json:"repository"`
@@ -81,56 +85,32 @@ func TestAptAdd(t *testing.T) {
 		t.Error(err)
 	}
 
-	resp := ui.MqttSendAndReceiveTimeout(t, "/apt/repos/add", string(data), 1*time.Second)
+	resp := c.Request(t, "/apt/repos/add", string(data))
 	assert.Equal(t, "INFO: OK\n", resp)
 
-	defer func() {
-		err = apt.RemoveRepository(params.Repository, "/etc/apt")
-		if err != nil {
-			t.Error(err)
-		}
-	}()
-
-	all, err := apt.ParseAPTConfigFolder("/etc/apt")
+	all, err := apt.ParseAPTConfigFolder(root)
 	if err != nil {
-		s.Error("/apt/repos/list", fmt.Errorf("Retrieving repositories: %s", err))
-		return
+		t.Fatal(err)
 	}
 
 	assert.True(t, all.Contains(params.Repository))
 }
 
 func TestAptRemoveError(t *testing.T) {
-	ui := NewMqttTestClientLocal()
-	defer ui.Close()
+	c := newTestConnector(t, Config{LegacyReplies: true})
+	defer c.Close()
 
-	s := NewStatus(program{}.Config, nil, nil, "")
-	s.mqttClient = mqtt.NewClient(mqtt.NewClientOptions().AddBroker("tcp://localhost:1883").SetClientID("arduino-connector"))
-	if token := s.mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		log.Fatal(token.Error())
-	}
-	defer s.mqttClient.Disconnect(100)
-
-	subscribeTopic(s.mqttClient, "0", "/apt/repos/remove/post", s, s.AptRepositoryRemoveEvent, true)
-
-	resp := ui.MqttSendAndReceiveTimeout(t, "/apt/repos/remove", "{test}", 1*time.Second)
+	resp := c.Request(t, "/apt/repos/remove", "{test}")
 
 	assert.True(t, strings.HasPrefix(resp, "ERROR"))
 	assert.True(t, strings.Contains(resp, "Unmarshal"))
 }
 
 func TestAptRemove(t *testing.T) {
-	ui := NewMqttTestClientLocal()
-	defer ui.Close()
-
-	s := NewStatus(program{}.Config, nil, nil, "")
-	s.mqttClient = mqtt.NewClient(mqtt.NewClientOptions().AddBroker("tcp://localhost:1883").SetClientID("arduino-connector"))
-	if token := s.mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		log.Fatal(token.Error())
-	}
-	defer s.mqttClient.Disconnect(100)
-
-	subscribeTopic(s.mqttClient, "0", "/apt/repos/remove/post", s, s.AptRepositoryRemoveEvent, true)
+	root := newAptRoot(t)
+	defer os.RemoveAll(root)
+	c := newTestConnector(t, Config{LegacyReplies: true, AptRoot: root})
+	defer c.Close()
 
 	var params struct {
 		Repository *apt.Repository `json:"repository"`
@@ -145,7 +125,7 @@ func TestAptRemove(t *testing.T) {
 		Comment:      "",
 	}
 
-	errAdd := apt.AddRepository(params.Repository, "/etc/apt")
+	errAdd := apt.AddRepository(params.Repository, root)
 	if errAdd != nil {
 		t.Error(errAdd)
 	}
@@ -155,49 +135,32 @@ func TestAptRemove(t *testing.T) {
 		t.Error(err)
 	}
 
-	resp := ui.MqttSendAndReceiveTimeout(t, "/apt/repos/remove", string(data), 1*time.Second)
+	resp := c.Request(t, "/apt/repos/remove", string(data))
 	assert.Equal(t, "INFO: OK\n", resp)
 
-	all, err := apt.ParseAPTConfigFolder("/etc/apt")
+	all, err := apt.ParseAPTConfigFolder(root)
 	if err != nil {
-		s.Error("/apt/repos/list", fmt.Errorf("Retrieving repositories: %s", err))
-		return
+		t.Fatal(err)
 	}
 
 	assert.False(t, all.Contains(params.Repository))
 }
 
 func TestAptEditError(t *testing.T) {
-	ui := NewMqttTestClientLocal()
-	defer ui.Close()
+	c := newTestConnector(t, Config{LegacyReplies: true})
+	defer c.Close()
 
-	s := NewStatus(program{}.Config, nil, nil, "")
-	s.mqttClient = mqtt.NewClient(mqtt.NewClientOptions().AddBroker("tcp://localhost:1883").SetClientID("arduino-connector"))
-	if token := s.mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		log.Fatal(token.Error())
-	}
-	defer s.mqttClient.Disconnect(100)
-
-	subscribeTopic(s.mqttClient, "0", "/apt/repos/edit/post", s, s.AptRepositoryEditEvent, true)
-
-	resp := ui.MqttSendAndReceiveTimeout(t, "/apt/repos/edit", "{test}", 1*time.Second)
+	resp := c.Request(t, "/apt/repos/edit", "{test}")
 
 	assert.True(t, strings.HasPrefix(resp, "ERROR"))
 	assert.True(t, strings.Contains(resp, "Unmarshal"))
 }
 
 func TestAptEdit(t *testing.T) {
-	ui := NewMqttTestClientLocal()
-	defer ui.Close()
-
-	s := NewStatus(program{}.Config, nil, nil, "")
-	s.mqttClient = mqtt.NewClient(mqtt.NewClientOptions().AddBroker("tcp://localhost:1883").SetClientID("arduino-connector"))
-	if token := s.mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		log.Fatal(token.Error())
-	}
-	defer s.mqttClient.Disconnect(100)
-
-	subscribeTopic(s.mqttClient, "0", "/apt/repos/edit/post", s, s.AptRepositoryEditEvent, true)
+	root := newAptRoot(t)
+	defer os.RemoveAll(root)
+	c := newTestConnector(t, Config{LegacyReplies: true, AptRoot: root})
+	defer c.Close()
 
 	var params struct {
 		OldRepository *apt.Repository `json:"old_repository"`
@@ -222,32 +185,110 @@ func TestAptEdit(t *testing.T) {
 		Comment:      "new",
 	}
 
-	errAdd := apt.AddRepository(params.OldRepository, "/etc/apt")
+	errAdd := apt.AddRepository(params.OldRepository, root)
 	if errAdd != nil {
 		t.Error(errAdd)
 	}
 
-	defer func() {
-		err := apt.RemoveRepository(params.NewRepository, "/etc/apt")
-		if err != nil {
-			t.Error(err)
-		}
-	}()
-
 	data, err := json.Marshal(params)
 	if err != nil {
 		t.Error(err)
 	}
 
-	resp := ui.MqttSendAndReceiveTimeout(t, "/apt/repos/edit", string(data), 1*time.Second)
+	resp := c.Request(t, "/apt/repos/edit", string(data))
 	assert.Equal(t, "INFO: OK\n", resp)
 
-	all, err := apt.ParseAPTConfigFolder("/etc/apt")
+	all, err := apt.ParseAPTConfigFolder(root)
 	if err != nil {
-		s.Error("/apt/repos/list", fmt.Errorf("Retrieving repositories: %s", err))
-		return
+		t.Fatal(err)
 	}
 
 	assert.True(t, all.Contains(params.NewRepository))
 	assert.False(t, all.Contains(params.OldRepository))
 }
+
+func TestAptEditRestoresOldRepository(t *testing.T) {
+	root := newAptRoot(t)
+	defer os.RemoveAll(root)
+	m := newAptPackageManager(root)
+
+	old := &apt.Repository{Enabled: true, URI: "http://archive.ubuntu.com/ubuntu/", Distribution: "bionic", Components: "main restricted"}
+	new := &apt.Repository{Enabled: true, Options: "arch=amd64", URI: "https://example.com/ubuntu", Distribution: "bionic", Components: "stable"}
+	assert.NoError(t, m.AddRepository(new))
+
+	// the new repository is already configured, adding it fails
+	assert.Error(t, m.EditRepository(old, new))
+	all, err := m.Repositories()
+	assert.NoError(t, err)
+	assert.True(t, all.Contains(old))
+	assert.True(t, all.Contains(new))
+}
+
+// newArmoredKey returns a new OpenPGP public key, ASCII armored, and its fingerprint
+func newArmoredKey(t *testing.T) (string, string) {
+	entity, err := openpgp.NewEntity("Test Repository", "", "repo@example.com", &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = entity.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	return buf.String(), fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint)
+}
+
+func TestAptKeys(t *testing.T) {
+	root := newAptRoot(t)
+	defer os.RemoveAll(root)
+	c := newTestConnector(t, Config{AptRoot: root})
+	defer c.Close()
+	armored, fingerprint := newArmoredKey(t)
+	other, _ := newArmoredKey(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, armored)
+	}))
+	defer server.Close()
+
+	var reply Reply
+	params, _ := json.Marshal(AptKeyAddRequest{Fingerprint: fingerprint, Key: other})
+	assert.NoError(t, json.Unmarshal([]byte(c.Request(t, "/apt/keys/add", string(params))), &reply))
+	assert.Equal(t, "error", reply.Status)
+	assert.Contains(t, reply.Error, "not "+fingerprint)
+
+	var key AptKey
+	params, _ = json.Marshal(AptKeyAddRequest{Fingerprint: strings.ToLower(fingerprint[:4] + " " + fingerprint[4:]), URL: server.URL})
+	decodeReply(t, c.Request(t, "/apt/keys/add", string(params)), &key)
+	assert.Equal(t, fingerprint, key.Fingerprint)
+	assert.Equal(t, []string{"Test Repository <repo@example.com>"}, key.UserIDs)
+	assert.Equal(t, filepath.Join(root, "keyrings", fingerprint+".gpg"), key.File)
+
+	var keys []AptKey
+	decodeReply(t, c.Request(t, "/apt/keys/list", `{}`), &keys)
+	assert.Equal(t, []AptKey{key}, keys)
+
+	repo := `{"repository": {"Enabled": true, "Options": "arch=amd64", "URI": "https://example.com/ubuntu", "Distribution": "bionic", "Components": "stable"}, "signed_by": "` + fingerprint + `"}`
+	assert.Contains(t, c.Request(t, "/apt/repos/add", repo), `"ok"`)
+	all, err := apt.ParseAPTConfigFolder(root)
+	assert.NoError(t, err)
+	if assert.Len(t, all, 2) {
+		assert.Equal(t, "https://example.com/ubuntu", all[1].URI)
+		assert.Equal(t, "arch=amd64 signed-by="+key.File, all[1].Options)
+	}
+
+	assert.Contains(t, c.Request(t, "/apt/keys/remove", `{"fingerprint": "`+fingerprint+`"}`), `"ok"`)
+	decodeReply(t, c.Request(t, "/apt/keys/list", `{}`), &keys)
+	assert.Empty(t, keys)
+	assert.NoError(t, json.Unmarshal([]byte(c.Request(t, "/apt/repos/add", repo)), &reply))
+	assert.Equal(t, "error", reply.Status)
+	assert.Contains(t, reply.Error, "no key with fingerprint")
+}
+
+func TestWithSignedBy(t *testing.T) {
+	assert.Equal(t, "signed-by=/etc/apt/keyrings/a.gpg", withSignedBy("", "/etc/apt/keyrings/a.gpg"))
+	assert.Equal(t, "arch=amd64 signed-by=/etc/apt/keyrings/b.gpg", withSignedBy("arch=amd64 signed-by=/etc/apt/keyrings/a.gpg", "/etc/apt/keyrings/b.gpg"))
+}
@@ -19,16 +19,16 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"os"
 	"os/exec"
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/arduino/go-apt-client"
 	dockerConfig "github.com/docker/cli/cli/config"
@@ -37,10 +37,7 @@ import (
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/network"
 	docker "github.com/docker/docker/client"
-	mqtt "github.com/eclipse/paho.mqtt.golang"
-	"github.com/pkg/errors"
 	"github.com/shirou/gopsutil/host"
-	"golang.org/x/net/context"
 )
 
 // RunPayload Struct merges connector specific parameters with
@@ -56,10 +53,18 @@ type RunPayload struct {
 	ContainerConfig         container.Config         `json:"container_config,omitempty"`
 	ContainerHostConfig     container.HostConfig     `json:"host_config,omitempty"`
 	NetworkNetworkingConfig network.NetworkingConfig `json:"networking_config,omitempty"`
+	Force                   *bool                    `json:"force,omitempty"`
+	RemoveVolumes           *bool                    `json:"remove_volumes,omitempty"`
+	PruneImages             bool                     `json:"prune_images,omitempty"`
+	Pull                    *ImagePullReport         `json:"pull,omitempty"`
 }
 
+// PsPayload are the parameters of /containers/ps: the containers can be
+// filtered by id or by stack, and Stacks lists the stacks instead
 type PsPayload struct {
 	ContainerID string `json:"id,omitempty"`
+	Stack       string `json:"stack,omitempty"`
+	Stacks      bool   `json:"stacks,omitempty"`
 }
 
 type ImagesPayload struct {
@@ -71,44 +76,26 @@ type ChangeNamePayload struct {
 	ContainerName string `json:"name"`
 }
 
-// ContainersPsEvent send info about "docker ps -a" command
-func (s *Status) ContainersPsEvent(client mqtt.Client, msg mqtt.Message) {
-	psPayload := PsPayload{}
-	err := json.Unmarshal(msg.Payload(), &psPayload)
-	if err != nil {
-		s.Error("/containers/ps", errors.Wrapf(err, "unmarshal %s", msg.Payload()))
-		return
-	}
-
+// ContainersPs returns the result of the "docker ps -a" command
+func (s *Status) ContainersPs(psPayload PsPayload) ([]types.Container, error) {
 	containerListOptions := types.ContainerListOptions{All: true}
+	containerListOptions.Filters = filters.NewArgs()
 	if psPayload.ContainerID != "" {
-		containerListOptions.Filters = filters.NewArgs(filters.Arg("id", psPayload.ContainerID))
+		containerListOptions.Filters.Add("id", psPayload.ContainerID)
 	}
-
-	containers, err := s.dockerClient.ContainerList(context.Background(), containerListOptions)
-	if err != nil {
-		s.Error("/containers/ps", fmt.Errorf("Json marshal result: %s", err))
-		return
+	if psPayload.Stack != "" {
+		containerListOptions.Filters.Add("label", stackLabel+"="+psPayload.Stack)
 	}
 
-	data, err := json.Marshal(containers)
+	containers, err := s.dockerClient.ContainerList(context.Background(), containerListOptions)
 	if err != nil {
-		s.Error("/containers/ps", fmt.Errorf("Json marsahl result: %s", err))
-		return
+		return nil, fmt.Errorf("containers list result: %s", err)
 	}
-
-	s.SendInfo(s.topicPertinence+"/containers/ps", string(data)+"\n")
+	return containers, nil
 }
 
-// ContainersListImagesEvent implements docker images
-func (s *Status) ContainersListImagesEvent(client mqtt.Client, msg mqtt.Message) {
-	imagesPayload := ImagesPayload{}
-	err := json.Unmarshal(msg.Payload(), &imagesPayload)
-	if err != nil {
-		s.Error("/containers/images", errors.Wrapf(err, "unmarshal %s", msg.Payload()))
-		return
-	}
-
+// ContainersListImages implements docker images
+func (s *Status) ContainersListImages(imagesPayload ImagesPayload) ([]types.ImageSummary, error) {
 	imageListOptions := types.ImageListOptions{All: true}
 	if imagesPayload.ImageName != "" {
 		imageListOptions.Filters = filters.NewArgs(filters.Arg("reference", imagesPayload.ImageName))
@@ -116,54 +103,23 @@ func (s *Status) ContainersListImagesEvent(client mqtt.Client, msg mqtt.Message)
 
 	images, err := s.dockerClient.ImageList(context.Background(), imageListOptions)
 	if err != nil {
-		s.Error("/containers/images", fmt.Errorf("images result: %s", err))
-		return
-	}
-
-	// Send result
-	data, err := json.Marshal(images)
-	if err != nil {
-		s.Error("/containers/images", fmt.Errorf("Json marsahl result: %s", err))
-		return
+		return nil, fmt.Errorf("images result: %s", err)
 	}
-
-	s.SendInfo(s.topicPertinence+"/containers/images", string(data)+"\n")
+	return images, nil
 }
 
-// ContainersRenameEvent implements docker rename
-func (s *Status) ContainersRenameEvent(client mqtt.Client, msg mqtt.Message) {
-	cnPayload := ChangeNamePayload{}
-	err := json.Unmarshal(msg.Payload(), &cnPayload)
+// ContainersRename implements docker rename
+func (s *Status) ContainersRename(cnPayload ChangeNamePayload) (*ChangeNamePayload, error) {
+	err := s.dockerClient.ContainerRename(context.Background(), cnPayload.ContainerID, cnPayload.ContainerName)
 	if err != nil {
-		s.Error("/containers/rename", errors.Wrapf(err, "unmarshal %s", msg.Payload()))
-		return
-	}
-	err = s.dockerClient.ContainerRename(context.Background(), cnPayload.ContainerID, cnPayload.ContainerName)
-	if err != nil {
-		s.Error("/containers/rename", fmt.Errorf("rename result: %s", err))
-		return
-	}
-
-	// Send result
-	data, err := json.Marshal(cnPayload)
-	if err != nil {
-		s.Error("/containers/rename", fmt.Errorf("Json marsahl result: %s", err))
-		return
+		return nil, fmt.Errorf("rename result: %s", err)
 	}
-
-	s.SendInfo(s.topicPertinence+"/containers/rename", string(data)+"\n")
+	return &cnPayload, nil
 }
 
-// ContainersActionEvent implements docker container action like run, start and stop, remove
-func (s *Status) ContainersActionEvent(client mqtt.Client, msg mqtt.Message) {
-
-	runParams := RunPayload{}
-	err := json.Unmarshal(msg.Payload(), &runParams)
-	if err != nil {
-		s.Error("/containers/action", errors.Wrapf(err, "unmarshal %s", msg.Payload()))
-		return
-	}
-
+// ContainersAction implements docker container action like pull, run, start and stop, remove
+func (s *Status) ContainersAction(ctx context.Context, job *JobHandle, runParams RunPayload, progressTopic string) (*RunPayload, error) {
+	var err error
 	runResponse := RunPayload{
 		ImageName:     runParams.ImageName,
 		ContainerName: runParams.ContainerName,
@@ -171,41 +127,17 @@ func (s *Status) ContainersActionEvent(client mqtt.Client, msg mqtt.Message) {
 		Action:        runParams.Action,
 	}
 
-	ctx := context.Background()
 	switch runParams.Action {
-	case "run":
-		// check if user and passw are present in order to add auth
-		// remember that the imageName should provide also the registry endpoint
-		// i.e 6435543362.dkr.ecr.eu-east-1.amazonaws.com/redis:latest
-		// the default is  docker.io/library/redis:latest
-		pullOpts, authConfig, errConf := ConfigureRegistryAuth(runParams)
-		if errConf != nil {
-			fmt.Println(errConf)
-			break
+	case "pull":
+		if runResponse.Pull, err = s.pullRegistryImage(ctx, job, runParams, progressTopic); err != nil {
+			return nil, err
 		}
 
-		if authConfig != nil {
-			_, err = s.dockerClient.RegistryLogin(ctx, *authConfig)
-			if err != nil {
-				ClearRegistryAuth(runParams)
-				s.Error("/containers/action", fmt.Errorf("auth test failed: %s", err))
-				return
-			}
-		}
-		out, errPull := s.dockerClient.ImagePull(ctx, runParams.ImageName, pullOpts)
-		if errPull != nil {
-			s.Error("/containers/action", fmt.Errorf("image pull result: %s", errPull))
-			return
-		}
-		// waiting the complete download of the image
-		_, err = io.Copy(ioutil.Discard, out)
-		if err != nil {
-			fmt.Println(err)
+	case "run":
+		if runResponse.Pull, err = s.pullRegistryImage(ctx, job, runParams, progressTopic); err != nil {
+			return nil, err
 		}
 
-		defer out.Close()
-		fmt.Fprintf(os.Stdout, "Successfully downloaded image: %s\n", runParams.ImageName)
-
 		// overwrite imagename in container.Config
 		runParams.ContainerConfig.Image = runParams.ImageName
 		// by default bind all the exposed ports via PublishAllPorts if the field PortBindings is empty
@@ -218,64 +150,88 @@ func (s *Status) ContainersActionEvent(client mqtt.Client, msg mqtt.Message) {
 			&runParams.NetworkNetworkingConfig, runParams.ContainerName)
 
 		if errCreate != nil {
-			s.Error("/containers/action", fmt.Errorf("container create result: %s", errCreate))
-			return
+			return nil, fmt.Errorf("container create result: %s", errCreate)
 		}
 
 		if err = s.dockerClient.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
-			s.Error("/containers/action", fmt.Errorf("container start result: %s", err))
-			return
+			return nil, fmt.Errorf("container start result: %s", err)
 		}
 		runResponse.ContainerID = resp.ID
 		fmt.Fprintf(os.Stdout, "Successfully started container %s from  Image: %s\n", resp.ID, runParams.ImageName)
+		job.Log("Successfully started container " + resp.ID)
 
 	case "stop":
 		if err = s.dockerClient.ContainerStop(ctx, runParams.ContainerID, nil); err != nil {
-			s.Error("/containers/action", fmt.Errorf("container action result: %s", err))
-			return
+			return nil, fmt.Errorf("container action result: %s", err)
 		}
 		fmt.Fprintf(os.Stdout, "Successfully stopped container %s\n", runParams.ContainerID)
+		job.Log("Successfully stopped container " + runParams.ContainerID)
 
 	case "start":
 		if err = s.dockerClient.ContainerStart(ctx, runParams.ContainerID, types.ContainerStartOptions{}); err != nil {
-			s.Error("/containers/action", fmt.Errorf("container action result: %s", err))
-			return
+			return nil, fmt.Errorf("container action result: %s", err)
 		}
 		fmt.Fprintf(os.Stdout, "Successfully started container %s\n", runParams.ContainerID)
+		job.Log("Successfully started container " + runParams.ContainerID)
 
 	case "remove":
-		forceAllOption := types.ContainerRemoveOptions{
-			Force:         true,
+		// force and remove_volumes are true unless the request says otherwise
+		removeOptions := types.ContainerRemoveOptions{
+			Force:         runParams.Force == nil || *runParams.Force,
 			RemoveLinks:   false,
-			RemoveVolumes: true,
+			RemoveVolumes: runParams.RemoveVolumes == nil || *runParams.RemoveVolumes,
 		}
 
-		if err = s.dockerClient.ContainerRemove(ctx, runParams.ContainerID, forceAllOption); err != nil {
-			s.Error("/containers/action", fmt.Errorf("container remove result: %s", err))
-			return
+		if err = s.dockerClient.ContainerRemove(ctx, runParams.ContainerID, removeOptions); err != nil {
+			return nil, fmt.Errorf("container remove result: %s", err)
 		}
 		fmt.Fprintf(os.Stdout, "Successfully removed container %s\n", runParams.ContainerID)
+		job.Log("Successfully removed container " + runParams.ContainerID)
+		if !runParams.PruneImages {
+			break
+		}
 		// implements docker image prune -a that removes all images not associated to a container
-		forceAllImagesArg, _ := filters.FromJSON(`{"dangling": false}`)
-		if _, errPrune := s.dockerClient.ImagesPrune(ctx, forceAllImagesArg); err != nil {
-			s.Error("/containers/action", fmt.Errorf("images prune result: %s", errPrune))
-			return
+		forceAllImagesArg := filters.NewArgs(filters.Arg("dangling", "false"))
+		if _, errPrune := s.dockerClient.ImagesPrune(ctx, forceAllImagesArg); errPrune != nil {
+			return nil, fmt.Errorf("images prune result: %s", errPrune)
 		}
 		fmt.Fprintf(os.Stdout, "Successfully pruned container images\n")
+		job.Log("Successfully pruned container images")
 
 	default:
-		s.Error("/containers/action", fmt.Errorf("container command %s not found", runParams.Action))
-		return
+		return nil, badRequest(fmt.Errorf("container command %s not found", runParams.Action))
 	}
 
-	// Send result
-	data, err := json.Marshal(runResponse)
-	if err != nil {
-		s.Error("/containers/action", fmt.Errorf("Json marshal result: %s", err))
-		return
+	return &runResponse, nil
+}
+
+// pullRegistryImage pulls the image of runParams, logging in to its registry
+// with the credentials of the request or the saved ones
+func (s *Status) pullRegistryImage(ctx context.Context, job *JobHandle, runParams RunPayload, progressTopic string) (*ImagePullReport, error) {
+	// check if user and passw are present in order to add auth
+	// remember that the imageName should provide also the registry endpoint
+	// i.e 6435543362.dkr.ecr.eu-east-1.amazonaws.com/redis:latest
+	// the default is  docker.io/library/redis:latest
+	pullOpts, authConfig, errConf := ConfigureRegistryAuth(runParams)
+	if errConf != nil {
+		fmt.Println(errConf)
 	}
 
-	s.SendInfo("/containers/action", string(data)+"\n")
+	if authConfig != nil {
+		_, err := s.dockerClient.RegistryLogin(ctx, *authConfig)
+		if err != nil {
+			ClearRegistryAuth(runParams)
+			return nil, fmt.Errorf("auth test failed: %s", err)
+		}
+	}
+	job.Log("Pulling image " + runParams.ImageName)
+	report, err := s.pullImage(ctx, job, runParams.ImageName, pullOpts, progressTopic)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stdout, "Successfully downloaded image: %s\n", runParams.ImageName)
+	job.Log("Successfully downloaded image " + runParams.ImageName)
+	return report, nil
 }
 
 // ConfigureRegistryAuth manages registry authentication usage flow
@@ -347,7 +303,7 @@ func ClearRegistryAuth(runParams RunPayload) {
 }
 
 // checkAndInstallDocker implements steps from https://docs.docker.com/install/linux/docker-ce/ubuntu/
-func checkAndInstallDocker() {
+func checkAndInstallDocker(config Config) {
 	cli, err := docker.NewClientWithOpts(docker.WithVersion("1.38"))
 	defer func() {
 		err = cli.Close()
@@ -372,7 +328,7 @@ func checkAndInstallDocker() {
 		if runtime.GOARCH == "amd64" {
 			if platform == "ubuntu" {
 				if distroVer >= 1604 {
-					installDockerCEOnXenialAndNewer()
+					installDockerCEOnXenialAndNewer(config)
 				}
 			}
 		} else if runtime.GOARCH == "arm" {
@@ -398,7 +354,18 @@ func installDockerCEViaConvenienceScript() {
 	}
 }
 
-func installDockerCEOnXenialAndNewer() {
+// dockerKeyURL is where the key that signs the Docker CE packages is
+// published, dockerKeyFingerprint is its fingerprint
+const (
+	dockerKeyURL         = "https://download.docker.com/linux/ubuntu/gpg"
+	dockerKeyFingerprint = "9DC858229FC7DD38854AE2D88D81803C0EBFCD88"
+)
+
+// installDockerCEOnXenialAndNewer installs docker-ce from the Docker
+// repository, added to the configured apt root
+func installDockerCEOnXenialAndNewer(config Config) {
+	packages := newAptPackageManager(config.AptRoot)
+
 	// dpkg --configure -a for prevent block of installation
 	dpkgCmd := exec.Command("dpkg", "--configure", "-a")
 	if out, err := dpkgCmd.CombinedOutput(); err != nil {
@@ -406,7 +373,7 @@ func installDockerCEOnXenialAndNewer() {
 		fmt.Println(string(out))
 	}
 
-	_, err := apt.CheckForUpdates()
+	_, err := packages.CheckForUpdates(context.Background(), nil)
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -415,39 +382,53 @@ func installDockerCEOnXenialAndNewer() {
 	dockerPrerequisitesPackages := []*apt.Package{
 		&apt.Package{Name: "apt-transport-https"},
 		&apt.Package{Name: "ca-certificates"},
-		&apt.Package{Name: "curl"},
-		&apt.Package{Name: "software-properties-common"},
 	}
 	for _, pac := range dockerPrerequisitesPackages {
-		if out, errInstall := apt.Install(pac); errInstall != nil {
+		if out, errInstall := packages.Install(context.Background(), nil, pac); errInstall != nil {
 			fmt.Println("Failed to install: ", pac.Name)
 			fmt.Println(string(out))
 			return
 		}
 	}
 
-	curlString := "curl -fsSL https://download.docker.com/linux/ubuntu/gpg | apt-key add -"
-	curlCmd := exec.Command("bash", "-c", curlString)
-	if out, errCmd := curlCmd.CombinedOutput(); errCmd != nil {
-		fmt.Println("Failed to add Docker’s official GPG key:")
-		fmt.Println(string(out))
+	// the key goes in the keyrings folder of the apt root and signs only the docker repository
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	data, err := downloadAptKey(ctx, dockerKeyURL)
+	cancel()
+	if err != nil {
+		fmt.Println("Failed to download Docker’s official GPG key:", err)
+		return
+	}
+	key, err := writeAptKey(packages.root, data, dockerKeyFingerprint)
+	if err != nil {
+		fmt.Println("Failed to add Docker’s official GPG key:", err)
+		return
 	}
 
-	repoString := `add-apt-repository "deb [arch=amd64] https://download.docker.com/linux/ubuntu $(lsb_release -cs) stable"`
-	repoCmd := exec.Command("bash", "-c", repoString)
-	if out, errCmd := repoCmd.CombinedOutput(); errCmd != nil {
-		fmt.Println("Failed to set up the stable docker repository:")
-		fmt.Println(string(out))
+	codename, err := exec.Command("lsb_release", "-cs").Output()
+	if err != nil {
+		fmt.Println("Failed to detect the Ubuntu release:", err)
+		return
+	}
+	repo := &apt.Repository{
+		Enabled:      true,
+		Options:      withSignedBy("arch=amd64", key.File),
+		URI:          "https://download.docker.com/linux/ubuntu",
+		Distribution: strings.TrimSpace(string(codename)),
+		Components:   "stable",
+	}
+	if err = packages.AddRepository(repo); err != nil {
+		fmt.Println("Failed to set up the stable docker repository:", err)
 	}
 
-	_, err = apt.CheckForUpdates()
+	_, err = packages.CheckForUpdates(context.Background(), nil)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 
 	toInstall := &apt.Package{Name: "docker-ce"}
-	if out, err := apt.Install(toInstall); err != nil {
+	if out, err := packages.Install(context.Background(), nil, toInstall); err != nil {
 		fmt.Println("Failed to install docker-ce:")
 		fmt.Println(string(out))
 		return
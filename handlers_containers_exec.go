@@ -0,0 +1,373 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2020  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/stdcopy"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+)
+
+// reasons why an exec session is closed
+const (
+	execExited = "exited"
+	execClosed = "closed"
+	execIdle   = "idle timeout"
+)
+
+// defaultExecIdleTimeout is how long a session stays open without input or
+// output when neither the configuration nor the request say it
+const defaultExecIdleTimeout = 10 * time.Minute
+
+// ContainersExecPayload are the parameters of /containers/exec: the command
+// to run in the container, /bin/sh if missing, and the size of the tty, if
+// it has one. IdleTimeout is in seconds, 0 for the default of the connector.
+type ContainersExecPayload struct {
+	ContainerID string   `json:"id"`
+	Cmd         []string `json:"cmd"`
+	Tty         bool     `json:"tty"`
+	Env         []string `json:"env"`
+	User        string   `json:"user"`
+	WorkingDir  string   `json:"working_dir"`
+	Rows        uint     `json:"rows"`
+	Cols        uint     `json:"cols"`
+	IdleTimeout int      `json:"idle_timeout"`
+}
+
+// ExecSessionRequest are the parameters of /containers/exec/close
+type ExecSessionRequest struct {
+	ID string `json:"id"`
+}
+
+// ExecResize is a message of the resize topic of a session
+type ExecResize struct {
+	Rows uint `json:"rows"`
+	Cols uint `json:"cols"`
+}
+
+// ExecSession is a process started in a container by /containers/exec. Its
+// output is published on OutputTopic, its input is read from StdinTopic and
+// the size of its tty from ResizeTopic. The session is closed when the
+// process exits, when it's asked or when nothing is read or written for
+// IdleTimeout seconds.
+type ExecSession struct {
+	ID          string     `json:"id"`
+	ContainerID string     `json:"container_id"`
+	ExecID      string     `json:"exec_id"`
+	Cmd         []string   `json:"cmd"`
+	Tty         bool       `json:"tty"`
+	OutputTopic string     `json:"output_topic"`
+	StdinTopic  string     `json:"stdin_topic"`
+	ResizeTopic string     `json:"resize_topic"`
+	IdleTimeout int        `json:"idle_timeout"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ClosedAt    *time.Time `json:"closed_at,omitempty"`
+	Reason      string     `json:"reason,omitempty"`
+	ExitCode    *int       `json:"exit_code,omitempty"`
+
+	conn     types.HijackedResponse
+	activity chan struct{}
+	done     chan struct{}
+	once     sync.Once
+	lock     sync.Mutex
+}
+
+// copy returns a copy of the session that can be marshalled while it goes on
+func (e *ExecSession) copy() ExecSession {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return ExecSession{
+		ID:          e.ID,
+		ContainerID: e.ContainerID,
+		ExecID:      e.ExecID,
+		Cmd:         e.Cmd,
+		Tty:         e.Tty,
+		OutputTopic: e.OutputTopic,
+		StdinTopic:  e.StdinTopic,
+		ResizeTopic: e.ResizeTopic,
+		IdleTimeout: e.IdleTimeout,
+		CreatedAt:   e.CreatedAt,
+		ClosedAt:    e.ClosedAt,
+		Reason:      e.Reason,
+		ExitCode:    e.ExitCode,
+	}
+}
+
+// touch resets the idle timeout of the session
+func (e *ExecSession) touch() {
+	select {
+	case e.activity <- struct{}{}:
+	default:
+	}
+}
+
+func newExecSessionID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic(err) // the system is out of entropy, nothing would work anyway
+	}
+	return hex.EncodeToString(id)
+}
+
+// execTopic returns a subtopic of the session, eg. /containers/exec/<id>/stdin
+func execTopic(id, name string) string {
+	return "/containers/exec/" + id + "/" + name
+}
+
+// ContainersExec implements docker exec: it starts the command in the
+// container and opens a session that streams its input and its output
+func (s *Status) ContainersExec(params ContainersExecPayload) (*ExecSession, error) {
+	if params.ContainerID == "" {
+		return nil, badRequest(errors.New("missing container id"))
+	}
+	if params.IdleTimeout < 0 {
+		return nil, badRequest(errors.New("invalid idle timeout"))
+	}
+	if len(params.Cmd) == 0 {
+		params.Cmd = []string{"/bin/sh"}
+	}
+	idleTimeout := params.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = int(s.config.ExecIdleTimeout / time.Second)
+	}
+	if idleTimeout <= 0 {
+		idleTimeout = int(defaultExecIdleTimeout / time.Second)
+	}
+
+	ctx := context.Background()
+	exec, err := s.dockerClient.ContainerExecCreate(ctx, params.ContainerID, types.ExecConfig{
+		User:         params.User,
+		Tty:          params.Tty,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Env:          params.Env,
+		WorkingDir:   params.WorkingDir,
+		Cmd:          params.Cmd,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("container exec result: %s", err)
+	}
+	conn, err := s.dockerClient.ContainerExecAttach(ctx, exec.ID, types.ExecStartCheck{Tty: params.Tty})
+	if err != nil {
+		return nil, fmt.Errorf("container exec attach result: %s", err)
+	}
+
+	id := newExecSessionID()
+	session := &ExecSession{
+		ID:          id,
+		ContainerID: params.ContainerID,
+		ExecID:      exec.ID,
+		Cmd:         params.Cmd,
+		Tty:         params.Tty,
+		OutputTopic: execTopic(id, "output"),
+		StdinTopic:  execTopic(id, "stdin"),
+		ResizeTopic: execTopic(id, "resize"),
+		IdleTimeout: idleTimeout,
+		CreatedAt:   time.Now(),
+		conn:        conn,
+		activity:    make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	if params.Tty && params.Rows > 0 && params.Cols > 0 {
+		s.resizeExec(session, ExecResize{Rows: params.Rows, Cols: params.Cols})
+	}
+
+	s.execLock.Lock()
+	s.execSessions[id] = session
+	s.execLock.Unlock()
+	if client := s.client(); client != nil {
+		subscribeExecSession(client, s, session)
+	}
+	go s.forwardExecOutput(session)
+	go s.watchExecIdle(session)
+
+	res := session.copy()
+	return &res, nil
+}
+
+// forwardExecOutput publishes the output of the process until it ends. The
+// output of the processes without a tty is multiplexed, stdout and stderr
+// are published together.
+func (s *Status) forwardExecOutput(session *ExecSession) {
+	output := execOutputWriter{status: s, session: session}
+	var err error
+	if session.Tty {
+		_, err = io.Copy(output, session.conn.Reader)
+	} else {
+		_, err = stdcopy.StdCopy(output, output, session.conn.Reader)
+	}
+	select {
+	case <-session.done:
+		return // closed by the connector, the read failed because of it
+	default:
+	}
+	if err != nil {
+		fmt.Printf("Reading the output of exec session %s: %s\n", session.ID, err)
+	}
+	s.closeExec(session, execExited)
+}
+
+// execOutputWriter publishes the output of a session on its topic, joining
+// the chunks that wait for the rate limiter like the output of the sketches
+type execOutputWriter struct {
+	status  *Status
+	session *ExecSession
+}
+
+func (w execOutputWriter) Write(p []byte) (int, error) {
+	w.session.touch()
+	w.status.Raw(w.session.OutputTopic, string(p))
+	return len(p), nil
+}
+
+// watchExecIdle closes the session when nothing is read or written for its
+// idle timeout
+func (s *Status) watchExecIdle(session *ExecSession) {
+	timeout := time.Duration(session.IdleTimeout) * time.Second
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-session.activity:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(timeout)
+		case <-timer.C:
+			s.closeExec(session, execIdle)
+			return
+		case <-session.done:
+			return
+		}
+	}
+}
+
+// closeExec ends a session, closing the connection with the process: its
+// stdin is closed, which makes the shells exit. The session is published on
+// its exit topic.
+func (s *Status) closeExec(session *ExecSession, reason string) {
+	session.once.Do(func() {
+		s.execLock.Lock()
+		delete(s.execSessions, session.ID)
+		s.execLock.Unlock()
+		if client := s.client(); client != nil {
+			client.Unsubscribe(s.topicPertinence+session.StdinTopic, s.topicPertinence+session.ResizeTopic)
+		}
+		session.conn.Close()
+		close(session.done)
+
+		now := time.Now()
+		session.lock.Lock()
+		session.ClosedAt = &now
+		session.Reason = reason
+		session.lock.Unlock()
+		if reason == execExited {
+			if inspect, err := s.dockerClient.ContainerExecInspect(context.Background(), session.ExecID); err == nil && !inspect.Running {
+				code := inspect.ExitCode
+				session.lock.Lock()
+				session.ExitCode = &code
+				session.lock.Unlock()
+			}
+		}
+
+		if data, err := json.Marshal(session.copy()); err == nil {
+			s.Notify(execTopic(session.ID, "exit"), string(data))
+		}
+	})
+}
+
+// resizeExec changes the size of the tty of the process of a session
+func (s *Status) resizeExec(session *ExecSession, size ExecResize) {
+	if !session.Tty {
+		return
+	}
+	err := s.dockerClient.ContainerExecResize(context.Background(), session.ExecID, types.ResizeOptions{Height: size.Rows, Width: size.Cols})
+	if err != nil {
+		fmt.Printf("Resizing exec session %s: %s\n", session.ID, err)
+	}
+}
+
+// ContainersExecSessions returns the open sessions, oldest first
+func (s *Status) ContainersExecSessions() []ExecSession {
+	s.execLock.Lock()
+	defer s.execLock.Unlock()
+	sessions := []ExecSession{}
+	for _, session := range s.execSessions {
+		sessions = append(sessions, session.copy())
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].CreatedAt.Before(sessions[j].CreatedAt) })
+	return sessions
+}
+
+// ContainersExecClose closes a session
+func (s *Status) ContainersExecClose(params ExecSessionRequest) (*ExecSession, error) {
+	s.execLock.Lock()
+	session := s.execSessions[params.ID]
+	s.execLock.Unlock()
+	if session == nil {
+		return nil, notFound(fmt.Errorf("exec session %s not found", params.ID))
+	}
+	s.closeExec(session, execClosed)
+	res := session.copy()
+	return &res, nil
+}
+
+// subscribeExecSessions subscribes again to the input topics of the open
+// sessions, whose subscriptions are lost when the connection drops
+func subscribeExecSessions(client mqtt.Client, status *Status) {
+	status.execLock.Lock()
+	defer status.execLock.Unlock()
+	for _, session := range status.execSessions {
+		subscribeExecSession(client, status, session)
+	}
+}
+
+// subscribeExecSession forwards the stdin topic of a session to its process,
+// like stdInCB does for the sketches, and the resize topic to its tty
+func subscribeExecSession(client mqtt.Client, status *Status, session *ExecSession) {
+	client.Subscribe(status.topicPertinence+session.StdinTopic, 1, func(client mqtt.Client, msg mqtt.Message) {
+		if len(msg.Payload()) > 0 {
+			session.touch()
+			if _, err := session.conn.Conn.Write(msg.Payload()); err != nil {
+				return
+			}
+		}
+	})
+	client.Subscribe(status.topicPertinence+session.ResizeTopic, 1, func(client mqtt.Client, msg mqtt.Message) {
+		var size ExecResize
+		if err := json.Unmarshal(msg.Payload(), &size); err != nil || size.Rows == 0 || size.Cols == 0 {
+			fmt.Printf("Invalid resize of exec session %s: %s\n", session.ID, msg.Payload())
+			return
+		}
+		session.touch()
+		status.resizeExec(session, size)
+	})
+}
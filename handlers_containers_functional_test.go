@@ -18,7 +18,6 @@ import (
 	"github.com/docker/docker/api/types/filters"
 	docker "github.com/docker/docker/client"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
-	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/context"
 )
@@ -38,7 +37,7 @@ func setupAndRun(m *testing.M) int {
 	ts.ui = NewMqttTestClientLocal()
 	defer ts.ui.Close()
 
-	ts.appStatus = NewStatus(program{}.Config, nil, nil, "")
+	ts.appStatus = NewStatus(Config{LegacyReplies: true}, nil, nil, "")
 	ts.appStatus.dockerClient, _ = docker.NewClientWithOpts(docker.WithVersion("1.38"))
 	ts.appStatus.mqttClient = mqtt.NewClient(mqtt.NewClientOptions().AddBroker("tcp://localhost:1883").SetClientID("arduino-connector"))
 
@@ -62,7 +61,7 @@ func execCmd(cmd string) []string {
 }
 
 func TestDockerPsApi(t *testing.T) {
-	subscribeTopic(ts.appStatus.mqttClient, "0", "/containers/ps/post", ts.appStatus, ts.appStatus.ContainersPsEvent, false)
+	subscribeTopic(ts.appStatus.mqttClient, "0", "/containers/ps/post", ts.appStatus, mqttHandler(ts.appStatus, "/containers/ps"))
 	resp := ts.ui.MqttSendAndReceiveTimeout(t, "/containers/ps", "{}", 50*time.Millisecond)
 
 	lines := execCmd("docker ps -a")
@@ -83,7 +82,7 @@ func TestDockerPsApi(t *testing.T) {
 }
 
 func TestDockerListImagesApi(t *testing.T) {
-	subscribeTopic(ts.appStatus.mqttClient, "0", "/containers/images/post", ts.appStatus, ts.appStatus.ContainersListImagesEvent, false)
+	subscribeTopic(ts.appStatus.mqttClient, "0", "/containers/images/post", ts.appStatus, mqttHandler(ts.appStatus, "/containers/images"))
 	resp := ts.ui.MqttSendAndReceiveTimeout(t, "/containers/images", "{}", 50*time.Millisecond)
 
 	lines := execCmd("docker images -a")
@@ -147,7 +146,7 @@ func TestDockerRenameApi(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	subscribeTopic(ts.appStatus.mqttClient, "0", "/containers/rename/post", ts.appStatus, ts.appStatus.ContainersRenameEvent, true)
+	subscribeTopic(ts.appStatus.mqttClient, "0", "/containers/rename/post", ts.appStatus, mqttHandler(ts.appStatus, "/containers/rename"))
 	resp := ts.ui.MqttSendAndReceiveTimeout(t, "/containers/rename", string(data), 250*time.Millisecond)
 
 	lines := execCmd("docker container ls -a")
@@ -175,7 +174,7 @@ func TestDockerRenameApi(t *testing.T) {
 }
 
 func TestDockerActionRunApi(t *testing.T) {
-	subscribeTopic(ts.appStatus.mqttClient, "0", "/containers/action/post", ts.appStatus, ts.appStatus.ContainersActionEvent, false)
+	subscribeTopic(ts.appStatus.mqttClient, "0", "/containers/action/post", ts.appStatus, mqttHandler(ts.appStatus, "/containers/action"))
 	testContainer := "test-container"
 	payload := map[string]interface{}{"action": "run", "image": "alpine", "name": testContainer}
 	data, err := json.Marshal(payload)
@@ -216,7 +215,7 @@ func TestDockerActionRunApi(t *testing.T) {
 }
 
 func TestDockerActionStopApi(t *testing.T) {
-	subscribeTopic(ts.appStatus.mqttClient, "0", "/containers/action/post", ts.appStatus, ts.appStatus.ContainersActionEvent, false)
+	subscribeTopic(ts.appStatus.mqttClient, "0", "/containers/action/post", ts.appStatus, mqttHandler(ts.appStatus, "/containers/action"))
 	testContainer := "test-container"
 
 	reader, err := ts.appStatus.dockerClient.ImagePull(context.Background(), "alpine", types.ImagePullOptions{})
@@ -279,7 +278,7 @@ func TestDockerActionStopApi(t *testing.T) {
 }
 
 func TestDockerActionStartApi(t *testing.T) {
-	subscribeTopic(ts.appStatus.mqttClient, "0", "/containers/action/post", ts.appStatus, ts.appStatus.ContainersActionEvent, false)
+	subscribeTopic(ts.appStatus.mqttClient, "0", "/containers/action/post", ts.appStatus, mqttHandler(ts.appStatus, "/containers/action"))
 	testContainer := "test-container"
 
 	reader, err := ts.appStatus.dockerClient.ImagePull(context.Background(), "alpine", types.ImagePullOptions{})
@@ -343,7 +342,7 @@ func TestDockerActionStartApi(t *testing.T) {
 }
 
 func TestDockerActionRemoveApi(t *testing.T) {
-	subscribeTopic(ts.appStatus.mqttClient, "0", "/containers/action/post", ts.appStatus, ts.appStatus.ContainersActionEvent, false)
+	subscribeTopic(ts.appStatus.mqttClient, "0", "/containers/action/post", ts.appStatus, mqttHandler(ts.appStatus, "/containers/action"))
 
 	reader, err := ts.appStatus.dockerClient.ImagePull(context.Background(), "alpine", types.ImagePullOptions{})
 	if err != nil {
@@ -382,79 +381,3 @@ func TestDockerActionRemoveApi(t *testing.T) {
 
 	assert.False(t, foundTestContainer)
 }
-
-type MqttTokenMock struct {
-	returnErr bool
-}
-
-func (t *MqttTokenMock) Wait() bool {
-	return true
-}
-
-func (t *MqttTokenMock) WaitTimeout(time.Duration) bool {
-	return true
-}
-
-func (t *MqttTokenMock) Error() error {
-	if t.returnErr {
-		return errors.New("test err")
-	}
-
-	return nil
-}
-
-type MqttClientMock struct {
-	errPublished string
-}
-
-func (c *MqttClientMock) IsConnected() bool {
-	return false
-}
-
-func (c *MqttClientMock) IsConnectionOpen() bool {
-	return true
-}
-
-func (c *MqttClientMock) Connect() mqtt.Token {
-	return nil
-}
-
-func (c *MqttClientMock) Disconnect(quiesce uint) {
-}
-
-func (c *MqttClientMock) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
-	payloadStr := payload.(string)
-	if strings.HasPrefix(payloadStr, "INFO") {
-		return &MqttTokenMock{returnErr: true}
-	}
-
-	c.errPublished = payloadStr
-	return &MqttTokenMock{returnErr: false}
-}
-
-func (c *MqttClientMock) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
-	return nil
-}
-
-func (c *MqttClientMock) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
-	return nil
-}
-
-func (c *MqttClientMock) Unsubscribe(topics ...string) mqtt.Token {
-	return nil
-}
-
-func (c *MqttClientMock) AddRoute(topic string, callback mqtt.MessageHandler) {
-}
-
-func (c *MqttClientMock) OptionsReader() mqtt.ClientOptionsReader {
-	return mqtt.ClientOptionsReader{}
-}
-
-func TestDockerApiError(t *testing.T) {
-	ts.appStatus.mqttClient = &MqttClientMock{}
-	topic := "/container/ps"
-	ts.appStatus.SendInfo(topic, "error")
-	mockClient := ts.appStatus.mqttClient.(*MqttClientMock)
-	assert.Equal(t, mockClient.errPublished, "ERROR: test err\n")
-}
@@ -0,0 +1,239 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2020  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	timetypes "github.com/docker/docker/api/types/time"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/pkg/errors"
+)
+
+// defaultContainerLogTail is the number of lines returned when the request
+// doesn't say it
+const defaultContainerLogTail = 100
+
+// ContainersLogsPayload are the parameters of /containers/logs. Tail is the
+// number of lines to return, the last ones, negative for all of them; Since
+// and Until take a timestamp (RFC3339 or unix) or a duration relative to now
+// (eg. 10m), like docker logs. Both stdout and stderr are returned unless
+// only one of them is asked.
+type ContainersLogsPayload struct {
+	ContainerID string `json:"id"`
+	Tail        *int   `json:"tail"`
+	Follow      bool   `json:"follow"`
+	Timestamps  bool   `json:"timestamps"`
+	Since       string `json:"since"`
+	Until       string `json:"until"`
+	Stdout      bool   `json:"stdout"`
+	Stderr      bool   `json:"stderr"`
+}
+
+// ContainerLogLine is a line of output of a container, Stream is stdout or
+// stderr
+type ContainerLogLine struct {
+	Stream    string     `json:"stream"`
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+	Line      string     `json:"line"`
+}
+
+// ContainersLogsResponse is the reply to /containers/logs: the lines, or the
+// topic where they are published and the job following them
+type ContainersLogsResponse struct {
+	ContainerID string             `json:"id"`
+	Lines       []ContainerLogLine `json:"lines,omitempty"`
+	Topic       string             `json:"topic,omitempty"`
+	Job         *Job               `json:"job,omitempty"`
+}
+
+// logLineWriter splits a stream of output of a container in lines
+type logLineWriter struct {
+	stream     string
+	timestamps bool
+	emit       func(ContainerLogLine)
+	buf        []byte
+}
+
+func (w *logLineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		w.line(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+}
+
+// Flush emits the last line, if it doesn't end with a newline
+func (w *logLineWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.line(string(w.buf))
+		w.buf = nil
+	}
+}
+
+// line emits a line, moving the timestamp that docker puts in front of it
+// to its own field
+func (w *logLineWriter) line(text string) {
+	line := ContainerLogLine{Stream: w.stream, Line: strings.TrimSuffix(text, "\r")}
+	if w.timestamps {
+		if i := strings.IndexByte(line.Line, ' '); i > 0 {
+			if t, err := time.Parse(time.RFC3339Nano, line.Line[:i]); err == nil {
+				line.Timestamp = &t
+				line.Line = line.Line[i+1:]
+			}
+		}
+	}
+	w.emit(line)
+}
+
+// containerLogsTopic is where the followed logs of a container are published
+func containerLogsTopic(id string) string {
+	return "/containers/logs/" + id
+}
+
+// logOptions validates the parameters and turns them to the options of
+// docker logs. The relative times are resolved now.
+func (p ContainersLogsPayload) logOptions() (types.ContainerLogsOptions, error) {
+	options := types.ContainerLogsOptions{
+		ShowStdout: p.Stdout || !p.Stderr,
+		ShowStderr: p.Stderr || !p.Stdout,
+		Timestamps: p.Timestamps,
+		Follow:     p.Follow,
+		Tail:       strconv.Itoa(defaultContainerLogTail),
+	}
+	if p.Tail != nil {
+		options.Tail = strconv.Itoa(*p.Tail)
+		if *p.Tail < 0 {
+			options.Tail = "all"
+		}
+	}
+	var err error
+	now := time.Now()
+	if p.Since != "" {
+		if options.Since, err = timetypes.GetTimestamp(p.Since, now); err != nil {
+			return options, fmt.Errorf("invalid since: %s", err)
+		}
+	}
+	if p.Until != "" {
+		if options.Until, err = timetypes.GetTimestamp(p.Until, now); err != nil {
+			return options, fmt.Errorf("invalid until: %s", err)
+		}
+	}
+	return options, nil
+}
+
+// ContainersLogs implements docker logs. The lines are returned in the reply,
+// unless the logs are followed: then a job publishes them on the topic of the
+// container as they come, until the container stops or the job is cancelled.
+func (s *Status) ContainersLogs(params ContainersLogsPayload) (*ContainersLogsResponse, error) {
+	if params.ContainerID == "" {
+		return nil, badRequest(errors.New("missing container id"))
+	}
+	options, err := params.logOptions()
+	if err != nil {
+		return nil, badRequest(err)
+	}
+	info, err := s.dockerClient.ContainerInspect(context.Background(), params.ContainerID)
+	if err != nil {
+		return nil, fmt.Errorf("container inspect result: %s", err)
+	}
+	tty := info.Config != nil && info.Config.Tty
+	res := &ContainersLogsResponse{ContainerID: info.ID}
+
+	if !params.Follow {
+		res.Lines = []ContainerLogLine{}
+		err = s.readContainerLogs(context.Background(), info.ID, tty, options, func(line ContainerLogLine) {
+			res.Lines = append(res.Lines, line)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+
+	topic := containerLogsTopic(info.ID)
+	job := s.jobs.Start(jobsLogs, "logs", info.ID, func(ctx context.Context, job *JobHandle) (interface{}, error) {
+		job.Log("Publishing the logs on " + topic)
+		err := s.readContainerLogs(ctx, info.ID, tty, options, func(line ContainerLogLine) {
+			s.publishContainerLog(topic, line)
+		})
+		if err != nil {
+			return nil, err
+		}
+		job.Log("The container stopped")
+		return &ContainersLogsResponse{ContainerID: info.ID, Topic: topic}, nil
+	})
+	res.Topic = topic
+	snapshot := s.jobs.Snapshot(job)
+	res.Job = &snapshot
+	return res, nil
+}
+
+// readContainerLogs reads the logs of a container, split in lines, until
+// their end or until ctx is done. The output of the containers without a
+// tty is multiplexed, those with a tty have only stdout.
+func (s *Status) readContainerLogs(ctx context.Context, id string, tty bool, options types.ContainerLogsOptions, emit func(ContainerLogLine)) error {
+	out, err := s.dockerClient.ContainerLogs(ctx, id, options)
+	if err != nil {
+		return fmt.Errorf("container logs result: %s", err)
+	}
+	defer out.Close()
+
+	stdout := &logLineWriter{stream: "stdout", timestamps: options.Timestamps, emit: emit}
+	stderr := &logLineWriter{stream: "stderr", timestamps: options.Timestamps, emit: emit}
+	if tty {
+		_, err = io.Copy(stdout, out)
+	} else {
+		_, err = stdcopy.StdCopy(stdout, stderr, out)
+	}
+	stdout.Flush()
+	stderr.Flush()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("container logs result: %s", err)
+	}
+	return nil
+}
+
+// publishContainerLog publishes a line of a followed log as a line of json.
+// The lines waiting for the rate limiter are joined in a single message.
+func (s *Status) publishContainerLog(topic string, line ContainerLogLine) {
+	if !s.canPublish() {
+		return
+	}
+	data, err := json.Marshal(line)
+	if err != nil {
+		panic(err) // Means that something went really wrong
+	}
+	_ = s.publish(classStdout, topic, 0, string(data)+"\n", coalesceAppend)
+}
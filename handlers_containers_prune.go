@@ -0,0 +1,156 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2020  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/filters"
+	timetypes "github.com/docker/docker/api/types/time"
+	"github.com/pkg/errors"
+)
+
+// targets of /containers/prune
+const (
+	pruneImages     = "images"
+	pruneVolumes    = "volumes"
+	pruneNetworks   = "networks"
+	pruneBuildCache = "build_cache"
+)
+
+// ContainersPrunePayload are the parameters of /containers/prune: what to
+// prune, in the order given, and the filters of docker. Only the dangling
+// images are pruned unless All says otherwise. Labels are key, key=value,
+// or key!=value for the objects without the label; Until is a timestamp or
+// a duration relative to now (eg. 24h), like docker system prune.
+type ContainersPrunePayload struct {
+	Targets []string `json:"targets"`
+	All     bool     `json:"all"`
+	Labels  []string `json:"labels"`
+	Until   string   `json:"until"`
+}
+
+// PruneReport lists what /containers/prune removed and the space it freed
+type PruneReport struct {
+	ImagesDeleted   []string `json:"images_deleted"`
+	VolumesDeleted  []string `json:"volumes_deleted"`
+	NetworksDeleted []string `json:"networks_deleted"`
+	SpaceReclaimed  uint64   `json:"space_reclaimed"`
+}
+
+// Validate checks the targets and that they support the filters: the volumes
+// can't be filtered by date, the build cache can't be filtered at all
+func (p ContainersPrunePayload) Validate() error {
+	if len(p.Targets) == 0 {
+		return errors.New("missing prune targets")
+	}
+	for _, target := range p.Targets {
+		switch target {
+		case pruneImages, pruneNetworks:
+		case pruneVolumes:
+			if p.Until != "" {
+				return errors.New("the volumes can't be pruned by date")
+			}
+		case pruneBuildCache:
+			if p.Until != "" || len(p.Labels) > 0 {
+				return errors.New("the build cache can't be pruned with filters")
+			}
+		default:
+			return fmt.Errorf("invalid prune target '%s'", target)
+		}
+	}
+	if p.Until != "" {
+		if _, err := timetypes.GetTimestamp(p.Until, time.Now()); err != nil {
+			return fmt.Errorf("invalid until: %s", err)
+		}
+	}
+	return nil
+}
+
+// pruneFilters returns the filters of docker, label!=value becomes a
+// label! filter
+func (p ContainersPrunePayload) pruneFilters() filters.Args {
+	args := filters.NewArgs()
+	for _, label := range p.Labels {
+		if i := strings.Index(label, "!="); i > 0 {
+			args.Add("label!", label[:i]+"="+label[i+2:])
+		} else {
+			args.Add("label", label)
+		}
+	}
+	if p.Until != "" {
+		args.Add("until", p.Until)
+	}
+	return args
+}
+
+// ContainersPrune implements docker image, volume, network and builder
+// prune. Nothing is pruned unless it's asked.
+func (s *Status) ContainersPrune(ctx context.Context, job *JobHandle, params ContainersPrunePayload) (*PruneReport, error) {
+	report := &PruneReport{ImagesDeleted: []string{}, VolumesDeleted: []string{}, NetworksDeleted: []string{}}
+	for _, target := range params.Targets {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		args := params.pruneFilters()
+		switch target {
+		case pruneImages:
+			args.Add("dangling", fmt.Sprint(!params.All))
+			res, err := s.dockerClient.ImagesPrune(ctx, args)
+			if err != nil {
+				return nil, fmt.Errorf("images prune result: %s", err)
+			}
+			deleted := 0
+			for _, img := range res.ImagesDeleted {
+				if img.Deleted != "" {
+					report.ImagesDeleted = append(report.ImagesDeleted, img.Deleted)
+					deleted++
+				}
+			}
+			report.SpaceReclaimed += res.SpaceReclaimed
+			job.Log(fmt.Sprintf("Pruned %d images", deleted))
+		case pruneVolumes:
+			res, err := s.dockerClient.VolumesPrune(ctx, args)
+			if err != nil {
+				return nil, fmt.Errorf("volumes prune result: %s", err)
+			}
+			report.VolumesDeleted = append(report.VolumesDeleted, res.VolumesDeleted...)
+			report.SpaceReclaimed += res.SpaceReclaimed
+			job.Log(fmt.Sprintf("Pruned %d volumes", len(res.VolumesDeleted)))
+		case pruneNetworks:
+			res, err := s.dockerClient.NetworksPrune(ctx, args)
+			if err != nil {
+				return nil, fmt.Errorf("networks prune result: %s", err)
+			}
+			report.NetworksDeleted = append(report.NetworksDeleted, res.NetworksDeleted...)
+			job.Log(fmt.Sprintf("Pruned %d networks", len(res.NetworksDeleted)))
+		case pruneBuildCache:
+			res, err := s.dockerClient.BuildCachePrune(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("build cache prune result: %s", err)
+			}
+			report.SpaceReclaimed += res.SpaceReclaimed
+			job.Log("Pruned the build cache")
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,188 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2020  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/jsonmessage"
+)
+
+// ImagePullProgress is published on the progress topic of a pull, once for
+// every message of docker about a layer and once at the end with the totals
+type ImagePullProgress struct {
+	ID         string  `json:"id"`
+	Image      string  `json:"image"`
+	State      string  `json:"state"`
+	Layer      string  `json:"layer,omitempty"`
+	Status     string  `json:"status,omitempty"`
+	Current    int64   `json:"current,omitempty"`
+	Total      int64   `json:"total,omitempty"`
+	TotalBytes int64   `json:"total_bytes,omitempty"`
+	Elapsed    float64 `json:"elapsed,omitempty"`
+}
+
+// ImagePullReport sums up a pull: the layers of the image, those that were
+// already there, the bytes downloaded and the seconds it took
+type ImagePullReport struct {
+	Image      string  `json:"image"`
+	Digest     string  `json:"digest,omitempty"`
+	Status     string  `json:"status"`
+	Layers     int     `json:"layers"`
+	Cached     int     `json:"cached"`
+	TotalBytes int64   `json:"total_bytes"`
+	Elapsed    float64 `json:"elapsed"`
+}
+
+// pullTracker follows the download of the layers of an image
+type pullTracker struct {
+	layers  map[string]bool
+	current map[string]int64
+	total   map[string]int64
+}
+
+// update records a message of docker, returns false if it isn't about a layer
+func (t *pullTracker) update(msg jsonmessage.JSONMessage, report *ImagePullReport) bool {
+	switch {
+	case strings.HasPrefix(msg.Status, "Digest: "):
+		report.Digest = strings.TrimPrefix(msg.Status, "Digest: ")
+		return false
+	case strings.HasPrefix(msg.Status, "Status: "):
+		report.Status = strings.TrimPrefix(msg.Status, "Status: ")
+		return false
+	case msg.ID == "" || strings.HasPrefix(msg.Status, "Pulling from "):
+		return false
+	}
+	if !t.layers[msg.ID] {
+		t.layers[msg.ID] = true
+		report.Layers++
+	}
+	switch msg.Status {
+	case "Already exists":
+		report.Cached++
+	case "Downloading":
+		if msg.Progress != nil {
+			t.current[msg.ID] = msg.Progress.Current
+			t.total[msg.ID] = msg.Progress.Total
+		}
+	case "Download complete":
+		t.current[msg.ID] = t.total[msg.ID]
+	}
+	return true
+}
+
+// percent is the percentage of the bytes to download already downloaded
+func (t *pullTracker) percent() float64 {
+	var current, total int64
+	for id, size := range t.total {
+		current += t.current[id]
+		total += size
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(100*current) / float64(total)
+}
+
+// bytes is the size of the layers downloaded
+func (t *pullTracker) bytes() int64 {
+	var total int64
+	for _, size := range t.total {
+		total += size
+	}
+	return total
+}
+
+// pullImage pulls an image, logging the progress of its layers in the job
+// and publishing it on topic, if not empty. The errors docker reports in the
+// stream fail the pull.
+func (s *Status) pullImage(ctx context.Context, job *JobHandle, ref string, options types.ImagePullOptions, topic string) (*ImagePullReport, error) {
+	start := time.Now()
+	report := &ImagePullReport{Image: ref}
+	s.publishPullProgress(topic, ImagePullProgress{ID: job.ID(), Image: ref, State: jobRunning})
+	end := func(state string) {
+		s.publishPullProgress(topic, ImagePullProgress{ID: job.ID(), Image: ref, State: state, TotalBytes: report.TotalBytes, Elapsed: report.Elapsed})
+	}
+
+	out, err := s.dockerClient.ImagePull(ctx, ref, options)
+	if err != nil {
+		end(jobFailed)
+		return nil, fmt.Errorf("image pull result: %s", err)
+	}
+	defer out.Close()
+
+	tracker := &pullTracker{layers: map[string]bool{}, current: map[string]int64{}, total: map[string]int64{}}
+	dec := json.NewDecoder(out)
+	for {
+		var msg jsonmessage.JSONMessage
+		if err = dec.Decode(&msg); err != nil {
+			break
+		}
+		if msg.Error != nil {
+			err = msg.Error
+			break
+		}
+		if !tracker.update(msg, report) {
+			continue
+		}
+		if msg.Status != "Downloading" && msg.Status != "Extracting" {
+			job.Log(msg.ID + ": " + msg.Status)
+		}
+		job.Progress("pull", tracker.percent())
+		layer := ImagePullProgress{ID: job.ID(), Image: ref, State: jobRunning, Layer: msg.ID, Status: msg.Status}
+		if msg.Progress != nil {
+			layer.Current = msg.Progress.Current
+			layer.Total = msg.Progress.Total
+		}
+		s.publishPullProgress(topic, layer)
+	}
+	report.TotalBytes = tracker.bytes()
+	report.Elapsed = time.Since(start).Seconds()
+
+	switch {
+	case ctx.Err() != nil:
+		end(jobCancelled)
+		return nil, ctx.Err()
+	case err != nil && err != io.EOF:
+		end(jobFailed)
+		return nil, fmt.Errorf("image pull result: %s", err)
+	}
+	end(jobSucceeded)
+	job.Log(fmt.Sprintf("Pulled %s: %d layers, %d bytes in %.1fs", ref, report.Layers, report.TotalBytes, report.Elapsed))
+	return report, nil
+}
+
+// publishPullProgress publishes a progress message as a line of json, the
+// lines waiting for the rate limiter are joined in a single message
+func (s *Status) publishPullProgress(topic string, progress ImagePullProgress) {
+	if topic == "" || !s.canPublish() {
+		return
+	}
+	data, err := json.Marshal(progress)
+	if err != nil {
+		panic(err) // Means that something went really wrong
+	}
+	_ = s.publish(classStdout, topic, 0, string(data)+"\n", coalesceAppend)
+}
@@ -0,0 +1,424 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2020  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	volumetypes "github.com/docker/docker/api/types/volume"
+	docker "github.com/docker/docker/client"
+	"github.com/pkg/errors"
+)
+
+// StackDeployRequest are the parameters of /containers/stack/deploy: the
+// stack, and if the images of its services must be pulled again
+type StackDeployRequest struct {
+	StackSpec
+	Pull bool `json:"pull"`
+}
+
+// StackRemoveRequest are the parameters of /containers/stack/remove, the
+// volumes of the stack are kept unless Volumes says otherwise
+type StackRemoveRequest struct {
+	Name    string `json:"name"`
+	Volumes bool   `json:"volumes"`
+}
+
+// StackReport tells what a deploy or a removal did to the services of a stack
+type StackReport struct {
+	Name      string   `json:"name"`
+	Created   []string `json:"created"`
+	Recreated []string `json:"recreated"`
+	Unchanged []string `json:"unchanged"`
+	Removed   []string `json:"removed"`
+}
+
+// StackStatus is the state of a deployed stack, reported by /containers/ps:
+// running if all its services are running, stopped if none is, partial
+// otherwise
+type StackStatus struct {
+	Name     string               `json:"name"`
+	State    string               `json:"state"`
+	Services []StackServiceStatus `json:"services"`
+	Networks []string             `json:"networks"`
+	Volumes  []string             `json:"volumes"`
+}
+
+// StackServiceStatus is the state of the container of a service
+type StackServiceStatus struct {
+	Name        string `json:"name"`
+	ContainerID string `json:"id"`
+	Image       string `json:"image"`
+	State       string `json:"state"`
+	Status      string `json:"status"`
+}
+
+func newStackReport(name string) *StackReport {
+	return &StackReport{Name: name, Created: []string{}, Recreated: []string{}, Unchanged: []string{}, Removed: []string{}}
+}
+
+// stackFilter selects the docker objects of a stack, of all of them if
+// name is empty
+func stackFilter(name string) filters.Args {
+	if name == "" {
+		return filters.NewArgs(filters.Arg("label", stackLabel))
+	}
+	return filters.NewArgs(filters.Arg("label", stackLabel+"="+name))
+}
+
+// stackContainers returns the containers of a stack by service
+func (s *Status) stackContainers(ctx context.Context, name string) (map[string][]types.Container, error) {
+	containers, err := s.dockerClient.ContainerList(ctx, types.ContainerListOptions{All: true, Filters: stackFilter(name)})
+	if err != nil {
+		return nil, fmt.Errorf("containers list result: %s", err)
+	}
+	res := map[string][]types.Container{}
+	for _, c := range containers {
+		service := c.Labels[serviceLabel]
+		res[service] = append(res[service], c)
+	}
+	return res, nil
+}
+
+// imageID returns the id of an image, empty if it hasn't been pulled
+func (s *Status) imageID(ctx context.Context, ref string) (string, error) {
+	img, _, err := s.dockerClient.ImageInspectWithRaw(ctx, ref)
+	if docker.IsErrNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("image inspect result: %s", err)
+	}
+	return img.ID, nil
+}
+
+// removeStackContainer stops and removes the container of a service
+func (s *Status) removeStackContainer(ctx context.Context, job *JobHandle, c types.Container) error {
+	if c.State == "running" {
+		if err := s.dockerClient.ContainerStop(ctx, c.ID, nil); err != nil {
+			return fmt.Errorf("container stop result: %s", err)
+		}
+	}
+	if err := s.dockerClient.ContainerRemove(ctx, c.ID, types.ContainerRemoveOptions{}); err != nil {
+		return fmt.Errorf("container remove result: %s", err)
+	}
+	job.Log("Removed container " + c.ID + " of service " + c.Labels[serviceLabel])
+	return nil
+}
+
+// DeployStack creates the networks, the volumes and the containers of the
+// stack, starting the services after their dependencies. The containers
+// whose configuration or image didn't change are kept, the others are
+// recreated; the services and the networks removed from the stack are
+// removed, the volumes are kept. The progress of the pulls is published on
+// progressTopic.
+func (s *Status) DeployStack(ctx context.Context, job *JobHandle, req StackDeployRequest, progressTopic string) (*StackReport, error) {
+	spec := req.StackSpec
+	order, err := spec.order()
+	if err != nil {
+		return nil, err
+	}
+	report := newStackReport(spec.Name)
+	current, err := s.stackContainers(ctx, spec.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	networks, err := s.dockerClient.NetworkList(ctx, types.NetworkListOptions{Filters: stackFilter(spec.Name)})
+	if err != nil {
+		return nil, fmt.Errorf("networks list result: %s", err)
+	}
+	existing := map[string]bool{}
+	for _, n := range networks {
+		existing[n.Name] = true
+	}
+	used := map[string]bool{}
+	for _, net := range spec.usedNetworks() {
+		name := stackObjectName(spec.Name, net)
+		used[name] = true
+		if existing[name] {
+			continue
+		}
+		options := types.NetworkCreate{CheckDuplicate: true, Labels: map[string]string{stackLabel: spec.Name}}
+		if n := spec.Networks[net]; n != nil {
+			options.Driver = n.Driver
+			for k, v := range n.Labels {
+				options.Labels[k] = v
+			}
+			options.Labels[stackLabel] = spec.Name
+		}
+		if _, err = s.dockerClient.NetworkCreate(ctx, name, options); err != nil {
+			return nil, fmt.Errorf("network create result: %s", err)
+		}
+		job.Log("Created network " + name)
+	}
+
+	for vol, v := range spec.Volumes {
+		options := volumetypes.VolumeCreateBody{Name: stackObjectName(spec.Name, vol), Labels: map[string]string{}}
+		if v != nil {
+			options.Driver = v.Driver
+			for k, value := range v.Labels {
+				options.Labels[k] = value
+			}
+		}
+		options.Labels[stackLabel] = spec.Name
+		if _, err = s.dockerClient.VolumeCreate(ctx, options); err != nil {
+			return nil, fmt.Errorf("volume create result: %s", err)
+		}
+	}
+
+	for _, name := range order {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err = s.deployStackService(ctx, job, &spec, name, current[name], req.Pull, progressTopic, report); err != nil {
+			return nil, fmt.Errorf("service %s: %s", name, err)
+		}
+		delete(current, name)
+	}
+
+	removed := []string{}
+	for name := range current {
+		removed = append(removed, name)
+	}
+	sort.Strings(removed)
+	for _, name := range removed {
+		for _, c := range current[name] {
+			if err = s.removeStackContainer(ctx, job, c); err != nil {
+				return nil, err
+			}
+		}
+		report.Removed = append(report.Removed, name)
+	}
+	for _, n := range networks {
+		if used[n.Name] {
+			continue
+		}
+		if err = s.dockerClient.NetworkRemove(ctx, n.ID); err != nil {
+			return nil, fmt.Errorf("network remove result: %s", err)
+		}
+		job.Log("Removed network " + n.Name)
+	}
+	return report, nil
+}
+
+// deployStackService brings the container of a service to its configuration
+func (s *Status) deployStackService(ctx context.Context, job *JobHandle, spec *StackSpec, name string, containers []types.Container, pull bool, progressTopic string, report *StackReport) error {
+	svc := spec.Services[name]
+	imageID, err := s.imageID(ctx, svc.Image)
+	if err != nil {
+		return err
+	}
+	if pull || imageID == "" {
+		job.Log("Pulling image " + svc.Image)
+		pullOpts, _, errConf := ConfigureRegistryAuth(RunPayload{ImageName: svc.Image})
+		if errConf != nil {
+			fmt.Println(errConf)
+		}
+		if _, err = s.pullImage(ctx, job, svc.Image, pullOpts, progressTopic); err != nil {
+			return err
+		}
+		if imageID, err = s.imageID(ctx, svc.Image); err != nil {
+			return err
+		}
+	}
+
+	// the container is kept if it has the same configuration and image,
+	// duplicates left by an interrupted deploy are removed
+	hash := serviceHash(svc)
+	var keep *types.Container
+	for i, c := range containers {
+		if keep == nil && c.Labels[stackHashLabel] == hash && c.ImageID == imageID {
+			keep = &containers[i]
+			continue
+		}
+		if err = s.removeStackContainer(ctx, job, c); err != nil {
+			return err
+		}
+	}
+	if keep != nil {
+		if keep.State != "running" {
+			if err = s.dockerClient.ContainerStart(ctx, keep.ID, types.ContainerStartOptions{}); err != nil {
+				return fmt.Errorf("container start result: %s", err)
+			}
+			job.Log("Started container " + keep.ID + " of service " + name)
+		}
+		report.Unchanged = append(report.Unchanged, name)
+		return nil
+	}
+
+	config, host, networking, extra, err := spec.containerConfig(name)
+	if err != nil {
+		return err
+	}
+	created, err := s.dockerClient.ContainerCreate(ctx, config, host, networking, stackObjectName(spec.Name, name))
+	if err != nil {
+		return fmt.Errorf("container create result: %s", err)
+	}
+	for _, net := range extra {
+		err = s.dockerClient.NetworkConnect(ctx, net, created.ID, &network.EndpointSettings{Aliases: []string{name}})
+		if err != nil {
+			return fmt.Errorf("network connect result: %s", err)
+		}
+	}
+	if err = s.dockerClient.ContainerStart(ctx, created.ID, types.ContainerStartOptions{}); err != nil {
+		return fmt.Errorf("container start result: %s", err)
+	}
+	job.Log("Started container " + created.ID + " of service " + name)
+	if len(containers) > 0 {
+		report.Recreated = append(report.Recreated, name)
+	} else {
+		report.Created = append(report.Created, name)
+	}
+	return nil
+}
+
+// RemoveStack removes the containers of a stack, the dependent services
+// first, then its networks and, if asked, its volumes
+func (s *Status) RemoveStack(ctx context.Context, job *JobHandle, req StackRemoveRequest) (*StackReport, error) {
+	current, err := s.stackContainers(ctx, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	networks, err := s.dockerClient.NetworkList(ctx, types.NetworkListOptions{Filters: stackFilter(req.Name)})
+	if err != nil {
+		return nil, fmt.Errorf("networks list result: %s", err)
+	}
+	volumes, err := s.dockerClient.VolumeList(ctx, stackFilter(req.Name))
+	if err != nil {
+		return nil, fmt.Errorf("volumes list result: %s", err)
+	}
+	if len(current) == 0 && len(networks) == 0 && len(volumes.Volumes) == 0 {
+		return nil, notFound(fmt.Errorf("stack %s not found", req.Name))
+	}
+
+	deps := map[string][]string{}
+	for name, containers := range current {
+		if depends := containers[0].Labels[dependsLabel]; depends != "" {
+			deps[name] = strings.Split(depends, ",")
+		} else {
+			deps[name] = nil
+		}
+	}
+	order, err := dependencyOrder(deps)
+	if err != nil {
+		return nil, err
+	}
+	report := newStackReport(req.Name)
+	for i := len(order) - 1; i >= 0; i-- {
+		for _, c := range current[order[i]] {
+			if err = s.removeStackContainer(ctx, job, c); err != nil {
+				return nil, err
+			}
+		}
+		report.Removed = append(report.Removed, order[i])
+	}
+	for _, n := range networks {
+		if err = s.dockerClient.NetworkRemove(ctx, n.ID); err != nil {
+			return nil, fmt.Errorf("network remove result: %s", err)
+		}
+		job.Log("Removed network " + n.Name)
+	}
+	if req.Volumes {
+		for _, v := range volumes.Volumes {
+			if err = s.dockerClient.VolumeRemove(ctx, v.Name, false); err != nil {
+				return nil, fmt.Errorf("volume remove result: %s", err)
+			}
+			job.Log("Removed volume " + v.Name)
+		}
+	}
+	return report, nil
+}
+
+// ContainersStacks returns the state of the deployed stacks, or of the one
+// with the given name
+func (s *Status) ContainersStacks(name string) ([]StackStatus, error) {
+	ctx := context.Background()
+	stacks := map[string]*StackStatus{}
+	stack := func(name string) *StackStatus {
+		if stacks[name] == nil {
+			stacks[name] = &StackStatus{Name: name, Services: []StackServiceStatus{}, Networks: []string{}, Volumes: []string{}}
+		}
+		return stacks[name]
+	}
+
+	containers, err := s.dockerClient.ContainerList(ctx, types.ContainerListOptions{All: true, Filters: stackFilter(name)})
+	if err != nil {
+		return nil, fmt.Errorf("containers list result: %s", err)
+	}
+	for _, c := range containers {
+		st := stack(c.Labels[stackLabel])
+		st.Services = append(st.Services, StackServiceStatus{
+			Name:        c.Labels[serviceLabel],
+			ContainerID: c.ID,
+			Image:       c.Image,
+			State:       c.State,
+			Status:      c.Status,
+		})
+	}
+	networks, err := s.dockerClient.NetworkList(ctx, types.NetworkListOptions{Filters: stackFilter(name)})
+	if err != nil {
+		return nil, fmt.Errorf("networks list result: %s", err)
+	}
+	for _, n := range networks {
+		st := stack(n.Labels[stackLabel])
+		st.Networks = append(st.Networks, n.Name)
+	}
+	volumes, err := s.dockerClient.VolumeList(ctx, stackFilter(name))
+	if err != nil {
+		return nil, fmt.Errorf("volumes list result: %s", err)
+	}
+	for _, v := range volumes.Volumes {
+		st := stack(v.Labels[stackLabel])
+		st.Volumes = append(st.Volumes, v.Name)
+	}
+
+	res := []StackStatus{}
+	for _, st := range stacks {
+		running := 0
+		for _, svc := range st.Services {
+			if svc.State == "running" {
+				running++
+			}
+		}
+		switch {
+		case running > 0 && running == len(st.Services):
+			st.State = "running"
+		case running > 0:
+			st.State = "partial"
+		default:
+			st.State = "stopped"
+		}
+		sort.Slice(st.Services, func(i, j int) bool { return st.Services[i].Name < st.Services[j].Name })
+		sort.Strings(st.Networks)
+		sort.Strings(st.Volumes)
+		res = append(res, *st)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	if name != "" && len(res) == 0 {
+		return nil, notFound(errors.New("stack " + name + " not found"))
+	}
+	return res, nil
+}
@@ -0,0 +1,576 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	volumetypes "github.com/docker/docker/api/types/volume"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContainersPsCommand(t *testing.T) {
+	c := newTestConnector(t, Config{})
+	defer c.Close()
+	web := c.docker.AddContainer("web", "nginx", "running")
+	c.docker.AddContainer("db", "postgres", "exited")
+
+	var containers []types.Container
+	decodeReply(t, c.Request(t, "/containers/ps", `{}`), &containers)
+	assert.Len(t, containers, 2)
+
+	decodeReply(t, c.Request(t, "/containers/ps", `{"id": "`+web.ID+`"}`), &containers)
+	if assert.Len(t, containers, 1) {
+		assert.Equal(t, []string{"/web"}, containers[0].Names)
+		assert.Equal(t, "running", containers[0].State)
+	}
+}
+
+func TestContainersImagesCommand(t *testing.T) {
+	c := newTestConnector(t, Config{})
+	defer c.Close()
+	c.docker.AddImage("nginx")
+	c.docker.AddImage("redis:5")
+
+	var images []types.ImageSummary
+	decodeReply(t, c.Request(t, "/containers/images", `{}`), &images)
+	assert.Len(t, images, 2)
+
+	decodeReply(t, c.Request(t, "/containers/images", `{"name": "redis:5"}`), &images)
+	if assert.Len(t, images, 1) {
+		assert.Equal(t, []string{"redis:5"}, images[0].RepoTags)
+	}
+}
+
+func TestContainersRenameCommand(t *testing.T) {
+	c := newTestConnector(t, Config{})
+	defer c.Close()
+	web := c.docker.AddContainer("web", "nginx", "running")
+
+	var renamed ChangeNamePayload
+	decodeReply(t, c.Request(t, "/containers/rename", `{"id": "`+web.ID+`", "name": "frontend"}`), &renamed)
+	assert.Equal(t, "frontend", renamed.ContainerName)
+	assert.Equal(t, []string{"/frontend"}, c.docker.Containers()[0].Names)
+
+	var reply Reply
+	assert.NoError(t, json.Unmarshal([]byte(c.Request(t, "/containers/rename", `{"id": "missing", "name": "x"}`)), &reply))
+	assert.Equal(t, "error", reply.Status)
+	assert.Contains(t, reply.Error, "No such container")
+}
+
+func TestContainersActionCommand(t *testing.T) {
+	c := newTestConnector(t, Config{})
+	defer c.Close()
+
+	var run RunPayload
+	decodeReply(t, c.Request(t, "/containers/action", `{"action": "run", "image": "redis", "name": "cache"}`), &run)
+	assert.Equal(t, "cache", run.ContainerName)
+	assert.NotEmpty(t, run.ContainerID)
+	containers := c.docker.Containers()
+	if assert.Len(t, containers, 1) {
+		assert.Equal(t, run.ContainerID, containers[0].ID)
+		assert.Equal(t, "running", containers[0].State)
+	}
+
+	decodeReply(t, c.Request(t, "/containers/action", `{"action": "stop", "id": "`+run.ContainerID+`"}`), nil)
+	assert.Equal(t, "exited", c.docker.Containers()[0].State)
+	decodeReply(t, c.Request(t, "/containers/action", `{"action": "start", "id": "`+run.ContainerID+`"}`), nil)
+	assert.Equal(t, "running", c.docker.Containers()[0].State)
+
+	// remove keeps the images unless asked to prune them
+	decodeReply(t, c.Request(t, "/containers/action", `{"action": "remove", "id": "`+run.ContainerID+`"}`), nil)
+	assert.Empty(t, c.docker.Containers())
+	assert.Len(t, c.docker.Images(), 1)
+	decodeReply(t, c.Request(t, "/containers/action", `{"action": "run", "image": "redis", "name": "cache"}`), &run)
+	decodeReply(t, c.Request(t, "/containers/action", `{"action": "remove", "id": "`+run.ContainerID+`", "prune_images": true}`), nil)
+	assert.Empty(t, c.docker.Containers())
+	assert.Empty(t, c.docker.Images())
+
+	// and forces the removal of running containers unless asked otherwise
+	decodeReply(t, c.Request(t, "/containers/action", `{"action": "run", "image": "redis", "name": "cache"}`), &run)
+	var removeReply Reply
+	assert.NoError(t, json.Unmarshal([]byte(c.Request(t, "/containers/action", `{"action": "remove", "id": "`+run.ContainerID+`", "force": false}`)), &removeReply))
+	assert.Equal(t, "error", removeReply.Status)
+	assert.Contains(t, removeReply.Error, "You cannot remove a running container")
+	assert.Len(t, c.docker.Containers(), 1)
+
+	var reply Reply
+	assert.NoError(t, json.Unmarshal([]byte(c.Request(t, "/containers/action", `{"action": "pause"}`)), &reply))
+	assert.Equal(t, "container command pause not found", reply.Error)
+}
+
+func TestContainersActionCommandError(t *testing.T) {
+	c := newTestConnector(t, Config{LegacyReplies: true})
+	defer c.Close()
+	c.docker.Fail("ImagePull", errors.New("pull access denied for private/image"))
+
+	resp := c.Request(t, "/containers/action", `{"action": "run", "image": "private/image"}`)
+	assert.Equal(t, "ERROR: image pull result: pull access denied for private/image\n", resp)
+	assert.NotContains(t, c.docker.Calls(), "ContainerCreate")
+
+	resp = c.Request(t, "/containers/action", `{test}`)
+	assert.Contains(t, resp, "ERROR: Unmarshal")
+}
+
+func TestContainersActionJob(t *testing.T) {
+	c := newTestConnector(t, Config{})
+	defer c.Close()
+
+	var job Job
+	decodeReply(t, c.Request(t, "/containers/action", `{"action": "run", "image": "redis", "name": "cache", "async": true}`), &job)
+	assert.Equal(t, jobsContainers, job.Category)
+	assert.Equal(t, "run", job.Operation)
+	assert.Equal(t, "cache", job.Target)
+
+	var run RunPayload
+	for start := time.Now(); job.State != jobSucceeded && time.Since(start) < 5*time.Second; {
+		decodeReply(t, c.Request(t, "/jobs/get", `{"id": "`+job.ID+`"}`), &job)
+	}
+	assert.Equal(t, jobSucceeded, job.State)
+	assert.Contains(t, job.Log, "Successfully downloaded image redis")
+	assert.NoError(t, json.Unmarshal(job.Result, &run))
+	assert.Equal(t, c.docker.Containers()[0].ID, run.ContainerID)
+
+	var jobs []Job
+	decodeReply(t, c.Request(t, "/jobs/list", `{"category": "containers"}`), &jobs)
+	if assert.Len(t, jobs, 1) {
+		assert.Equal(t, job.ID, jobs[0].ID)
+		assert.Empty(t, jobs[0].Log)
+	}
+	decodeReply(t, c.Request(t, "/jobs/list", `{"category": "packages"}`), &jobs)
+	assert.Empty(t, jobs)
+}
+
+func TestContainersActionPull(t *testing.T) {
+	c := newTestConnector(t, Config{})
+	defer c.Close()
+	c.docker.SetImageLayers("redis:5", 3000, 1000)
+	messages := c.Subscribe(t, "/containers/action/progress")
+
+	var pulled RunPayload
+	decodeReply(t, c.Request(t, "/containers/action", `{"action": "pull", "image": "redis:5"}`), &pulled)
+	assert.Empty(t, c.docker.Containers(), "pull doesn't run the image")
+	assert.Len(t, c.docker.Images(), 1)
+	if assert.NotNil(t, pulled.Pull) {
+		assert.Equal(t, "Downloaded newer image for redis:5", pulled.Pull.Status)
+		assert.Equal(t, 2, pulled.Pull.Layers)
+		assert.Equal(t, int64(4000), pulled.Pull.TotalBytes)
+		assert.NotEmpty(t, pulled.Pull.Digest)
+	}
+
+	// the progress has a json line for every message about a layer
+	var progress []ImagePullProgress
+	for len(progress) == 0 || progress[len(progress)-1].State == jobRunning {
+		select {
+		case msg := <-messages:
+			for _, text := range strings.Split(strings.TrimSuffix(msg, "\n"), "\n") {
+				var line ImagePullProgress
+				assert.NoError(t, json.Unmarshal([]byte(text), &line))
+				progress = append(progress, line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no progress received")
+		}
+	}
+	assert.Contains(t, progress, ImagePullProgress{ID: progress[0].ID, Image: "redis:5", State: jobRunning, Layer: "000000000001", Status: "Downloading", Current: 1500, Total: 3000})
+	last := progress[len(progress)-1]
+	assert.Equal(t, jobSucceeded, last.State)
+	assert.Equal(t, int64(4000), last.TotalBytes)
+
+	// the images already pulled are up to date
+	pulled = RunPayload{}
+	decodeReply(t, c.Request(t, "/containers/action", `{"action": "pull", "image": "redis:5"}`), &pulled)
+	assert.Equal(t, "Image is up to date for redis:5", pulled.Pull.Status)
+	assert.Zero(t, pulled.Pull.TotalBytes)
+
+	// the errors at the end of the stream fail the pull
+	c.docker.FailPull("private/image", "manifest for private/image:latest not found")
+	var reply Reply
+	assert.NoError(t, json.Unmarshal([]byte(c.Request(t, "/containers/action", `{"action": "run", "image": "private/image"}`)), &reply))
+	assert.Equal(t, "error", reply.Status)
+	assert.Equal(t, "image pull result: manifest for private/image:latest not found", reply.Error)
+	assert.NotContains(t, c.docker.Calls(), "ContainerCreate")
+}
+
+func TestContainersPruneCommand(t *testing.T) {
+	c := newTestConnector(t, Config{})
+	defer c.Close()
+	c.docker.AddContainer("web", "nginx", "running")
+	c.docker.AddImage("redis:5")
+	dangling := c.docker.AddDanglingImage()
+	c.docker.SetBuildCache(4096)
+	ctx := context.Background()
+	_, err := c.docker.VolumeCreate(ctx, volumetypes.VolumeCreateBody{Name: "cache", Labels: map[string]string{"keep": "true"}})
+	assert.NoError(t, err)
+	_, err = c.docker.VolumeCreate(ctx, volumetypes.VolumeCreateBody{Name: "tmp"})
+	assert.NoError(t, err)
+	_, err = c.docker.NetworkCreate(ctx, "old", types.NetworkCreate{})
+	assert.NoError(t, err)
+
+	// only the dangling images unless all
+	var report PruneReport
+	decodeReply(t, c.Request(t, "/containers/prune", `{"targets": ["images"]}`), &report)
+	assert.Equal(t, []string{dangling.ID}, report.ImagesDeleted)
+	assert.Empty(t, report.VolumesDeleted)
+	assert.Len(t, c.docker.Images(), 2)
+	report = PruneReport{}
+	decodeReply(t, c.Request(t, "/containers/prune", `{"targets": ["images"], "all": true, "until": "1h"}`), &report)
+	assert.Empty(t, report.ImagesDeleted, "the images are newer")
+	report = PruneReport{}
+	decodeReply(t, c.Request(t, "/containers/prune", `{"targets": ["images"], "all": true}`), &report)
+	assert.Len(t, report.ImagesDeleted, 1)
+	if assert.Len(t, c.docker.Images(), 1, "the images of the containers are kept") {
+		assert.Equal(t, []string{"nginx:latest"}, c.docker.Images()[0].RepoTags)
+	}
+
+	report = PruneReport{}
+	decodeReply(t, c.Request(t, "/containers/prune", `{"targets": ["volumes", "networks"], "labels": ["keep!=true"]}`), &report)
+	assert.Equal(t, []string{"tmp"}, report.VolumesDeleted)
+	assert.Equal(t, []string{"old"}, report.NetworksDeleted)
+	if assert.Len(t, c.docker.Volumes(), 1) {
+		assert.Equal(t, "cache", c.docker.Volumes()[0].Name)
+	}
+	report = PruneReport{}
+	decodeReply(t, c.Request(t, "/containers/prune", `{"targets": ["build_cache"]}`), &report)
+	assert.Equal(t, uint64(4096), report.SpaceReclaimed)
+
+	var reply Reply
+	for payload, err := range map[string]string{
+		`{}`:                          "missing prune targets",
+		`{"targets": ["containers"]}`: "invalid prune target 'containers'",
+		`{"targets": ["volumes"], "until": "24h"}`:      "the volumes can't be pruned by date",
+		`{"targets": ["build_cache"], "labels": ["a"]}`: "the build cache can't be pruned with filters",
+		`{"targets": ["images"], "until": "yesterday"}`: "invalid until",
+	} {
+		reply = Reply{}
+		assert.NoError(t, json.Unmarshal([]byte(c.Request(t, "/containers/prune", payload)), &reply))
+		assert.Equal(t, "error", reply.Status, payload)
+		assert.Contains(t, reply.Error, err, payload)
+	}
+}
+
+func TestContainersLogsCommand(t *testing.T) {
+	c := newTestConnector(t, Config{})
+	defer c.Close()
+	web := c.docker.AddContainer("web", "nginx", "running")
+	start := time.Date(2020, 5, 4, 10, 0, 0, 0, time.UTC)
+	c.docker.AddLog("web", "stdout", "starting", start)
+	c.docker.AddLog("web", "stderr", "no config found", start.Add(time.Minute))
+	c.docker.AddLog("web", "stdout", "ready", start.Add(2*time.Minute))
+
+	var logs ContainersLogsResponse
+	decodeReply(t, c.Request(t, "/containers/logs", `{"id": "web"}`), &logs)
+	assert.Equal(t, web.ID, logs.ContainerID)
+	assert.Equal(t, []ContainerLogLine{
+		{Stream: "stdout", Line: "starting"},
+		{Stream: "stderr", Line: "no config found"},
+		{Stream: "stdout", Line: "ready"},
+	}, logs.Lines)
+
+	var tail ContainersLogsResponse
+	decodeReply(t, c.Request(t, "/containers/logs", `{"id": "web", "tail": 1, "timestamps": true}`), &tail)
+	if assert.Len(t, tail.Lines, 1) && assert.NotNil(t, tail.Lines[0].Timestamp) {
+		assert.Equal(t, "ready", tail.Lines[0].Line)
+		assert.True(t, start.Add(2*time.Minute).Equal(*tail.Lines[0].Timestamp))
+	}
+
+	var stderr ContainersLogsResponse
+	decodeReply(t, c.Request(t, "/containers/logs", `{"id": "web", "stderr": true}`), &stderr)
+	assert.Equal(t, []ContainerLogLine{{Stream: "stderr", Line: "no config found"}}, stderr.Lines)
+
+	var since ContainersLogsResponse
+	decodeReply(t, c.Request(t, "/containers/logs", `{"id": "web", "since": "2020-05-04T10:01:00Z", "until": "2020-05-04T10:01:30Z"}`), &since)
+	assert.Equal(t, []ContainerLogLine{{Stream: "stderr", Line: "no config found"}}, since.Lines)
+
+	var reply Reply
+	assert.NoError(t, json.Unmarshal([]byte(c.Request(t, "/containers/logs", `{"id": "web", "since": "yesterday"}`)), &reply))
+	assert.Equal(t, "error", reply.Status)
+	assert.Contains(t, reply.Error, "invalid since")
+	assert.NoError(t, json.Unmarshal([]byte(c.Request(t, "/containers/logs", `{"id": "missing"}`)), &reply))
+	assert.Equal(t, "error", reply.Status)
+	assert.Contains(t, reply.Error, "No such container")
+}
+
+func TestContainersLogsFollow(t *testing.T) {
+	c := newTestConnector(t, Config{})
+	defer c.Close()
+	web := c.docker.AddContainer("web", "nginx", "running")
+	c.docker.AddLog("web", "stdout", "starting", time.Now())
+	messages := c.Subscribe(t, "/containers/logs/"+web.ID)
+
+	// the messages have a json line for every line of output
+	var lines []ContainerLogLine
+	waitLines := func(n int) {
+		t.Helper()
+		for len(lines) < n {
+			select {
+			case msg := <-messages:
+				for _, text := range strings.Split(strings.TrimSuffix(msg, "\n"), "\n") {
+					var line ContainerLogLine
+					assert.NoError(t, json.Unmarshal([]byte(text), &line))
+					lines = append(lines, line)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("no logs received")
+			}
+		}
+	}
+
+	var logs ContainersLogsResponse
+	decodeReply(t, c.Request(t, "/containers/logs", `{"id": "web", "follow": true, "tail": 1}`), &logs)
+	assert.Equal(t, "/containers/logs/"+web.ID, logs.Topic)
+	if assert.NotNil(t, logs.Job) {
+		assert.Equal(t, jobsLogs, logs.Job.Category)
+		assert.Equal(t, web.ID, logs.Job.Target)
+	}
+	waitLines(1)
+	c.docker.AddLog("web", "stderr", "GET /missing 404", time.Now())
+	waitLines(2)
+	assert.Equal(t, []ContainerLogLine{{Stream: "stdout", Line: "starting"}, {Stream: "stderr", Line: "GET /missing 404"}}, lines)
+
+	var job Job
+	decodeReply(t, c.Request(t, "/jobs/cancel", `{"id": "`+logs.Job.ID+`"}`), &job)
+	assert.Equal(t, jobCancelling, job.State)
+	for start := time.Now(); job.State == jobCancelling && time.Since(start) < 5*time.Second; {
+		decodeReply(t, c.Request(t, "/jobs/get", `{"id": "`+logs.Job.ID+`"}`), &job)
+	}
+	assert.Equal(t, jobCancelled, job.State)
+
+	// the logs end when the container stops
+	c.docker.AddLog("web", "stdout", "shutting down", time.Now())
+	var stopped ContainersLogsResponse
+	decodeReply(t, c.Request(t, "/containers/logs", `{"id": "web", "follow": true, "tail": 1}`), &stopped)
+	waitLines(3)
+	decodeReply(t, c.Request(t, "/containers/action", `{"action": "stop", "id": "`+web.ID+`"}`), nil)
+	for start := time.Now(); job.State != jobSucceeded && time.Since(start) < 5*time.Second; {
+		decodeReply(t, c.Request(t, "/jobs/get", `{"id": "`+stopped.Job.ID+`"}`), &job)
+	}
+	assert.Equal(t, jobSucceeded, job.State)
+	assert.Equal(t, "shutting down", lines[2].Line)
+}
+
+func TestContainersExecCommand(t *testing.T) {
+	c := newTestConnector(t, Config{})
+	defer c.Close()
+	c.docker.AddContainer("web", "nginx", "running")
+
+	var session ExecSession
+	decodeReply(t, c.Request(t, "/containers/exec", `{"id": "web", "cmd": ["cat"], "tty": true, "rows": 24, "cols": 80}`), &session)
+	assert.NotEmpty(t, session.ID)
+	assert.Equal(t, "/containers/exec/"+session.ID+"/output", session.OutputTopic)
+	assert.Equal(t, int(defaultExecIdleTimeout/time.Second), session.IdleTimeout)
+	height, width := c.docker.ExecSize(session.ExecID)
+	assert.Equal(t, []uint{24, 80}, []uint{height, width})
+
+	output := c.Subscribe(t, session.OutputTopic)
+	exit := c.Subscribe(t, "/containers/exec/"+session.ID+"/exit")
+	c.Publish(t, session.StdinTopic, "ls\n")
+	select {
+	case msg := <-output:
+		assert.Equal(t, "ls\n", msg)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no output received")
+	}
+	c.Publish(t, session.ResizeTopic, `{"rows": 50, "cols": 132}`)
+	for start := time.Now(); height != 50 && time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		height, width = c.docker.ExecSize(session.ExecID)
+	}
+	assert.Equal(t, []uint{50, 132}, []uint{height, width})
+
+	var sessions []ExecSession
+	decodeReply(t, c.Request(t, "/containers/exec/list", `{}`), &sessions)
+	if assert.Len(t, sessions, 1) {
+		assert.Equal(t, session.ID, sessions[0].ID)
+		assert.Equal(t, "web", sessions[0].ContainerID)
+	}
+
+	// the session ends with the process
+	c.Publish(t, session.StdinTopic, "exit 3\n")
+	select {
+	case msg := <-exit:
+		var closed ExecSession
+		decodeEvent(t, msg, &closed)
+		assert.Equal(t, execExited, closed.Reason)
+		if assert.NotNil(t, closed.ExitCode) {
+			assert.Equal(t, 3, *closed.ExitCode)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session didn't end")
+	}
+	decodeReply(t, c.Request(t, "/containers/exec/list", `{}`), &sessions)
+	assert.Empty(t, sessions)
+}
+
+func TestContainersExecClose(t *testing.T) {
+	c := newTestConnector(t, Config{})
+	defer c.Close()
+	c.docker.AddContainer("web", "nginx", "running")
+	c.docker.AddContainer("db", "postgres", "exited")
+
+	var session ExecSession
+	decodeReply(t, c.Request(t, "/containers/exec", `{"id": "web"}`), &session)
+	assert.Equal(t, []string{"/bin/sh"}, session.Cmd)
+	var closed ExecSession
+	decodeReply(t, c.Request(t, "/containers/exec/close", `{"id": "`+session.ID+`"}`), &closed)
+	assert.Equal(t, execClosed, closed.Reason)
+	assert.NotNil(t, closed.ClosedAt)
+
+	var reply Reply
+	assert.NoError(t, json.Unmarshal([]byte(c.Request(t, "/containers/exec/close", `{"id": "`+session.ID+`"}`)), &reply))
+	assert.Equal(t, "error", reply.Status)
+	assert.NoError(t, json.Unmarshal([]byte(c.Request(t, "/containers/exec", `{"id": "db"}`)), &reply))
+	assert.Equal(t, "error", reply.Status)
+	assert.Contains(t, reply.Error, "is not running")
+
+	// the idle sessions are closed
+	var idle ExecSession
+	decodeReply(t, c.Request(t, "/containers/exec", `{"id": "web", "idle_timeout": 1}`), &idle)
+	exit := c.Subscribe(t, "/containers/exec/"+idle.ID+"/exit")
+	select {
+	case msg := <-exit:
+		decodeEvent(t, msg, &closed)
+		assert.Equal(t, execIdle, closed.Reason)
+		assert.Nil(t, closed.ExitCode)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the idle session wasn't closed")
+	}
+}
+
+const testStack = `{"name": "shop", "services": {
+	"web": {"image": "nginx", "ports": ["8080:80"], "networks": ["front", "back"], "depends_on": ["api"], "restart": "always"},
+	"api": {"image": "shop/api", "environment": ["DB=db"], "networks": ["back"], "depends_on": ["db"]},
+	"db": {"image": "postgres", "volumes": ["data:/var/lib/postgresql/data"], "networks": ["back"], "restart": "on-failure:3"}
+}, "networks": {"front": {}, "back": {}}, "volumes": {"data": {}}}`
+
+func TestContainersStackDeploy(t *testing.T) {
+	c := newTestConnector(t, Config{})
+	defer c.Close()
+
+	var report StackReport
+	decodeReply(t, c.Request(t, "/containers/stack/deploy", testStack), &report)
+	assert.Equal(t, []string{"db", "api", "web"}, report.Created, "the services start after their dependencies")
+	assert.Empty(t, report.Recreated)
+	assert.Len(t, c.docker.Networks(), 2)
+	if assert.Len(t, c.docker.Volumes(), 1) {
+		assert.Equal(t, "shop_data", c.docker.Volumes()[0].Name)
+		assert.Equal(t, "shop", c.docker.Volumes()[0].Labels[stackLabel])
+	}
+
+	containers := map[string]types.Container{}
+	for _, container := range c.docker.Containers() {
+		assert.Equal(t, "running", container.State)
+		containers[container.Labels[serviceLabel]] = container
+	}
+	assert.Len(t, containers, 3)
+	web, err := c.docker.ContainerInspect(context.Background(), containers["web"].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "/shop_web", web.Name)
+	assert.Equal(t, "always", web.HostConfig.RestartPolicy.Name)
+	assert.Len(t, containers["web"].NetworkSettings.Networks, 2)
+	db, err := c.docker.ContainerInspect(context.Background(), containers["db"].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, db.HostConfig.RestartPolicy.MaximumRetryCount)
+	if assert.Len(t, db.Mounts, 1) {
+		assert.Equal(t, "shop_data", db.Mounts[0].Name)
+	}
+
+	// only the services that changed are recreated
+	changed := strings.Replace(testStack, `"DB=db"`, `"DB=db", "DEBUG=1"`, 1)
+	report = StackReport{}
+	decodeReply(t, c.Request(t, "/containers/stack/deploy", changed), &report)
+	assert.Equal(t, []string{"api"}, report.Recreated)
+	assert.Equal(t, []string{"db", "web"}, report.Unchanged)
+	assert.Empty(t, report.Created)
+	for _, container := range c.docker.Containers() {
+		if service := container.Labels[serviceLabel]; service != "api" {
+			assert.Equal(t, containers[service].ID, container.ID)
+		} else {
+			assert.NotEqual(t, containers[service].ID, container.ID)
+		}
+	}
+
+	// and those whose image changed, when pulled
+	c.docker.UpdateImage("postgres")
+	report = StackReport{}
+	decodeReply(t, c.Request(t, "/containers/stack/deploy", `{"pull": true, `+changed[1:]), &report)
+	assert.Equal(t, []string{"db"}, report.Recreated)
+
+	// the services removed from the stack are removed
+	report = StackReport{}
+	decodeReply(t, c.Request(t, "/containers/stack/deploy", `{"name": "shop", "services": {"db": {"image": "postgres", "volumes": ["data:/var/lib/postgresql/data"], "networks": ["back"], "restart": "on-failure:3"}}, "networks": {"back": {}}, "volumes": {"data": {}}}`), &report)
+	assert.Equal(t, []string{"api", "web"}, report.Removed)
+	assert.Equal(t, []string{"db"}, report.Unchanged)
+	assert.Len(t, c.docker.Containers(), 1)
+	if assert.Len(t, c.docker.Networks(), 1) {
+		assert.Equal(t, "shop_back", c.docker.Networks()[0].Name)
+	}
+}
+
+func TestContainersStackDeployInvalid(t *testing.T) {
+	c := newTestConnector(t, Config{})
+	defer c.Close()
+
+	var reply Reply
+	resp := c.Request(t, "/containers/stack/deploy", `{"name": "loop", "services": {"a": {"image": "x", "depends_on": ["b"]}, "b": {"image": "y", "depends_on": ["a"]}}}`)
+	assert.NoError(t, json.Unmarshal([]byte(resp), &reply))
+	assert.Equal(t, "error", reply.Status)
+	assert.Contains(t, reply.Error, "circular dependency: a -> b -> a")
+
+	reply = Reply{}
+	resp = c.Request(t, "/containers/stack/deploy", `{"name": "app", "services": {"a": {"image": "x", "networks": ["missing"]}}}`)
+	assert.NoError(t, json.Unmarshal([]byte(resp), &reply))
+	assert.Contains(t, reply.Error, "service a: undefined network missing")
+	assert.Empty(t, c.docker.Calls(), "nothing is done on invalid stacks")
+}
+
+func TestContainersStackRemove(t *testing.T) {
+	c := newTestConnector(t, Config{})
+	defer c.Close()
+	c.docker.AddContainer("other", "redis", "running")
+	decodeReply(t, c.Request(t, "/containers/stack/deploy", testStack), nil)
+
+	var stacks []StackStatus
+	decodeReply(t, c.Request(t, "/containers/ps", `{"stacks": true}`), &stacks)
+	if assert.Len(t, stacks, 1) {
+		assert.Equal(t, "shop", stacks[0].Name)
+		assert.Equal(t, "running", stacks[0].State)
+		assert.Len(t, stacks[0].Services, 3)
+		assert.Equal(t, []string{"shop_back", "shop_front"}, stacks[0].Networks)
+		assert.Equal(t, []string{"shop_data"}, stacks[0].Volumes)
+	}
+	var containers []types.Container
+	decodeReply(t, c.Request(t, "/containers/ps", `{"stack": "shop"}`), &containers)
+	assert.Len(t, containers, 3)
+
+	for _, container := range c.docker.Containers() {
+		if container.Labels[serviceLabel] == "api" {
+			assert.NoError(t, c.docker.ContainerStop(context.Background(), container.ID, nil))
+		}
+	}
+	stacks = nil
+	decodeReply(t, c.Request(t, "/containers/ps", `{"stacks": true, "stack": "shop"}`), &stacks)
+	if assert.Len(t, stacks, 1) {
+		assert.Equal(t, "partial", stacks[0].State)
+	}
+
+	var report StackReport
+	decodeReply(t, c.Request(t, "/containers/stack/remove", `{"name": "shop"}`), &report)
+	assert.Equal(t, []string{"web", "api", "db"}, report.Removed, "the dependent services are removed first")
+	if assert.Len(t, c.docker.Containers(), 1) {
+		assert.Equal(t, []string{"/other"}, c.docker.Containers()[0].Names)
+	}
+	assert.Empty(t, c.docker.Networks())
+	assert.Len(t, c.docker.Volumes(), 1, "the volumes are kept unless asked")
+
+	decodeReply(t, c.Request(t, "/containers/stack/remove", `{"name": "shop", "volumes": true}`), nil)
+	assert.Empty(t, c.docker.Volumes())
+
+	var reply Reply
+	assert.NoError(t, json.Unmarshal([]byte(c.Request(t, "/containers/stack/remove", `{"name": "shop"}`)), &reply))
+	assert.Equal(t, "error", reply.Status)
+	assert.Contains(t, reply.Error, "stack shop not found")
+}
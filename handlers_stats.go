@@ -19,7 +19,7 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"os/exec"
 
@@ -27,108 +27,96 @@ import (
 	"github.com/arduino/go-system-stats/disk"
 	"github.com/arduino/go-system-stats/mem"
 	net "github.com/arduino/go-system-stats/network"
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/pkg/errors"
 )
 
-// WiFiEvent tries to connect to the specified wifi network
-func (s *Status) WiFiEvent(client mqtt.Client, msg mqtt.Message) {
-	// try registering a new wifi network
-	var info struct {
-		SSID     string `json:"ssid"`
-		Password string `json:"password"`
-	}
-	err := json.Unmarshal(msg.Payload(), &info)
-	if err != nil {
-		s.Error("/wifi", errors.Wrapf(err, "unmarshal %s", msg.Payload()))
-		return
-	}
-	err = net.AddWirelessConnection(info.SSID, info.Password)
-	if err != nil {
-		return
-	}
+// WiFiRequest are the parameters of /wifi
+type WiFiRequest struct {
+	SSID     string `json:"ssid"`
+	Password string `json:"password"`
 }
 
-// EthEvent tries to change IP/Netmask/DNS configuration of the wired connection
-func (s *Status) EthEvent(client mqtt.Client, msg mqtt.Message) {
-	// try registering a new wifi network
-	var info net.IPProxyConfig
-	err := json.Unmarshal(msg.Payload(), &info)
-	if err != nil {
-		s.Error("/ethernet", errors.Wrapf(err, "unmarshal %s", msg.Payload()))
-		return
-	}
-	err = net.AddWiredConnection(info)
-	if err != nil {
-		return
-	}
+// WiFi tries to connect to the specified wifi network
+func (s *Status) WiFi(info WiFiRequest) error {
+	return errors.Wrapf(net.AddWirelessConnection(info.SSID, info.Password), "add wifi network %s", info.SSID)
 }
 
-func checkAndInstallNetworkManager() {
+// Ethernet tries to change IP/Netmask/DNS configuration of the wired connection
+func (s *Status) Ethernet(info net.IPProxyConfig) error {
+	return errors.Wrap(net.AddWiredConnection(info), "configure wired connection")
+}
+
+func checkAndInstallNetworkManager(config Config) {
 	_, err := net.GetNetworkStats()
 	if err == nil {
 		return
 	}
 
-	dpkgCmd := exec.Command("dpkg", "--configure", "-a")
-	if out, err := dpkgCmd.CombinedOutput(); err != nil {
-		fmt.Println("Failed to dpkg configure all:")
-		fmt.Println(string(out))
+	packages, err := newPackageManager(config)
+	if err != nil {
+		fmt.Println("Failed to install network-manager:", err)
+		return
+	}
+
+	// the name of the package and the way to start the service depend on
+	// the distribution
+	name, start := "network-manager", []string{"/etc/init.d/network-manager", "start"}
+	switch packages.Name() {
+	case "apt":
+		dpkgCmd := exec.Command("dpkg", "--configure", "-a")
+		if out, err := dpkgCmd.CombinedOutput(); err != nil {
+			fmt.Println("Failed to dpkg configure all:")
+			fmt.Println(string(out))
+		}
+	case "dnf":
+		name, start = "NetworkManager", []string{"systemctl", "start", "NetworkManager"}
+	case "apk":
+		name, start = "networkmanager", []string{"rc-service", "networkmanager", "start"}
 	}
 
-	toInstall := &apt.Package{Name: "network-manager"}
-	if out, err := apt.Install(toInstall); err != nil {
-		fmt.Println("Failed to install network-manager:")
+	toInstall := &apt.Package{Name: name}
+	if out, err := packages.Install(context.Background(), nil, toInstall); err != nil {
+		fmt.Println("Failed to install " + name + ":")
 		fmt.Println(string(out))
 		return
 	}
-	cmd := exec.Command("/etc/init.d/network-manager", "start")
+	cmd := exec.Command(start[0], start[1:]...)
 	if out, err := cmd.CombinedOutput(); err != nil {
-		fmt.Println("Failed to start network-manager:")
+		fmt.Println("Failed to start " + name + ":")
 		fmt.Println(string(out))
 	}
 }
 
-// StatsEvent sends statistics about resource used in the system (RAM, Disk, Network, etc...)
-func (s *Status) StatsEvent(client mqtt.Client, msg mqtt.Message) {
-	// Gather all system data metrics
-	memStats, err := mem.GetStats()
-	if err != nil {
-		s.Error("/stats", fmt.Errorf("Retrieving memory stats: %s", err))
-	}
+// StatsPayload is the reply to /stats, the statistics that can't be
+// gathered are left empty and their error is reported in Errors
+type StatsPayload struct {
+	Memory    *mem.Stats                `json:"memory"`
+	Disk      []*disk.FSStats           `json:"disk"`
+	Network   *net.Stats                `json:"network"`
+	Publisher map[string]PublisherStats `json:"publisher"`
+	Outbox    *OutboxStats              `json:"outbox,omitempty"`
+	Errors    []string                  `json:"errors,omitempty"`
+}
 
-	diskStats, err := disk.GetStats()
-	if err != nil {
-		s.Error("/stats", fmt.Errorf("Retrieving disk stats: %s", err))
-	}
+// Stats returns statistics about resource used in the system (RAM, Disk, Network, etc...)
+func (s *Status) Stats() *StatsPayload {
+	info := &StatsPayload{Publisher: s.publisher.Stats()}
 
-	netStats, err := net.GetNetworkStats()
-	if err != nil {
-		s.Error("/stats", fmt.Errorf("Retrieving network stats: %s", err))
+	// Gather all system data metrics
+	var err error
+	if info.Memory, err = mem.GetStats(); err != nil {
+		info.Errors = append(info.Errors, fmt.Sprintf("Retrieving memory stats: %s", err))
 	}
-
-	type StatsPayload struct {
-		Memory  *mem.Stats      `json:"memory"`
-		Disk    []*disk.FSStats `json:"disk"`
-		Network *net.Stats      `json:"network"`
+	if info.Disk, err = disk.GetStats(); err != nil {
+		info.Errors = append(info.Errors, fmt.Sprintf("Retrieving disk stats: %s", err))
 	}
-
-	info := StatsPayload{
-		Memory:  memStats,
-		Disk:    diskStats,
-		Network: netStats,
+	if info.Network, err = net.GetNetworkStats(); err != nil {
+		info.Errors = append(info.Errors, fmt.Sprintf("Retrieving network stats: %s", err))
 	}
 
-	// Send result
-	data, err := json.Marshal(info)
-	if err != nil {
-		s.Error("/stats", fmt.Errorf("Json marsahl result: %s", err))
-		return
+	if s.outbox != nil {
+		outboxStats := s.outbox.Stats()
+		info.Outbox = &outboxStats
 	}
-
-	//var out bytes.Buffer
-	//json.Indent(&out, data, "", "  ")
-	//fmt.Println(string(out.Bytes()))
-
-	s.Info("/stats", string(data)+"\n")
+	return info
 }
@@ -21,9 +21,14 @@ package main
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -44,6 +49,9 @@ func ExecAsVagrantSshCmd(command string) (string, error) {
 // tests
 func TestSketchProcessIsRunning(t *testing.T) {
 	mqtt := NewMqttTestClient()
+	if mqtt == nil {
+		t.Skip("requires the test thing on AWS IoT and the Vagrant VM, see test/")
+	}
 	defer mqtt.Close()
 	sketchTopic := "upload"
 
@@ -83,6 +91,9 @@ func TestSketchProcessIsRunning(t *testing.T) {
 // tests
 func TestMaliciousSketchProcessIsNotRunning(t *testing.T) {
 	mqtt := NewMqttTestClient()
+	if mqtt == nil {
+		t.Skip("requires the test thing on AWS IoT and the Vagrant VM, see test/")
+	}
 	defer mqtt.Close()
 	sketchTopic := "upload"
 
@@ -113,6 +124,9 @@ func TestMaliciousSketchProcessIsNotRunning(t *testing.T) {
 func TestSketchProcessHasConfigWhitelistedEnvVars(t *testing.T) {
 	// see upload_dev_artifacts_on_s3.sh to see where env vars are passed to the config
 	mqtt := NewMqttTestClient()
+	if mqtt == nil {
+		t.Skip("requires the test thing on AWS IoT and the Vagrant VM, see test/")
+	}
 	defer mqtt.Close()
 
 	//test connector config
@@ -163,3 +177,52 @@ func TestSketchProcessHasConfigWhitelistedEnvVars(t *testing.T) {
 	}
 
 }
+
+func TestUploadSketch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sketches")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	server, publicKey := newSketchServer(t, "#!/bin/sh\necho $GREETING > \"$0.out\"\nsleep 10\n")
+	defer server.Close()
+	c := newTestConnector(t, Config{LegacyReplies: true, SketchesPath: dir, SignatureKey: publicKey})
+	defer c.Close()
+
+	resp := c.Request(t, "/upload", `{"id": "blink", "name": "blink", "url": "`+server.URL+`/blink", "environment": {"GREETING": "hello"}}`)
+	if !assert.True(t, strings.HasPrefix(resp, "INFO: Sketch started with PID "), resp) {
+		return
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(resp, "INFO: Sketch started with PID ")))
+	assert.NoError(t, err)
+	assert.NoError(t, syscall.Kill(pid, 0))
+
+	out := filepath.Join(dir, "sketches", "blink.out")
+	deadline := time.Now().Add(5 * time.Second)
+	for data, _ := ioutil.ReadFile(out); string(data) != "hello\n" && time.Now().Before(deadline); data, _ = ioutil.ReadFile(out) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	data, _ := ioutil.ReadFile(out)
+	assert.Equal(t, "hello\n", string(data))
+
+	resp = c.Request(t, "/sketch", `{"id": "blink", "action": "STOP"}`)
+	assert.Equal(t, "INFO: successfully performed STOP on sketch blink\n", resp)
+	resp = c.Request(t, "/sketch", `{"id": "missing", "action": "STOP"}`)
+	assert.Equal(t, "ERROR: sketch missing not found\n", resp)
+}
+
+func TestUploadMaliciousSketch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sketches")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	trusted, publicKey := newSketchServer(t, "#!/bin/sh\nsleep 10\n")
+	trusted.Close()
+	malicious, _ := newSketchServer(t, "#!/bin/sh\nrm -rf /\n")
+	defer malicious.Close()
+	c := newTestConnector(t, Config{LegacyReplies: true, SketchesPath: dir, SignatureKey: publicKey})
+	defer c.Close()
+
+	resp := c.Request(t, "/upload", `{"id": "blink", "name": "blink", "url": "`+malicious.URL+`/blink"}`)
+	assert.True(t, strings.HasPrefix(resp, "ERROR: signature do not match"), resp)
+	assert.Empty(t, c.status.SketchList())
+}
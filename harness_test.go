@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arduino/arduino-connector/testharness"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// testConnector is a connector wired to an embedded MQTT broker, to a fake
+// docker and to a fake package manager, with a client playing the part of the
+// cloud. If config.AptRoot is set the apt package manager is used instead,
+// on that folder.
+type testConnector struct {
+	status   *Status
+	broker   *testharness.Broker
+	docker   *testharness.Docker
+	packages *testharness.Packages
+	ui       *MqttTestClient
+}
+
+func newTestConnector(t *testing.T, config Config) *testConnector {
+	t.Helper()
+	broker, err := testharness.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := broker.Connect("arduino-connector")
+	if err != nil {
+		broker.Close()
+		t.Fatal(err)
+	}
+
+	c := &testConnector{broker: broker, docker: testharness.NewDocker(), packages: testharness.NewPackages()}
+	c.status = NewStatus(config, client, c.docker, "things/test")
+	if config.AptRoot == "" {
+		c.status.packages = c.packages
+	}
+	subscribeTopics(client, config.ID, c.status)
+	c.ui = NewMqttTestClientBroker(broker.URL())
+	return c
+}
+
+func (c *testConnector) Close() {
+	c.ui.Close()
+	c.status.client().Disconnect(100)
+	c.broker.Close()
+}
+
+// Request sends the payload to the command and waits for the reply
+func (c *testConnector) Request(t *testing.T, command, payload string) string {
+	t.Helper()
+	return c.ui.MqttSendAndReceiveTimeout(t, c.status.topicPertinence+command, payload, 5*time.Second)
+}
+
+// Subscribe returns the messages published by the connector on topic
+func (c *testConnector) Subscribe(t *testing.T, topic string) <-chan string {
+	t.Helper()
+	messages := make(chan string, 1000)
+	handler := func(client mqtt.Client, msg mqtt.Message) {
+		messages <- string(msg.Payload())
+	}
+	if token := c.ui.client.Subscribe(c.status.topicPertinence+topic, 0, handler); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	return messages
+}
+
+// Publish sends a message on topic, as the cloud would
+func (c *testConnector) Publish(t *testing.T, topic, payload string) {
+	t.Helper()
+	if token := c.ui.client.Publish(c.status.topicPertinence+topic, 1, false, payload); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+}
+
+// decodeReply checks that resp is a successful reply and decodes its data in v
+func decodeReply(t *testing.T, resp string, v interface{}) {
+	t.Helper()
+	var reply Reply
+	if err := json.Unmarshal([]byte(resp), &reply); err != nil {
+		t.Fatalf("unmarshal reply %q: %s", resp, err)
+	}
+	if reply.Status != "ok" {
+		t.Fatalf("request failed: %s", reply.Error)
+	}
+	if v != nil {
+		if err := json.Unmarshal(reply.Data, v); err != nil {
+			t.Fatalf("unmarshal data %s: %s", reply.Data, err)
+		}
+	}
+}
+
+// decodeEvent decodes in v the json of an event published with Notify
+func decodeEvent(t *testing.T, msg string, v interface{}) {
+	t.Helper()
+	if !strings.HasPrefix(msg, "INFO: ") {
+		t.Fatalf("event %q without the INFO: prefix", msg)
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(msg, "INFO: ")), v); err != nil {
+		t.Fatalf("unmarshal event %q: %s", msg, err)
+	}
+}
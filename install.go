@@ -144,10 +144,10 @@ func registerDeviceViaMQTT(config Config) {
 	certKeyPath := filepath.Join(config.CertPath, "certificate.key")
 
 	fmt.Println("Check successful MQTT connection")
-	client, err := setupMQTTConnection(certPemPath, certKeyPath, config.ID, config.URL, nil)
+	client, err := setupMQTTConnection(certPemPath, certKeyPath, config, nil)
 	check(err, "ConnectMQTT")
 
-	err = registerDevice(client, config.ID)
+	err = registerDevice(client, config.thingTopic())
 	check(err, "RegisterDevice")
 
 	client.Disconnect(100)
@@ -381,7 +381,7 @@ func createService(config Config, configFile, listenFile string) (service.Servic
 }
 
 // registerDevice publishes on the topic /register with info about the device itself
-func registerDevice(client mqtt.Client, id string) error {
+func registerDevice(client mqtt.Client, thingTopic string) error {
 	// get host
 	host, err := os.Hostname()
 	if err != nil {
@@ -407,7 +407,7 @@ func registerDevice(client mqtt.Client, id string) error {
 		return err
 	}
 
-	if token := client.Publish("$aws/things/"+id+"/register", 1, false, msg); token.Wait() && token.Error() != nil {
+	if token := client.Publish(thingTopic+"/register", 1, false, msg); token.Wait() && token.Error() != nil {
 		return err
 	}
 
@@ -374,7 +374,7 @@ func isDockerInstalled() (bool, error) {
 }
 
 func TestInstallDocker(t *testing.T) {
-	checkAndInstallDocker()
+	checkAndInstallDocker(Config{})
 	installed, err := isDockerInstalled()
 	assert.True(t, err == nil)
 	assert.True(t, installed)
@@ -388,7 +388,7 @@ func isNetManagerInstalled() bool {
 
 func TestInstallNetworkManager(t *testing.T) {
 	assert.False(t, isNetManagerInstalled())
-	checkAndInstallNetworkManager()
+	checkAndInstallNetworkManager(Config{})
 	defer func() {
 		c := exec.Command("bash", "-c", "apt-get remove -y network-manager")
 		_, err := c.CombinedOutput()
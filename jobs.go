@@ -0,0 +1,551 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2020  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// categories of the jobs, each one with its own limit of running jobs
+const (
+	jobsPackages   = "packages"
+	jobsContainers = "containers"
+	jobsSketches   = "sketches"
+	jobsUpdate     = "update"
+	jobsLogs       = "logs"
+)
+
+// states of a job
+const (
+	jobQueued     = "queued"
+	jobRunning    = "running"
+	jobCancelling = "cancelling"
+	jobSucceeded  = "succeeded"
+	jobFailed     = "failed"
+	jobCancelled  = "cancelled"
+)
+
+// defaultJobHistory is the number of finished jobs kept when the
+// configuration doesn't say it
+const defaultJobHistory = 100
+
+// maxJobLogLines is the number of lines of log kept for every job, the
+// oldest ones are dropped
+const maxJobLogLines = 500
+
+var jobsBucket = []byte("jobs")
+
+// errJobCancelled is the error of the jobs interrupted by /jobs/cancel
+var errJobCancelled = errors.New("cancelled")
+
+// errJobInterrupted is the error of the jobs found running at startup
+var errJobInterrupted = errors.New("interrupted by a restart of the connector")
+
+// Job is a long running operation of the device (a package upgrade, a sketch
+// upload...) that runs in background. The jobs of a category wait in queue
+// while too many of them are running.
+type Job struct {
+	ID         string          `json:"id"`
+	Category   string          `json:"category"`
+	Operation  string          `json:"operation"`
+	Target     string          `json:"target,omitempty"`
+	State      string          `json:"state"`
+	Action     string          `json:"action,omitempty"`
+	Percent    float64         `json:"percent"`
+	Log        []string        `json:"log,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+	StartedAt  *time.Time      `json:"started_at,omitempty"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+
+	run    JobFunc
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	result interface{}
+	err    error
+}
+
+// finished tells if the job has ended, whatever the outcome
+func (j *Job) finished() bool {
+	return j.State != jobQueued && j.State != jobRunning && j.State != jobCancelling
+}
+
+// copy returns a copy of the job that can be marshalled while the job goes on
+func (j *Job) copy() Job {
+	res := *j
+	res.Log = append([]string(nil), j.Log...)
+	return res
+}
+
+// JobFunc is the work of a job. It reports its progress through job and must
+// return as soon as possible when ctx is cancelled. The result is the reply
+// to the command that started the job.
+type JobFunc func(ctx context.Context, job *JobHandle) (interface{}, error)
+
+// JobHandle lets a running job report its progress. A nil handle discards
+// everything, so that the operations can also run outside of a job.
+type JobHandle struct {
+	manager *JobManager
+	job     *Job
+}
+
+// ID returns the id of the job
+func (h *JobHandle) ID() string {
+	if h == nil {
+		return ""
+	}
+	return h.job.ID
+}
+
+// Log appends a line to the log of the job
+func (h *JobHandle) Log(line string) {
+	if h == nil {
+		return
+	}
+	h.manager.lock.Lock()
+	defer h.manager.lock.Unlock()
+	h.job.Log = append(h.job.Log, line)
+	if len(h.job.Log) > maxJobLogLines {
+		h.job.Log = h.job.Log[len(h.job.Log)-maxJobLogLines:]
+	}
+}
+
+// Progress updates what the job is doing and its percentage of completion
+func (h *JobHandle) Progress(action string, percent float64) {
+	if h == nil {
+		return
+	}
+	h.manager.lock.Lock()
+	defer h.manager.lock.Unlock()
+	h.job.Action = action
+	h.job.Percent = percent
+}
+
+// JobManager runs the jobs, at most limits[category] at a time for every
+// category, and keeps the history of the last finished ones in a bolt file.
+// It's safe for concurrent use.
+type JobManager struct {
+	limits  map[string]int
+	history int
+	jobs    map[string]*Job
+	queue   []*Job
+	running map[string]int
+	db      *bolt.DB
+	lock    sync.Mutex
+	dbLock  sync.Mutex // serializes the writes of the history file
+}
+
+func newJobManager(limits map[string]int, history int) *JobManager {
+	if history <= 0 {
+		history = defaultJobHistory
+	}
+	return &JobManager{
+		limits:  limits,
+		history: history,
+		jobs:    map[string]*Job{},
+		running: map[string]int{},
+	}
+}
+
+func newJobID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic(err) // the system is out of entropy, nothing would work anyway
+	}
+	return hex.EncodeToString(id)
+}
+
+// open loads the history of the jobs from the given file, then saves there
+// every change. The jobs that were queued or running when the connector
+// stopped are marked as failed.
+func (m *JobManager) open(path string) error {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return errors.Wrapf(err, "open jobs db %s", path)
+	}
+
+	var interrupted []string
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, errBucket := tx.CreateBucketIfNotExists(jobsBucket)
+		if errBucket != nil {
+			return errBucket
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			job := &Job{done: make(chan struct{})}
+			if errJSON := json.Unmarshal(v, job); errJSON != nil {
+				return errors.Wrapf(errJSON, "unmarshal job %s", k)
+			}
+			close(job.done)
+			if !job.finished() {
+				now := time.Now()
+				job.State = jobFailed
+				job.Error = errJobInterrupted.Error()
+				job.FinishedAt = &now
+				interrupted = append(interrupted, job.ID)
+			}
+			job.err = errors.New(job.Error)
+			if job.State == jobSucceeded {
+				job.err = nil
+			}
+			m.jobs[job.ID] = job
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	m.dbLock.Lock()
+	m.lock.Lock()
+	m.db = db
+	removed := m.prune()
+	m.lock.Unlock()
+	m.dbLock.Unlock()
+	m.save(interrupted...)
+	m.delete(removed...)
+	return nil
+}
+
+// Close releases the history file
+func (m *JobManager) Close() error {
+	m.dbLock.Lock()
+	defer m.dbLock.Unlock()
+	if m.db == nil {
+		return nil
+	}
+	err := m.db.Close()
+	m.db = nil
+	return err
+}
+
+// save writes the current state of the jobs in the history file, if it's
+// open. Taking the copies while holding dbLock the last write of a job is
+// always its latest state.
+func (m *JobManager) save(ids ...string) {
+	m.dbLock.Lock()
+	defer m.dbLock.Unlock()
+	if m.db == nil || len(ids) == 0 {
+		return
+	}
+	var jobs []Job
+	m.lock.Lock()
+	for _, id := range ids {
+		if job, ok := m.jobs[id]; ok {
+			jobs = append(jobs, job.copy())
+		}
+	}
+	m.lock.Unlock()
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		for _, job := range jobs {
+			data, err := json.Marshal(job)
+			if err != nil {
+				return err
+			}
+			if err = tx.Bucket(jobsBucket).Put([]byte(job.ID), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Println("Saving the jobs:", err)
+	}
+}
+
+// delete removes the jobs from the history file, if it's open
+func (m *JobManager) delete(ids ...string) {
+	m.dbLock.Lock()
+	defer m.dbLock.Unlock()
+	if m.db == nil || len(ids) == 0 {
+		return
+	}
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		for _, id := range ids {
+			if err := tx.Bucket(jobsBucket).Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Println("Removing old jobs:", err)
+	}
+}
+
+// prune forgets the oldest finished jobs beyond the size of the history and
+// returns their ids. It must be called holding the lock.
+func (m *JobManager) prune() []string {
+	var finished []*Job
+	for _, job := range m.jobs {
+		if job.finished() {
+			finished = append(finished, job)
+		}
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].CreatedAt.Before(finished[j].CreatedAt) })
+	var removed []string
+	for i := 0; i < len(finished)-m.history; i++ {
+		delete(m.jobs, finished[i].ID)
+		removed = append(removed, finished[i].ID)
+	}
+	return removed
+}
+
+// limit returns how many jobs of the category can run at the same time
+func (m *JobManager) limit(category string) int {
+	if limit := m.limits[category]; limit > 0 {
+		return limit
+	}
+	return 1
+}
+
+// Start queues a new job, it runs as soon as the limit of its category allows
+func (m *JobManager) Start(category, operation, target string, run JobFunc) *Job {
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{
+		ID:        newJobID(),
+		Category:  category,
+		Operation: operation,
+		Target:    target,
+		State:     jobQueued,
+		CreatedAt: time.Now(),
+		run:       run,
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	m.lock.Lock()
+	m.jobs[job.ID] = job
+	m.queue = append(m.queue, job)
+	m.lock.Unlock()
+	m.save(job.ID)
+
+	m.schedule()
+	return job
+}
+
+// schedule starts the queued jobs that can run, in order of arrival
+func (m *JobManager) schedule() {
+	m.lock.Lock()
+	var started []string
+	queue := m.queue[:0]
+	for _, job := range m.queue {
+		if m.running[job.Category] >= m.limit(job.Category) {
+			queue = append(queue, job)
+			continue
+		}
+		m.running[job.Category]++
+		now := time.Now()
+		job.State = jobRunning
+		job.StartedAt = &now
+		started = append(started, job.ID)
+		go m.execute(job)
+	}
+	m.queue = queue
+	m.lock.Unlock()
+	m.save(started...)
+}
+
+// execute runs a job and records its outcome
+func (m *JobManager) execute(job *Job) {
+	result, err := job.run(job.ctx, &JobHandle{manager: m, job: job})
+
+	m.lock.Lock()
+	m.running[job.Category]--
+	now := time.Now()
+	job.FinishedAt = &now
+	job.result, job.err = result, err
+	switch {
+	case err == nil:
+		job.State = jobSucceeded
+		job.Percent = 100
+		if result != nil {
+			job.Result, _ = json.Marshal(result)
+		}
+	case job.ctx.Err() != nil:
+		job.State = jobCancelled
+		job.err = errJobCancelled
+		job.Error = errJobCancelled.Error()
+	default:
+		job.State = jobFailed
+		job.Error = err.Error()
+	}
+	job.cancel()
+	removed := m.prune()
+	m.lock.Unlock()
+
+	m.save(job.ID)
+	m.delete(removed...)
+	close(job.done)
+	m.schedule()
+}
+
+// Wait waits for the end of the job and returns its result
+func (m *JobManager) Wait(job *Job) (interface{}, error) {
+	<-job.done
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return job.result, job.err
+}
+
+// Get returns a copy of the job with the given id
+func (m *JobManager) Get(id string) (*Job, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil, notFound(errors.Errorf("job %s not found", id))
+	}
+	res := job.copy()
+	return &res, nil
+}
+
+// Snapshot returns a copy of the job
+func (m *JobManager) Snapshot(job *Job) Job {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return job.copy()
+}
+
+// List returns the jobs of a category (all if it's empty), from the oldest
+// to the newest, without their logs and results
+func (m *JobManager) List(category string) []Job {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	jobs := []Job{}
+	for _, job := range m.jobs {
+		if category != "" && job.Category != category {
+			continue
+		}
+		res := *job
+		res.Log, res.Result = nil, nil
+		jobs = append(jobs, res)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.Before(jobs[j].CreatedAt) })
+	return jobs
+}
+
+// Cancel removes a queued job from the queue, or interrupts a running one
+// without waiting for it to stop: the job is cancelling until it ends, and
+// its end is reported like the one of any other job
+func (m *JobManager) Cancel(id string) (*Job, error) {
+	m.lock.Lock()
+	job, ok := m.jobs[id]
+	if !ok {
+		m.lock.Unlock()
+		return nil, notFound(errors.Errorf("job %s not found", id))
+	}
+	switch job.State {
+	case jobQueued:
+		for i, queued := range m.queue {
+			if queued == job {
+				m.queue = append(m.queue[:i], m.queue[i+1:]...)
+				break
+			}
+		}
+		now := time.Now()
+		job.State = jobCancelled
+		job.FinishedAt = &now
+		job.err = errJobCancelled
+		job.Error = errJobCancelled.Error()
+		job.cancel()
+		close(job.done)
+		removed := m.prune()
+		m.lock.Unlock()
+		m.save(id)
+		m.delete(removed...)
+	case jobRunning:
+		job.State = jobCancelling
+		job.cancel()
+		m.lock.Unlock()
+		m.save(id)
+	default:
+		state := job.State
+		m.lock.Unlock()
+		return nil, badRequest(errors.Errorf("job %s is already %s", id, state))
+	}
+	return m.Get(id)
+}
+
+// pendingReply is the response of a command that replies when its job ends:
+// the transports wait for it without blocking the other commands
+type pendingReply struct {
+	wait func() (interface{}, error)
+}
+
+// JobRequest are the parameters of /jobs/get and /jobs/cancel
+type JobRequest struct {
+	ID string `json:"id"`
+}
+
+// JobListRequest are the parameters of /jobs/list
+type JobListRequest struct {
+	Category string `json:"category"`
+}
+
+// startJob starts a job keeping the root filesystem writable while it runs,
+// like the commands that require it
+func (s *Status) startJob(category, operation, target string, run JobFunc) *Job {
+	return s.jobs.Start(category, operation, target, func(ctx context.Context, job *JobHandle) (interface{}, error) {
+		s.acquireWritableFs()
+		defer s.releaseWritableFs()
+		return run(ctx, job)
+	})
+}
+
+// jobResponse is the response of a command that started a job: the job
+// itself if the request says "async": true, otherwise the result of the job
+// once it ends
+func (s *Status) jobResponse(req Request, job *Job) (interface{}, error) {
+	var params struct {
+		Async bool `json:"async"`
+	}
+	if len(req.Payload) > 0 {
+		_ = json.Unmarshal(req.Payload, &params)
+	}
+	if params.Async {
+		res := s.jobs.Snapshot(job)
+		return &res, nil
+	}
+	return &pendingReply{wait: func() (interface{}, error) {
+		return s.jobs.Wait(job)
+	}}, nil
+}
+
+// openJobHistory opens the history of the jobs in the data folder
+func (s *Status) openJobHistory() error {
+	folder, err := getDataFolder(s.config)
+	if err != nil {
+		return err
+	}
+	return s.jobs.open(filepath.Join(folder, "jobs.db"))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingJob returns a job that runs until release is closed or it's cancelled
+func blockingJob(started chan<- string, release <-chan struct{}) JobFunc {
+	return func(ctx context.Context, job *JobHandle) (interface{}, error) {
+		started <- job.ID()
+		select {
+		case <-release:
+			job.Log("done")
+			return "result of " + job.ID(), nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func TestJobManagerLimits(t *testing.T) {
+	m := newJobManager(map[string]int{jobsContainers: 2}, 10)
+	started := make(chan string, 10)
+	release := make(chan struct{})
+
+	first := m.Start(jobsContainers, "run", "a", blockingJob(started, release))
+	second := m.Start(jobsContainers, "run", "b", blockingJob(started, release))
+	third := m.Start(jobsContainers, "run", "c", blockingJob(started, release))
+	packages := m.Start(jobsPackages, "install", "vim", blockingJob(started, release))
+	<-started
+	<-started
+	<-started
+
+	jobs := m.List("")
+	if assert.Len(t, jobs, 4) {
+		assert.Equal(t, []string{first.ID, second.ID, third.ID, packages.ID}, []string{jobs[0].ID, jobs[1].ID, jobs[2].ID, jobs[3].ID})
+		assert.Equal(t, []string{jobRunning, jobRunning, jobQueued, jobRunning}, []string{jobs[0].State, jobs[1].State, jobs[2].State, jobs[3].State})
+	}
+	assert.Len(t, m.List(jobsPackages), 1)
+
+	cancelling, err := m.Cancel(first.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, jobCancelling, cancelling.State)
+	_, err = m.Cancel(first.ID)
+	assert.EqualError(t, err, "job "+first.ID+" is already cancelling")
+	_, err = m.Wait(first)
+	assert.Equal(t, errJobCancelled, err)
+	cancelled, err := m.Get(first.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, jobCancelled, cancelled.State)
+	assert.Equal(t, "cancelled", cancelled.Error)
+	assert.Equal(t, third.ID, <-started)
+
+	close(release)
+	res, err := m.Wait(third)
+	assert.NoError(t, err)
+	assert.Equal(t, "result of "+third.ID, res)
+	job, err := m.Get(third.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, jobSucceeded, job.State)
+	assert.Equal(t, []string{"done"}, job.Log)
+	assert.Equal(t, `"result of `+third.ID+`"`, string(job.Result))
+
+	_, err = m.Cancel(third.ID)
+	assert.EqualError(t, err, "job "+third.ID+" is already succeeded")
+	_, err = m.Get("missing")
+	assert.Equal(t, errorNotFound, errorKind(err))
+}
+
+func TestJobManagerCancelQueued(t *testing.T) {
+	m := newJobManager(nil, 10)
+	started := make(chan string, 10)
+	release := make(chan struct{})
+	defer close(release)
+
+	m.Start(jobsUpdate, "update", "", blockingJob(started, release))
+	queued := m.Start(jobsUpdate, "update", "", blockingJob(started, release))
+	<-started
+
+	job, err := m.Cancel(queued.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, jobCancelled, job.State)
+	assert.Nil(t, job.StartedAt)
+}
+
+func TestJobManagerHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobs")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jobs.db")
+
+	m := newJobManager(nil, 2)
+	assert.NoError(t, m.open(path))
+	for i := 0; i < 3; i++ {
+		_, _ = m.Wait(m.Start(jobsSketches, "upload", "sketch", func(ctx context.Context, job *JobHandle) (interface{}, error) {
+			return nil, errors.New("download failed")
+		}))
+	}
+	started := make(chan string, 1)
+	running := m.Start(jobsSketches, "upload", "sketch", blockingJob(started, nil))
+	<-started
+	assert.NoError(t, m.Close())
+	defer m.Cancel(running.ID)
+
+	restarted := newJobManager(nil, 2)
+	assert.NoError(t, restarted.open(path))
+	defer restarted.Close()
+	jobs := restarted.List("")
+	if assert.Len(t, jobs, 2) {
+		assert.Equal(t, jobFailed, jobs[0].State)
+		assert.Equal(t, "download failed", jobs[0].Error)
+		assert.Equal(t, running.ID, jobs[1].ID)
+		assert.Equal(t, jobFailed, jobs[1].State)
+		assert.Equal(t, errJobInterrupted.Error(), jobs[1].Error)
+	}
+}
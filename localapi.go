@@ -0,0 +1,196 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2020  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	localAPIPrefix = "/api/v1"
+
+	// maximum size of the body of a request to the local API
+	maxLocalAPIBody = 1 << 20
+)
+
+// mqttOnlyCommands can't be used through the local API: the sessions they
+// open exchange their data on MQTT topics
+var mqttOnlyCommands = map[string]bool{
+	"/containers/exec": true,
+}
+
+// LocalAPI exposes the commands of the router as a REST API on the LAN,
+// so that the device can be managed without the cloud.
+// Each command is mapped to a path: eg. a POST on /api/v1/apt/list
+// with the same json payload is handled like a message on {{id}}/apt/list/post,
+// and the reply is returned as the response.
+type LocalAPI struct {
+	status *Status
+}
+
+// newLocalAPI prepares the local API, it requires either a token or
+// a client CA to authenticate the requests, and TLS unless it's reachable
+// only from the device itself
+func newLocalAPI(status *Status) (*LocalAPI, error) {
+	config := status.config
+	if config.LocalAPIToken == "" && config.LocalAPIClientCA == "" {
+		return nil, errors.New("the local API requires local_api_token or local_api_client_ca")
+	}
+	if config.LocalAPIClientCA != "" && (config.LocalAPICert == "" || config.LocalAPIKey == "") {
+		return nil, errors.New("local_api_client_ca requires local_api_cert and local_api_key")
+	}
+	// the token and the commands must not cross the LAN in cleartext
+	if config.LocalAPICert == "" && !isLoopbackAddress(config.LocalAPIAddress) {
+		return nil, errors.New("the local API requires local_api_cert and local_api_key unless it listens on a loopback address")
+	}
+
+	return &LocalAPI{status: status}, nil
+}
+
+// isLoopbackAddress tells if a host:port address is reachable only from
+// the device itself
+func isLoopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// ListenAndServe serves the API on the configured address, over TLS if a
+// certificate is configured
+func (a *LocalAPI) ListenAndServe() error {
+	config := a.status.config
+	server := &http.Server{
+		Addr:        config.LocalAPIAddress,
+		Handler:     a,
+		ReadTimeout: 30 * time.Second,
+	}
+	if config.LocalAPICert == "" {
+		return server.ListenAndServe()
+	}
+
+	server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	if config.LocalAPIClientCA != "" {
+		ca, err := ioutil.ReadFile(config.LocalAPIClientCA)
+		if err != nil {
+			return errors.Wrap(err, "read client CA")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return errors.New("no certificates found in " + config.LocalAPIClientCA)
+		}
+		server.TLSConfig.ClientCAs = pool
+		server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return server.ListenAndServeTLS(config.LocalAPICert, config.LocalAPIKey)
+}
+
+// authorized checks the token of the request, client certificates are
+// already verified by the TLS handshake
+func (a *LocalAPI) authorized(r *http.Request) bool {
+	config := a.status.config
+	if config.LocalAPIClientCA != "" && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+		return false
+	}
+	if config.LocalAPIToken == "" {
+		return true
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(config.LocalAPIToken)) == 1
+}
+
+func (a *LocalAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		writeReply(w, http.StatusUnauthorized, newReply("", "", errors.New("unauthorized")))
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, localAPIPrefix+"/") {
+		writeReply(w, http.StatusNotFound, newReply("", "", errors.New("unknown command "+r.URL.Path)))
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeReply(w, http.StatusMethodNotAllowed, newReply("", "", errors.New("use POST")))
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxLocalAPIBody))
+	if err != nil {
+		writeReply(w, http.StatusBadRequest, newReply("", "", errors.Wrap(err, "read request")))
+		return
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		body = []byte("{}")
+	}
+
+	req := Request{
+		ID:      requestID(body),
+		Command: strings.TrimPrefix(r.URL.Path, localAPIPrefix),
+		Payload: body,
+	}
+	if mqttOnlyCommands[req.Command] {
+		writeReply(w, http.StatusBadRequest, newReply(req.ID, "", errors.New(req.Command+" is only available over MQTT")))
+		return
+	}
+	resp, err := a.status.router.Dispatch(req)
+	if pending, ok := resp.(*pendingReply); ok && err == nil {
+		resp, err = pending.wait()
+	}
+	var msg string
+	if err == nil {
+		msg, err = formatResponse(resp)
+	}
+
+	code := http.StatusOK
+	switch {
+	case err == nil:
+	case errorKind(err) == errorBadRequest:
+		code = http.StatusBadRequest
+	case errorKind(err) == errorNotFound:
+		code = http.StatusNotFound
+	default:
+		code = http.StatusInternalServerError
+	}
+	writeReply(w, code, newReply(req.ID, msg, err))
+}
+
+func writeReply(w http.ResponseWriter, code int, reply Reply) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(reply); err != nil {
+		fmt.Println("local API:", err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func localAPIRequest(t *testing.T, server *httptest.Server, method, path, token, body string) (int, Reply) {
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	assert.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	var reply Reply
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&reply))
+	return resp.StatusCode, reply
+}
+
+func TestLocalAPI(t *testing.T) {
+	client := newRecordingMqttClient()
+	status := NewStatus(Config{LocalAPIAddress: "127.0.0.1:8443", LocalAPIToken: "secret"}, client, nil, "test")
+	status.Set("sketch1", &SketchStatus{ID: "sketch1", Name: "blink", Status: "STOPPED"})
+
+	api, err := newLocalAPI(status)
+	assert.NoError(t, err)
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	code, reply := localAPIRequest(t, server, "POST", "/api/v1/status", "secret", `{"request_id": "abc"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "abc", reply.RequestID)
+	var snapshot StatusSnapshot
+	assert.NoError(t, json.Unmarshal(reply.Data, &snapshot))
+	assert.Equal(t, "blink", snapshot.Sketches["sketch1"].Name)
+	// the reply is not sent to the cloud
+	assert.Empty(t, client.Published("test/status")[1:])
+
+	code, reply = localAPIRequest(t, server, "POST", "/api/v1/sketch", "secret", `{"id": "missing", "action": "START"}`)
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, "error", reply.Status)
+	assert.Equal(t, "sketch missing not found", reply.Error)
+
+	code, _ = localAPIRequest(t, server, "POST", "/api/v1/status", "wrong", "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = localAPIRequest(t, server, "POST", "/api/v1/nothing", "secret", "")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = localAPIRequest(t, server, "GET", "/api/v1/status", "secret", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+	code, reply = localAPIRequest(t, server, "POST", "/api/v1/containers/exec", "secret", `{"id": "web"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "/containers/exec is only available over MQTT", reply.Error)
+	code, reply = localAPIRequest(t, server, "POST", "/api/v1/sketch", "secret", "[1, 2]")
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, reply.Error, "Unmarshal")
+}
+
+func TestLocalAPIAuthConfig(t *testing.T) {
+	_, err := newLocalAPI(NewStatus(Config{}, nil, nil, ""))
+	assert.Error(t, err)
+	_, err = newLocalAPI(NewStatus(Config{LocalAPIClientCA: "ca.pem"}, nil, nil, ""))
+	assert.Error(t, err)
+
+	// plain HTTP only on loopback
+	_, err = newLocalAPI(NewStatus(Config{LocalAPIAddress: "0.0.0.0:8443", LocalAPIToken: "secret"}, nil, nil, ""))
+	assert.Error(t, err)
+	_, err = newLocalAPI(NewStatus(Config{LocalAPIAddress: ":8443", LocalAPIToken: "secret"}, nil, nil, ""))
+	assert.Error(t, err)
+	_, err = newLocalAPI(NewStatus(Config{LocalAPIAddress: "localhost:8443", LocalAPIToken: "secret"}, nil, nil, ""))
+	assert.NoError(t, err)
+	_, err = newLocalAPI(NewStatus(Config{LocalAPIAddress: "[::1]:8443", LocalAPIToken: "secret"}, nil, nil, ""))
+	assert.NoError(t, err)
+	_, err = newLocalAPI(NewStatus(Config{LocalAPIAddress: "0.0.0.0:8443", LocalAPIToken: "secret", LocalAPICert: "cert.pem", LocalAPIKey: "key.pem"}, nil, nil, ""))
+	assert.NoError(t, err)
+
+	api, err := newLocalAPI(NewStatus(Config{LocalAPIClientCA: "ca.pem", LocalAPICert: "cert.pem", LocalAPIKey: "key.pem"}, nil, nil, ""))
+	assert.NoError(t, err)
+	req := httptest.NewRequest("POST", "/api/v1/status", nil)
+	assert.False(t, api.authorized(req))
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+	assert.True(t, api.authorized(req))
+}
@@ -19,6 +19,7 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io/ioutil"
@@ -30,6 +31,7 @@ import (
 	"strings"
 	"time"
 
+	net "github.com/arduino/go-system-stats/network"
 	docker "github.com/docker/docker/client"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/fsnotify/fsnotify"
@@ -44,6 +46,9 @@ import (
 
 const (
 	defaultConfigFile = "/etc/arduino-connector/arduino-connector.cfg"
+
+	// maximum delay between two attempts to connect to the cloud in local mode
+	maxMQTTReconnectDelay = 5 * time.Minute
 )
 
 var (
@@ -53,21 +58,54 @@ var (
 
 // Config holds the configuration needed by the application
 type Config struct {
-	ID            string
-	URL           string
-	HTTPProxy     string
-	HTTPSProxy    string
-	ALLProxy      string
-	AuthURL       string
-	AuthClientID  string
-	APIURL        string
-	updateURL     string
-	appName       string
-	CertPath      string
-	SketchesPath  string
-	CheckRoFs     bool
-	SignatureKey  string
-	EnvVarsToLoad string
+	ID             string
+	URL            string
+	HTTPProxy      string
+	HTTPSProxy     string
+	ALLProxy       string
+	AuthURL        string
+	AuthClientID   string
+	APIURL         string
+	updateURL      string
+	appName        string
+	CertPath       string
+	SketchesPath   string
+	CheckRoFs      bool
+	SignatureKey   string
+	EnvVarsToLoad  string
+	BrokerScheme   string
+	BrokerPort     int
+	TopicRoot      string
+	LegacyReplies  bool
+	AptRoot        string
+	PackageBackend string
+
+	StdoutRate       float64
+	StdoutBurst      int
+	ShadowRate       float64
+	ShadowBurst      int
+	RepliesRate      float64
+	RepliesBurst     int
+	PublishQueueSize int
+
+	OutboxSize       int
+	OutboxTTL        time.Duration
+	OutboxDropPolicy string
+
+	PackageJobs   int
+	ContainerJobs int
+	SketchJobs    int
+	LogStreams    int
+	JobHistory    int
+
+	ManifestCheckInterval time.Duration
+	ExecIdleTimeout       time.Duration
+
+	LocalAPIAddress  string
+	LocalAPIToken    string
+	LocalAPICert     string
+	LocalAPIKey      string
+	LocalAPIClientCA string
 }
 
 func (c Config) String() string {
@@ -83,9 +121,80 @@ func (c Config) String() string {
 	out += "sketches_path=" + c.SketchesPath + "\r\n"
 	out += "check_ro_fs=" + strconv.FormatBool(c.CheckRoFs) + "\r\n"
 	out += "env_vars_to_load=" + c.EnvVarsToLoad + "\r\n"
+	out += "broker_scheme=" + c.BrokerScheme + "\r\n"
+	out += "broker_port=" + strconv.Itoa(c.BrokerPort) + "\r\n"
+	out += "topic_root=" + c.TopicRoot + "\r\n"
+	out += "legacy_replies=" + strconv.FormatBool(c.LegacyReplies) + "\r\n"
+	out += "apt_root=" + c.AptRoot + "\r\n"
+	out += "package_manager=" + c.PackageBackend + "\r\n"
+	out += "stdout_rate=" + strconv.FormatFloat(c.StdoutRate, 'f', -1, 64) + "\r\n"
+	out += "stdout_burst=" + strconv.Itoa(c.StdoutBurst) + "\r\n"
+	out += "shadow_rate=" + strconv.FormatFloat(c.ShadowRate, 'f', -1, 64) + "\r\n"
+	out += "shadow_burst=" + strconv.Itoa(c.ShadowBurst) + "\r\n"
+	out += "replies_rate=" + strconv.FormatFloat(c.RepliesRate, 'f', -1, 64) + "\r\n"
+	out += "replies_burst=" + strconv.Itoa(c.RepliesBurst) + "\r\n"
+	out += "publish_queue_size=" + strconv.Itoa(c.PublishQueueSize) + "\r\n"
+	out += "outbox_size=" + strconv.Itoa(c.OutboxSize) + "\r\n"
+	out += "outbox_ttl=" + c.OutboxTTL.String() + "\r\n"
+	out += "outbox_drop_policy=" + c.OutboxDropPolicy + "\r\n"
+	out += "package_jobs=" + strconv.Itoa(c.PackageJobs) + "\r\n"
+	out += "container_jobs=" + strconv.Itoa(c.ContainerJobs) + "\r\n"
+	out += "sketch_jobs=" + strconv.Itoa(c.SketchJobs) + "\r\n"
+	out += "log_streams=" + strconv.Itoa(c.LogStreams) + "\r\n"
+	out += "job_history=" + strconv.Itoa(c.JobHistory) + "\r\n"
+	out += "manifest_check_interval=" + c.ManifestCheckInterval.String() + "\r\n"
+	out += "exec_idle_timeout=" + c.ExecIdleTimeout.String() + "\r\n"
+	out += "local_api_address=" + c.LocalAPIAddress + "\r\n"
+	out += "local_api_token=" + c.LocalAPIToken + "\r\n"
+	out += "local_api_cert=" + c.LocalAPICert + "\r\n"
+	out += "local_api_key=" + c.LocalAPIKey + "\r\n"
+	out += "local_api_client_ca=" + c.LocalAPIClientCA + "\r\n"
 	return out
 }
 
+// thingTopic returns the root of all the topics belonging to the device
+func (c Config) thingTopic() string {
+	if c.TopicRoot == "" {
+		return c.ID
+	}
+	return strings.TrimSuffix(c.TopicRoot, "/") + "/" + c.ID
+}
+
+// brokerURL returns the address of the MQTT broker built from the configured scheme, host and port
+func (c Config) brokerURL() (string, error) {
+	switch c.BrokerScheme {
+	case "tcp", "tls", "ws", "wss":
+	default:
+		return "", errors.New("unsupported broker scheme " + c.BrokerScheme)
+	}
+	return fmt.Sprintf("%s://%s:%d/mqtt", c.BrokerScheme, c.URL, c.BrokerPort), nil
+}
+
+// rateLimits returns the limits of the outbound messages for every class
+func (c Config) rateLimits() map[string]RateLimit {
+	return map[string]RateLimit{
+		classStdout:  {Rate: c.StdoutRate, Burst: c.StdoutBurst, QueueSize: c.PublishQueueSize},
+		classShadow:  {Rate: c.ShadowRate, Burst: c.ShadowBurst, QueueSize: c.PublishQueueSize},
+		classReplies: {Rate: c.RepliesRate, Burst: c.RepliesBurst, QueueSize: c.PublishQueueSize},
+	}
+}
+
+// jobLimits returns how many jobs of every category can run at the same time
+func (c Config) jobLimits() map[string]int {
+	return map[string]int{
+		jobsPackages:   c.PackageJobs,
+		jobsContainers: c.ContainerJobs,
+		jobsSketches:   c.SketchJobs,
+		jobsUpdate:     1,
+		jobsLogs:       c.LogStreams,
+	}
+}
+
+// isBrokerSecure returns true if the connection to the broker is established over TLS
+func (c Config) isBrokerSecure() bool {
+	return c.BrokerScheme == "tls" || c.BrokerScheme == "wss"
+}
+
 func main() {
 	fmt.Println("Version: " + version)
 
@@ -117,6 +226,34 @@ func main() {
 	flag.BoolVar(&debugMqtt, "debug-mqtt", false, "Output all received/sent messages")
 	flag.StringVar(&config.SignatureKey, "signature_key", "-----BEGIN PUBLIC KEY-----\nMIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEAvc0yZr1yUSen7qmE3cxF\nIE12rCksDnqR+Hp7o0nGi9123eCSFcJ7CkIRC8F+8JMhgI3zNqn4cUEn47I3RKD1\nZChPUCMiJCvbLbloxfdJrUi7gcSgUXrlKQStOKF5Iz7xv1M4XOP3JtjXLGo3EnJ1\npFgdWTOyoSrA8/w1rck4c/ISXZSinVAggPxmLwVEAAln6Itj6giIZHKvA2fL2o8z\nCeK057Lu8X6u2CG8tRWSQzVoKIQw/PKK6CNXCAy8vo4EkXudRutnEYHEJlPkVgPn\n2qP06GI+I+9zKE37iqj0k1/wFaCVXHXIvn06YrmjQw6I0dDj/60Wvi500FuRVpn9\ntwIDAQAB\n-----END PUBLIC KEY-----", "key for verifying sketch binary signature")
 	flag.StringVar(&config.EnvVarsToLoad, "env_vars_to_load", "", "List of comma-separated Environment variables to load from system before launching sketches binaries")
+	flag.StringVar(&config.BrokerScheme, "broker_scheme", "tls", "Scheme used to connect to the MQTT broker (tcp, tls, ws, wss)")
+	flag.IntVar(&config.BrokerPort, "broker_port", 8883, "Port of the MQTT broker")
+	flag.StringVar(&config.TopicRoot, "topic_root", "$aws/things", "Root of the MQTT topics, the id of the thing is appended to it")
+	flag.BoolVar(&config.LegacyReplies, "legacy_replies", false, "Reply to commands with INFO:/ERROR: prefixed strings instead of json envelopes")
+	flag.StringVar(&config.AptRoot, "apt_root", defaultAptRoot, "Folder of the apt configuration where the repositories are managed")
+	flag.StringVar(&config.PackageBackend, "package_manager", "auto", "Package manager of the system (apt, dnf, apk), auto to detect it")
+	flag.Float64Var(&config.StdoutRate, "stdout_rate", 10, "Messages per second published with the output of the sketches (0 means no limit)")
+	flag.IntVar(&config.StdoutBurst, "stdout_burst", 100, "Messages with the output of the sketches published in a burst")
+	flag.Float64Var(&config.ShadowRate, "shadow_rate", 10, "Shadow updates per second (0 means no limit)")
+	flag.IntVar(&config.ShadowBurst, "shadow_burst", 50, "Shadow updates published in a burst")
+	flag.Float64Var(&config.RepliesRate, "replies_rate", 20, "Replies to commands and status messages per second (0 means no limit)")
+	flag.IntVar(&config.RepliesBurst, "replies_burst", 100, "Replies to commands and status messages published in a burst")
+	flag.IntVar(&config.PublishQueueSize, "publish_queue_size", 1000, "Messages of each class queued while rate limited, the exceeding ones are dropped")
+	flag.IntVar(&config.OutboxSize, "outbox_size", 10000, "Messages stored on disk while the MQTT connection is down (0 disables the outbox)")
+	flag.DurationVar(&config.OutboxTTL, "outbox_ttl", 24*time.Hour, "How long a message stored while the MQTT connection is down is kept")
+	flag.StringVar(&config.OutboxDropPolicy, "outbox_drop_policy", "oldest", "Messages dropped when the outbox is full (oldest, newest)")
+	flag.IntVar(&config.PackageJobs, "package_jobs", 1, "Package manager jobs running at the same time")
+	flag.IntVar(&config.ContainerJobs, "container_jobs", 2, "Container jobs running at the same time")
+	flag.IntVar(&config.SketchJobs, "sketch_jobs", 2, "Sketch upload jobs running at the same time")
+	flag.IntVar(&config.LogStreams, "log_streams", 4, "Container logs followed at the same time")
+	flag.IntVar(&config.JobHistory, "job_history", defaultJobHistory, "Finished jobs kept in the history")
+	flag.DurationVar(&config.ManifestCheckInterval, "manifest_check_interval", time.Hour, "How often the packages are compared with the last applied manifest (0 disables the check)")
+	flag.DurationVar(&config.ExecIdleTimeout, "exec_idle_timeout", defaultExecIdleTimeout, "How long a container exec session stays open without input or output")
+	flag.StringVar(&config.LocalAPIAddress, "local_api_address", "", "Address of the local REST API (eg. 127.0.0.1:8443, non-loopback addresses require local_api_cert), empty to disable it")
+	flag.StringVar(&config.LocalAPIToken, "local_api_token", "", "Token required in the Authorization: Bearer header of the local API requests")
+	flag.StringVar(&config.LocalAPICert, "local_api_cert", "", "Certificate used to serve the local API over TLS")
+	flag.StringVar(&config.LocalAPIKey, "local_api_key", "", "Key of the certificate used to serve the local API over TLS")
+	flag.StringVar(&config.LocalAPIClientCA, "local_api_client_ca", "", "CA that signs the client certificates accepted by the local API (mTLS)")
 
 	flag.Parse()
 
@@ -180,7 +317,7 @@ func main() {
 		os.Exit(0)
 	}
 
-	go checkAndInstallDependencies()
+	go checkAndInstallDependencies(config)
 
 	err = s.Run()
 	check(err, "RunService")
@@ -224,22 +361,29 @@ func (p program) run() {
 	}
 
 	// Create global status
-	status := NewStatus(p.Config, nil, nil, "$aws/things/"+p.Config.ID)
+	status := NewStatus(p.Config, nil, nil, p.Config.thingTopic())
 	status.Update(p.Config)
+	if err = status.openOutbox(); err != nil {
+		log.Printf("Opening the outbox failed, messages published while disconnected will be lost: %v", err)
+	}
+	if err = status.openJobHistory(); err != nil {
+		log.Printf("Opening the job history failed, it will be lost on restart: %v", err)
+	}
+	if p.Config.ManifestCheckInterval > 0 {
+		go status.watchManifestDrift(p.Config.ManifestCheckInterval)
+	}
 
 	// Setup MQTT connection
 	certPemPath := filepath.Join(p.Config.CertPath, "certificate.pem")
 	certKeyPath := filepath.Join(p.Config.CertPath, "certificate.key")
-	mqttClient, err := setupMQTTConnection(certPemPath, certKeyPath, p.Config.ID, p.Config.URL, status)
+	mqttClient, err := setupMQTTConnection(certPemPath, certKeyPath, p.Config, status)
 
 	if err == nil {
 		log.Println("Connected to MQTT")
-		status.mqttClient = mqttClient
+		attachMQTTClient(mqttClient, status)
 	} else {
-		log.Printf("Connection to MQTT failed, cloud features unavailable: %v", err)
-
-		// TODO: temporary, fail if no connection is available
-		os.Exit(0)
+		log.Printf("Connection to MQTT failed, running in local mode until the cloud is reachable: %v", err)
+		go connectMQTTInBackground(certPemPath, certKeyPath, p.Config, status)
 	}
 
 	if p.listenFile != "" {
@@ -254,6 +398,18 @@ func (p program) run() {
 	}
 	status.dockerClient = cli
 
+	// Start the local API
+	if p.Config.LocalAPIAddress != "" {
+		api, errAPI := newLocalAPI(status)
+		if errAPI != nil {
+			log.Printf("Local API disabled: %v", errAPI)
+		} else {
+			go func() {
+				log.Printf("Local API stopped: %v", api.ListenAndServe())
+			}()
+		}
+	}
+
 	// Start nats-client for local server
 	nc, err := nats.Connect(nats.DefaultURL)
 	check(err, "ConnectNATS")
@@ -263,21 +419,6 @@ func (p program) run() {
 		return
 	}
 
-	// wipe the thing shadows
-	if status.mqttClient != nil {
-		mqttClient.Publish("$aws/things/"+p.Config.ID+"/shadow/delete", 1, false, "")
-	}
-
-	// start heartbeat
-	if status.mqttClient != nil {
-		newHeartbeat(func(payload string) error {
-			if !status.Info("/heartbeat", payload) {
-				return fmt.Errorf("Publish failed")
-			}
-			return nil
-		})
-	}
-
 	sketchFolder, err := getSketchFolder(status)
 	if err != nil {
 		fmt.Println(err)
@@ -289,6 +430,16 @@ func (p program) run() {
 
 	addIntelLibrariesToLdPath()
 
+	restoreSketches("/tmp/sketches", sketchFolder, status)
+	autospawnSketchIfMatchesName("sketchLoadedThroughUSB", status)
+
+	select {}
+}
+
+// restoreSketches adds the sketches of sketchFolder to the status, starts
+// the ones that were running and watches tmpFolder for sketches copied
+// there manually
+func restoreSketches(tmpFolder, sketchFolder string, status *Status) {
 	files, err := ioutil.ReadDir(sketchFolder)
 	if err == nil {
 		for _, file := range files {
@@ -301,21 +452,59 @@ func (p program) run() {
 		}
 	}
 
-	err = os.Mkdir("/tmp/sketches", 0700)
-	if err != nil {
-		return
+	// the folder is still there if the connector restarted without a reboot
+	err = os.Mkdir(tmpFolder, 0700)
+	if err == nil || os.IsExist(err) {
+		go addWatcherForManuallyAddedSketches(tmpFolder, sketchFolder, status)
+	} else {
+		fmt.Println(err)
 	}
 
-	go addWatcherForManuallyAddedSketches("/tmp/sketches", sketchFolder, status)
+	startSketchesInDesiredState(status)
+}
 
-	autospawnSketchIfMatchesName("sketchLoadedThroughUSB", status)
+// attachMQTTClient makes the status publish through a client connected to the cloud
+func attachMQTTClient(mqttClient mqtt.Client, status *Status) {
+	status.setClient(mqttClient)
+	go status.replayOutbox()
 
-	select {}
+	// wipe the thing shadows
+	mqttClient.Publish(status.topicPertinence+"/shadow/delete", 1, false, "")
+
+	// start heartbeat
+	newHeartbeat(func(payload string) error {
+		if !status.Notify("/heartbeat", payload) {
+			return fmt.Errorf("Publish failed")
+		}
+		return nil
+	})
+
+	status.Publish()
+}
+
+// connectMQTTInBackground retries to connect to the MQTT broker, waiting
+// longer and longer between the attempts, until it succeeds
+func connectMQTTInBackground(cert, key string, config Config, status *Status) {
+	delay := time.Second
+	for {
+		time.Sleep(delay)
+		mqttClient, err := setupMQTTConnection(cert, key, config, status)
+		if err == nil {
+			log.Println("Connected to MQTT, leaving local mode")
+			attachMQTTClient(mqttClient, status)
+			return
+		}
+		delay *= 2
+		if delay > maxMQTTReconnectDelay {
+			delay = maxMQTTReconnectDelay
+		}
+		log.Printf("Connection to MQTT failed, retrying in %s: %v", delay, err)
+	}
 }
 
 func autospawnSketchIfMatchesName(name string, status *Status) {
-	if status.Sketches[name] != nil {
-		err := applyAction(status.Sketches[name], "START", status)
+	if sketch, ok := status.Sketch(name); ok && status.ReadSketch(sketch).PID == 0 {
+		err := applyAction(sketch, "START", status)
 		if err != nil {
 			fmt.Println(err)
 			return
@@ -323,47 +512,390 @@ func autospawnSketchIfMatchesName(name string, status *Status) {
 	}
 }
 
-func subscribeTopics(mqttClient mqtt.Client, id string, status *Status) {
-	// Subscribe to topics endpoint
-	if status == nil {
-		return
+// newCommandRouter registers all the commands, they are received on MQTT
+// and on the local API
+func newCommandRouter(status *Status) *Router {
+	r := newRouter(status)
+
+	r.Handle("/status", false, func(req Request) (interface{}, error) {
+		return status.Snapshot(), nil
+	})
+	r.Handle("/upload", true, func(req Request) (interface{}, error) {
+		var params UploadRequest
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		job := status.startJob(jobsSketches, "upload", params.Name, func(ctx context.Context, job *JobHandle) (interface{}, error) {
+			return status.Upload(ctx, job, params)
+		})
+		return status.jobResponse(req, job)
+	})
+	r.Handle("/sketch", true, func(req Request) (interface{}, error) {
+		var params SketchRequest
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		return status.SketchAction(params)
+	})
+	r.Handle("/update", true, func(req Request) (interface{}, error) {
+		var params SelfUpdateRequest
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		job := status.startJob(jobsUpdate, "update", params.URL, func(ctx context.Context, job *JobHandle) (interface{}, error) {
+			return nil, status.SelfUpdate(ctx, job, params)
+		})
+		return status.jobResponse(req, job)
+	})
+	r.Handle("/stats", false, func(req Request) (interface{}, error) {
+		return status.Stats(), nil
+	})
+	r.Handle("/wifi", true, func(req Request) (interface{}, error) {
+		var params WiFiRequest
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		return nil, status.WiFi(params)
+	})
+	r.Handle("/ethernet", true, func(req Request) (interface{}, error) {
+		var params net.IPProxyConfig
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		return nil, status.Ethernet(params)
+	})
+
+	r.Handle("/jobs/list", false, func(req Request) (interface{}, error) {
+		var params JobListRequest
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		return status.jobs.List(params.Category), nil
+	})
+	r.Handle("/jobs/get", false, func(req Request) (interface{}, error) {
+		var params JobRequest
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		return status.jobs.Get(params.ID)
+	})
+	r.Handle("/jobs/cancel", false, func(req Request) (interface{}, error) {
+		var params JobRequest
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		return status.jobs.Cancel(params.ID)
+	})
+
+	r.Handle("/packages/get", false, func(req Request) (interface{}, error) {
+		var params AptGetRequest
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		return status.AptGet(params)
+	})
+	r.Handle("/packages/list", false, func(req Request) (interface{}, error) {
+		var params AptListRequest
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		return status.AptList(params)
+	})
+	r.Handle("/packages/install", true, func(req Request) (interface{}, error) {
+		var params AptPackagesRequest
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		return status.jobResponse(req, status.AptInstall(params, req.Command+"/progress"))
+	})
+	r.Handle("/packages/update", true, func(req Request) (interface{}, error) {
+		return status.jobResponse(req, status.AptUpdate(req.Command+"/progress"))
+	})
+	r.Handle("/packages/upgrade", true, func(req Request) (interface{}, error) {
+		var params AptPackagesRequest
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		return status.jobResponse(req, status.AptUpgrade(params, req.Command+"/progress"))
+	})
+	r.Handle("/packages/remove", true, func(req Request) (interface{}, error) {
+		var params AptPackagesRequest
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		return status.jobResponse(req, status.AptRemove(params, req.Command+"/progress"))
+	})
+	r.Handle("/packages/hold", true, func(req Request) (interface{}, error) {
+		var params AptPackagesRequest
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		return status.AptHold(params)
+	})
+	r.Handle("/packages/unhold", true, func(req Request) (interface{}, error) {
+		var params AptPackagesRequest
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		return status.AptUnhold(params)
+	})
+	r.Handle("/packages/manifest/apply", true, func(req Request) (interface{}, error) {
+		var params AptManifestRequest
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		if params.DryRun {
+			return status.AptManifestPlan(params.PackageManifest)
+		}
+		job, err := status.AptManifestApply(params.PackageManifest, req.Command+"/progress")
+		if err != nil {
+			return nil, err
+		}
+		return status.jobResponse(req, job)
+	})
+	r.Handle("/packages/manifest/get", false, func(req Request) (interface{}, error) {
+		return status.AptManifest()
+	})
+	r.Handle("/packages/manifest/check", false, func(req Request) (interface{}, error) {
+		return status.AptManifestCheck()
+	})
+	r.Handle("/packages/jobs/list", false, func(req Request) (interface{}, error) {
+		return status.PackageJobs(), nil
+	})
+	r.Handle("/packages/jobs/get", false, func(req Request) (interface{}, error) {
+		var params JobRequest
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		return status.PackageJob(params)
+	})
+	r.Handle("/packages/jobs/cancel", false, func(req Request) (interface{}, error) {
+		var params JobRequest
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		return status.CancelPackageJob(params)
+	})
+
+	r.Handle("/packages/repos/list", false, func(req Request) (interface{}, error) {
+		return status.AptRepositoryList()
+	})
+	r.Handle("/packages/repos/add", true, func(req Request) (interface{}, error) {
+		var params AptRepositoryRequest
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		if err := status.AptRepositoryAdd(params); err != nil {
+			return nil, err
+		}
+		return "OK", nil
+	})
+	r.Handle("/packages/repos/remove", true, func(req Request) (interface{}, error) {
+		var params AptRepositoryRequest
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		if err := status.AptRepositoryRemove(params); err != nil {
+			return nil, err
+		}
+		return "OK", nil
+	})
+	r.Handle("/packages/repos/edit", true, func(req Request) (interface{}, error) {
+		var params AptRepositoryEditRequest
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		if err := status.AptRepositoryEdit(params); err != nil {
+			return nil, err
+		}
+		return "OK", nil
+	})
+
+	// /apt/* are the names of the package commands from before dnf and apk
+	for _, command := range r.Commands() {
+		if strings.HasPrefix(command, "/packages/") {
+			r.Alias("/apt/"+strings.TrimPrefix(command, "/packages/"), command)
+		}
 	}
-	subscribeTopic(mqttClient, id, "/status/post", status, status.StatusEvent, false)
-	subscribeTopic(mqttClient, id, "/upload/post", status, status.UploadEvent, true)
-	subscribeTopic(mqttClient, id, "/sketch/post", status, status.SketchEvent, true)
-	subscribeTopic(mqttClient, id, "/update/post", status, status.UpdateEvent, true)
-	subscribeTopic(mqttClient, id, "/stats/post", status, status.StatsEvent, false)
-	subscribeTopic(mqttClient, id, "/wifi/post", status, status.WiFiEvent, true)
-	subscribeTopic(mqttClient, id, "/ethernet/post", status, status.EthEvent, true)
 
-	subscribeTopic(mqttClient, id, "/apt/get/post", status, status.AptGetEvent, false)
-	subscribeTopic(mqttClient, id, "/apt/list/post", status, status.AptListEvent, false)
-	subscribeTopic(mqttClient, id, "/apt/install/post", status, status.AptInstallEvent, true)
-	subscribeTopic(mqttClient, id, "/apt/update/post", status, status.AptUpdateEvent, true)
-	subscribeTopic(mqttClient, id, "/apt/upgrade/post", status, status.AptUpgradeEvent, true)
-	subscribeTopic(mqttClient, id, "/apt/remove/post", status, status.AptRemoveEvent, true)
+	// pins, keys and unattended-upgrades exist only with apt
+	r.Handle("/apt/pins/list", false, func(req Request) (interface{}, error) {
+		return status.AptPins()
+	})
+	r.Handle("/apt/pins/set", true, func(req Request) (interface{}, error) {
+		var params AptPin
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		if err := status.AptPinSet(params); err != nil {
+			return nil, err
+		}
+		return "OK", nil
+	})
+	r.Handle("/apt/pins/remove", true, func(req Request) (interface{}, error) {
+		var params AptPinRequest
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		if err := status.AptPinRemove(params); err != nil {
+			return nil, err
+		}
+		return "OK", nil
+	})
+	r.Handle("/apt/keys/list", false, func(req Request) (interface{}, error) {
+		return status.AptKeys()
+	})
+	r.Handle("/apt/keys/add", true, func(req Request) (interface{}, error) {
+		var params AptKeyAddRequest
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		return status.AptKeyAdd(params)
+	})
+	r.Handle("/apt/keys/remove", true, func(req Request) (interface{}, error) {
+		var params AptKeyRequest
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		if err := status.AptKeyRemove(params); err != nil {
+			return nil, err
+		}
+		return "OK", nil
+	})
+	r.Handle("/apt/unattended/get", false, func(req Request) (interface{}, error) {
+		return status.AptUnattendedUpgrades()
+	})
+	r.Handle("/apt/unattended/set", true, func(req Request) (interface{}, error) {
+		var params UnattendedUpgrades
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		if err := status.AptUnattendedUpgradesSet(params); err != nil {
+			return nil, err
+		}
+		return "OK", nil
+	})
 
-	subscribeTopic(mqttClient, id, "/apt/repos/list/post", status, status.AptRepositoryListEvent, false)
-	subscribeTopic(mqttClient, id, "/apt/repos/add/post", status, status.AptRepositoryAddEvent, true)
-	subscribeTopic(mqttClient, id, "/apt/repos/remove/post", status, status.AptRepositoryRemoveEvent, true)
-	subscribeTopic(mqttClient, id, "/apt/repos/edit/post", status, status.AptRepositoryEditEvent, true)
+	r.Handle("/containers/ps", false, func(req Request) (interface{}, error) {
+		var params PsPayload
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		if params.Stacks {
+			return status.ContainersStacks(params.Stack)
+		}
+		return status.ContainersPs(params)
+	})
+	r.Handle("/containers/images", false, func(req Request) (interface{}, error) {
+		var params ImagesPayload
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		return status.ContainersListImages(params)
+	})
+	r.Handle("/containers/action", true, func(req Request) (interface{}, error) {
+		var params RunPayload
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		target := params.ContainerName
+		if target == "" {
+			target = params.ContainerID
+		}
+		if target == "" {
+			target = params.ImageName
+		}
+		job := status.startJob(jobsContainers, params.Action, target, func(ctx context.Context, job *JobHandle) (interface{}, error) {
+			return status.ContainersAction(ctx, job, params, req.Command+"/progress")
+		})
+		return status.jobResponse(req, job)
+	})
+	r.Handle("/containers/prune", true, func(req Request) (interface{}, error) {
+		var params ContainersPrunePayload
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		if err := params.Validate(); err != nil {
+			return nil, badRequest(err)
+		}
+		job := status.startJob(jobsContainers, "prune", strings.Join(params.Targets, " "), func(ctx context.Context, job *JobHandle) (interface{}, error) {
+			return status.ContainersPrune(ctx, job, params)
+		})
+		return status.jobResponse(req, job)
+	})
+	r.Handle("/containers/stack/deploy", true, func(req Request) (interface{}, error) {
+		var params StackDeployRequest
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		if err := params.Validate(); err != nil {
+			return nil, badRequest(err)
+		}
+		job := status.startJob(jobsContainers, "stack deploy", params.Name, func(ctx context.Context, job *JobHandle) (interface{}, error) {
+			return status.DeployStack(ctx, job, params, req.Command+"/progress")
+		})
+		return status.jobResponse(req, job)
+	})
+	r.Handle("/containers/stack/remove", true, func(req Request) (interface{}, error) {
+		var params StackRemoveRequest
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		if !stackNamePattern.MatchString(params.Name) {
+			return nil, badRequest(fmt.Errorf("invalid stack name '%s'", params.Name))
+		}
+		job := status.startJob(jobsContainers, "stack remove", params.Name, func(ctx context.Context, job *JobHandle) (interface{}, error) {
+			return status.RemoveStack(ctx, job, params)
+		})
+		return status.jobResponse(req, job)
+	})
+	r.Handle("/containers/logs", false, func(req Request) (interface{}, error) {
+		var params ContainersLogsPayload
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		return status.ContainersLogs(params)
+	})
+	r.Handle("/containers/exec", false, func(req Request) (interface{}, error) {
+		var params ContainersExecPayload
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		return status.ContainersExec(params)
+	})
+	r.Handle("/containers/exec/list", false, func(req Request) (interface{}, error) {
+		return status.ContainersExecSessions(), nil
+	})
+	r.Handle("/containers/exec/close", false, func(req Request) (interface{}, error) {
+		var params ExecSessionRequest
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		return status.ContainersExecClose(params)
+	})
+	r.Handle("/containers/rename", true, func(req Request) (interface{}, error) {
+		var params ChangeNamePayload
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		return status.ContainersRename(params)
+	})
 
-	subscribeTopic(mqttClient, id, "/containers/ps/post", status, status.ContainersPsEvent, false)
-	subscribeTopic(mqttClient, id, "/containers/images/post", status, status.ContainersListImagesEvent, false)
-	subscribeTopic(mqttClient, id, "/containers/action/post", status, status.ContainersActionEvent, true)
-	subscribeTopic(mqttClient, id, "/containers/rename/post", status, status.ContainersRenameEvent, true)
+	return r
 }
 
-func subscribeTopic(client mqtt.Client, id, topic string, s *Status, statusHandler mqtt.MessageHandler, isWriteFsRequiredForTopic bool) {
-	handler := statusHandler
-	if s.config.CheckRoFs && isWriteFsRequiredForTopic {
-		handler = func(client mqtt.Client, msg mqtt.Message) {
-			mountRootFilesystemRw()
-			statusHandler(client, msg)
-			mountRootFilesystemRo()
-		}
+// subscribeTopics subscribes to the /post topic of every command of the router
+func subscribeTopics(mqttClient mqtt.Client, id string, status *Status) {
+	// Subscribe to topics endpoint
+	if status == nil {
+		return
+	}
+	for _, command := range status.router.Commands() {
+		subscribeTopic(mqttClient, id, command+"/post", status, mqttHandler(status, command))
 	}
+}
 
+func subscribeTopic(client mqtt.Client, id, topic string, s *Status, handler mqtt.MessageHandler) {
 	completeTopic := s.topicPertinence + topic
 	if debugMqtt {
 		debugHandler := func(client mqtt.Client, msg mqtt.Message) {
@@ -409,19 +941,52 @@ func mountRootFilesystemRo() {
 
 }
 
-func addFileToSketchDB(file os.FileInfo, status *Status) *SketchStatus {
-	id, err := getSketchIDFromDB(file.Name(), status)
-	if err != nil {
-		id = file.Name()
+// acquireWritableFs remounts the root filesystem read-write, if the connector
+// is configured to check it, until every holder has released it: commands
+// and package jobs can overlap.
+func (s *Status) acquireWritableFs() {
+	if !s.config.CheckRoFs {
+		return
+	}
+	s.writableFsLock.Lock()
+	defer s.writableFsLock.Unlock()
+	if s.writableFsHolders == 0 {
+		mountRootFilesystemRw()
 	}
-	fmt.Println("Getting sketch from " + id + " " + file.Name())
+	s.writableFsHolders++
+}
+
+// releaseWritableFs remounts the root filesystem read-only when the last
+// holder releases it
+func (s *Status) releaseWritableFs() {
+	if !s.config.CheckRoFs {
+		return
+	}
+	s.writableFsLock.Lock()
+	defer s.writableFsLock.Unlock()
+	s.writableFsHolders--
+	if s.writableFsHolders == 0 {
+		mountRootFilesystemRo()
+	}
+}
+
+func addFileToSketchDB(file os.FileInfo, status *Status) *SketchStatus {
 	s := SketchStatus{
-		ID:     id,
+		ID:     file.Name(),
 		PID:    0,
 		Name:   file.Name(),
 		Status: "STOPPED",
 	}
-	status.Set(id, &s)
+	if db, err := getSketchDB(status); err == nil {
+		if record, errFind := db.FindByName(file.Name()); errFind == nil {
+			s.ID = record.ID
+			s.RestartPolicy = record.RestartPolicy
+			s.DesiredState = record.DesiredState
+			s.environment = record.Environment
+		}
+	}
+	fmt.Println("Getting sketch from " + s.ID + " " + file.Name())
+	status.Set(s.ID, &s)
 	status.Publish()
 	return &s
 }
@@ -466,7 +1031,10 @@ func addWatcherForManuallyAddedSketches(folderOrigin, folderDest string, status
 					filename := filepath.Join(folderDest, "sketchLoadedThroughUSB")
 
 					// stop already running sketch if it exists
-					if sketch, ok := status.Sketches["sketchLoadedThroughUSB"]; ok {
+					if sketch, ok := status.Sketch("sketchLoadedThroughUSB"); ok {
+						status.UpdateSketch(sketch, func(sketch *SketchStatus) {
+							sketch.DesiredState = "STOPPED"
+						})
 						err = applyAction(sketch, "STOP", status)
 					}
 
@@ -491,6 +1059,12 @@ func addWatcherForManuallyAddedSketches(folderOrigin, folderDest string, status
 						break
 					}
 					s := addFileToSketchDB(fileInfo, status)
+					status.UpdateSketch(s, func(s *SketchStatus) {
+						s.DesiredState = "RUNNING"
+					})
+					if err = saveSketchState(s, status); err != nil {
+						log.Println(err)
+					}
 					err = applyAction(s, "START", status)
 					if err != nil {
 						fmt.Println(err)
@@ -504,7 +1078,9 @@ func addWatcherForManuallyAddedSketches(folderOrigin, folderDest string, status
 	}()
 	err = watcher.Add(folderOrigin)
 	if err != nil {
-		log.Fatal(err)
+		// the sketches can still be uploaded through the cloud
+		log.Println("Watching", folderOrigin, "failed:", err)
+		return
 	}
 	<-done
 }
@@ -518,7 +1094,7 @@ func tailAndReport(listenFile string, status *Status) {
 	}
 	for line := range t.Lines {
 		if strings.Contains(line.Text, "$$$") {
-			status.Info("/install", line.Text)
+			status.Notify("/install", line.Text)
 		}
 	}
 }
@@ -549,34 +1125,43 @@ func check(err error, context string) {
 	}
 }
 
-// setupMQTTConnection establish a connection with aws iot
-func setupMQTTConnection(cert, key, id, url string, status *Status) (mqtt.Client, error) {
-	fmt.Println("setupMQTT", cert, key, id, url)
-	// Read certificate
-	cer, err := tls.LoadX509KeyPair(cert, key)
+// setupMQTTConnection establish a connection with the configured MQTT broker
+func setupMQTTConnection(cert, key string, config Config, status *Status) (mqtt.Client, error) {
+	fmt.Println("setupMQTT", cert, key, config.ID, config.URL)
+	brokerURL, err := config.brokerURL()
 	if err != nil {
-		return nil, errors.Wrap(err, "read certificate")
+		return nil, err
 	}
 
 	// AutoReconnect option is true by default
 	// CleanSession option is true by default
 	// KeepAlive option is 30 seconds by default
 	opts := mqtt.NewClientOptions() // This line is different, we use the constructor function instead of creating the instance ourselves.
-	opts.SetClientID(id)
+	opts.SetClientID(config.ID)
 	opts.SetMaxReconnectInterval(20 * time.Second)
 	opts.SetConnectTimeout(30 * time.Second)
 	opts.SetAutoReconnect(true)
 	opts.SetOnConnectHandler(func(c mqtt.Client) {
-		subscribeTopics(c, id, status)
-	})
-	opts.SetTLSConfig(&tls.Config{
-		Certificates: []tls.Certificate{cer},
-		ServerName:   url,
+		subscribeTopics(c, config.ID, status)
+		if status != nil {
+			subscribeSketchesStdin(c, status)
+			subscribeExecSessions(c, status)
+			go status.replayOutbox()
+		}
 	})
 
-	port := 8883
-	path := "/mqtt"
-	brokerURL := fmt.Sprintf("tcps://%s:%d%s", url, port, path)
+	if config.isBrokerSecure() {
+		// Read certificate
+		cer, errCert := tls.LoadX509KeyPair(cert, key)
+		if errCert != nil {
+			return nil, errors.Wrap(errCert, "read certificate")
+		}
+		opts.SetTLSConfig(&tls.Config{
+			Certificates: []tls.Certificate{cer},
+			ServerName:   config.URL,
+		})
+	}
+
 	opts.AddBroker(brokerURL)
 
 	// mqtt.DEBUG = log.New(os.Stdout, "DEBUG: ", log.Lshortfile)
@@ -606,7 +1191,7 @@ func configureNatsdLogger(s *server.Server, opts *server.Options) {
 }
 
 // checkAndInstallDependencies wraps all the dependencies installation steps that uses apt and needs to be executed sequentially
-func checkAndInstallDependencies() {
-	checkAndInstallDocker()
-	checkAndInstallNetworkManager()
+func checkAndInstallDependencies(config Config) {
+	checkAndInstallDocker(config)
+	checkAndInstallNetworkManager(config)
 }
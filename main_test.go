@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigThingTopic(t *testing.T) {
+	c := Config{ID: "user:0002251d", TopicRoot: "$aws/things"}
+	assert.Equal(t, "$aws/things/user:0002251d", c.thingTopic())
+
+	c.TopicRoot = "fleet/devices/"
+	assert.Equal(t, "fleet/devices/user:0002251d", c.thingTopic())
+
+	c.TopicRoot = ""
+	assert.Equal(t, "user:0002251d", c.thingTopic())
+}
+
+func TestConfigBrokerURL(t *testing.T) {
+	c := Config{URL: "localhost", BrokerScheme: "tcp", BrokerPort: 1883}
+	url, err := c.brokerURL()
+	assert.NoError(t, err)
+	assert.Equal(t, "tcp://localhost:1883/mqtt", url)
+	assert.False(t, c.isBrokerSecure())
+
+	c.BrokerScheme = "wss"
+	c.BrokerPort = 443
+	url, err = c.brokerURL()
+	assert.NoError(t, err)
+	assert.Equal(t, "wss://localhost:443/mqtt", url)
+	assert.True(t, c.isBrokerSecure())
+
+	c.BrokerScheme = "tcps"
+	_, err = c.brokerURL()
+	assert.Error(t, err)
+}
+
+func TestRestoreSketchesWhenTmpFolderExists(t *testing.T) {
+	status := NewStatus(Config{SketchesPath: t.TempDir()}, nil, nil, "")
+	sketchFolder, err := getSketchFolder(status)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(sketchFolder, "blink"), []byte("#!/bin/sh\nsleep 1\n"), 0700))
+	db, err := getSketchDB(status)
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.NoError(t, db.Put(SketchRecord{ID: "0f4a2c", Name: "blink", DesiredState: "RUNNING"}))
+
+	// left behind by a previous run of the connector
+	tmpFolder := t.TempDir()
+	restoreSketches(tmpFolder, sketchFolder, status)
+
+	sketch, ok := status.Sketch("0f4a2c")
+	if assert.True(t, ok) {
+		current := status.ReadSketch(sketch)
+		assert.Equal(t, "RUNNING", current.Status)
+		assert.NotZero(t, current.PID)
+	}
+}
@@ -0,0 +1,279 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2020  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+var outboxBucket = []byte("messages")
+
+// drop policies of the outbox, applied when it's full
+const (
+	dropOldest = "oldest"
+	dropNewest = "newest"
+)
+
+// OutboxStats are the counters of the outbox, reported on /stats
+type OutboxStats struct {
+	Queued   int    `json:"queued"`
+	Stored   uint64 `json:"stored"`
+	Replayed uint64 `json:"replayed"`
+	Expired  uint64 `json:"expired"`
+	Dropped  uint64 `json:"dropped"`
+}
+
+type storedMessage struct {
+	Topic    string    `json:"topic"`
+	QoS      byte      `json:"qos"`
+	Payload  string    `json:"payload"`
+	QueuedAt time.Time `json:"queued_at"`
+}
+
+// Outbox keeps on disk the messages published while the MQTT connection is
+// down, to send them in order once it's back. It holds at most size messages,
+// each one for at most ttl.
+type Outbox struct {
+	mu         sync.Mutex
+	db         *bolt.DB
+	size       int
+	ttl        time.Duration
+	dropPolicy string
+	count      int
+	pending    bool // there are messages to be replayed before sending new ones
+	replaying  bool
+	stats      OutboxStats
+}
+
+// openOutbox opens (or creates) the outbox in the given file, keeping the
+// messages not sent before the connector was stopped
+func openOutbox(path string, size int, ttl time.Duration, dropPolicy string) (*Outbox, error) {
+	switch dropPolicy {
+	case dropOldest, dropNewest:
+	default:
+		return nil, errors.New("unknown drop policy " + dropPolicy)
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "open outbox %s", path)
+	}
+	o := &Outbox{db: db, size: size, ttl: ttl, dropPolicy: dropPolicy}
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, errBucket := tx.CreateBucketIfNotExists(outboxBucket)
+		if errBucket != nil {
+			return errBucket
+		}
+		o.count = bucket.Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	o.pending = o.count > 0
+	return o, nil
+}
+
+// Close releases the outbox file
+func (o *Outbox) Close() error {
+	return o.db.Close()
+}
+
+// Pending tells if there are messages waiting to be replayed: new messages
+// must be pushed after them to keep the order
+func (o *Outbox) Pending() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.pending
+}
+
+// Push stores a message, applying the drop policy if the outbox is full
+func (o *Outbox) Push(topic string, qos byte, payload string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.push(topic, qos, payload)
+}
+
+// PushIfPending stores a message only if older messages are waiting to be
+// replayed, it returns false if the outbox is drained and the message can
+// be sent directly. The check and the push are atomic, so a replay that
+// ends in the meantime can't leave the message behind.
+func (o *Outbox) PushIfPending(topic string, qos byte, payload string) (bool, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.pending {
+		return false, nil
+	}
+	return true, o.push(topic, qos, payload)
+}
+
+// push stores a message, o.mu must be held
+func (o *Outbox) push(topic string, qos byte, payload string) error {
+	if o.size <= 0 || (o.count >= o.size && o.dropPolicy == dropNewest) {
+		o.stats.Dropped++
+		return errMessageDropped
+	}
+
+	data, err := json.Marshal(storedMessage{Topic: topic, QoS: qos, Payload: payload, QueuedAt: time.Now()})
+	if err != nil {
+		return err
+	}
+	dropped := 0
+	err = o.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(outboxBucket)
+		c := bucket.Cursor()
+		for k, _ := c.First(); k != nil && o.count-dropped >= o.size; k, _ = c.First() {
+			if errDelete := c.Delete(); errDelete != nil {
+				return errDelete
+			}
+			dropped++
+		}
+		seq, errSeq := bucket.NextSequence()
+		if errSeq != nil {
+			return errSeq
+		}
+		return bucket.Put(outboxKey(seq), data)
+	})
+	if err != nil {
+		return errors.Wrap(err, "store message in outbox")
+	}
+	o.count += 1 - dropped
+	o.stats.Dropped += uint64(dropped)
+	o.stats.Stored++
+	o.pending = true
+	return nil
+}
+
+// first returns the oldest message, or a nil key if the outbox is empty
+func (o *Outbox) first() ([]byte, storedMessage, error) {
+	var key []byte
+	var msg storedMessage
+	err := o.db.View(func(tx *bolt.Tx) error {
+		k, v := tx.Bucket(outboxBucket).Cursor().First()
+		if k == nil {
+			return nil
+		}
+		key = append([]byte{}, k...)
+		return json.Unmarshal(v, &msg)
+	})
+	return key, msg, err
+}
+
+// remove deletes a message, if it has not been dropped in the meantime
+func (o *Outbox) remove(key []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	removed := false
+	err := o.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(outboxBucket)
+		if bucket.Get(key) == nil {
+			return nil
+		}
+		removed = true
+		return bucket.Delete(key)
+	})
+	if err == nil && removed {
+		o.count--
+	}
+	return err
+}
+
+// Replay sends the stored messages in order, respecting the given rate limit.
+// It stops at the first error, leaving the remaining messages for the next
+// replay. Only one replay runs at a time.
+func (o *Outbox) Replay(send sendFunc, limit RateLimit) {
+	o.mu.Lock()
+	if o.replaying {
+		o.mu.Unlock()
+		return
+	}
+	o.replaying = true
+	o.mu.Unlock()
+
+	defer func() {
+		o.mu.Lock()
+		o.replaying = false
+		o.mu.Unlock()
+	}()
+
+	bucket := newTokenBucket(limit.Rate, limit.Burst)
+	for {
+		o.mu.Lock()
+		key, msg, err := o.first()
+		if err == nil && key == nil {
+			// everything has been sent, new messages can be published directly
+			o.pending = false
+			o.mu.Unlock()
+			return
+		}
+		o.mu.Unlock()
+		if err != nil {
+			fmt.Println("read outbox:", err)
+			return
+		}
+
+		if o.ttl > 0 && time.Since(msg.QueuedAt) > o.ttl {
+			if err = o.remove(key); err != nil {
+				fmt.Println("remove expired message from outbox:", err)
+				return
+			}
+			o.mu.Lock()
+			o.stats.Expired++
+			o.mu.Unlock()
+			continue
+		}
+
+		for wait := bucket.reserve(time.Now()); wait > 0; wait = bucket.reserve(time.Now()) {
+			time.Sleep(wait)
+		}
+		if err = send(msg.Topic, msg.QoS, msg.Payload); err != nil {
+			fmt.Println("replay outbox:", err)
+			return
+		}
+		if err = o.remove(key); err != nil {
+			fmt.Println("remove message from outbox:", err)
+			return
+		}
+		o.mu.Lock()
+		o.stats.Replayed++
+		o.mu.Unlock()
+	}
+}
+
+// Stats returns the counters of the outbox
+func (o *Outbox) Stats() OutboxStats {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	stats := o.stats
+	stats.Queued = o.count
+	return stats
+}
+
+func outboxKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
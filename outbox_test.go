@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutboxReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "outbox.db")
+
+	o, err := openOutbox(path, 10, time.Hour, dropOldest)
+	assert.NoError(t, err)
+	assert.False(t, o.Pending())
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, o.Push("/stdout", 1, fmt.Sprint(i)))
+	}
+	assert.True(t, o.Pending())
+	assert.NoError(t, o.Close())
+
+	// the messages survive a restart
+	o, err = openOutbox(path, 10, time.Hour, dropOldest)
+	assert.NoError(t, err)
+	defer o.Close()
+	assert.True(t, o.Pending())
+
+	// a failure stops the replay, keeping the message that was not sent
+	sent := &sentMessages{}
+	fail := func(topic string, qos byte, payload string) error {
+		if payload == "1" {
+			return errors.New("disconnected")
+		}
+		return sent.send(topic, qos, payload)
+	}
+	o.Replay(fail, RateLimit{})
+	assert.Equal(t, []string{"0"}, sent.Payloads())
+	assert.True(t, o.Pending())
+
+	pushed, err := o.PushIfPending("/stdout", 1, "3")
+	assert.NoError(t, err)
+	assert.True(t, pushed)
+
+	o.Replay(sent.send, RateLimit{})
+	assert.Equal(t, []string{"0", "1", "2", "3"}, sent.Payloads())
+	assert.False(t, o.Pending())
+
+	// once drained, new messages are sent directly
+	pushed, err = o.PushIfPending("/stdout", 1, "4")
+	assert.NoError(t, err)
+	assert.False(t, pushed)
+	stats := o.Stats()
+	assert.Equal(t, 0, stats.Queued)
+	assert.Equal(t, uint64(4), stats.Replayed)
+}
+
+func TestOutboxDropPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	oldest, err := openOutbox(filepath.Join(dir, "oldest.db"), 2, time.Hour, dropOldest)
+	assert.NoError(t, err)
+	defer oldest.Close()
+	newest, err := openOutbox(filepath.Join(dir, "newest.db"), 2, time.Hour, dropNewest)
+	assert.NoError(t, err)
+	defer newest.Close()
+
+	for _, payload := range []string{"a", "b", "c"} {
+		assert.NoError(t, oldest.Push("/heartbeat", 1, payload))
+		err = newest.Push("/heartbeat", 1, payload)
+	}
+	assert.Equal(t, errMessageDropped, err)
+
+	sent := &sentMessages{}
+	oldest.Replay(sent.send, RateLimit{})
+	assert.Equal(t, []string{"b", "c"}, sent.Payloads())
+	assert.Equal(t, uint64(1), oldest.Stats().Dropped)
+
+	sent = &sentMessages{}
+	newest.Replay(sent.send, RateLimit{})
+	assert.Equal(t, []string{"a", "b"}, sent.Payloads())
+	assert.Equal(t, uint64(1), newest.Stats().Dropped)
+
+	_, err = openOutbox(filepath.Join(dir, "other.db"), 2, time.Hour, "random")
+	assert.Error(t, err)
+}
+
+func TestOutboxTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	o, err := openOutbox(filepath.Join(dir, "outbox.db"), 10, 50*time.Millisecond, dropOldest)
+	assert.NoError(t, err)
+	defer o.Close()
+
+	assert.NoError(t, o.Push("/heartbeat", 1, "old"))
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, o.Push("/heartbeat", 1, "new"))
+
+	sent := &sentMessages{}
+	o.Replay(sent.send, RateLimit{})
+	assert.Equal(t, []string{"new"}, sent.Payloads())
+	assert.Equal(t, uint64(1), o.Stats().Expired)
+}
+
+func TestStatusStoresMessagesWhileDisconnected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	client := newRecordingMqttClient()
+	config := Config{SketchesPath: dir, OutboxSize: 10, OutboxTTL: time.Hour, OutboxDropPolicy: dropOldest}
+	status := NewStatus(config, client, nil, "test")
+	assert.NoError(t, status.openOutbox())
+	defer status.outbox.Close()
+
+	status.Raw("/stdout", "before")
+	client.SetOffline(true)
+	status.Raw("/stdout", "while disconnected")
+	assert.Equal(t, []string{"before"}, client.Published("test/stdout"))
+
+	client.SetOffline(false)
+	status.replayOutbox()
+	status.Raw("/stdout", "after")
+	assert.Equal(t, []string{"before", "while disconnected", "after"}, client.Published("test/stdout"))
+}
+
+func TestStatusLocalMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := Config{SketchesPath: dir, OutboxSize: 10, OutboxTTL: time.Hour, OutboxDropPolicy: dropOldest}
+	status := NewStatus(config, nil, nil, "test")
+	assert.NoError(t, status.openOutbox())
+	defer status.outbox.Close()
+
+	// without a client the messages wait in the outbox
+	assert.True(t, status.Info("/sketch/exited", "", "crashed"))
+	assert.Equal(t, 1, status.outbox.Stats().Queued)
+
+	client := newRecordingMqttClient()
+	status.setClient(client)
+	status.replayOutbox()
+	assert.Len(t, client.Published("test/sketch/exited"), 1)
+	assert.False(t, status.outbox.Pending())
+}
@@ -0,0 +1,250 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2020  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/arduino/arduino-connector/packaging"
+	apt "github.com/arduino/go-apt-client"
+)
+
+// PackageManager installs and upgrades the packages of the system and
+// manages the repositories they come from. The commands return the output
+// of the underlying tool, also when they fail; while they run the output is
+// sent line by line to progress, which can be nil. They are interrupted when
+// ctx is cancelled.
+//
+// Packages and repositories are described with the types of go-apt-client
+// whatever the backend: Status is installed, not-installed, config-files or
+// upgradable, and each backend maps its repository definitions to the fields
+// of apt.Repository. A package passed to Install, Upgrade or Remove with a
+// Version is pinned to that exact version.
+type PackageManager interface {
+	Name() string
+
+	Search(pattern string) ([]*apt.Package, error)
+	ListUpgradable() ([]*apt.Package, error)
+	CheckForUpdates(ctx context.Context, progress packaging.ProgressFunc) ([]byte, error)
+	Install(ctx context.Context, progress packaging.ProgressFunc, packs ...*apt.Package) ([]byte, error)
+	Upgrade(ctx context.Context, progress packaging.ProgressFunc, packs ...*apt.Package) ([]byte, error)
+	UpgradeAll(ctx context.Context, progress packaging.ProgressFunc) ([]byte, error)
+	Remove(ctx context.Context, progress packaging.ProgressFunc, packs ...*apt.Package) ([]byte, error)
+
+	// Versions returns the versions of a package available in the
+	// repositories or installed, like apt-cache policy
+	Versions(name string) ([]packaging.PackageVersion, error)
+
+	// Hold keeps the packages at their installed version, Upgrade and
+	// UpgradeAll leave them alone until Unhold
+	Hold(packs ...*apt.Package) ([]byte, error)
+	Unhold(packs ...*apt.Package) ([]byte, error)
+	Held() ([]string, error)
+
+	Repositories() (apt.RepositoryList, error)
+	AddRepository(repo *apt.Repository) error
+	RemoveRepository(repo *apt.Repository) error
+	EditRepository(old, new *apt.Repository) error
+}
+
+// packageManagerCommands are the executables that identify the supported
+// package managers, in order of detection
+var packageManagerCommands = []struct {
+	name    string
+	command string
+}{
+	{"apt", "apt-get"},
+	{"dnf", "dnf"},
+	{"dnf", "yum"},
+	{"apk", "apk"},
+}
+
+// newPackageManager returns the package manager of the system, as named by
+// config.PackageBackend (apt, dnf or apk) or detected if that's empty or auto
+func newPackageManager(config Config) (PackageManager, error) {
+	name, command := config.PackageBackend, ""
+	if name == "" || name == "auto" {
+		name, command = detectPackageManager()
+		if name == "" {
+			return nil, fmt.Errorf("no supported package manager found")
+		}
+	}
+
+	switch name {
+	case "apt":
+		return newAptPackageManager(config.AptRoot), nil
+	case "dnf":
+		return newDnfPackageManager(command, defaultDnfReposDir), nil
+	case "apk":
+		return newApkPackageManager(defaultApkRoot), nil
+	}
+	return nil, fmt.Errorf("unknown package manager %s", name)
+}
+
+// detectPackageManager returns the name and the executable of the first
+// package manager found in the PATH
+func detectPackageManager() (string, string) {
+	for _, pm := range packageManagerCommands {
+		if _, err := exec.LookPath(pm.command); err == nil {
+			return pm.name, pm.command
+		}
+	}
+	return "", ""
+}
+
+// packageNames returns the names of the packages, checking they are not empty
+func packageNames(packs []*apt.Package) ([]string, error) {
+	names := []string{}
+	for _, pack := range packs {
+		if pack == nil || pack.Name == "" {
+			return nil, fmt.Errorf("invalid package with empty name")
+		}
+		names = append(names, pack.Name)
+	}
+	return names, nil
+}
+
+// packageSpecs returns the names of the packages as the package manager
+// takes them on the command line: followed by sep and the version for the
+// packages pinned to a version
+func packageSpecs(packs []*apt.Package, sep string) ([]string, error) {
+	names, err := packageNames(packs)
+	if err != nil {
+		return nil, err
+	}
+	for i, pack := range packs {
+		if pack.Version != "" {
+			names[i] += sep + pack.Version
+		}
+	}
+	return names, nil
+}
+
+// hasVersions tells if any of the packages is pinned to a version
+func hasVersions(packs []*apt.Package) bool {
+	for _, pack := range packs {
+		if pack != nil && pack.Version != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// sortPackages sorts the packages by name
+func sortPackages(packs []*apt.Package) {
+	sort.Slice(packs, func(i, j int) bool { return packs[i].Name < packs[j].Name })
+}
+
+// statusParser parses a line that a package manager writes on its status
+// file descriptor, returning the action and the percentage of completion
+type statusParser func(line string) (string, float64, bool)
+
+// runPackageCommand runs a package manager command, sending its output to
+// progress line by line. If parseStatus is set the command gets a pipe as
+// file descriptor 3, the lines written there update the percentage. The
+// command is interrupted when ctx is cancelled, and killed if it doesn't
+// exit within 10 seconds.
+func runPackageCommand(ctx context.Context, progress packaging.ProgressFunc, parseStatus statusParser, name string, args ...string) ([]byte, error) {
+	if progress == nil {
+		progress = func(string, string, float64) {}
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer outR.Close()
+	cmd := exec.Command(name, args...)
+	cmd.Stdout, cmd.Stderr = outW, outW
+
+	var statusR, statusW *os.File
+	if parseStatus != nil {
+		if statusR, statusW, err = os.Pipe(); err != nil {
+			outW.Close()
+			return nil, err
+		}
+		defer statusR.Close()
+		cmd.ExtraFiles = []*os.File{statusW}
+	}
+	err = cmd.Start()
+	outW.Close()
+	if statusW != nil {
+		statusW.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	exited := make(chan struct{})
+	defer close(exited)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = cmd.Process.Signal(os.Interrupt)
+			select {
+			case <-exited:
+			case <-time.After(10 * time.Second):
+				_ = cmd.Process.Kill()
+			}
+		case <-exited:
+		}
+	}()
+
+	var lock sync.Mutex
+	action, percent := "", 0.0
+	var wg sync.WaitGroup
+	if parseStatus != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			scanner := bufio.NewScanner(statusR)
+			for scanner.Scan() {
+				if a, p, ok := parseStatus(scanner.Text()); ok {
+					lock.Lock()
+					action, percent = a, p
+					progress("", action, percent)
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(outR)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		out.WriteString(scanner.Text() + "\n")
+		lock.Lock()
+		progress(scanner.Text(), action, percent)
+		lock.Unlock()
+	}
+	wg.Wait()
+	err = cmd.Wait()
+	if ctx.Err() != nil {
+		return out.Bytes(), ctx.Err()
+	}
+	return out.Bytes(), err
+}
@@ -0,0 +1,296 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2020  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/arduino/arduino-connector/packaging"
+	apt "github.com/arduino/go-apt-client"
+)
+
+const defaultApkRoot = "/etc/apk"
+
+// apkPackageManager is the PackageManager of Alpine. A repository is a line
+// of the repositories file in root, "[#][@Options ]URI": commented lines
+// are disabled repositories and Options holds the tag of tagged ones.
+type apkPackageManager struct {
+	root string
+}
+
+func newApkPackageManager(root string) *apkPackageManager {
+	return &apkPackageManager{root: root}
+}
+
+func (m *apkPackageManager) Name() string {
+	return "apk"
+}
+
+// apk runs an apk command, reporting its progress through --progress-fd
+func (m *apkPackageManager) apk(ctx context.Context, progress packaging.ProgressFunc, args ...string) ([]byte, error) {
+	return runPackageCommand(ctx, progress, parseApkProgress, "apk", append([]string{"--progress-fd", "3"}, args...)...)
+}
+
+// apkPackages runs an apk command on a set of packages, given as
+// name=version when pinned to a version
+func (m *apkPackageManager) apkPackages(ctx context.Context, progress packaging.ProgressFunc, args []string, packs []*apt.Package) ([]byte, error) {
+	names, err := packageSpecs(packs, "=")
+	if err != nil {
+		return nil, err
+	}
+	return m.apk(ctx, progress, append(args, names...)...)
+}
+
+// parseApkProgress parses the lines of --progress-fd, eg. "120/480"
+func parseApkProgress(line string) (string, float64, bool) {
+	var done, total float64
+	if _, err := fmt.Sscanf(line, "%g/%g", &done, &total); err != nil || total <= 0 {
+		return "", 0, false
+	}
+	return "", done * 100 / total, true
+}
+
+func (m *apkPackageManager) Search(pattern string) ([]*apt.Package, error) {
+	out, err := exec.Command("apk", "list", pattern).Output()
+	if err != nil {
+		return nil, fmt.Errorf("running apk list: %s", err)
+	}
+	res := parseApkList(out)
+	sortPackages(res)
+	return res, nil
+}
+
+func (m *apkPackageManager) ListUpgradable() ([]*apt.Package, error) {
+	out, err := exec.Command("apk", "list", "--upgradable").Output()
+	if err != nil {
+		return nil, fmt.Errorf("running apk list: %s", err)
+	}
+	res := parseApkList(out)
+	for _, pack := range res {
+		pack.Status = "upgradable"
+	}
+	sortPackages(res)
+	return res, nil
+}
+
+func (m *apkPackageManager) CheckForUpdates(ctx context.Context, progress packaging.ProgressFunc) ([]byte, error) {
+	return m.apk(ctx, progress, "update")
+}
+
+func (m *apkPackageManager) Install(ctx context.Context, progress packaging.ProgressFunc, packs ...*apt.Package) ([]byte, error) {
+	return m.apkPackages(ctx, progress, []string{"add"}, packs)
+}
+
+func (m *apkPackageManager) Upgrade(ctx context.Context, progress packaging.ProgressFunc, packs ...*apt.Package) ([]byte, error) {
+	return m.apkPackages(ctx, progress, []string{"add", "--upgrade"}, packs)
+}
+
+func (m *apkPackageManager) UpgradeAll(ctx context.Context, progress packaging.ProgressFunc) ([]byte, error) {
+	return m.apk(ctx, progress, "upgrade")
+}
+
+func (m *apkPackageManager) Remove(ctx context.Context, progress packaging.ProgressFunc, packs ...*apt.Package) ([]byte, error) {
+	return m.apkPackages(ctx, progress, []string{"del"}, packs)
+}
+
+func (m *apkPackageManager) Versions(name string) ([]packaging.PackageVersion, error) {
+	out, err := exec.Command("apk", "policy", name).Output()
+	if err != nil {
+		return nil, fmt.Errorf("running apk policy: %s", err)
+	}
+	return parseApkPolicy(out), nil
+}
+
+// parseApkPolicy parses the output of apk policy, eg.
+//
+//	docker policy:
+//	  19.03.5-r0:
+//	    lib/apk/db/installed
+//	    http://dl-cdn.alpinelinux.org/alpine/v3.11/community
+//	  20.10.0-r0:
+//	    http://dl-cdn.alpinelinux.org/alpine/edge/community
+//
+// The versions are sorted, the last one is the candidate.
+func parseApkPolicy(out []byte) []packaging.PackageVersion {
+	res := []packaging.PackageVersion{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "    ") && len(res) > 0:
+			last := &res[len(res)-1]
+			if origin := strings.TrimSpace(line); origin == "lib/apk/db/installed" {
+				last.Installed = true
+			} else {
+				last.Origins = append(last.Origins, origin)
+			}
+		case strings.HasPrefix(line, "  ") && strings.HasSuffix(line, ":"):
+			res = append(res, packaging.PackageVersion{Version: strings.TrimSuffix(strings.TrimSpace(line), ":"), Origins: []string{}})
+		}
+	}
+	if len(res) > 0 {
+		res[len(res)-1].Candidate = true
+	}
+	return res
+}
+
+// eg. "busybox-1.36.1-r5 x86_64 {busybox} (GPL-2.0-only) [installed]"
+var apkListLine = regexp.MustCompile(`^(\S+)-(\d\S*-r\d+) (\S+) \{[^}]*\} \([^)]*\)( \[([^\]]*)\])?`)
+
+// parseApkList parses the output of apk list
+func parseApkList(out []byte) []*apt.Package {
+	res := []*apt.Package{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		matches := apkListLine.FindStringSubmatch(scanner.Text())
+		if matches == nil {
+			continue
+		}
+		status := "not-installed"
+		if matches[5] == "installed" || strings.HasPrefix(matches[5], "upgradable from") {
+			status = "installed"
+		}
+		res = append(res, &apt.Package{
+			Name:         matches[1],
+			Version:      matches[2],
+			Architecture: matches[3],
+			Status:       status,
+		})
+	}
+	return res
+}
+
+// readRepos parses the repositories file, returning the repositories and
+// the line of each one
+func (m *apkPackageManager) readRepos() (apt.RepositoryList, []int, []string, error) {
+	file := filepath.Join(m.root, "repositories")
+	data, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, nil, fmt.Errorf("Reading %s: %s", file, err)
+	}
+	lines := []string{}
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+
+	repos := apt.RepositoryList{}
+	indexes := []int{}
+	for i, line := range lines {
+		repo := &apt.Repository{Enabled: true}
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			repo.Enabled = false
+			line = strings.TrimSpace(strings.TrimPrefix(line, "#"))
+		}
+		if strings.HasPrefix(line, "@") {
+			fields := strings.Fields(line)
+			if len(fields) != 2 {
+				continue
+			}
+			repo.Options, line = fields[0], fields[1]
+		}
+		// skip the comments that are not disabled repositories
+		if strings.ContainsAny(line, " \t") || !(strings.Contains(line, "://") || strings.HasPrefix(line, "/")) {
+			continue
+		}
+		repo.URI = line
+		repos = append(repos, repo)
+		indexes = append(indexes, i)
+	}
+	return repos, indexes, lines, nil
+}
+
+// repoLine returns the line of the repositories file describing repo
+func repoLine(repo *apt.Repository) string {
+	line := repo.URI
+	if repo.Options != "" {
+		line = repo.Options + " " + line
+	}
+	if !repo.Enabled {
+		line = "#" + line
+	}
+	return line
+}
+
+// Hold is not supported: apk keeps a package at a version when it's added
+// to the world with that version, eg. "docker=19.03.5-r0"
+func (m *apkPackageManager) Hold(packs ...*apt.Package) ([]byte, error) {
+	return nil, fmt.Errorf("holding packages is not supported by apk")
+}
+
+func (m *apkPackageManager) Unhold(packs ...*apt.Package) ([]byte, error) {
+	return nil, fmt.Errorf("holding packages is not supported by apk")
+}
+
+func (m *apkPackageManager) Held() ([]string, error) {
+	return []string{}, nil
+}
+
+func (m *apkPackageManager) Repositories() (apt.RepositoryList, error) {
+	repos, _, _, err := m.readRepos()
+	return repos, err
+}
+
+func (m *apkPackageManager) AddRepository(repo *apt.Repository) error {
+	repos, _, lines, err := m.readRepos()
+	if err != nil {
+		return err
+	}
+	if repos.Contains(repo) {
+		return fmt.Errorf("The repository is already configured")
+	}
+	return writeLines(filepath.Join(m.root, "repositories"), append(lines, repoLine(repo)))
+}
+
+func (m *apkPackageManager) RemoveRepository(repo *apt.Repository) error {
+	repos, indexes, lines, err := m.readRepos()
+	if err != nil {
+		return err
+	}
+	for i, r := range repos {
+		if r.Equals(repo) {
+			lines = append(lines[:indexes[i]], lines[indexes[i]+1:]...)
+			return writeLines(filepath.Join(m.root, "repositories"), lines)
+		}
+	}
+	return fmt.Errorf("Repository already removed")
+}
+
+func (m *apkPackageManager) EditRepository(old, new *apt.Repository) error {
+	repos, indexes, lines, err := m.readRepos()
+	if err != nil {
+		return err
+	}
+	for i, r := range repos {
+		if r.Equals(old) {
+			lines[indexes[i]] = repoLine(new)
+			return writeLines(filepath.Join(m.root, "repositories"), lines)
+		}
+	}
+	return fmt.Errorf("Repository doesn't exist")
+}
@@ -0,0 +1,304 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2020  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/arduino/arduino-connector/packaging"
+	apt "github.com/arduino/go-apt-client"
+)
+
+const defaultAptRoot = "/etc/apt"
+
+// aptPackageManager is the PackageManager of Debian based systems. The
+// repositories are read from and written to the apt configuration in root,
+// which is passed to the apt tools as Dir::Etc when it's not the default one.
+type aptPackageManager struct {
+	root string
+}
+
+func newAptPackageManager(root string) *aptPackageManager {
+	if root == "" {
+		root = defaultAptRoot
+	}
+	return &aptPackageManager{root: root}
+}
+
+// withRoot prepends to the arguments of an apt command the options that
+// make it read the configuration in root
+func (m *aptPackageManager) withRoot(args ...string) []string {
+	if m.root == defaultAptRoot {
+		return args
+	}
+	return append([]string{"-o", "Dir::Etc=" + m.root}, args...)
+}
+
+// aptGet runs apt-get, reporting its progress through APT::Status-Fd
+func (m *aptPackageManager) aptGet(ctx context.Context, progress packaging.ProgressFunc, args ...string) ([]byte, error) {
+	options := m.withRoot("-o", "APT::Status-Fd=3")
+	return runPackageCommand(ctx, progress, parseAptStatus, "apt-get", append(options, args...)...)
+}
+
+// aptGetPackages runs an apt-get command on a set of packages, given as
+// name=version when pinned to a version
+func (m *aptPackageManager) aptGetPackages(ctx context.Context, progress packaging.ProgressFunc, args []string, packs []*apt.Package) ([]byte, error) {
+	names, err := packageSpecs(packs, "=")
+	if err != nil {
+		return nil, err
+	}
+	return m.aptGet(ctx, progress, append(append(args, "-y"), names...)...)
+}
+
+// parseAptStatus parses the lines of APT::Status-Fd, eg.
+// "dlstatus:1:20.5:Retrieving file 1 of 3" or "pmstatus:curl:50:Installing curl"
+func parseAptStatus(line string) (string, float64, bool) {
+	fields := strings.SplitN(line, ":", 4)
+	if len(fields) != 4 || (fields[0] != "dlstatus" && fields[0] != "pmstatus") {
+		return "", 0, false
+	}
+	percent, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return fields[3], percent, true
+}
+
+func (m *aptPackageManager) Name() string {
+	return "apt"
+}
+
+// Search runs dpkg-query, which reads the dpkg database: it doesn't
+// depend on the apt configuration, then root doesn't apply
+func (m *aptPackageManager) Search(pattern string) ([]*apt.Package, error) {
+	return apt.Search(pattern)
+}
+
+// ListUpgradable runs apt list, the candidate versions depend on the
+// repositories and the pins in root
+func (m *aptPackageManager) ListUpgradable() ([]*apt.Package, error) {
+	out, err := exec.Command("apt", m.withRoot("list", "--upgradable")...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("running apt list: %s", err)
+	}
+	return parseAptUpgradable(out), nil
+}
+
+// aptUpgradable matches a line of apt list --upgradable, eg.
+// "git/bionic-updates 1:2.17.1-1ubuntu0.5 amd64 [upgradable from: 1:2.17.1-1ubuntu0.4]"
+var aptUpgradable = regexp.MustCompile(`^([^ ]+) ([^ ]+) ([^ ]+)( \[upgradable from: [^\[\]]*\])?`)
+
+// parseAptUpgradable parses the output of apt list --upgradable, the
+// packages have the version an upgrade would install
+func parseAptUpgradable(out []byte) []*apt.Package {
+	res := []*apt.Package{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		matches := aptUpgradable.FindStringSubmatch(scanner.Text())
+		if matches == nil {
+			continue
+		}
+		res = append(res, &apt.Package{
+			// the name is followed by the suites, eg. "git/bionic-updates,bionic-security"
+			Name:         strings.Split(matches[1], "/")[0],
+			Status:       "upgradable",
+			Version:      matches[2],
+			Architecture: matches[3],
+		})
+	}
+	return res
+}
+
+func (m *aptPackageManager) CheckForUpdates(ctx context.Context, progress packaging.ProgressFunc) ([]byte, error) {
+	return m.aptGet(ctx, progress, "update", "-q")
+}
+
+// Install installs the packages, downgrading the ones pinned to a version
+// older than the installed one
+func (m *aptPackageManager) Install(ctx context.Context, progress packaging.ProgressFunc, packs ...*apt.Package) ([]byte, error) {
+	args := []string{"install"}
+	if hasVersions(packs) {
+		args = append(args, "--allow-downgrades")
+	}
+	return m.aptGetPackages(ctx, progress, args, packs)
+}
+
+// Upgrade upgrades the packages if they are installed, apt-get upgrade
+// would ignore the versions
+func (m *aptPackageManager) Upgrade(ctx context.Context, progress packaging.ProgressFunc, packs ...*apt.Package) ([]byte, error) {
+	return m.aptGetPackages(ctx, progress, []string{"install", "--only-upgrade"}, packs)
+}
+
+func (m *aptPackageManager) UpgradeAll(ctx context.Context, progress packaging.ProgressFunc) ([]byte, error) {
+	return m.aptGet(ctx, progress, "upgrade", "-y")
+}
+
+func (m *aptPackageManager) Remove(ctx context.Context, progress packaging.ProgressFunc, packs ...*apt.Package) ([]byte, error) {
+	return m.aptGetPackages(ctx, progress, []string{"remove"}, packs)
+}
+
+func (m *aptPackageManager) Versions(name string) ([]packaging.PackageVersion, error) {
+	out, err := exec.Command("apt-cache", m.withRoot("policy", name)...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("running apt-cache policy: %s", err)
+	}
+	return parseAptPolicy(out), nil
+}
+
+// parseAptPolicy parses the output of apt-cache policy for a package, eg.
+//
+//	docker-ce:
+//	  Installed: 5:19.03.13~3-0~ubuntu-bionic
+//	  Candidate: 5:20.10.0~3-0~ubuntu-bionic
+//	  Version table:
+//	     5:20.10.0~3-0~ubuntu-bionic 500
+//	        500 https://download.docker.com/linux/ubuntu bionic/stable amd64 Packages
+//	 *** 5:19.03.13~3-0~ubuntu-bionic 100
+//	        100 /var/lib/dpkg/status
+func parseAptPolicy(out []byte) []packaging.PackageVersion {
+	res := []packaging.PackageVersion{}
+	candidate := ""
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 2 && fields[0] == "Candidate:":
+			candidate = fields[1]
+		case strings.HasPrefix(line, " *** ") || (strings.HasPrefix(line, "     ") && !strings.HasPrefix(line, "      ")):
+			installed := fields[0] == "***"
+			if installed {
+				fields = fields[1:]
+			}
+			if len(fields) != 2 {
+				continue
+			}
+			priority, _ := strconv.Atoi(fields[1])
+			res = append(res, packaging.PackageVersion{
+				Version:   fields[0],
+				Installed: installed,
+				Candidate: fields[0] == candidate,
+				Priority:  priority,
+				Origins:   []string{},
+			})
+		case strings.HasPrefix(line, "        ") && len(res) > 0 && len(fields) >= 2:
+			if fields[1] == "/var/lib/dpkg/status" {
+				continue
+			}
+			last := &res[len(res)-1]
+			last.Origins = append(last.Origins, strings.Join(fields[1:], " "))
+		}
+	}
+	return res
+}
+
+func (m *aptPackageManager) aptMark(command string, packs []*apt.Package) ([]byte, error) {
+	names, err := packageNames(packs)
+	if err != nil {
+		return nil, err
+	}
+	return exec.Command("apt-mark", m.withRoot(append([]string{command}, names...)...)...).CombinedOutput()
+}
+
+func (m *aptPackageManager) Hold(packs ...*apt.Package) ([]byte, error) {
+	return m.aptMark("hold", packs)
+}
+
+func (m *aptPackageManager) Unhold(packs ...*apt.Package) ([]byte, error) {
+	return m.aptMark("unhold", packs)
+}
+
+func (m *aptPackageManager) Held() ([]string, error) {
+	out, err := exec.Command("apt-mark", m.withRoot("showhold")...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("running apt-mark showhold: %s", err)
+	}
+	held := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if name := strings.TrimSpace(scanner.Text()); name != "" {
+			held = append(held, name)
+		}
+	}
+	return held, nil
+}
+
+func (m *aptPackageManager) Repositories() (apt.RepositoryList, error) {
+	return apt.ParseAPTConfigFolder(m.root)
+}
+
+// AddRepository adds the repository to sources.list.d/managed.list. The
+// repositories with options (eg. signed-by) are written here: go-apt-client
+// doesn't put a space between the options and the uri, then it can't parse
+// the line back.
+func (m *aptPackageManager) AddRepository(repo *apt.Repository) error {
+	if strings.TrimSpace(repo.Options) == "" {
+		return apt.AddRepository(repo, m.root)
+	}
+	repos, err := m.Repositories()
+	if err != nil {
+		return fmt.Errorf("parsing APT config: %s", err)
+	}
+	if repos.Contains(repo) {
+		return fmt.Errorf("The repository is already configured")
+	}
+	managedPath := filepath.Join(m.root, "sources.list.d", "managed.list")
+	f, err := os.OpenFile(managedPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("Opening %s: %s", managedPath, err)
+	}
+	defer f.Close()
+	line := strings.Replace(repo.APTConfigLine(), "["+repo.Options+"]", "["+repo.Options+"] ", 1)
+	if _, err = f.WriteString(line + "\n"); err != nil {
+		return fmt.Errorf("Writing repo data to config file %s: %s", managedPath, err)
+	}
+	return nil
+}
+
+func (m *aptPackageManager) RemoveRepository(repo *apt.Repository) error {
+	return apt.RemoveRepository(repo, m.root)
+}
+
+// EditRepository replaces a repository, the new one is moved to
+// managed.list if it has options (see AddRepository). The old one is put
+// back if the new one can't be added.
+func (m *aptPackageManager) EditRepository(old, new *apt.Repository) error {
+	if strings.TrimSpace(new.Options) == "" {
+		return apt.EditRepository(old, new, m.root)
+	}
+	if err := apt.RemoveRepository(old, m.root); err != nil {
+		return err
+	}
+	if err := m.AddRepository(new); err != nil {
+		if errRestore := m.AddRepository(old); errRestore != nil {
+			return fmt.Errorf("%s, restoring the old repository: %s", err, errRestore)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2020  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// maxAptKeySize is the size of the largest key file that is downloaded
+const maxAptKeySize = 1024 * 1024
+
+// AptKey is an OpenPGP public key that signs the packages of a repository,
+// saved in its own file of the keyrings folder of the apt configuration.
+// Fingerprint is the fingerprint of its primary key, in upper case hex.
+type AptKey struct {
+	Fingerprint string   `json:"fingerprint"`
+	UserIDs     []string `json:"user_ids"`
+	File        string   `json:"file"`
+}
+
+// aptKeyringsDir is the folder of the keys referenced by signed-by
+func aptKeyringsDir(root string) string {
+	return filepath.Join(root, "keyrings")
+}
+
+// normalizeFingerprint removes the spaces and the 0x prefix of a
+// fingerprint, as gpg prints it, and turns it to upper case
+func normalizeFingerprint(fingerprint string) string {
+	fingerprint = strings.ToUpper(strings.Join(strings.Fields(fingerprint), ""))
+	return strings.TrimPrefix(fingerprint, "0X")
+}
+
+// dearmorKeyring returns the binary form of a keyring, which every version
+// of apt reads, decoding it if it's ASCII armored
+func dearmorKeyring(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN PGP")) {
+		return data, nil
+	}
+	block, err := armor.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(block.Body)
+}
+
+// readKeyring parses a keyring, either ASCII armored or binary
+func readKeyring(data []byte) (openpgp.EntityList, error) {
+	data, err := dearmorKeyring(data)
+	if err != nil {
+		return nil, err
+	}
+	return openpgp.ReadKeyRing(bytes.NewReader(data))
+}
+
+// newAptKey describes the key of a keyring file
+func newAptKey(entity *openpgp.Entity, file string) AptKey {
+	key := AptKey{
+		Fingerprint: fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint),
+		UserIDs:     []string{},
+		File:        file,
+	}
+	for name := range entity.Identities {
+		key.UserIDs = append(key.UserIDs, name)
+	}
+	sort.Strings(key.UserIDs)
+	return key
+}
+
+// writeAptKey saves the key in the keyrings folder of root, in binary form
+// as <fingerprint>.gpg, after checking that data holds the key with the
+// given fingerprint and no other
+func writeAptKey(root string, data []byte, fingerprint string) (*AptKey, error) {
+	fingerprint = normalizeFingerprint(fingerprint)
+	if fingerprint == "" {
+		return nil, fmt.Errorf("missing fingerprint of the key")
+	}
+	data, err := dearmorKeyring(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %s", err)
+	}
+	entities, err := readKeyring(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %s", err)
+	}
+	if len(entities) != 1 {
+		return nil, fmt.Errorf("expected a single key, found %d", len(entities))
+	}
+	key := newAptKey(entities[0], filepath.Join(aptKeyringsDir(root), fingerprint+".gpg"))
+	if key.Fingerprint != fingerprint {
+		return nil, fmt.Errorf("the fingerprint of the key is %s, not %s", key.Fingerprint, fingerprint)
+	}
+
+	if err = os.MkdirAll(aptKeyringsDir(root), 0755); err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(key.File, data, 0644); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// readAptKeys returns the keys of the keyrings folder of root
+func readAptKeys(root string) ([]AptKey, error) {
+	files, err := ioutil.ReadDir(aptKeyringsDir(root))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	keys := []AptKey{}
+	for _, file := range files {
+		ext := filepath.Ext(file.Name())
+		if file.IsDir() || (ext != ".gpg" && ext != ".asc") {
+			continue
+		}
+		path := filepath.Join(aptKeyringsDir(root), file.Name())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		entities, err := readKeyring(data)
+		if err != nil {
+			fmt.Printf("Skipping invalid keyring %s: %s\n", path, err)
+			continue
+		}
+		for _, entity := range entities {
+			keys = append(keys, newAptKey(entity, path))
+		}
+	}
+	return keys, nil
+}
+
+// errAptKeyNotFound is returned when no key of the keyrings folder has the
+// requested fingerprint
+var errAptKeyNotFound = errors.New("no key with this fingerprint")
+
+// findAptKey returns the file of the keyrings folder with the key of the
+// given fingerprint
+func findAptKey(root, fingerprint string) (*AptKey, error) {
+	keys, err := readAptKeys(root)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint = normalizeFingerprint(fingerprint)
+	for i := range keys {
+		if keys[i].Fingerprint == fingerprint {
+			return &keys[i], nil
+		}
+	}
+	return nil, errAptKeyNotFound
+}
+
+// removeAptKey removes the file with the key of the given fingerprint
+func removeAptKey(root, fingerprint string) error {
+	key, err := findAptKey(root, fingerprint)
+	if err != nil {
+		return err
+	}
+	return os.Remove(key.File)
+}
+
+// downloadAptKey downloads a key file
+func downloadAptKey(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("downloading %s: expected OK, got %s", url, resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxAptKeySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("downloading %s: %s", url, err)
+	}
+	if len(data) > maxAptKeySize {
+		return nil, fmt.Errorf("downloading %s: the key is larger than %d bytes", url, maxAptKeySize)
+	}
+	return data, nil
+}
+
+// withSignedBy sets the signed-by option of a repository, replacing the
+// one already there
+func withSignedBy(options, file string) string {
+	fields := []string{}
+	for _, option := range strings.Fields(options) {
+		if !strings.HasPrefix(option, "signed-by=") {
+			fields = append(fields, option)
+		}
+	}
+	return strings.Join(append(fields, "signed-by="+file), " ")
+}
@@ -0,0 +1,408 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2020  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// managedPinPrefix is the prefix of the files of preferences.d written by the connector
+const managedPinPrefix = "arduino-connector-"
+
+// unattendedUpgradesFile is the file of apt.conf.d where the connector
+// configures unattended-upgrades, named to be read after the others
+const unattendedUpgradesFile = "99arduino-connector-unattended-upgrades"
+
+// apt only reads the files of the .d folders with these names
+var aptConfFileName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+var invalidFileNameChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// AptPin is a stanza of apt preferences: the versions of Package that match
+// Pin (eg. "version 5:19.03.*", "release a=stable" or "origin example.com")
+// get Pin-Priority. Package can be a list of names, globs or /regexps/.
+type AptPin struct {
+	Package  string `json:"package"`
+	Pin      string `json:"pin"`
+	Priority int    `json:"priority"`
+	File     string `json:"file,omitempty"`
+	Managed  bool   `json:"managed"`
+}
+
+// Matches tells if the pin applies to the package with the given name
+func (p *AptPin) Matches(name string) bool {
+	for _, pattern := range strings.Fields(p.Package) {
+		if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+			if re, err := regexp.Compile(pattern[1 : len(pattern)-1]); err == nil && re.MatchString(name) {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the fields that the connector writes
+func (p *AptPin) Validate() error {
+	if strings.TrimSpace(p.Package) == "" {
+		return fmt.Errorf("missing package of the pin")
+	}
+	kind := strings.SplitN(p.Pin, " ", 2)[0]
+	if kind != "version" && kind != "release" && kind != "origin" {
+		return fmt.Errorf("invalid pin %q, it must start with version, release or origin", p.Pin)
+	}
+	if strings.ContainsAny(p.Package+p.Pin, "\n") {
+		return fmt.Errorf("invalid pin with a newline")
+	}
+	return nil
+}
+
+// managedPinFile returns the file of preferences.d where the connector
+// writes the pin of a package
+func managedPinFile(root, pkg string) string {
+	name := invalidFileNameChars.ReplaceAllString(pkg, "_")
+	return filepath.Join(root, "preferences.d", managedPinPrefix+name)
+}
+
+// readAptPins returns the pins of the preferences file and of preferences.d
+// in the apt configuration folder root
+func readAptPins(root string) ([]AptPin, error) {
+	files := []string{filepath.Join(root, "preferences")}
+	entries, err := ioutil.ReadDir(filepath.Join(root, "preferences.d"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !aptConfFileName.MatchString(name) || (filepath.Ext(name) != "" && filepath.Ext(name) != ".pref") {
+			continue
+		}
+		files = append(files, filepath.Join(root, "preferences.d", name))
+	}
+
+	pins := []AptPin{}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Reading %s: %s", file, err)
+		}
+		managed := strings.HasPrefix(filepath.Base(file), managedPinPrefix)
+		for _, stanza := range strings.Split(string(data), "\n\n") {
+			pin := AptPin{File: file, Managed: managed}
+			for _, line := range strings.Split(stanza, "\n") {
+				kv := strings.SplitN(line, ":", 2)
+				if len(kv) != 2 || strings.HasPrefix(line, "#") {
+					continue
+				}
+				value := strings.TrimSpace(kv[1])
+				switch strings.ToLower(strings.TrimSpace(kv[0])) {
+				case "package":
+					pin.Package = value
+				case "pin":
+					pin.Pin = value
+				case "pin-priority":
+					pin.Priority, _ = strconv.Atoi(value)
+				}
+			}
+			if pin.Package != "" && pin.Pin != "" {
+				pins = append(pins, pin)
+			}
+		}
+	}
+	return pins, nil
+}
+
+// writeAptPin writes the pin in its own file of preferences.d, replacing the
+// pin of the same packages written before
+func writeAptPin(root string, pin AptPin) error {
+	if err := os.MkdirAll(filepath.Join(root, "preferences.d"), 0755); err != nil {
+		return err
+	}
+	return writeLines(managedPinFile(root, pin.Package), []string{
+		"# Managed by arduino-connector",
+		"Package: " + pin.Package,
+		"Pin: " + pin.Pin,
+		"Pin-Priority: " + strconv.Itoa(pin.Priority),
+	})
+}
+
+// errAptPinNotFound is returned when the connector didn't write a pin of
+// the package
+var errAptPinNotFound = errors.New("no pin managed by the connector")
+
+// removeAptPin removes the pin of pkg written by the connector
+func removeAptPin(root, pkg string) error {
+	err := os.Remove(managedPinFile(root, pkg))
+	if os.IsNotExist(err) {
+		return errAptPinNotFound
+	}
+	return err
+}
+
+// UnattendedUpgrades is the configuration of the unattended-upgrades package:
+// whether it runs, the origins of the upgrades it installs, as patterns like
+// "origin=Debian,codename=${distro_codename},label=Debian-Security", and if
+// and when it reboots the system when an upgrade requires it
+type UnattendedUpgrades struct {
+	Enabled    bool     `json:"enabled"`
+	Origins    []string `json:"origins"`
+	Reboot     bool     `json:"reboot"`
+	RebootTime string   `json:"reboot_time,omitempty"`
+}
+
+var rebootTime = regexp.MustCompile(`^([01][0-9]|2[0-3]):[0-5][0-9]$|^now$`)
+
+// Validate checks the configuration before it's written
+func (u *UnattendedUpgrades) Validate() error {
+	if u.RebootTime != "" && !rebootTime.MatchString(u.RebootTime) {
+		return fmt.Errorf("invalid reboot time %q, it must be HH:MM or now", u.RebootTime)
+	}
+	for _, origin := range u.Origins {
+		if strings.ContainsAny(origin, "\"\n") {
+			return fmt.Errorf("invalid origin %q", origin)
+		}
+	}
+	return nil
+}
+
+// readUnattendedUpgrades returns the configuration of unattended-upgrades
+// that results from the files of the apt configuration folder root
+func readUnattendedUpgrades(root string) (*UnattendedUpgrades, error) {
+	conf, err := readAptConf(root)
+	if err != nil {
+		return nil, err
+	}
+	isTrue := func(key string) bool {
+		values := conf[strings.ToLower(key)]
+		if len(values) == 0 {
+			return false
+		}
+		switch strings.ToLower(values[len(values)-1]) {
+		case "1", "true", "yes", "on":
+			return true
+		}
+		return false
+	}
+	res := &UnattendedUpgrades{
+		Enabled: isTrue("APT::Periodic::Unattended-Upgrade"),
+		Origins: append([]string{}, conf["unattended-upgrade::origins-pattern"]...),
+		Reboot:  isTrue("Unattended-Upgrade::Automatic-Reboot"),
+	}
+	if times := conf["unattended-upgrade::automatic-reboot-time"]; len(times) > 0 {
+		res.RebootTime = times[len(times)-1]
+	}
+	return res, nil
+}
+
+// writeUnattendedUpgrades writes the configuration in the file of
+// apt.conf.d owned by the connector, which overrides the others
+func writeUnattendedUpgrades(root string, u UnattendedUpgrades) error {
+	flag := func(b bool) string {
+		if b {
+			return "1"
+		}
+		return "0"
+	}
+	lines := []string{
+		"// Managed by arduino-connector",
+		`APT::Periodic::Update-Package-Lists "` + flag(u.Enabled) + `";`,
+		`APT::Periodic::Unattended-Upgrade "` + flag(u.Enabled) + `";`,
+		"#clear Unattended-Upgrade::Allowed-Origins;",
+		"#clear Unattended-Upgrade::Origins-Pattern;",
+		"Unattended-Upgrade::Origins-Pattern {",
+	}
+	for _, origin := range u.Origins {
+		lines = append(lines, `	"`+origin+`";`)
+	}
+	lines = append(lines, "};", `Unattended-Upgrade::Automatic-Reboot "`+strconv.FormatBool(u.Reboot)+`";`)
+	if u.RebootTime != "" {
+		lines = append(lines, `Unattended-Upgrade::Automatic-Reboot-Time "`+u.RebootTime+`";`)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "apt.conf.d"), 0755); err != nil {
+		return err
+	}
+	return writeLines(filepath.Join(root, "apt.conf.d", unattendedUpgradesFile), lines)
+}
+
+// readAptConf parses apt.conf and the files of apt.conf.d in root, in the
+// order apt reads them. The keys are lower case, like apt they are case
+// insensitive; a scalar is a list of one value.
+func readAptConf(root string) (map[string][]string, error) {
+	files := []string{filepath.Join(root, "apt.conf")}
+	entries, err := ioutil.ReadDir(filepath.Join(root, "apt.conf.d"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	names := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !aptConfFileName.MatchString(name) || (filepath.Ext(name) != "" && filepath.Ext(name) != ".conf") {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		files = append(files, filepath.Join(root, "apt.conf.d", name))
+	}
+
+	conf := map[string][]string{}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Reading %s: %s", file, err)
+		}
+		p := &aptConfParser{tokens: tokenizeAptConf(string(data)), conf: conf}
+		p.parseBlock("")
+	}
+	return conf, nil
+}
+
+// tokenizeAptConf splits the content of an apt configuration file into
+// keys, "quoted values", the punctuation and the #clear directives
+func tokenizeAptConf(data string) []string {
+	var tokens []string
+	for i := 0; i < len(data); {
+		c := data[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case strings.HasPrefix(data[i:], "//"):
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(data[i:], "/*"):
+			end := strings.Index(data[i+2:], "*/")
+			if end < 0 {
+				return tokens
+			}
+			i += end + 4
+		case c == '#':
+			end := strings.IndexAny(data[i:], " \t\n")
+			if end < 0 {
+				end = len(data) - i
+			}
+			directive := data[i : i+end]
+			if directive == "#clear" {
+				tokens = append(tokens, directive)
+				i += end
+				continue
+			}
+			// #include and comments
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+		case c == '"':
+			end := strings.IndexByte(data[i+1:], '"')
+			if end < 0 {
+				return tokens
+			}
+			tokens = append(tokens, data[i:i+end+2])
+			i += end + 2
+		case c == '{' || c == '}' || c == ';':
+			tokens = append(tokens, string(c))
+			i++
+		default:
+			end := strings.IndexAny(data[i:], " \t\r\n{};\"")
+			if end < 0 {
+				end = len(data) - i
+			}
+			tokens = append(tokens, data[i:i+end])
+			i += end
+		}
+	}
+	return tokens
+}
+
+type aptConfParser struct {
+	tokens []string
+	conf   map[string][]string
+}
+
+func (p *aptConfParser) next() string {
+	if len(p.tokens) == 0 {
+		return ""
+	}
+	token := p.tokens[0]
+	p.tokens = p.tokens[1:]
+	return token
+}
+
+// parseBlock parses the statements of the scope named prefix, until its
+// closing brace
+func (p *aptConfParser) parseBlock(prefix string) {
+	join := func(key string) string {
+		key = strings.ToLower(strings.TrimSuffix(key, "::"))
+		if prefix == "" {
+			return key
+		}
+		return prefix + "::" + key
+	}
+	for {
+		token := p.next()
+		switch {
+		case token == "" || token == "}":
+			return
+		case token == ";":
+		case token == "#clear":
+			for key := p.next(); key != "" && key != ";"; key = p.next() {
+				cleared := join(key)
+				for k := range p.conf {
+					if k == cleared || strings.HasPrefix(k, cleared+"::") {
+						delete(p.conf, k)
+					}
+				}
+			}
+		case strings.HasPrefix(token, `"`):
+			// a value of the list named prefix
+			p.conf[prefix] = append(p.conf[prefix], strings.Trim(token, `"`))
+		default:
+			key := join(token)
+			switch value := p.next(); {
+			case value == "{":
+				p.parseBlock(key)
+			case strings.HasPrefix(value, `"`):
+				if strings.HasSuffix(token, "::") {
+					p.conf[key] = append(p.conf[key], strings.Trim(value, `"`))
+				} else {
+					p.conf[key] = []string{strings.Trim(value, `"`)}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,444 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2020  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/arduino/arduino-connector/packaging"
+	apt "github.com/arduino/go-apt-client"
+	"github.com/pkg/errors"
+)
+
+const defaultDnfReposDir = "/etc/yum.repos.d"
+
+const (
+	rpmQueryFormat  = "%{NAME}\t%{ARCH}\t%{VERSION}-%{RELEASE}\t%{SIZE}\t%{SUMMARY}\n"
+	repoQueryFormat = "%{name}\t%{arch}\t%{version}-%{release}\t%{installsize}\t%{summary}\n"
+)
+
+// dnfPackageManager is the PackageManager of Fedora and the other RPM based
+// systems, it runs dnf or yum (version 4, where yum is dnf). A repository
+// is a section of a .repo file in reposDir:
+//
+//	[Distribution]
+//	name=Comment
+//	baseurl=URI
+//	enabled=1
+//
+// the other keys of the section are kept in Options, eg. "gpgcheck=1".
+type dnfPackageManager struct {
+	command  string
+	reposDir string
+}
+
+func newDnfPackageManager(command, reposDir string) *dnfPackageManager {
+	if command == "" {
+		command = "dnf"
+	}
+	return &dnfPackageManager{command: command, reposDir: reposDir}
+}
+
+func (m *dnfPackageManager) Name() string {
+	return "dnf"
+}
+
+// dnf runs a dnf command, it doesn't report the percentage of completion
+func (m *dnfPackageManager) dnf(ctx context.Context, progress packaging.ProgressFunc, args ...string) ([]byte, error) {
+	return runPackageCommand(ctx, progress, nil, m.command, args...)
+}
+
+// dnfPackages runs a dnf command on a set of packages, given as
+// name-version when pinned to a version
+func (m *dnfPackageManager) dnfPackages(ctx context.Context, progress packaging.ProgressFunc, command string, packs []*apt.Package) ([]byte, error) {
+	names, err := packageSpecs(packs, "-")
+	if err != nil {
+		return nil, err
+	}
+	return m.dnf(ctx, progress, append([]string{command, "-y"}, names...)...)
+}
+
+func (m *dnfPackageManager) Search(pattern string) ([]*apt.Package, error) {
+	out, err := exec.Command("rpm", "-qa", "--qf", rpmQueryFormat, pattern).Output()
+	if err != nil {
+		return nil, fmt.Errorf("running rpm: %s", err)
+	}
+	res := parseRPMPackages(out, "installed")
+
+	out, err = exec.Command(m.command, "-q", "repoquery", "--qf", repoQueryFormat, pattern).Output()
+	if err != nil {
+		return nil, fmt.Errorf("running %s repoquery: %s", m.command, err)
+	}
+	found := map[string]bool{}
+	for _, pack := range res {
+		found[pack.Name] = true
+	}
+	for _, pack := range parseRPMPackages(out, "not-installed") {
+		if !found[pack.Name] {
+			found[pack.Name] = true
+			res = append(res, pack)
+		}
+	}
+	sortPackages(res)
+	return res, nil
+}
+
+func (m *dnfPackageManager) ListUpgradable() ([]*apt.Package, error) {
+	out, err := exec.Command(m.command, "-q", "repoquery", "--upgrades", "--qf", repoQueryFormat).Output()
+	if err != nil {
+		return nil, fmt.Errorf("running %s repoquery: %s", m.command, err)
+	}
+	res := parseRPMPackages(out, "upgradable")
+	sortPackages(res)
+	return res, nil
+}
+
+func (m *dnfPackageManager) CheckForUpdates(ctx context.Context, progress packaging.ProgressFunc) ([]byte, error) {
+	return m.dnf(ctx, progress, "makecache")
+}
+
+func (m *dnfPackageManager) Install(ctx context.Context, progress packaging.ProgressFunc, packs ...*apt.Package) ([]byte, error) {
+	return m.dnfPackages(ctx, progress, "install", packs)
+}
+
+func (m *dnfPackageManager) Upgrade(ctx context.Context, progress packaging.ProgressFunc, packs ...*apt.Package) ([]byte, error) {
+	return m.dnfPackages(ctx, progress, "upgrade", packs)
+}
+
+func (m *dnfPackageManager) UpgradeAll(ctx context.Context, progress packaging.ProgressFunc) ([]byte, error) {
+	return m.dnf(ctx, progress, "upgrade", "-y")
+}
+
+func (m *dnfPackageManager) Remove(ctx context.Context, progress packaging.ProgressFunc, packs ...*apt.Package) ([]byte, error) {
+	return m.dnfPackages(ctx, progress, "remove", packs)
+}
+
+func (m *dnfPackageManager) Versions(name string) ([]packaging.PackageVersion, error) {
+	out, err := exec.Command(m.command, "-q", "list", "--showduplicates", name).Output()
+	if err != nil {
+		// dnf list fails when no package matches
+		if _, ok := err.(*exec.ExitError); ok {
+			return []packaging.PackageVersion{}, nil
+		}
+		return nil, fmt.Errorf("running %s list: %s", m.command, err)
+	}
+	return parseDnfVersions(out), nil
+}
+
+// parseDnfVersions parses the output of dnf list --showduplicates, eg.
+//
+//	Installed Packages
+//	docker-ce.x86_64    3:19.03.13-3.el8    @docker-ce-stable
+//	Available Packages
+//	docker-ce.x86_64    3:19.03.13-3.el8    docker-ce-stable
+//	docker-ce.x86_64    3:20.10.0-3.el8     docker-ce-stable
+//
+// The available versions are sorted, the last one is the candidate.
+func parseDnfVersions(out []byte) []packaging.PackageVersion {
+	res := []packaging.PackageVersion{}
+	index := map[string]int{}
+	candidate := -1
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || !strings.Contains(fields[0], ".") {
+			continue
+		}
+		installed := strings.HasPrefix(fields[2], "@")
+		i, ok := index[fields[1]]
+		if !ok {
+			i = len(res)
+			index[fields[1]] = i
+			res = append(res, packaging.PackageVersion{Version: fields[1], Origins: []string{}})
+		}
+		if installed {
+			res[i].Installed = true
+			continue
+		}
+		res[i].Origins = append(res[i].Origins, fields[2])
+		candidate = i
+	}
+	if candidate >= 0 {
+		res[candidate].Candidate = true
+	} else {
+		for i := range res {
+			res[i].Candidate = res[i].Installed
+		}
+	}
+	return res
+}
+
+// errVersionLockMissing is returned when holding packages on a system
+// without the versionlock plugin, it isn't installed by default on Fedora
+var errVersionLockMissing = errors.New("the dnf versionlock plugin is not installed, install python3-dnf-plugin-versionlock to hold packages")
+
+// isVersionLockMissing tells if dnf failed because it doesn't know the
+// versionlock command
+func isVersionLockMissing(out []byte) bool {
+	return bytes.Contains(out, []byte("No such command")) || bytes.Contains(out, []byte("Unknown argument"))
+}
+
+// Hold locks the packages at their installed version through the
+// versionlock plugin
+func (m *dnfPackageManager) Hold(packs ...*apt.Package) ([]byte, error) {
+	return m.versionLock("add", packs)
+}
+
+func (m *dnfPackageManager) Unhold(packs ...*apt.Package) ([]byte, error) {
+	return m.versionLock("delete", packs)
+}
+
+func (m *dnfPackageManager) versionLock(action string, packs []*apt.Package) ([]byte, error) {
+	names, err := packageNames(packs)
+	if err != nil {
+		return nil, err
+	}
+	out, err := exec.Command(m.command, append([]string{"versionlock", action}, names...)...).CombinedOutput()
+	if err != nil && isVersionLockMissing(out) {
+		return out, errVersionLockMissing
+	}
+	return out, err
+}
+
+// Held returns the packages locked by versionlock, none if the plugin
+// isn't installed
+func (m *dnfPackageManager) Held() ([]string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(m.command, "-q", "versionlock", "list")
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if isVersionLockMissing(stderr.Bytes()) {
+			return []string{}, nil
+		}
+		return nil, fmt.Errorf("running %s versionlock: %s", m.command, err)
+	}
+	return parseVersionLocks(out), nil
+}
+
+// versionLock matches an entry of dnf versionlock list, eg.
+// "docker-ce-3:19.03.5-3.el7.*", capturing the name of the package
+var versionLock = regexp.MustCompile(`^(.+)-(\d+:)?[^-]+-[^-]+$`)
+
+// parseVersionLocks returns the names of the packages locked by versionlock
+func parseVersionLocks(out []byte) []string {
+	held := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimPrefix(strings.TrimSpace(scanner.Text()), "!")
+		if m := versionLock.FindStringSubmatch(line); m != nil {
+			held = append(held, m[1])
+		}
+	}
+	return held
+}
+
+// parseRPMPackages parses the output of rpm and repoquery in rpmQueryFormat
+func parseRPMPackages(out []byte, status string) []*apt.Package {
+	res := []*apt.Package{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 5)
+		if len(fields) < 5 {
+			continue
+		}
+		size, _ := strconv.Atoi(fields[3])
+		res = append(res, &apt.Package{
+			Name:             fields[0],
+			Architecture:     fields[1],
+			Version:          fields[2],
+			InstalledSizeKB:  size / 1024,
+			ShortDescription: fields[4],
+			Status:           status,
+		})
+	}
+	return res
+}
+
+// dnfRepo is a section of a .repo file, lines [start, end) of file
+type dnfRepo struct {
+	*apt.Repository
+	file  string
+	start int
+	end   int
+}
+
+// readRepos parses the .repo files, returning the repositories and the
+// lines of each file
+func (m *dnfPackageManager) readRepos() ([]*dnfRepo, map[string][]string, error) {
+	files, err := filepath.Glob(filepath.Join(m.reposDir, "*.repo"))
+	if err != nil {
+		return nil, nil, err
+	}
+	repos := []*dnfRepo{}
+	contents := map[string][]string{}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Reading %s: %s", file, err)
+		}
+		lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		contents[file] = lines
+
+		var current *dnfRepo
+		for i, line := range lines {
+			line = strings.TrimSpace(line)
+			if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+				if current != nil {
+					current.end = i
+				}
+				current = &dnfRepo{
+					Repository: &apt.Repository{Enabled: true, Distribution: line[1 : len(line)-1]},
+					file:       file,
+					start:      i,
+					end:        len(lines),
+				}
+				repos = append(repos, current)
+				continue
+			}
+			kv := strings.SplitN(line, "=", 2)
+			if current == nil || len(kv) != 2 || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+				continue
+			}
+			key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+			switch key {
+			case "name":
+				current.Comment = value
+			case "baseurl", "metalink", "mirrorlist":
+				if current.URI == "" {
+					current.URI = value
+				}
+			case "enabled":
+				current.Enabled = value != "0" && value != "false" && value != "no"
+			default:
+				current.Options = strings.TrimSpace(current.Options + " " + key + "=" + value)
+			}
+		}
+	}
+	return repos, contents, nil
+}
+
+// repoSection returns the lines of the section of a .repo file describing repo
+func repoSection(repo *apt.Repository) []string {
+	enabled := "0"
+	if repo.Enabled {
+		enabled = "1"
+	}
+	lines := []string{"[" + repo.Distribution + "]"}
+	if repo.Comment != "" {
+		lines = append(lines, "name="+repo.Comment)
+	}
+	if repo.URI != "" {
+		lines = append(lines, "baseurl="+repo.URI)
+	}
+	lines = append(lines, "enabled="+enabled)
+	lines = append(lines, strings.Fields(repo.Options)...)
+	return append(lines, "")
+}
+
+func findDnfRepo(repos []*dnfRepo, repo *apt.Repository) *dnfRepo {
+	for _, r := range repos {
+		if r.Equals(repo) {
+			return r
+		}
+	}
+	return nil
+}
+
+func writeLines(file string, lines []string) error {
+	content := strings.Join(lines, "\n")
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		return fmt.Errorf("Writing %s: %s", file, err)
+	}
+	return nil
+}
+
+func (m *dnfPackageManager) Repositories() (apt.RepositoryList, error) {
+	repos, _, err := m.readRepos()
+	if err != nil {
+		return nil, err
+	}
+	res := apt.RepositoryList{}
+	for _, r := range repos {
+		res = append(res, r.Repository)
+	}
+	return res, nil
+}
+
+// AddRepository adds the repository to managed.repo
+func (m *dnfPackageManager) AddRepository(repo *apt.Repository) error {
+	if repo.Distribution == "" {
+		return fmt.Errorf("missing repository id in distribution")
+	}
+	repos, contents, err := m.readRepos()
+	if err != nil {
+		return err
+	}
+	if findDnfRepo(repos, repo) != nil {
+		return fmt.Errorf("The repository is already configured")
+	}
+	managed := filepath.Join(m.reposDir, "managed.repo")
+	lines := contents[managed]
+	if len(lines) > 0 && lines[len(lines)-1] != "" {
+		lines = append(lines, "")
+	}
+	return writeLines(managed, append(lines, repoSection(repo)...))
+}
+
+func (m *dnfPackageManager) RemoveRepository(repo *apt.Repository) error {
+	repos, contents, err := m.readRepos()
+	if err != nil {
+		return err
+	}
+	r := findDnfRepo(repos, repo)
+	if r == nil {
+		return fmt.Errorf("Repository already removed")
+	}
+	lines := contents[r.file]
+	return writeLines(r.file, append(lines[:r.start:r.start], lines[r.end:]...))
+}
+
+func (m *dnfPackageManager) EditRepository(old, new *apt.Repository) error {
+	if new.Distribution == "" {
+		return fmt.Errorf("missing repository id in distribution")
+	}
+	repos, contents, err := m.readRepos()
+	if err != nil {
+		return err
+	}
+	r := findDnfRepo(repos, old)
+	if r == nil {
+		return fmt.Errorf("Repository doesn't exist")
+	}
+	lines := contents[r.file]
+	edited := append(append(lines[:r.start:r.start], repoSection(new)...), lines[r.end:]...)
+	return writeLines(r.file, edited)
+}
@@ -0,0 +1,104 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2020  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/arduino/arduino-connector/packaging"
+)
+
+// PackageJobProgress is published on the progress topic of a package job,
+// once for every line of output or change of the percentage and once at the end
+type PackageJobProgress struct {
+	ID      string  `json:"id"`
+	State   string  `json:"state"`
+	Line    string  `json:"line,omitempty"`
+	Action  string  `json:"action,omitempty"`
+	Percent float64 `json:"percent"`
+}
+
+// startPackageJob starts a job running a package manager command, its output
+// goes to the log of the job and with the percentage of completion to topic.
+// The result of the job is the output of the command, description is the
+// prefix of its error, eg. "Running installer".
+func (s *Status) startPackageJob(operation, description string, packages []string, topic string, run func(ctx context.Context, progress packaging.ProgressFunc) ([]byte, error)) *Job {
+	return s.startJob(jobsPackages, operation, strings.Join(packages, " "), func(ctx context.Context, job *JobHandle) (interface{}, error) {
+		s.publishPackageProgress(topic, PackageJobProgress{ID: job.ID(), State: jobRunning})
+		out, err := run(ctx, func(line, action string, percent float64) {
+			if line != "" {
+				job.Log(line)
+			}
+			job.Progress(action, percent)
+			s.publishPackageProgress(topic, PackageJobProgress{ID: job.ID(), State: jobRunning, Line: line, Action: action, Percent: percent})
+		})
+
+		final := PackageJobProgress{ID: job.ID(), State: jobSucceeded, Percent: 100}
+		switch {
+		case ctx.Err() != nil:
+			final = PackageJobProgress{ID: job.ID(), State: jobCancelled}
+		case err != nil:
+			final = PackageJobProgress{ID: job.ID(), State: jobFailed}
+		}
+		s.publishPackageProgress(topic, final)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s\nOutput:\n%s", description, err, out)
+		}
+		return &CommandOutput{Output: string(out), JobID: job.ID()}, nil
+	})
+}
+
+func (s *Status) publishPackageProgress(topic string, progress PackageJobProgress) {
+	if !s.canPublish() {
+		return
+	}
+	data, err := json.Marshal(progress)
+	if err != nil {
+		panic(err) // Means that something went really wrong
+	}
+	_ = s.publish(classStdout, topic, 0, string(data), coalesceNone)
+}
+
+// PackageJobs returns the jobs of the package manager
+func (s *Status) PackageJobs() []Job {
+	return s.jobs.List(jobsPackages)
+}
+
+// PackageJob returns a job of the package manager
+func (s *Status) PackageJob(params JobRequest) (*Job, error) {
+	job, err := s.jobs.Get(params.ID)
+	if err != nil {
+		return nil, err
+	}
+	if job.Category != jobsPackages {
+		return nil, notFound(fmt.Errorf("job %s not found", params.ID))
+	}
+	return job, nil
+}
+
+// CancelPackageJob interrupts a job of the package manager
+func (s *Status) CancelPackageJob(params JobRequest) (*Job, error) {
+	if _, err := s.PackageJob(params); err != nil {
+		return nil, err
+	}
+	return s.jobs.Cancel(params.ID)
+}
@@ -0,0 +1,246 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2020  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/arduino/arduino-connector/packaging"
+	apt "github.com/arduino/go-apt-client"
+)
+
+// PackageManifest is the desired state of the packages of the system: the
+// repositories that must be configured, the packages that must be installed,
+// as name or name=version, and the ones that must be absent. Repositories
+// and packages not in the manifest are left alone.
+type PackageManifest struct {
+	Repositories []*apt.Repository `json:"repositories,omitempty"`
+	Packages     []string          `json:"packages,omitempty"`
+	Absent       []string          `json:"absent,omitempty"`
+}
+
+// Validate checks that the manifest is consistent
+func (m *PackageManifest) Validate() error {
+	for _, repo := range m.Repositories {
+		if repo == nil || repo.URI == "" {
+			return fmt.Errorf("invalid repository without uri")
+		}
+	}
+	wanted := map[string]bool{}
+	for _, pack := range toPackages(m.Packages) {
+		if pack.Name == "" {
+			return fmt.Errorf("invalid package with empty name")
+		}
+		wanted[pack.Name] = true
+	}
+	for _, name := range m.Absent {
+		if name == "" {
+			return fmt.Errorf("invalid package with empty name")
+		}
+		if wanted[name] {
+			return fmt.Errorf("package %s is both wanted and absent", name)
+		}
+	}
+	return nil
+}
+
+// ManifestPlan are the changes that bring the system to the state of a
+// manifest: the repositories to add or enable, the packages to install, or
+// to change to the given version, and the packages to remove
+type ManifestPlan struct {
+	Repositories []*apt.Repository `json:"repositories"`
+	Install      []string          `json:"install"`
+	Remove       []string          `json:"remove"`
+}
+
+// Empty tells if the system is already in the state of the manifest
+func (p *ManifestPlan) Empty() bool {
+	return len(p.Repositories) == 0 && len(p.Install) == 0 && len(p.Remove) == 0
+}
+
+// Lines describes the changes of the plan, one per line
+func (p *ManifestPlan) Lines() []string {
+	if p.Empty() {
+		return []string{"Nothing to do, the system matches the manifest"}
+	}
+	lines := []string{}
+	for _, repo := range p.Repositories {
+		lines = append(lines, "Configure repository "+repo.APTConfigLine())
+	}
+	for _, pack := range p.Install {
+		lines = append(lines, "Install "+pack)
+	}
+	for _, pack := range p.Remove {
+		lines = append(lines, "Remove "+pack)
+	}
+	return lines
+}
+
+// planManifest compares the manifest with the state of the system managed
+// by pm and returns the changes needed to apply it
+func planManifest(pm PackageManager, m PackageManifest) (*ManifestPlan, error) {
+	plan := &ManifestPlan{Repositories: []*apt.Repository{}, Install: []string{}, Remove: []string{}}
+
+	repos, err := pm.Repositories()
+	if err != nil {
+		return nil, fmt.Errorf("Retrieving repositories: %s", err)
+	}
+	for _, repo := range m.Repositories {
+		if found := repos.Find(repo); found == nil || found.Enabled != repo.Enabled {
+			plan.Repositories = append(plan.Repositories, repo)
+		}
+	}
+
+	installed := func(name string) (*apt.Package, error) {
+		packs, err := pm.Search(name)
+		if err != nil {
+			return nil, fmt.Errorf("Retrieving package %s: %s", name, err)
+		}
+		for _, pack := range packs {
+			if pack.Name == name && pack.Status == "installed" {
+				return pack, nil
+			}
+		}
+		return nil, nil
+	}
+	for i, pack := range toPackages(m.Packages) {
+		current, err := installed(pack.Name)
+		if err != nil {
+			return nil, err
+		}
+		if current == nil || (pack.Version != "" && pack.Version != current.Version) {
+			plan.Install = append(plan.Install, m.Packages[i])
+		}
+	}
+	for _, name := range m.Absent {
+		current, err := installed(name)
+		if err != nil {
+			return nil, err
+		}
+		if current != nil {
+			plan.Remove = append(plan.Remove, name)
+		}
+	}
+	return plan, nil
+}
+
+// applyManifestPlan makes the changes of the plan: it configures the
+// repositories, updating the package lists if any changed, then it installs
+// and removes the packages. It returns the output of the commands.
+func applyManifestPlan(ctx context.Context, progress packaging.ProgressFunc, pm PackageManager, plan *ManifestPlan) ([]byte, error) {
+	if progress == nil {
+		progress = func(string, string, float64) {}
+	}
+	var out []byte
+	log := func(line string) {
+		out = append(out, line+"\n"...)
+		progress(line, "", 0)
+	}
+	for _, line := range plan.Lines() {
+		log(line)
+	}
+
+	if len(plan.Repositories) > 0 {
+		repos, err := pm.Repositories()
+		if err != nil {
+			return out, fmt.Errorf("Retrieving repositories: %s", err)
+		}
+		for _, repo := range plan.Repositories {
+			if found := repos.Find(repo); found != nil {
+				err = pm.EditRepository(found, repo)
+			} else {
+				err = pm.AddRepository(repo)
+			}
+			if err != nil {
+				return out, fmt.Errorf("Configuring repository '%s': %s", repo.APTConfigLine(), err)
+			}
+		}
+		res, err := pm.CheckForUpdates(ctx, progress)
+		out = append(out, res...)
+		if err != nil {
+			return out, err
+		}
+	}
+	if len(plan.Install) > 0 {
+		res, err := pm.Install(ctx, progress, toPackages(plan.Install)...)
+		out = append(out, res...)
+		if err != nil {
+			return out, err
+		}
+	}
+	if len(plan.Remove) > 0 {
+		res, err := pm.Remove(ctx, progress, toPackages(plan.Remove)...)
+		out = append(out, res...)
+		if err != nil {
+			return out, err
+		}
+	}
+	return out, nil
+}
+
+// ManifestRecord is the last manifest applied, saved in the data folder with
+// the outcome of the last check of the drift of the system from it
+type ManifestRecord struct {
+	Manifest  PackageManifest `json:"manifest"`
+	AppliedAt time.Time       `json:"applied_at"`
+	JobID     string          `json:"job_id"`
+	Error     string          `json:"error,omitempty"`
+	CheckedAt *time.Time      `json:"checked_at,omitempty"`
+	Drift     *ManifestPlan   `json:"drift,omitempty"`
+}
+
+// readManifestRecord reads the record saved in path, nil if there's none
+func readManifestRecord(path string) (*ManifestRecord, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var record ManifestRecord
+	if err = json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("Reading %s: %s", path, err)
+	}
+	return &record, nil
+}
+
+// writeManifestRecord saves the record in path, replacing it atomically
+func writeManifestRecord(path string, record *ManifestRecord) error {
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// describeDrift summarizes a drift in a line, for the logs
+func describeDrift(plan *ManifestPlan) string {
+	return strings.Join(plan.Lines(), ", ")
+}
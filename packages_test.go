@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arduino/arduino-connector/packaging"
+	apt "github.com/arduino/go-apt-client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPackageManager(t *testing.T) {
+	for _, name := range []string{"apt", "dnf", "apk"} {
+		pm, err := newPackageManager(Config{PackageBackend: name})
+		assert.NoError(t, err)
+		assert.Equal(t, name, pm.Name())
+	}
+	_, err := newPackageManager(Config{PackageBackend: "pacman"})
+	assert.EqualError(t, err, "unknown package manager pacman")
+}
+
+func TestParseRPMPackages(t *testing.T) {
+	out := "bash\tx86_64\t5.2.26-3.fc40\t8123456\tThe GNU Bourne Again shell\n\n" +
+		"malformed line\n" +
+		"vim-enhanced\tx86_64\t9.1.393-1.fc40\t4194304\tA version of the VIM editor which includes recent enhancements\n"
+	packs := parseRPMPackages([]byte(out), "installed")
+	if assert.Len(t, packs, 2) {
+		assert.Equal(t, &apt.Package{
+			Name:             "bash",
+			Status:           "installed",
+			Architecture:     "x86_64",
+			Version:          "5.2.26-3.fc40",
+			ShortDescription: "The GNU Bourne Again shell",
+			InstalledSizeKB:  7933,
+		}, packs[0])
+		assert.Equal(t, "vim-enhanced", packs[1].Name)
+	}
+}
+
+func TestParseApkList(t *testing.T) {
+	out := "busybox-1.36.1-r29 x86_64 {busybox} (GPL-2.0-only) [installed]\n" +
+		"py3-requests-2.32.3-r0 noarch {py3-requests} (Apache-2.0)\n" +
+		"musl-1.2.5-r1 x86_64 {musl} (MIT) [upgradable from: musl-1.2.5-r0]\n" +
+		"WARNING: opening /var/cache/apk: No such file or directory\n"
+	packs := parseApkList([]byte(out))
+	if assert.Len(t, packs, 3) {
+		assert.Equal(t, &apt.Package{Name: "busybox", Version: "1.36.1-r29", Architecture: "x86_64", Status: "installed"}, packs[0])
+		assert.Equal(t, &apt.Package{Name: "py3-requests", Version: "2.32.3-r0", Architecture: "noarch", Status: "not-installed"}, packs[1])
+		assert.Equal(t, &apt.Package{Name: "musl", Version: "1.2.5-r1", Architecture: "x86_64", Status: "installed"}, packs[2])
+	}
+}
+
+func TestDnfRepositories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yum.repos.d")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fedora := "[fedora]\nname=Fedora $releasever - $basearch\n" +
+		"metalink=https://mirrors.fedoraproject.org/metalink?repo=fedora-$releasever&arch=$basearch\n" +
+		"enabled=1\ngpgcheck=1\n\n" +
+		"[fedora-debuginfo]\nname=Fedora $releasever - $basearch - Debug\nenabled=0\n"
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "fedora.repo"), []byte(fedora), 0644))
+	m := newDnfPackageManager("dnf", dir)
+
+	repos, err := m.Repositories()
+	assert.NoError(t, err)
+	if assert.Len(t, repos, 2) {
+		assert.Equal(t, "fedora", repos[0].Distribution)
+		assert.Equal(t, "Fedora $releasever - $basearch", repos[0].Comment)
+		assert.Equal(t, "https://mirrors.fedoraproject.org/metalink?repo=fedora-$releasever&arch=$basearch", repos[0].URI)
+		assert.Equal(t, "gpgcheck=1", repos[0].Options)
+		assert.True(t, repos[0].Enabled)
+		assert.False(t, repos[1].Enabled)
+	}
+
+	docker := &apt.Repository{Enabled: true, Distribution: "docker-ce-stable", URI: "https://download.docker.com/linux/fedora/$releasever/$basearch/stable", Comment: "Docker CE Stable"}
+	assert.NoError(t, m.AddRepository(docker))
+	assert.Error(t, m.AddRepository(docker))
+	data, err := ioutil.ReadFile(filepath.Join(dir, "managed.repo"))
+	assert.NoError(t, err)
+	assert.Equal(t, "[docker-ce-stable]\nname=Docker CE Stable\nbaseurl=https://download.docker.com/linux/fedora/$releasever/$basearch/stable\nenabled=1\n", string(data))
+
+	debuginfo := *repos[1]
+	debuginfo.Enabled = true
+	assert.NoError(t, m.EditRepository(repos[1], &debuginfo))
+	assert.NoError(t, m.RemoveRepository(repos[0]))
+	assert.Error(t, m.RemoveRepository(repos[0]))
+	data, err = ioutil.ReadFile(filepath.Join(dir, "fedora.repo"))
+	assert.NoError(t, err)
+	assert.Equal(t, "[fedora-debuginfo]\nname=Fedora $releasever - $basearch - Debug\nenabled=1\n", string(data))
+
+	repos, err = m.Repositories()
+	assert.NoError(t, err)
+	assert.Len(t, repos, 2)
+}
+
+func TestApkRepositories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apk")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	content := "# official repositories\n" +
+		"https://dl-cdn.alpinelinux.org/alpine/v3.20/main\n" +
+		"#https://dl-cdn.alpinelinux.org/alpine/v3.20/community\n" +
+		"@edge https://dl-cdn.alpinelinux.org/alpine/edge/testing\n"
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "repositories"), []byte(content), 0644))
+	m := newApkPackageManager(dir)
+
+	repos, err := m.Repositories()
+	assert.NoError(t, err)
+	assert.Equal(t, apt.RepositoryList{
+		{Enabled: true, URI: "https://dl-cdn.alpinelinux.org/alpine/v3.20/main"},
+		{Enabled: false, URI: "https://dl-cdn.alpinelinux.org/alpine/v3.20/community"},
+		{Enabled: true, URI: "https://dl-cdn.alpinelinux.org/alpine/edge/testing", Options: "@edge"},
+	}, repos)
+
+	community := *repos[1]
+	community.Enabled = true
+	assert.NoError(t, m.EditRepository(repos[1], &community))
+	assert.NoError(t, m.RemoveRepository(repos[2]))
+	assert.Error(t, m.RemoveRepository(repos[2]))
+	assert.NoError(t, m.AddRepository(&apt.Repository{Enabled: true, URI: "/var/cache/packages"}))
+	assert.Error(t, m.AddRepository(&apt.Repository{Enabled: true, URI: "/var/cache/packages"}))
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "repositories"))
+	assert.NoError(t, err)
+	assert.Equal(t, "# official repositories\n"+
+		"https://dl-cdn.alpinelinux.org/alpine/v3.20/main\n"+
+		"https://dl-cdn.alpinelinux.org/alpine/v3.20/community\n"+
+		"/var/cache/packages\n", string(data))
+}
+
+func TestRunPackageCommand(t *testing.T) {
+	var lines []string
+	var percents []float64
+	progress := func(line, action string, percent float64) {
+		if line != "" {
+			lines = append(lines, line)
+		} else {
+			percents = append(percents, percent)
+		}
+	}
+	script := "echo 'pmstatus:curl:50:Installing curl' >&3; echo first; echo second >&2; exit 3"
+	out, err := runPackageCommand(context.Background(), progress, parseAptStatus, "sh", "-c", script)
+	assert.EqualError(t, err, "exit status 3")
+	assert.Equal(t, "first\nsecond\n", string(out))
+	assert.Equal(t, []string{"first", "second"}, lines)
+	assert.Equal(t, []float64{50}, percents)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = runPackageCommand(ctx, nil, nil, "sleep", "10")
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestParseProgress(t *testing.T) {
+	action, percent, ok := parseAptStatus("dlstatus:1:20.5:Retrieving file 1 of 3")
+	assert.True(t, ok)
+	assert.Equal(t, "Retrieving file 1 of 3", action)
+	assert.Equal(t, 20.5, percent)
+	action, percent, ok = parseAptStatus("pmstatus:vim:75:Installed vim: done")
+	assert.True(t, ok)
+	assert.Equal(t, "Installed vim: done", action)
+	assert.Equal(t, 75.0, percent)
+	_, _, ok = parseAptStatus("pmerror:vim:50:trying to overwrite file")
+	assert.False(t, ok)
+
+	_, percent, ok = parseApkProgress("3/12")
+	assert.True(t, ok)
+	assert.Equal(t, 25.0, percent)
+	_, _, ok = parseApkProgress("0/0")
+	assert.False(t, ok)
+}
+
+func TestReadAptConf(t *testing.T) {
+	root, err := ioutil.TempDir("", "apt")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+	assert.NoError(t, os.Mkdir(filepath.Join(root, "apt.conf.d"), 0755))
+	conf := `// comment
+APT {
+  Periodic {
+    Unattended-Upgrade "1"; /* inline */
+  };
+};
+Dir::Cache "/var/cache/apt";
+List { "a"; "b"; };
+List:: "c";
+`
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "apt.conf.d", "10first"), []byte(conf), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "apt.conf.d", "20second"), []byte("#clear List;\nList { \"d\"; };\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "apt.conf.d", "30ignored.bak~"), []byte("Dir::Cache \"/tmp\";\n"), 0644))
+
+	res, err := readAptConf(root)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1"}, res["apt::periodic::unattended-upgrade"])
+	assert.Equal(t, []string{"/var/cache/apt"}, res["dir::cache"])
+	assert.Equal(t, []string{"d"}, res["list"])
+}
+
+func TestAptWithRoot(t *testing.T) {
+	assert.Equal(t, []string{"showhold"}, newAptPackageManager("").withRoot("showhold"))
+	assert.Equal(t, []string{"-o", "Dir::Etc=/tmp/apt", "hold", "vim"}, newAptPackageManager("/tmp/apt").withRoot("hold", "vim"))
+}
+
+func TestParseAptUpgradable(t *testing.T) {
+	out := "Listing... Done\n" +
+		"git/bionic-updates,bionic-security 1:2.17.1-1ubuntu0.5 amd64 [upgradable from: 1:2.17.1-1ubuntu0.4]\n" +
+		"docker-ce/bionic 5:20.10.0~3-0~ubuntu-bionic amd64 [upgradable from: 5:19.03.13~3-0~ubuntu-bionic]\n"
+	packs := parseAptUpgradable([]byte(out))
+	if assert.Len(t, packs, 2) {
+		assert.Equal(t, &apt.Package{Name: "git", Status: "upgradable", Version: "1:2.17.1-1ubuntu0.5", Architecture: "amd64"}, packs[0])
+		assert.Equal(t, "docker-ce", packs[1].Name)
+	}
+}
+
+func TestAptPinMatches(t *testing.T) {
+	pin := AptPin{Package: "docker-ce* /^linux-(image|headers)-/ git"}
+	assert.True(t, pin.Matches("docker-ce"))
+	assert.True(t, pin.Matches("docker-ce-cli"))
+	assert.True(t, pin.Matches("linux-image-generic"))
+	assert.True(t, pin.Matches("git"))
+	assert.False(t, pin.Matches("git-man"))
+	assert.False(t, pin.Matches("containerd"))
+}
+
+func TestParseVersionLocks(t *testing.T) {
+	out := []byte("Last metadata expiration check: 0:10:00 ago.\ndocker-ce-3:19.03.13-3.el8.*\n!kernel-0:4.18.0-240.el8.*\n")
+	assert.Equal(t, []string{"docker-ce", "kernel"}, parseVersionLocks(out))
+}
+
+func TestDnfVersionLockMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnf")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// dnf without the versionlock plugin
+	command := filepath.Join(dir, "dnf")
+	script := "#!/bin/sh\necho 'No such command: versionlock. Please use /usr/bin/dnf --help' >&2\nexit 1\n"
+	assert.NoError(t, ioutil.WriteFile(command, []byte(script), 0700))
+	m := newDnfPackageManager(command, dir)
+
+	held, err := m.Held()
+	assert.NoError(t, err)
+	assert.Empty(t, held)
+
+	_, err = m.Hold(&apt.Package{Name: "docker-ce"})
+	assert.Equal(t, errVersionLockMissing, err)
+	_, err = m.Unhold(&apt.Package{Name: "docker-ce"})
+	assert.Equal(t, errVersionLockMissing, err)
+}
+
+func TestPackageSpecs(t *testing.T) {
+	packs := toPackages([]string{"vim", "docker-ce=5:19.03.13~3-0~ubuntu-bionic"})
+	assert.Equal(t, "5:19.03.13~3-0~ubuntu-bionic", packs[1].Version)
+	specs, err := packageSpecs(packs, "=")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"vim", "docker-ce=5:19.03.13~3-0~ubuntu-bionic"}, specs)
+	names, err := packageNames(packs)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"vim", "docker-ce"}, names)
+}
+
+func TestParsePackageVersions(t *testing.T) {
+	policy := `docker-ce:
+  Installed: 5:19.03.13~3-0~ubuntu-bionic
+  Candidate: 5:19.03.13~3-0~ubuntu-bionic
+  Package pin: 5:19.03.13~3-0~ubuntu-bionic
+  Version table:
+     5:20.10.0~3-0~ubuntu-bionic 1001
+        500 https://download.docker.com/linux/ubuntu bionic/stable amd64 Packages
+ *** 5:19.03.13~3-0~ubuntu-bionic 1001
+        500 https://download.docker.com/linux/ubuntu bionic/stable amd64 Packages
+        100 /var/lib/dpkg/status
+`
+	assert.Equal(t, []packaging.PackageVersion{
+		{Version: "5:20.10.0~3-0~ubuntu-bionic", Priority: 1001, Origins: []string{"https://download.docker.com/linux/ubuntu bionic/stable amd64 Packages"}},
+		{Version: "5:19.03.13~3-0~ubuntu-bionic", Installed: true, Candidate: true, Priority: 1001, Origins: []string{"https://download.docker.com/linux/ubuntu bionic/stable amd64 Packages"}},
+	}, parseAptPolicy([]byte(policy)))
+
+	list := `Installed Packages
+docker-ce.x86_64                3:19.03.13-3.el8                @docker-ce-stable
+Available Packages
+docker-ce.x86_64                3:19.03.13-3.el8                docker-ce-stable
+docker-ce.x86_64                3:20.10.0-3.el8                 docker-ce-stable
+`
+	assert.Equal(t, []packaging.PackageVersion{
+		{Version: "3:19.03.13-3.el8", Installed: true, Origins: []string{"docker-ce-stable"}},
+		{Version: "3:20.10.0-3.el8", Candidate: true, Origins: []string{"docker-ce-stable"}},
+	}, parseDnfVersions([]byte(list)))
+
+	apkPolicy := `docker policy:
+  19.03.5-r0:
+    lib/apk/db/installed
+    http://dl-cdn.alpinelinux.org/alpine/v3.11/community
+  20.10.0-r0:
+    http://dl-cdn.alpinelinux.org/alpine/edge/community
+`
+	assert.Equal(t, []packaging.PackageVersion{
+		{Version: "19.03.5-r0", Installed: true, Origins: []string{"http://dl-cdn.alpinelinux.org/alpine/v3.11/community"}},
+		{Version: "20.10.0-r0", Candidate: true, Origins: []string{"http://dl-cdn.alpinelinux.org/alpine/edge/community"}},
+	}, parseApkPolicy([]byte(apkPolicy)))
+}
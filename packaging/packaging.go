@@ -0,0 +1,38 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2020  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+// Package packaging contains the types shared by the package managers of
+// the connector and by the fake one of testharness.
+package packaging
+
+// ProgressFunc receives the updates of a running package manager command:
+// a line of its output, or just a new percentage of completion if line is
+// empty. action describes what the command is doing, when the tool tells it.
+type ProgressFunc func(line, action string, percent float64)
+
+// PackageVersion is a version of a package that the package manager can
+// install, with the repositories it comes from. Candidate is the version
+// installed by an install or an upgrade without a version; Priority is the
+// apt pin priority, 0 with the other backends.
+type PackageVersion struct {
+	Version   string   `json:"version"`
+	Installed bool     `json:"installed"`
+	Candidate bool     `json:"candidate"`
+	Priority  int      `json:"priority,omitempty"`
+	Origins   []string `json:"origins"`
+}
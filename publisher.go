@@ -0,0 +1,279 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2020  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// classes of the outbound messages, each one has its own rate limit
+const (
+	classStdout  = "stdout"
+	classShadow  = "shadow"
+	classReplies = "replies"
+)
+
+// maxCoalescedSize is the maximum size of the payload obtained by joining
+// queued stdout chunks, it's well below the 128KB limit of AWS IoT
+const maxCoalescedSize = 32 * 1024
+
+// errMessageDropped is returned when a message doesn't fit in the queue of its class
+var errMessageDropped = errors.New("outbound queue full, message dropped")
+
+// coalesce modes tell what to do with a message when another one for the
+// same topic is already waiting in the queue
+const (
+	coalesceNone    = iota // queue it after the other one
+	coalesceAppend         // append the payload to the queued one (stdout chunks)
+	coalesceReplace        // replace the queued payload (full snapshots like /status)
+)
+
+// RateLimit configures the token bucket of a class of messages: Rate messages
+// per second can be sent on average, with bursts of up to Burst messages.
+// A Rate of 0 disables the limit. Messages exceeding the limit wait in a queue
+// of at most QueueSize messages.
+type RateLimit struct {
+	Rate      float64
+	Burst     int
+	QueueSize int
+}
+
+// PublisherStats are the counters of a class of messages, reported on /stats
+type PublisherStats struct {
+	Sent      uint64 `json:"sent"`
+	Queued    int    `json:"queued"`
+	Delayed   uint64 `json:"delayed"`
+	Coalesced uint64 `json:"coalesced"`
+	Dropped   uint64 `json:"dropped"`
+}
+
+type outboundMessage struct {
+	topic    string
+	qos      byte
+	payload  string
+	coalesce int
+}
+
+// sendFunc actually publishes a message
+type sendFunc func(topic string, qos byte, payload string) error
+
+// tokenBucket is a classic token bucket, it's not safe for concurrent use
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+// reserve takes a token if available, otherwise it returns how long to wait for the next one
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// publishQueue holds the messages of a class waiting for a token. Only one
+// message of the class is sent at a time, so that they keep their order.
+type publishQueue struct {
+	mu       sync.Mutex
+	limit    RateLimit
+	bucket   *tokenBucket
+	messages []outboundMessage
+	sending  bool
+	stats    PublisherStats
+	wake     chan struct{}
+}
+
+// Publisher sends the outbound messages respecting the rate limit of their
+// class. Messages are sent right away while there are tokens, then they are
+// queued and coalesced, so that callers (often MQTT callbacks) never sleep.
+type Publisher struct {
+	send   sendFunc
+	queues map[string]*publishQueue
+	stop   chan struct{}
+}
+
+// newPublisher starts a publisher with the given limits, classes without a
+// limit are not rate limited
+func newPublisher(limits map[string]RateLimit, send sendFunc) *Publisher {
+	p := &Publisher{
+		send:   send,
+		queues: map[string]*publishQueue{},
+		stop:   make(chan struct{}),
+	}
+	for _, class := range []string{classStdout, classShadow, classReplies} {
+		limit := limits[class]
+		q := &publishQueue{
+			limit:  limit,
+			bucket: newTokenBucket(limit.Rate, limit.Burst),
+			wake:   make(chan struct{}, 1),
+		}
+		p.queues[class] = q
+		go p.drain(q)
+	}
+	return p
+}
+
+// Close stops sending the queued messages
+func (p *Publisher) Close() {
+	close(p.stop)
+}
+
+// Publish sends the message if its class has a token left and nothing else
+// to send, otherwise it queues it. It returns errMessageDropped if the queue
+// is full.
+func (p *Publisher) Publish(class string, msg outboundMessage) error {
+	q, ok := p.queues[class]
+	if !ok {
+		return errors.New("unknown message class " + class)
+	}
+
+	q.mu.Lock()
+	if len(q.messages) == 0 && !q.sending && q.bucket.reserve(time.Now()) == 0 {
+		q.sending = true
+		q.stats.Sent++
+		q.mu.Unlock()
+		err := p.send(msg.topic, msg.qos, msg.payload)
+		q.sent()
+		return err
+	}
+	defer q.mu.Unlock()
+
+	if q.coalesce(msg) {
+		q.stats.Coalesced++
+		return nil
+	}
+	if len(q.messages) >= q.limit.QueueSize {
+		q.stats.Dropped++
+		return errMessageDropped
+	}
+	q.messages = append(q.messages, msg)
+	q.stats.Delayed++
+	q.signal()
+	return nil
+}
+
+// signal wakes up the drain loop of the queue, if it's waiting
+func (q *publishQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// sent ends the send of a message, letting the next one go
+func (q *publishQueue) sent() {
+	q.mu.Lock()
+	q.sending = false
+	q.mu.Unlock()
+	q.signal()
+}
+
+// coalesce merges msg into a queued message for the same topic, if its mode allows it
+func (q *publishQueue) coalesce(msg outboundMessage) bool {
+	switch msg.coalesce {
+	case coalesceAppend:
+		last := len(q.messages) - 1
+		if last < 0 || q.messages[last].topic != msg.topic || q.messages[last].coalesce != coalesceAppend {
+			return false
+		}
+		if len(q.messages[last].payload)+len(msg.payload) > maxCoalescedSize {
+			return false
+		}
+		q.messages[last].payload += msg.payload
+		return true
+	case coalesceReplace:
+		for i := range q.messages {
+			if q.messages[i].topic == msg.topic && q.messages[i].coalesce == coalesceReplace {
+				q.messages[i] = msg
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// drain sends the queued messages of a class as soon as there are tokens
+func (p *Publisher) drain(q *publishQueue) {
+	for {
+		q.mu.Lock()
+		if len(q.messages) == 0 || q.sending {
+			q.mu.Unlock()
+			select {
+			case <-q.wake:
+				continue
+			case <-p.stop:
+				return
+			}
+		}
+		if wait := q.bucket.reserve(time.Now()); wait > 0 {
+			q.mu.Unlock()
+			select {
+			case <-time.After(wait):
+				continue
+			case <-p.stop:
+				return
+			}
+		}
+		msg := q.messages[0]
+		q.messages = q.messages[1:]
+		q.sending = true
+		q.stats.Sent++
+		q.mu.Unlock()
+
+		if err := p.send(msg.topic, msg.qos, msg.payload); err != nil {
+			fmt.Println("publish on", msg.topic, err)
+		}
+		q.sent()
+	}
+}
+
+// Stats returns the counters of every class
+func (p *Publisher) Stats() map[string]PublisherStats {
+	stats := map[string]PublisherStats{}
+	for class, q := range p.queues {
+		q.mu.Lock()
+		s := q.stats
+		s.Queued = len(q.messages)
+		q.mu.Unlock()
+		stats[class] = s
+	}
+	return stats
+}
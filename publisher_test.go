@@ -0,0 +1,134 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type sentMessages struct {
+	mu       sync.Mutex
+	payloads []string
+}
+
+func (s *sentMessages) send(topic string, qos byte, payload string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.payloads = append(s.payloads, payload)
+	return nil
+}
+
+func (s *sentMessages) Payloads() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.payloads...)
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(2, 3)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, time.Duration(0), b.reserve(now))
+	}
+	assert.Equal(t, 500*time.Millisecond, b.reserve(now))
+
+	now = now.Add(500 * time.Millisecond)
+	assert.Equal(t, time.Duration(0), b.reserve(now))
+	assert.True(t, b.reserve(now) > 0)
+
+	// tokens never exceed the burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, time.Duration(0), b.reserve(now))
+	}
+	assert.True(t, b.reserve(now) > 0)
+
+	unlimited := newTokenBucket(0, 0)
+	for i := 0; i < 1000; i++ {
+		assert.Equal(t, time.Duration(0), unlimited.reserve(now))
+	}
+}
+
+func TestPublisherCoalesce(t *testing.T) {
+	sent := &sentMessages{}
+	limits := map[string]RateLimit{
+		classStdout:  {Rate: 20, Burst: 1, QueueSize: 10},
+		classReplies: {Rate: 20, Burst: 1, QueueSize: 10},
+	}
+	p := newPublisher(limits, sent.send)
+	defer p.Close()
+
+	for _, chunk := range []string{"a", "b", "c", "d"} {
+		assert.NoError(t, p.Publish(classStdout, outboundMessage{topic: "/stdout", payload: chunk, coalesce: coalesceAppend}))
+	}
+	for _, status := range []string{"1", "2", "3"} {
+		assert.NoError(t, p.Publish(classReplies, outboundMessage{topic: "/status", payload: status, coalesce: coalesceReplace}))
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sent.Payloads()) < 4 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.ElementsMatch(t, []string{"a", "bcd", "1", "3"}, sent.Payloads())
+
+	stats := p.Stats()
+	assert.Equal(t, uint64(2), stats[classStdout].Sent)
+	assert.Equal(t, uint64(2), stats[classStdout].Coalesced)
+	assert.Equal(t, uint64(1), stats[classReplies].Coalesced)
+	assert.Equal(t, 0, stats[classStdout].Queued)
+}
+
+func TestPublisherDrop(t *testing.T) {
+	sent := &sentMessages{}
+	limits := map[string]RateLimit{
+		classShadow: {Rate: 0.001, Burst: 1, QueueSize: 2},
+	}
+	p := newPublisher(limits, sent.send)
+	defer p.Close()
+
+	assert.NoError(t, p.Publish(classShadow, outboundMessage{topic: "/shadow/update", payload: "1"}))
+	assert.NoError(t, p.Publish(classShadow, outboundMessage{topic: "/shadow/update", payload: "2"}))
+	assert.NoError(t, p.Publish(classShadow, outboundMessage{topic: "/shadow/update", payload: "3"}))
+	assert.Equal(t, errMessageDropped, p.Publish(classShadow, outboundMessage{topic: "/shadow/update", payload: "4"}))
+
+	assert.Equal(t, []string{"1"}, sent.Payloads())
+	stats := p.Stats()
+	assert.Equal(t, uint64(1), stats[classShadow].Sent)
+	assert.Equal(t, 2, stats[classShadow].Queued)
+	assert.Equal(t, uint64(2), stats[classShadow].Delayed)
+	assert.Equal(t, uint64(1), stats[classShadow].Dropped)
+}
+
+func TestPublisherOrder(t *testing.T) {
+	sent := &sentMessages{}
+	release := make(chan struct{})
+	send := func(topic string, qos byte, payload string) error {
+		if payload == "1" {
+			<-release
+		}
+		return sent.send(topic, qos, payload)
+	}
+	limits := map[string]RateLimit{
+		classReplies: {Rate: 1000, Burst: 1, QueueSize: 10},
+	}
+	p := newPublisher(limits, send)
+	defer p.Close()
+
+	go p.Publish(classReplies, outboundMessage{topic: "/status", payload: "1"})
+	for p.Stats()[classReplies].Sent == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// a token is available again, but "1" is still being sent
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, p.Publish(classReplies, outboundMessage{topic: "/status", payload: "2"}))
+	close(release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sent.Payloads()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, []string{"1", "2"}, sent.Payloads())
+	assert.Equal(t, uint64(1), p.Stats()[classReplies].Delayed)
+}
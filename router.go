@@ -0,0 +1,190 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2020  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+)
+
+// kinds of the errors returned by the commands, the transports map them to
+// their own status codes
+const (
+	errorInternal = iota
+	errorBadRequest
+	errorNotFound
+)
+
+// commandError is an error with a kind
+type commandError struct {
+	kind int
+	err  error
+}
+
+func (e *commandError) Error() string {
+	return e.err.Error()
+}
+
+// badRequest marks an error caused by the parameters of the request
+func badRequest(err error) error {
+	return &commandError{kind: errorBadRequest, err: err}
+}
+
+// notFound marks an error caused by a missing sketch, container...
+func notFound(err error) error {
+	return &commandError{kind: errorNotFound, err: err}
+}
+
+// errorKind returns the kind of an error, errorInternal if it's not a commandError
+func errorKind(err error) int {
+	if e, ok := err.(*commandError); ok {
+		return e.kind
+	}
+	return errorInternal
+}
+
+// Request is a command received by the connector, regardless of the
+// transport that delivered it
+type Request struct {
+	ID      string // correlation id chosen by the sender, echoed in the reply
+	Command string // eg. /apt/list
+	Payload []byte // json parameters of the command
+}
+
+// Decode unmarshals the json payload of the request into params
+func (r Request) Decode(params interface{}) error {
+	if err := json.Unmarshal(r.Payload, params); err != nil {
+		return badRequest(fmt.Errorf("Unmarshal '%s': %s", r.Payload, err))
+	}
+	return nil
+}
+
+// CommandHandler executes a command. A string response is sent as it is,
+// any other response is sent as json. A nil response sends just the outcome.
+type CommandHandler func(req Request) (interface{}, error)
+
+type route struct {
+	handler           CommandHandler
+	isWriteFsRequired bool
+}
+
+// Router dispatches the commands to their handlers. MQTT and the local API
+// are adapters that turn their messages into Requests for the router.
+type Router struct {
+	status   *Status
+	routes   map[string]route
+	commands []string
+}
+
+func newRouter(status *Status) *Router {
+	return &Router{status: status, routes: map[string]route{}}
+}
+
+// Handle registers the handler of a command. If isWriteFsRequired is set the
+// root filesystem is remounted read-write while the command runs.
+func (r *Router) Handle(command string, isWriteFsRequired bool, handler CommandHandler) {
+	if _, ok := r.routes[command]; !ok {
+		r.commands = append(r.commands, command)
+	}
+	r.routes[command] = route{handler: handler, isWriteFsRequired: isWriteFsRequired}
+}
+
+// Alias registers alias as another name of a command registered with Handle
+func (r *Router) Alias(alias, command string) {
+	route, ok := r.routes[command]
+	if !ok {
+		panic("alias of unknown command " + command)
+	}
+	if _, ok := r.routes[alias]; !ok {
+		r.commands = append(r.commands, alias)
+	}
+	r.routes[alias] = route
+}
+
+// Commands returns the registered commands, in registration order
+func (r *Router) Commands() []string {
+	return append([]string{}, r.commands...)
+}
+
+// Dispatch runs the handler of the command of the request
+func (r *Router) Dispatch(req Request) (interface{}, error) {
+	route, ok := r.routes[req.Command]
+	if !ok {
+		return nil, notFound(errors.New("unknown command " + req.Command))
+	}
+
+	if r.status != nil && route.isWriteFsRequired {
+		r.status.acquireWritableFs()
+		defer r.status.releaseWritableFs()
+	}
+	return route.handler(req)
+}
+
+// formatResponse turns the response of a command into the message of a reply
+func formatResponse(resp interface{}) (string, error) {
+	if resp == nil {
+		return "", nil
+	}
+	if msg, ok := resp.(string); ok {
+		return msg, nil
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return "", fmt.Errorf("Json marshal result: %s", err)
+	}
+	return string(data) + "\n", nil
+}
+
+// mqttHandler adapts a command of the router to MQTT: the request arrives on
+// {{id}}<command>/post and the reply is published on {{id}}<command>. The
+// commands that reply when their job ends don't hold up the other messages.
+func mqttHandler(s *Status, command string) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		req := Request{ID: requestID(msg.Payload()), Command: command, Payload: msg.Payload()}
+		resp, err := s.router.Dispatch(req)
+		if pending, ok := resp.(*pendingReply); ok && err == nil {
+			go func() {
+				resp, err := pending.wait()
+				mqttReply(s, command, req.ID, resp, err)
+			}()
+			return
+		}
+		mqttReply(s, command, req.ID, resp, err)
+	}
+}
+
+// mqttReply publishes the response of a command
+func mqttReply(s *Status, command, requestID string, resp interface{}, err error) {
+	var reply string
+	if err == nil {
+		reply, err = formatResponse(resp)
+	}
+	if err != nil {
+		s.Error(command, requestID, err)
+		return
+	}
+	// an empty envelope still echoes the request_id, legacy clients never
+	// got a reply on success
+	if reply != "" || !s.config.LegacyReplies {
+		s.Info(command, requestID, reply)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouterDispatch(t *testing.T) {
+	r := newRouter(nil)
+	r.Handle("/echo", false, func(req Request) (interface{}, error) {
+		var params struct {
+			Text string `json:"text"`
+		}
+		if err := req.Decode(&params); err != nil {
+			return nil, err
+		}
+		return params.Text, nil
+	})
+	r.Handle("/fail", true, func(req Request) (interface{}, error) {
+		return nil, errors.New("failed")
+	})
+	assert.Equal(t, []string{"/echo", "/fail"}, r.Commands())
+
+	resp, err := r.Dispatch(Request{Command: "/echo", Payload: []byte(`{"text": "hello"}`)})
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", resp)
+
+	_, err = r.Dispatch(Request{Command: "/echo", Payload: []byte(`[1, 2]`)})
+	assert.Equal(t, errorBadRequest, errorKind(err))
+	assert.Contains(t, err.Error(), "Unmarshal '[1, 2]'")
+
+	_, err = r.Dispatch(Request{Command: "/fail", Payload: []byte(`{}`)})
+	assert.Equal(t, errorInternal, errorKind(err))
+
+	_, err = r.Dispatch(Request{Command: "/missing"})
+	assert.Equal(t, errorNotFound, errorKind(err))
+}
+
+func TestRouterAlias(t *testing.T) {
+	r := newRouter(nil)
+	r.Handle("/packages/list", false, func(req Request) (interface{}, error) {
+		return req.Command, nil
+	})
+	r.Alias("/apt/list", "/packages/list")
+	assert.Equal(t, []string{"/packages/list", "/apt/list"}, r.Commands())
+
+	resp, err := r.Dispatch(Request{Command: "/apt/list", Payload: []byte(`{}`)})
+	assert.NoError(t, err)
+	assert.Equal(t, "/apt/list", resp)
+	assert.Panics(t, func() { r.Alias("/apt/get", "/packages/get") })
+}
+
+func TestMqttHandler(t *testing.T) {
+	client := newRecordingMqttClient()
+	status := NewStatus(Config{}, client, nil, "test")
+	status.Set("sketch1", &SketchStatus{ID: "sketch1", Name: "blink"})
+
+	mqttHandler(status, "/status")(client, &fakeMessage{payload: []byte(`{"request_id": "abc"}`)})
+	replies := client.Published("test/status")
+	if assert.Len(t, replies, 2) {
+		var reply struct {
+			Reply
+			Data StatusSnapshot `json:"data"`
+		}
+		assert.NoError(t, json.Unmarshal([]byte(replies[1]), &reply))
+		assert.Equal(t, "abc", reply.RequestID)
+		assert.Equal(t, "ok", reply.Status)
+		assert.Equal(t, "blink", reply.Data.Sketches["sketch1"].Name)
+	}
+
+	mqttHandler(status, "/sketch")(client, &fakeMessage{payload: []byte(`{"request_id": "def", "id": "missing"}`)})
+	replies = client.Published("test/sketch")
+	if assert.Len(t, replies, 1) {
+		var reply Reply
+		assert.NoError(t, json.Unmarshal([]byte(replies[0]), &reply))
+		assert.Equal(t, "def", reply.RequestID)
+		assert.Equal(t, "sketch missing not found", reply.Error)
+	}
+
+	// commands without a response reply with an empty envelope
+	status.router.Handle("/noop", false, func(req Request) (interface{}, error) {
+		return nil, nil
+	})
+	mqttHandler(status, "/noop")(client, &fakeMessage{payload: []byte(`{"request_id": "ghi"}`)})
+	replies = client.Published("test/noop")
+	if assert.Len(t, replies, 1) {
+		assert.JSONEq(t, `{"request_id": "ghi", "status": "ok"}`, replies[0])
+	}
+
+	// but legacy clients don't get a reply on success
+	status.config.LegacyReplies = true
+	mqttHandler(status, "/noop")(client, &fakeMessage{payload: []byte(`{"request_id": "jkl"}`)})
+	assert.Len(t, client.Published("test/noop"), 1)
+}
@@ -0,0 +1,234 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2020  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+var sketchesBucket = []byte("sketches")
+
+// errSketchNotFound is returned when the DB doesn't contain the requested sketch
+var errSketchNotFound = errors.New("No matching sketch")
+
+// SketchRecord is a sketch saved in the DB, with everything needed to run it
+// again after a restart of the connector
+type SketchRecord struct {
+	ID            string            `json:"id"`
+	Name          string            `json:"name"`
+	BinaryHash    string            `json:"binary_hash,omitempty"`
+	Signature     string            `json:"signature,omitempty"`
+	UploadedAt    time.Time         `json:"uploaded_at"`
+	RestartPolicy RestartPolicy     `json:"restart_policy"`
+	DesiredState  string            `json:"desired_state"`
+	Environment   map[string]string `json:"environment,omitempty"`
+}
+
+// SketchDB is a transactional store of the sketches, backed by a bolt file.
+// It's safe for concurrent use.
+type SketchDB struct {
+	db *bolt.DB
+}
+
+// openSketchDB opens (or creates) the DB in the given file
+func openSketchDB(path string) (*SketchDB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "open sketch db %s", path)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, errBucket := tx.CreateBucketIfNotExists(sketchesBucket)
+		return errBucket
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SketchDB{db: db}, nil
+}
+
+// Close releases the DB file
+func (s *SketchDB) Close() error {
+	return s.db.Close()
+}
+
+// Put saves the record, replacing the one with the same ID
+func (s *SketchDB) Put(record SketchRecord) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putSketchRecord(tx, record)
+	})
+}
+
+// Get returns the record with the given ID
+func (s *SketchDB) Get(id string) (SketchRecord, error) {
+	var record SketchRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(sketchesBucket).Get([]byte(id))
+		if data == nil {
+			return errSketchNotFound
+		}
+		return json.Unmarshal(data, &record)
+	})
+	return record, err
+}
+
+// FindByName returns the record of the sketch with the given name
+func (s *SketchDB) FindByName(name string) (SketchRecord, error) {
+	records, err := s.List()
+	if err != nil {
+		return SketchRecord{}, err
+	}
+	for _, record := range records {
+		if record.Name == name {
+			return record, nil
+		}
+	}
+	return SketchRecord{}, errSketchNotFound
+}
+
+// List returns all the records
+func (s *SketchDB) List() ([]SketchRecord, error) {
+	var records []SketchRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(sketchesBucket).ForEach(func(k, v []byte) error {
+			var record SketchRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return errors.Wrapf(err, "unmarshal sketch %s", k)
+			}
+			records = append(records, record)
+			return nil
+		})
+	})
+	return records, err
+}
+
+// Update modifies the record with the given ID in a single transaction,
+// creating it if it doesn't exist yet
+func (s *SketchDB) Update(id string, update func(record *SketchRecord)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		record := SketchRecord{ID: id}
+		if data := tx.Bucket(sketchesBucket).Get([]byte(id)); data != nil {
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+		}
+		update(&record)
+		record.ID = id
+		return putSketchRecord(tx, record)
+	})
+}
+
+// Delete removes the record with the given ID
+func (s *SketchDB) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sketchesBucket).Delete([]byte(id))
+	})
+}
+
+func putSketchRecord(tx *bolt.Tx, record SketchRecord) error {
+	if record.ID == "" {
+		return errors.New("sketch without id")
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(sketchesBucket).Put([]byte(record.ID), data)
+}
+
+// migrate imports the sketches saved in the json file used by the previous
+// versions of the connector, then renames it so that it's imported only once
+func (s *SketchDB) migrate(oldDB string) error {
+	raw, err := ioutil.ReadFile(oldDB)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var c []SketchRecord
+	if err = json.Unmarshal(raw, &c); err != nil {
+		return errors.Wrapf(err, "unmarshal %s", oldDB)
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		for _, record := range c {
+			if tx.Bucket(sketchesBucket).Get([]byte(record.ID)) != nil {
+				continue
+			}
+			if errPut := putSketchRecord(tx, record); errPut != nil {
+				return errPut
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Migrated %d sketches from %s\n", len(c), oldDB)
+	return os.Rename(oldDB, oldDB+".migrated")
+}
+
+// getSketchDB returns the DB of the sketches, opening it and importing the
+// old json DB on first use
+func getSketchDB(status *Status) (*SketchDB, error) {
+	status.sketchDBLock.Lock()
+	defer status.sketchDBLock.Unlock()
+
+	if status.sketchDB != nil {
+		return status.sketchDB, nil
+	}
+
+	folder, err := getSketchDBFolder(status)
+	if err != nil {
+		return nil, errors.New("Can't open DB")
+	}
+	db, err := openSketchDB(filepath.Join(folder, "sketches.db"))
+	if err != nil {
+		return nil, err
+	}
+	if err = db.migrate(filepath.Join(folder, "db")); err != nil {
+		fmt.Println("Migrating the old sketch DB:", err)
+	}
+	status.sketchDB = db
+	return db, nil
+}
+
+// saveSketchState persists the restart policy and the desired state of a sketch
+func saveSketchState(sketch *SketchStatus, status *Status) error {
+	db, err := getSketchDB(status)
+	if err != nil {
+		return err
+	}
+	current := status.ReadSketch(sketch)
+	return db.Update(current.ID, func(record *SketchRecord) {
+		record.Name = current.Name
+		record.RestartPolicy = current.RestartPolicy
+		record.DesiredState = current.DesiredState
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSketchDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sketchdb")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := openSketchDB(filepath.Join(dir, "sketches.db"))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	record := SketchRecord{
+		ID:            "4c1f3a9d",
+		Name:          "sketch_oct31a",
+		BinaryHash:    "e3b0c442",
+		RestartPolicy: RestartPolicy{Name: restartOnFailure, MaxRetries: 3},
+		DesiredState:  "RUNNING",
+		Environment:   map[string]string{"LOG_LEVEL": "debug"},
+	}
+	assert.NoError(t, db.Put(record))
+
+	err = db.Update("4c1f3a9d", func(r *SketchRecord) {
+		r.DesiredState = "STOPPED"
+	})
+	assert.NoError(t, err)
+
+	found, err := db.FindByName("sketch_oct31a")
+	assert.NoError(t, err)
+	assert.Equal(t, "STOPPED", found.DesiredState)
+	assert.Equal(t, record.RestartPolicy, found.RestartPolicy)
+	assert.Equal(t, record.Environment, found.Environment)
+	assert.Equal(t, "e3b0c442", found.BinaryHash)
+
+	assert.NoError(t, db.Delete("4c1f3a9d"))
+	_, err = db.Get("4c1f3a9d")
+	assert.Equal(t, errSketchNotFound, err)
+}
+
+func TestSketchDBConcurrentUpdates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sketchdb")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := openSketchDB(filepath.Join(dir, "sketches.db"))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := db.Update("counter", func(r *SketchRecord) {
+				r.RestartPolicy.MaxRetries++
+			})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	record, err := db.Get("counter")
+	assert.NoError(t, err)
+	assert.Equal(t, 20, record.RestartPolicy.MaxRetries)
+}
+
+func TestSketchDBMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sketches")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	status := NewStatus(Config{SketchesPath: dir}, nil, nil, "")
+
+	folder, err := getSketchDBFolder(status)
+	assert.NoError(t, err)
+	oldDB := filepath.Join(folder, "db")
+	old := `[{"name":"sketch_oct31a","id":"4c1f3a9d"},{"name":"blink","id":"77aa01"}]`
+	assert.NoError(t, ioutil.WriteFile(oldDB, []byte(old), 0600))
+
+	db, err := getSketchDB(status)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	records, err := db.List()
+	assert.NoError(t, err)
+	assert.Len(t, records, 2)
+
+	record, err := db.FindByName("blink")
+	assert.NoError(t, err)
+	assert.Equal(t, "77aa01", record.ID)
+
+	_, err = os.Stat(oldDB)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(oldDB + ".migrated")
+	assert.NoError(t, err)
+}
@@ -22,7 +22,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
-	"strconv"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	docker "github.com/docker/docker/client"
@@ -30,32 +32,58 @@ import (
 	"github.com/pkg/errors"
 )
 
-// Status contains info about the sketches running on the device
+// Status contains info about the sketches running on the device.
+// Sketches and the fields of every SketchStatus are shared between the MQTT
+// handlers and the goroutines watching the sketch processes: they must be
+// accessed through the methods of Status, that hold the lock.
 type Status struct {
 	config          Config
 	id              string
 	mqttClient      mqtt.Client
 	dockerClient    docker.APIClient
+	packages        PackageManager
 	Sketches        map[string]*SketchStatus `json:"sketches"`
-	messagesSent    int
-	firstMessageAt  time.Time
+	publisher       *Publisher
+	outbox          *Outbox
+	router          *Router
 	topicPertinence string
+	sketchDB        *SketchDB
+	sketchDBLock    sync.Mutex
+	lock            sync.RWMutex
+	mqttClientLock  sync.RWMutex
+	jobs            *JobManager
+	manifestLock    sync.Mutex
+	execSessions    map[string]*ExecSession
+	execLock        sync.Mutex
+
+	writableFsHolders int
+	writableFsLock    sync.Mutex
 }
 
-// SketchBinding represents a pair (SketchName,SketchId)
-type SketchBinding struct {
-	Name string `json:"name"`
-	ID   string `json:"id"`
+// StatusSnapshot is a copy of the status taken at a point in time, it can be
+// marshalled while the status keeps changing
+type StatusSnapshot struct {
+	Sketches map[string]*SketchStatus `json:"sketches"`
 }
 
 // SketchStatus contains info about a single running sketch
 type SketchStatus struct {
-	Name      string     `json:"name"`
-	ID        string     `json:"id"`
-	PID       int        `json:"pid"`
-	Status    string     `json:"status"` // could be bool if we don't allow Pause
-	Endpoints []Endpoint `json:"endpoints"`
-	pty       *os.File
+	Name          string        `json:"name"`
+	ID            string        `json:"id"`
+	PID           int           `json:"pid"`
+	Status        string        `json:"status"` // could be bool if we don't allow Pause
+	Endpoints     []Endpoint    `json:"endpoints"`
+	RestartPolicy RestartPolicy `json:"restart_policy"`
+	DesiredState  string        `json:"desired_state"`
+	RestartCount  int           `json:"restart_count"`
+	LastExitCode  int           `json:"last_exit_code"`
+	ExitSignal    string        `json:"exit_signal,omitempty"`
+	ExitReason    string        `json:"exit_reason,omitempty"`
+	LastOutput    []string      `json:"last_output,omitempty"`
+	StartedAt     *time.Time    `json:"started_at,omitempty"`
+	StoppedAt     *time.Time    `json:"stopped_at,omitempty"`
+	pty           *os.File
+	environment   map[string]string
 }
 
 // Endpoint is an exposed function
@@ -66,142 +94,303 @@ type Endpoint struct {
 
 // NewStatus creates a new status that publishes on a topic
 func NewStatus(config Config, mqttClient mqtt.Client, dockerClient docker.APIClient, topicPertinence string) *Status {
-	return &Status{
+	s := &Status{
 		config:          config,
 		id:              config.ID,
 		mqttClient:      mqttClient,
 		dockerClient:    dockerClient,
 		Sketches:        map[string]*SketchStatus{},
+		execSessions:    map[string]*ExecSession{},
 		topicPertinence: topicPertinence,
+		jobs:            newJobManager(config.jobLimits(), config.JobHistory),
+	}
+	s.publisher = newPublisher(config.rateLimits(), s.send)
+	packages, err := newPackageManager(config)
+	if err != nil {
+		fmt.Println(err, "- falling back to apt")
+		packages = newAptPackageManager(config.AptRoot)
 	}
+	s.packages = packages
+	s.router = newCommandRouter(s)
+	return s
 }
 
-// Set adds or modify a sketch
-func (s *Status) Set(name string, sketch *SketchStatus) {
-	s.Sketches[name] = sketch
+// client returns the MQTT client, nil if the connector is running in local mode
+func (s *Status) client() mqtt.Client {
+	s.mqttClientLock.RLock()
+	defer s.mqttClientLock.RUnlock()
+	return s.mqttClient
+}
 
-	if s.mqttClient == nil {
-		return
+// setClient attaches the status to a connected MQTT client
+func (s *Status) setClient(client mqtt.Client) {
+	s.mqttClientLock.Lock()
+	s.mqttClient = client
+	s.mqttClientLock.Unlock()
+}
+
+// canPublish tells if messages can be sent now or stored to be sent later
+func (s *Status) canPublish() bool {
+	return s.client() != nil || s.outbox != nil
+}
+
+// send publishes a message on the MQTT broker, storing it in the outbox if
+// the connection is down or if older messages are still waiting there
+func (s *Status) send(topic string, qos byte, payload string) error {
+	if s.outbox == nil {
+		return s.sendNow(topic, qos, payload)
 	}
-	msg, err := json.Marshal(s)
-	if err != nil {
-		panic(err) // Means that something went really wrong
+	client := s.client()
+	if client == nil || !client.IsConnectionOpen() {
+		return s.outbox.Push(topic, qos, payload)
 	}
-
-	s.messagesSent++
-	if token := s.mqttClient.Publish("/status", 1, false, msg); token.Wait() && token.Error() != nil {
-		panic(err) // Means that something went really wrong
+	if pushed, err := s.outbox.PushIfPending(topic, qos, payload); pushed {
+		return err
 	}
-	if debugMqtt {
-		fmt.Println("MQTT OUT: /status", string(msg))
+	if err := s.sendNow(topic, qos, payload); err != nil {
+		fmt.Println(err)
+		return s.outbox.Push(topic, qos, payload)
 	}
+	return nil
 }
 
-// Error logs an error on the specified topic
-func (s *Status) Error(topic string, err error) {
-	if s.mqttClient == nil {
-		return
+// sendNow publishes a message on the MQTT broker, waiting for the delivery
+func (s *Status) sendNow(topic string, qos byte, payload string) error {
+	client := s.client()
+	if client == nil {
+		return errors.New("not connected to the MQTT broker")
 	}
-	s.messagesSent++
-	token := s.mqttClient.Publish(s.topicPertinence+topic, 1, false, "ERROR: "+err.Error()+"\n")
+	token := client.Publish(topic, qos, false, payload)
 	token.Wait()
 	if debugMqtt {
-		fmt.Println("MQTT OUT: "+s.topicPertinence+s.id+topic, "ERROR: "+err.Error()+"\n")
+		fmt.Println("MQTT OUT: "+topic, payload)
 	}
+	return token.Error()
 }
 
-// Info logs a message on the specified topic
-func (s *Status) Info(topic, msg string) bool {
-	if s.mqttClient == nil {
-		return false
+// openOutbox opens the outbox in the data folder, from now on the messages
+// published while disconnected are stored there
+func (s *Status) openOutbox() error {
+	if s.config.OutboxSize <= 0 {
+		return nil
 	}
-	s.messagesSent++
-	token := s.mqttClient.Publish("$aws/things/"+s.id+topic, 1, false, "INFO: "+msg+"\n")
-	res := token.Wait()
-	if debugMqtt {
-		fmt.Println("MQTT OUT: $aws/things/"+s.id+topic, "INFO: "+msg+"\n")
+	folder, err := getDataFolder(s.config)
+	if err != nil {
+		return err
+	}
+	outbox, err := openOutbox(filepath.Join(folder, "outbox.db"), s.config.OutboxSize, s.config.OutboxTTL, s.config.OutboxDropPolicy)
+	if err != nil {
+		return err
 	}
-	return res
+	s.outbox = outbox
+	return nil
 }
 
-// SendInfo send information to a specific topic
-func (s *Status) SendInfo(topic, msg string) {
-	if s.mqttClient == nil {
+// replayOutbox sends the messages stored while disconnected
+func (s *Status) replayOutbox() {
+	if s.outbox == nil || s.client() == nil {
 		return
 	}
+	s.outbox.Replay(s.sendNow, s.config.rateLimits()[classReplies])
+}
 
-	s.messagesSent++
+// publish sends a message through the rate limited publisher
+func (s *Status) publish(class, topic string, qos byte, payload string, coalesce int) error {
+	err := s.publisher.Publish(class, outboundMessage{
+		topic:    s.topicPertinence + topic,
+		qos:      qos,
+		payload:  payload,
+		coalesce: coalesce,
+	})
+	if err == errMessageDropped {
+		fmt.Println("rate limiting: dropped message on " + topic)
+	}
+	return err
+}
 
-	if token := s.mqttClient.Publish(s.topicPertinence+topic, 0, false, "INFO: "+msg+"\n"); token.Wait() && token.Error() != nil {
-		s.Error(topic, token.Error())
+// Snapshot returns a copy of the status and of all its sketches
+func (s *Status) Snapshot() StatusSnapshot {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	sketches := make(map[string]*SketchStatus, len(s.Sketches))
+	for id, sketch := range s.Sketches {
+		if sketch == nil {
+			sketches[id] = nil
+			continue
+		}
+		sketchCopy := *sketch
+		sketches[id] = &sketchCopy
 	}
+	return StatusSnapshot{Sketches: sketches}
+}
 
-	if debugMqtt {
-		fmt.Println("MQTT OUT: "+s.topicPertinence+topic, "INFO: "+msg+"\n")
+// Sketch returns the sketch with the given id
+func (s *Status) Sketch(id string) (*SketchStatus, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	sketch, ok := s.Sketches[id]
+	return sketch, ok && sketch != nil
+}
+
+// SketchList returns all the sketches
+func (s *Status) SketchList() []*SketchStatus {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var sketches []*SketchStatus
+	for _, sketch := range s.Sketches {
+		if sketch != nil {
+			sketches = append(sketches, sketch)
+		}
 	}
+	return sketches
 }
 
-// Raw sends a message on the specified topic without further processing
-func (s *Status) Raw(topic, msg string) {
-	if s.mqttClient == nil {
+// ReadSketch returns a copy of the sketch, taken while holding the lock
+func (s *Status) ReadSketch(sketch *SketchStatus) SketchStatus {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return *sketch
+}
+
+// UpdateSketch modifies the fields of a sketch while holding the lock
+func (s *Status) UpdateSketch(sketch *SketchStatus, update func(sketch *SketchStatus)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	update(sketch)
+}
+
+// Remove deletes a sketch
+func (s *Status) Remove(name string) {
+	s.lock.Lock()
+	delete(s.Sketches, name)
+	s.lock.Unlock()
+}
+
+// Set adds or modify a sketch
+func (s *Status) Set(name string, sketch *SketchStatus) {
+	s.lock.Lock()
+	s.Sketches[name] = sketch
+	s.lock.Unlock()
+
+	if !s.canPublish() {
 		return
 	}
+	msg, err := json.Marshal(s.Snapshot())
+	if err != nil {
+		panic(err) // Means that something went really wrong
+	}
+
+	// only the latest status is worth sending
+	if err = s.publish(classReplies, "/status", 1, string(msg), coalesceReplace); err != nil {
+		fmt.Println(err)
+	}
+}
 
-	if s.messagesSent < 10 {
-		// first 10 messages are virtually free
-		s.firstMessageAt = time.Now()
+// Reply is the envelope of the messages sent in response to a command.
+// RequestID echoes the optional request_id field of the command payload.
+type Reply struct {
+	RequestID string          `json:"request_id,omitempty"`
+	Status    string          `json:"status"`
+	Error     string          `json:"error,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+}
+
+// requestID extracts the optional correlation id from a command payload
+func requestID(payload []byte) string {
+	var req struct {
+		RequestID string `json:"request_id"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return ""
 	}
+	return req.RequestID
+}
 
-	if s.messagesSent > 1000 {
-		// if started more than one day ago, reset the counter
-		if time.Since(s.firstMessageAt) > 24*time.Hour {
-			s.messagesSent = 0
+// newReply builds the json envelope of a reply
+func newReply(requestID string, msg string, err error) Reply {
+	reply := Reply{RequestID: requestID, Status: "ok"}
+	if err != nil {
+		reply.Status = "error"
+		reply.Error = err.Error()
+	} else if msg = strings.TrimSpace(msg); msg != "" {
+		if json.Valid([]byte(msg)) {
+			reply.Data = json.RawMessage(msg)
+		} else {
+			reply.Data, _ = json.Marshal(msg)
 		}
+	}
+	return reply
+}
 
-		fmt.Println("rate limiting: " + strconv.Itoa(s.messagesSent))
-		introducedDelay := time.Duration(s.messagesSent/1000) * time.Second
-		if introducedDelay > 20*time.Second {
-			introducedDelay = 20 * time.Second
+// formatReply builds the payload of a reply, either as a json Reply or,
+// if LegacyReplies is set, as a string prefixed by INFO: or ERROR:
+func (s *Status) formatReply(requestID string, msg string, err error) string {
+	if s.config.LegacyReplies {
+		if err != nil {
+			return "ERROR: " + err.Error() + "\n"
 		}
-		time.Sleep(introducedDelay)
+		return "INFO: " + msg + "\n"
 	}
-	s.messagesSent++
-	token := s.mqttClient.Publish("$aws/things/"+s.id+topic, 1, false, msg)
-	token.Wait()
-	if debugMqtt {
-		fmt.Println("MQTT OUT: $aws/things/"+s.id+topic, string(msg))
+
+	data, errMarshal := json.Marshal(newReply(requestID, msg, err))
+	if errMarshal != nil {
+		panic(errMarshal) // Means that something went really wrong
 	}
+	return string(data) + "\n"
 }
 
-// InfoCommandOutput sends command output on the specified topic
-func (s *Status) InfoCommandOutput(topic string, out []byte) {
-	// Prepare response payload
-	type response struct {
-		Output string `json:"output"`
-	}
-	info := response{Output: string(out)}
-	data, err := json.Marshal(info)
-	if err != nil {
-		s.Error(topic, fmt.Errorf("Json marshal result: %s", err))
+// Error logs an error on the specified topic
+func (s *Status) Error(topic, requestID string, err error) {
+	if !s.canPublish() {
 		return
 	}
+	payload := s.formatReply(requestID, "", err)
+	if errPublish := s.publish(classReplies, topic, 1, payload, coalesceNone); errPublish != nil {
+		fmt.Println(errPublish)
+	}
+}
 
-	// Send result
-	s.Info(topic, string(data)+"\n")
+// Info logs a message on the specified topic
+func (s *Status) Info(topic, requestID, msg string) bool {
+	if !s.canPublish() {
+		return false
+	}
+	payload := s.formatReply(requestID, msg, nil)
+	return s.publish(classReplies, topic, 1, payload, coalesceNone) == nil
+}
+
+// Notify sends on the specified topic a message that isn't the reply to a
+// command, eg. the heartbeat. It keeps the INFO: prefix whatever the format
+// of the replies.
+func (s *Status) Notify(topic, msg string) bool {
+	if !s.canPublish() {
+		return false
+	}
+	return s.publish(classReplies, topic, 1, "INFO: "+msg+"\n", coalesceNone) == nil
+}
+
+// Raw sends a message on the specified topic without further processing.
+// Consecutive messages waiting for the rate limiter are joined together.
+func (s *Status) Raw(topic, msg string) {
+	if !s.canPublish() {
+		return
+	}
+	_ = s.publish(classStdout, topic, 1, msg, coalesceAppend)
 }
 
 // Publish sens on the /status topic a json representation of the connector
 func (s *Status) Publish() {
-	data, err := json.Marshal(s)
+	data, err := json.Marshal(s.Snapshot())
 
 	//var out bytes.Buffer
 	//json.Indent(&out, data, "", "  ")
 	//fmt.Println(string(out.Bytes()))
 
 	if err != nil {
-		s.Error("/status", errors.Wrap(err, "status request"))
+		s.Error("/status", "", errors.Wrap(err, "status request"))
 		return
 	}
 
-	s.Info("/status", string(data)+"\n")
+	s.Info("/status", "", string(data)+"\n")
 }
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestID(t *testing.T) {
+	assert.Equal(t, "abc", requestID([]byte(`{"request_id": "abc", "packages": []}`)))
+	assert.Equal(t, "", requestID([]byte(`{}`)))
+	assert.Equal(t, "", requestID([]byte(`not json`)))
+}
+
+func TestFormatReply(t *testing.T) {
+	s := NewStatus(Config{}, nil, nil, "")
+
+	var reply Reply
+	assert.NoError(t, json.Unmarshal([]byte(s.formatReply("abc", `{"output": "done"}`+"\n", nil)), &reply))
+	assert.Equal(t, "abc", reply.RequestID)
+	assert.Equal(t, "ok", reply.Status)
+	assert.Equal(t, "", reply.Error)
+	assert.JSONEq(t, `{"output": "done"}`, string(reply.Data))
+
+	reply = Reply{}
+	assert.NoError(t, json.Unmarshal([]byte(s.formatReply("", "OK", nil)), &reply))
+	assert.JSONEq(t, `"OK"`, string(reply.Data))
+
+	reply = Reply{}
+	assert.NoError(t, json.Unmarshal([]byte(s.formatReply("abc", "", errors.New("failed"))), &reply))
+	assert.Equal(t, "error", reply.Status)
+	assert.Equal(t, "failed", reply.Error)
+	assert.Nil(t, reply.Data)
+
+	s.config.LegacyReplies = true
+	assert.Equal(t, "INFO: OK\n", s.formatReply("abc", "OK", nil))
+	assert.Equal(t, "ERROR: failed\n", s.formatReply("abc", "", errors.New("failed")))
+}
+
+func TestNotifyIsNotAReply(t *testing.T) {
+	c := newTestConnector(t, Config{})
+	defer c.Close()
+
+	heartbeat := c.Subscribe(t, "/heartbeat")
+	assert.True(t, c.status.Notify("/heartbeat", "162653.88"))
+	select {
+	case msg := <-heartbeat:
+		assert.Equal(t, "INFO: 162653.88\n", msg)
+	case <-time.After(5 * time.Second):
+		t.Fatal("heartbeat not received")
+	}
+}
+
+type fakeMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m *fakeMessage) Duplicate() bool   { return false }
+func (m *fakeMessage) Qos() byte         { return 1 }
+func (m *fakeMessage) Retained() bool    { return false }
+func (m *fakeMessage) Topic() string     { return m.topic }
+func (m *fakeMessage) MessageID() uint16 { return 0 }
+func (m *fakeMessage) Payload() []byte   { return m.payload }
+func (m *fakeMessage) Ack()              {}
+
+type fakeToken struct{}
+
+func (t *fakeToken) Wait() bool                     { return true }
+func (t *fakeToken) WaitTimeout(time.Duration) bool { return true }
+func (t *fakeToken) Error() error                   { return nil }
+
+// recordingMqttClient keeps the messages published, it's safe for concurrent use
+type recordingMqttClient struct {
+	mu        sync.Mutex
+	published map[string][]string
+	offline   bool
+}
+
+func newRecordingMqttClient() *recordingMqttClient {
+	return &recordingMqttClient{published: map[string][]string{}}
+}
+
+func (c *recordingMqttClient) IsConnected() bool { return true }
+func (c *recordingMqttClient) IsConnectionOpen() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.offline
+}
+func (c *recordingMqttClient) Connect() mqtt.Token { return &fakeToken{} }
+func (c *recordingMqttClient) Disconnect(uint)     {}
+func (c *recordingMqttClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch p := payload.(type) {
+	case string:
+		c.published[topic] = append(c.published[topic], p)
+	case []byte:
+		c.published[topic] = append(c.published[topic], string(p))
+	}
+	return &fakeToken{}
+}
+func (c *recordingMqttClient) Subscribe(string, byte, mqtt.MessageHandler) mqtt.Token {
+	return &fakeToken{}
+}
+func (c *recordingMqttClient) SubscribeMultiple(map[string]byte, mqtt.MessageHandler) mqtt.Token {
+	return &fakeToken{}
+}
+func (c *recordingMqttClient) Unsubscribe(...string) mqtt.Token     { return &fakeToken{} }
+func (c *recordingMqttClient) AddRoute(string, mqtt.MessageHandler) {}
+func (c *recordingMqttClient) OptionsReader() mqtt.ClientOptionsReader {
+	return mqtt.ClientOptionsReader{}
+}
+
+func (c *recordingMqttClient) SetOffline(offline bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.offline = offline
+}
+
+func (c *recordingMqttClient) Published(topic string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string{}, c.published[topic]...)
+}
+
+// newSketchServer serves a signed sketch and returns the public key to verify it
+func newSketchServer(t *testing.T, sketch string) (*httptest.Server, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	hash := sha256.Sum256([]byte(sketch))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	assert.NoError(t, err)
+	publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".sig") {
+			w.Write(signature)
+			return
+		}
+		w.Write([]byte(sketch))
+	}))
+	return server, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey}))
+}
+
+// TestConcurrentEvents is meant to be run with the race detector
+func TestConcurrentEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sketches")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	server, publicKey := newSketchServer(t, "#!/bin/sh\necho running\nsleep 10\n")
+	defer server.Close()
+
+	client := newRecordingMqttClient()
+	status := NewStatus(Config{SketchesPath: dir, SignatureKey: publicKey}, client, nil, "test")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		id := fmt.Sprintf("sketch%d", i)
+		wg.Add(4)
+		go func() {
+			defer wg.Done()
+			payload := fmt.Sprintf(`{"id": "%s", "name": "%s", "url": "%s/%s"}`, id, id, server.URL, id)
+			mqttHandler(status, "/upload")(client, &fakeMessage{topic: "test/upload/post", payload: []byte(payload)})
+		}()
+		go func() {
+			defer wg.Done()
+			for _, action := range []string{"STOP", "START", "PAUSE", "START"} {
+				payload := fmt.Sprintf(`{"id": "%s", "action": "%s"}`, id, action)
+				mqttHandler(status, "/sketch")(client, &fakeMessage{topic: "test/sketch/post", payload: []byte(payload)})
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			mqttHandler(status, "/status")(client, &fakeMessage{topic: "test/status/post", payload: []byte(`{}`)})
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := json.Marshal(status.Snapshot())
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	// the uploads reply when their jobs end
+	for start := time.Now(); len(client.Published("test/upload")) < 4 && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	snapshot := status.Snapshot()
+	for i := 0; i < 4; i++ {
+		id := fmt.Sprintf("sketch%d", i)
+		if assert.Contains(t, snapshot.Sketches, id) {
+			assert.Equal(t, "RUNNING", snapshot.Sketches[id].DesiredState)
+		}
+		mqttHandler(status, "/sketch")(client, &fakeMessage{payload: []byte(`{"id": "` + id + `", "action": "STOP"}`)})
+	}
+	assert.NotEmpty(t, client.Published("test/status"))
+
+	db, err := getSketchDB(status)
+	assert.NoError(t, err)
+	records, err := db.List()
+	assert.NoError(t, err)
+	assert.Len(t, records, 4)
+	db.Close()
+}
@@ -0,0 +1,276 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2020  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	restartNo        = "no"
+	restartOnFailure = "on-failure"
+	restartAlways    = "always"
+
+	maxRestartBackoff = 5 * time.Minute
+
+	// number of output lines of a sketch kept to be reported when it exits
+	sketchOutputLines   = 20
+	maxOutputLineLength = 1024
+)
+
+// RestartPolicy tells the supervisor what to do when a sketch exits:
+// - "no" leaves it stopped
+// - "on-failure" restarts it if the exit code is not 0, up to MaxRetries times (0 means forever)
+// - "always" restarts it regardless of the exit code
+// Between two restarts the supervisor waits Backoff seconds, doubling the delay each time
+type RestartPolicy struct {
+	Name       string `json:"name"`
+	MaxRetries int    `json:"max_retries,omitempty"`
+	Backoff    int    `json:"backoff,omitempty"`
+}
+
+// Validate checks that the policy is one of the supported ones
+func (p RestartPolicy) Validate() error {
+	switch p.Name {
+	case "", restartNo, restartOnFailure, restartAlways:
+	default:
+		return errors.New("unknown restart policy " + p.Name)
+	}
+	if p.MaxRetries < 0 || p.Backoff < 0 {
+		return errors.New("max_retries and backoff must not be negative")
+	}
+	return nil
+}
+
+// shouldRestart tells if a sketch that exited with exitCode after being
+// restarted restartCount times must be restarted again
+func (p RestartPolicy) shouldRestart(exitCode, restartCount int) bool {
+	switch p.Name {
+	case restartAlways:
+		return true
+	case restartOnFailure:
+		return exitCode != 0 && (p.MaxRetries == 0 || restartCount < p.MaxRetries)
+	default:
+		return false
+	}
+}
+
+// delay returns how long to wait before the next restart
+func (p RestartPolicy) delay(restartCount int) time.Duration {
+	delay := time.Duration(p.Backoff) * time.Second
+	if delay == 0 {
+		delay = time.Second
+	}
+	for i := 0; i < restartCount && delay < maxRestartBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxRestartBackoff {
+		delay = maxRestartBackoff
+	}
+	return delay
+}
+
+// SketchExit describes how a sketch terminated, it's published on /sketch/exited
+type SketchExit struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	PID       int        `json:"pid"`
+	Reason    string     `json:"reason"` // stopped, exited, failed or killed
+	ExitCode  int        `json:"exit_code"`
+	Signal    string     `json:"signal,omitempty"`
+	Output    []string   `json:"output"`
+	StartedAt *time.Time `json:"started_at,omitempty"`
+	StoppedAt time.Time  `json:"stopped_at"`
+}
+
+// newSketchExit collects the info about the termination of the process with the given pid
+func newSketchExit(sketch *SketchStatus, pid int, state *os.ProcessState, output []string) SketchExit {
+	exit := SketchExit{
+		ID:        sketch.ID,
+		Name:      sketch.Name,
+		PID:       pid,
+		ExitCode:  state.ExitCode(),
+		Output:    output,
+		StartedAt: sketch.StartedAt,
+		StoppedAt: time.Now(),
+	}
+	ws, ok := state.Sys().(syscall.WaitStatus)
+	switch {
+	case sketch.PID != pid:
+		// the connector stopped the sketch on purpose
+		exit.Reason = "stopped"
+	case ok && ws.Signaled():
+		exit.Reason = "killed"
+	case exit.ExitCode == 0:
+		exit.Reason = "exited"
+	default:
+		exit.Reason = "failed"
+	}
+	if ok && ws.Signaled() {
+		exit.Signal = ws.Signal().String()
+	}
+	return exit
+}
+
+// sketchExited is called when the process with the given pid of a sketch terminates.
+// It records how the sketch exited, publishes it on /sketch/exited, marks the sketch
+// as stopped and restarts it if required by its restart policy
+func sketchExited(sketch *SketchStatus, pid int, state *os.ProcessState, output []string, status *Status) {
+	current := status.ReadSketch(sketch)
+	exit := newSketchExit(&current, pid, state, output)
+	fmt.Printf("sketch %s %s with code %d %s\n", current.ID, exit.Reason, exit.ExitCode, exit.Signal)
+
+	if data, err := json.Marshal(exit); err == nil {
+		status.Notify("/sketch/exited", string(data))
+	}
+
+	restarted, stopped := false, false
+	status.UpdateSketch(sketch, func(sketch *SketchStatus) {
+		if sketch.PID != pid && sketch.PID != 0 {
+			// the sketch has been restarted in the meantime, keep the info of the new process
+			restarted = true
+			return
+		}
+		sketch.LastExitCode = exit.ExitCode
+		sketch.ExitSignal = exit.Signal
+		sketch.ExitReason = exit.Reason
+		sketch.LastOutput = exit.Output
+		sketch.StoppedAt = &exit.StoppedAt
+
+		if sketch.PID != pid {
+			// the sketch has been stopped in the meantime
+			stopped = true
+			return
+		}
+		sketch.PID = 0
+		sketch.Status = "STOPPED"
+
+		if sketch.DesiredState == "RUNNING" && sketch.RestartPolicy.shouldRestart(exit.ExitCode, sketch.RestartCount) {
+			delay := sketch.RestartPolicy.delay(sketch.RestartCount)
+			sketch.RestartCount++
+			fmt.Printf("restarting sketch %s in %s\n", sketch.ID, delay)
+			time.AfterFunc(delay, func() {
+				restartSketch(sketch, status)
+			})
+		}
+	})
+	if restarted {
+		return
+	}
+	if current, ok := status.Sketch(current.ID); !ok || current != sketch {
+		// deleted or replaced by a new upload, don't add it back
+		return
+	}
+
+	status.Set(current.ID, sketch)
+	if !stopped {
+		status.Publish()
+	}
+}
+
+// restartSketch starts again a sketch, unless it has been started or stopped by
+// someone else while waiting for the backoff
+func restartSketch(sketch *SketchStatus, status *Status) {
+	current := status.ReadSketch(sketch)
+	if current.DesiredState != "RUNNING" || current.PID != 0 {
+		return
+	}
+	if current, ok := status.Sketch(current.ID); !ok || current != sketch {
+		// deleted or replaced by a new upload while waiting
+		return
+	}
+	if err := applyAction(sketch, "START", status); err != nil {
+		fmt.Println(err)
+		return
+	}
+	status.Set(current.ID, sketch)
+	status.Publish()
+}
+
+// startSketchesInDesiredState starts all the sketches that were running when the connector was stopped
+func startSketchesInDesiredState(status *Status) {
+	for _, sketch := range status.SketchList() {
+		current := status.ReadSketch(sketch)
+		if current.DesiredState != "RUNNING" || current.PID != 0 {
+			continue
+		}
+		if err := applyAction(sketch, "START", status); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		status.Set(current.ID, sketch)
+	}
+	status.Publish()
+}
+
+// outputTail keeps the last lines written by a sketch
+type outputTail struct {
+	mu      sync.Mutex
+	max     int
+	lines   []string
+	partial string
+}
+
+func newOutputTail(max int) *outputTail {
+	return &outputTail{max: max}
+}
+
+// Write splits p in lines, keeping only the last ones
+func (t *outputTail) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lines := strings.Split(t.partial+string(p), "\n")
+	t.partial = lines[len(lines)-1]
+	if len(t.partial) > maxOutputLineLength {
+		// the sketch is not printing new lines, don't let the line grow forever
+		lines = append(lines, "")
+		t.partial = ""
+	}
+	for _, line := range lines[:len(lines)-1] {
+		t.lines = append(t.lines, strings.TrimRight(line, "\r"))
+	}
+	if len(t.lines) > t.max {
+		t.lines = append([]string{}, t.lines[len(t.lines)-t.max:]...)
+	}
+	return len(p), nil
+}
+
+// Lines returns a copy of the last lines written, including the incomplete one
+func (t *outputTail) Lines() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lines := append([]string{}, t.lines...)
+	if t.partial != "" {
+		lines = append(lines, strings.TrimRight(t.partial, "\r"))
+	}
+	if len(lines) > t.max {
+		lines = lines[len(lines)-t.max:]
+	}
+	return lines
+}
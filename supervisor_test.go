@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRestartPolicyShouldRestart(t *testing.T) {
+	assert.False(t, RestartPolicy{}.shouldRestart(1, 0))
+	assert.False(t, RestartPolicy{Name: restartNo}.shouldRestart(1, 0))
+	assert.True(t, RestartPolicy{Name: restartAlways}.shouldRestart(0, 100))
+
+	onFailure := RestartPolicy{Name: restartOnFailure, MaxRetries: 2}
+	assert.False(t, onFailure.shouldRestart(0, 0))
+	assert.True(t, onFailure.shouldRestart(1, 1))
+	assert.False(t, onFailure.shouldRestart(1, 2))
+
+	onFailure.MaxRetries = 0
+	assert.True(t, onFailure.shouldRestart(-1, 1000))
+}
+
+func TestRestartPolicyDelay(t *testing.T) {
+	p := RestartPolicy{Name: restartAlways}
+	assert.Equal(t, time.Second, p.delay(0))
+	assert.Equal(t, 4*time.Second, p.delay(2))
+
+	p.Backoff = 10
+	assert.Equal(t, 10*time.Second, p.delay(0))
+	assert.Equal(t, 20*time.Second, p.delay(1))
+	assert.Equal(t, maxRestartBackoff, p.delay(50))
+}
+
+func TestRestartPolicyValidate(t *testing.T) {
+	assert.NoError(t, RestartPolicy{}.Validate())
+	assert.NoError(t, RestartPolicy{Name: restartOnFailure, MaxRetries: 3, Backoff: 5}.Validate())
+	assert.Error(t, RestartPolicy{Name: "sometimes"}.Validate())
+	assert.Error(t, RestartPolicy{Name: restartOnFailure, MaxRetries: -1}.Validate())
+}
+
+func TestOutputTail(t *testing.T) {
+	tail := newOutputTail(3)
+	_, _ = tail.Write([]byte("one\r\ntwo\nthr"))
+	assert.Equal(t, []string{"one", "two", "thr"}, tail.Lines())
+
+	_, _ = tail.Write([]byte("ee\nfour\nfive"))
+	assert.Equal(t, []string{"three", "four", "five"}, tail.Lines())
+}
+
+func TestNewSketchExit(t *testing.T) {
+	sketch := &SketchStatus{ID: "4c1f3a9d", Name: "sketch_oct31a"}
+
+	cmd := exec.Command("sh", "-c", "exit 3")
+	assert.Error(t, cmd.Run())
+	sketch.PID = cmd.ProcessState.Pid()
+	exit := newSketchExit(sketch, cmd.ProcessState.Pid(), cmd.ProcessState, nil)
+	assert.Equal(t, "failed", exit.Reason)
+	assert.Equal(t, 3, exit.ExitCode)
+	assert.Equal(t, "", exit.Signal)
+
+	cmd = exec.Command("sh", "-c", "kill -TERM $$")
+	assert.Error(t, cmd.Run())
+	sketch.PID = cmd.ProcessState.Pid()
+	exit = newSketchExit(sketch, cmd.ProcessState.Pid(), cmd.ProcessState, nil)
+	assert.Equal(t, "killed", exit.Reason)
+	assert.Equal(t, -1, exit.ExitCode)
+	assert.Equal(t, "terminated", exit.Signal)
+
+	// the connector resets the PID before stopping the sketch
+	sketch.PID = 0
+	exit = newSketchExit(sketch, cmd.ProcessState.Pid(), cmd.ProcessState, nil)
+	assert.Equal(t, "stopped", exit.Reason)
+}
+
+func TestSketchExitIsRecorded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sketches")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	status := NewStatus(Config{SketchesPath: dir}, nil, nil, "")
+
+	script := filepath.Join(dir, "crashing_sketch")
+	assert.NoError(t, ioutil.WriteFile(script, []byte("#!/bin/sh\necho starting\necho crashing\nsleep 0.2\nexit 7\n"), 0700))
+
+	sketch := &SketchStatus{ID: "crashing_sketch", Name: "crashing_sketch", DesiredState: "RUNNING"}
+	status.Set(sketch.ID, sketch)
+	_, _, _, err = spawnProcess(script, sketch, status)
+	assert.NoError(t, err)
+	assert.NotNil(t, status.ReadSketch(sketch).StartedAt)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for status.ReadSketch(sketch).ExitReason == "" && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	recorded := status.Snapshot().Sketches["crashing_sketch"]
+	assert.Equal(t, "STOPPED", recorded.Status)
+	assert.Equal(t, 0, recorded.PID)
+	assert.Equal(t, 7, recorded.LastExitCode)
+	assert.Equal(t, "failed", recorded.ExitReason)
+	assert.Equal(t, []string{"starting", "crashing"}, recorded.LastOutput)
+	assert.NotNil(t, recorded.StoppedAt)
+}
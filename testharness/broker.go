@@ -0,0 +1,467 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2020  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+// Package testharness provides in-process replacements for the external
+// services used by the arduino-connector, so that its handlers can be tested
+// end to end with a plain `go test`:
+//
+//	broker, err := testharness.NewBroker()
+//	client, err := broker.Connect("arduino-connector")
+//	docker := testharness.NewDocker()
+//	packages := testharness.NewPackages()
+//
+// Broker is an MQTT broker listening on a random port of localhost, Docker
+// is a fake docker.APIClient keeping containers and images in memory and
+// Packages is a fake package manager keeping packages and repositories in
+// memory.
+package testharness
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+)
+
+// MQTT control packet types
+const (
+	packetConnect     = 1
+	packetConnack     = 2
+	packetPublish     = 3
+	packetPuback      = 4
+	packetPubrec      = 5
+	packetPubrel      = 6
+	packetPubcomp     = 7
+	packetSubscribe   = 8
+	packetSuback      = 9
+	packetUnsubscribe = 10
+	packetUnsuback    = 11
+	packetPingreq     = 12
+	packetPingresp    = 13
+	packetDisconnect  = 14
+)
+
+type packet struct {
+	header byte
+	body   []byte
+}
+
+type message struct {
+	topic   string
+	payload []byte
+	qos     byte
+}
+
+// session is a connected client
+type session struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+	nextID  uint16
+	subs    map[string]byte // filter -> qos, guarded by the lock of the broker
+}
+
+// Broker is a minimal MQTT 3.1.1 broker. It supports QoS 0 and 1 (QoS 2
+// messages are delivered as QoS 1), retained messages and wildcards, which is
+// all the connector needs. Sessions are not persisted across connections.
+type Broker struct {
+	listener net.Listener
+	mu       sync.Mutex
+	sessions map[string]*session
+	retained map[string]message
+	wg       sync.WaitGroup
+}
+
+// NewBroker starts a broker on a random port of localhost
+func NewBroker() (*Broker, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, errors.Wrap(err, "listen")
+	}
+	b := &Broker{
+		listener: listener,
+		sessions: map[string]*session{},
+		retained: map[string]message{},
+	}
+	b.wg.Add(1)
+	go b.accept()
+	return b, nil
+}
+
+// URL returns the address of the broker, eg. tcp://127.0.0.1:34567
+func (b *Broker) URL() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+// Connect returns a paho client connected to the broker
+func (b *Broker) Connect(clientID string) (mqtt.Client, error) {
+	opts := mqtt.NewClientOptions().AddBroker(b.URL()).SetClientID(clientID)
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+	return client, nil
+}
+
+// Close disconnects all the clients and stops the broker
+func (b *Broker) Close() error {
+	err := b.listener.Close()
+	b.mu.Lock()
+	for _, s := range b.sessions {
+		s.conn.Close()
+	}
+	b.mu.Unlock()
+	b.wg.Wait()
+	return err
+}
+
+func (b *Broker) accept() {
+	defer b.wg.Done()
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		b.wg.Add(1)
+		go b.serve(conn)
+	}
+}
+
+func (b *Broker) serve(conn net.Conn) {
+	defer b.wg.Done()
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	p, err := readPacket(r)
+	if err != nil || p.header>>4 != packetConnect {
+		return
+	}
+	id, err := parseConnect(p.body)
+	if err != nil {
+		return
+	}
+
+	s := &session{conn: conn, subs: map[string]byte{}}
+	b.mu.Lock()
+	if id == "" {
+		id = fmt.Sprintf("anonymous-%p", s)
+	}
+	if old, ok := b.sessions[id]; ok {
+		// a client connecting with the same id takes over the session
+		old.conn.Close()
+	}
+	b.sessions[id] = s
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		if b.sessions[id] == s {
+			delete(b.sessions, id)
+		}
+		b.mu.Unlock()
+	}()
+
+	if s.write(packetConnack<<4, []byte{0, 0}) != nil {
+		return
+	}
+	for {
+		p, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		switch p.header >> 4 {
+		case packetPublish:
+			err = b.publish(s, p)
+		case packetPubrel:
+			err = s.write(packetPubcomp<<4, p.body)
+		case packetSubscribe:
+			err = b.subscribe(s, p)
+		case packetUnsubscribe:
+			err = b.unsubscribe(s, p)
+		case packetPingreq:
+			err = s.write(packetPingresp<<4, nil)
+		case packetDisconnect:
+			return
+		case packetPuback, packetPubrec, packetPubcomp:
+			// deliveries are fire and forget
+		default:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (b *Broker) publish(s *session, p packet) error {
+	qos := (p.header >> 1) & 3
+	topic, rest, err := readString(p.body)
+	if err != nil {
+		return err
+	}
+	var packetID []byte
+	if qos > 0 {
+		if len(rest) < 2 {
+			return errors.New("missing packet id")
+		}
+		packetID, rest = rest[:2], rest[2:]
+	}
+	msg := message{topic: topic, payload: rest, qos: qos}
+
+	if p.header&1 == 1 {
+		b.mu.Lock()
+		if len(msg.payload) == 0 {
+			delete(b.retained, topic)
+		} else {
+			b.retained[topic] = msg
+		}
+		b.mu.Unlock()
+	}
+	b.deliver(msg)
+
+	switch qos {
+	case 1:
+		return s.write(packetPuback<<4, packetID)
+	case 2:
+		return s.write(packetPubrec<<4, packetID)
+	}
+	return nil
+}
+
+// deliver sends the message to every session subscribed to its topic
+func (b *Broker) deliver(msg message) {
+	type delivery struct {
+		s   *session
+		qos byte
+	}
+	var deliveries []delivery
+	b.mu.Lock()
+	for _, s := range b.sessions {
+		matched, qos := false, byte(0)
+		for filter, subQos := range s.subs {
+			if match(filter, msg.topic) {
+				matched = true
+				if subQos > qos {
+					qos = subQos
+				}
+			}
+		}
+		if matched {
+			if msg.qos < qos {
+				qos = msg.qos
+			}
+			deliveries = append(deliveries, delivery{s, qos})
+		}
+	}
+	b.mu.Unlock()
+
+	for _, d := range deliveries {
+		// errors are detected by the goroutine reading from the session
+		_ = d.s.send(msg, d.qos, false)
+	}
+}
+
+func (b *Broker) subscribe(s *session, p packet) error {
+	if len(p.body) < 2 {
+		return errors.New("missing packet id")
+	}
+	ack := append([]byte{}, p.body[:2]...)
+	var filters []string
+	b.mu.Lock()
+	for rest := p.body[2:]; len(rest) > 0; {
+		filter, tail, err := readString(rest)
+		if err != nil || len(tail) < 1 {
+			b.mu.Unlock()
+			return errors.New("malformed subscribe")
+		}
+		qos := tail[0] & 3
+		if qos > 1 {
+			qos = 1
+		}
+		s.subs[filter] = qos
+		filters = append(filters, filter)
+		ack = append(ack, qos)
+		rest = tail[1:]
+	}
+	var retained []message
+	for _, msg := range b.retained {
+		for _, filter := range filters {
+			if match(filter, msg.topic) {
+				retained = append(retained, msg)
+				break
+			}
+		}
+	}
+	b.mu.Unlock()
+
+	if err := s.write(packetSuback<<4, ack); err != nil {
+		return err
+	}
+	for _, msg := range retained {
+		if err := s.send(msg, 0, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Broker) unsubscribe(s *session, p packet) error {
+	if len(p.body) < 2 {
+		return errors.New("missing packet id")
+	}
+	b.mu.Lock()
+	for rest := p.body[2:]; len(rest) > 0; {
+		filter, tail, err := readString(rest)
+		if err != nil {
+			b.mu.Unlock()
+			return err
+		}
+		delete(s.subs, filter)
+		rest = tail
+	}
+	b.mu.Unlock()
+	return s.write(packetUnsuback<<4, p.body[:2])
+}
+
+// send delivers a message to the client of the session
+func (s *session) send(msg message, qos byte, retained bool) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	header := byte(packetPublish<<4) | qos<<1
+	if retained {
+		header |= 1
+	}
+	body := appendString(nil, msg.topic)
+	if qos > 0 {
+		s.nextID++
+		if s.nextID == 0 {
+			s.nextID = 1
+		}
+		body = append(body, byte(s.nextID>>8), byte(s.nextID))
+	}
+	body = append(body, msg.payload...)
+	return writePacket(s.conn, header, body)
+}
+
+func (s *session) write(header byte, body []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return writePacket(s.conn, header, body)
+}
+
+// match tells if a topic matches a subscription filter with + and # wildcards
+func match(filter, topic string) bool {
+	// topics starting with $ are not matched by wildcards at the first level
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// parseConnect returns the client id of a CONNECT packet
+func parseConnect(body []byte) (string, error) {
+	protocol, rest, err := readString(body)
+	if err != nil {
+		return "", err
+	}
+	if protocol != "MQTT" && protocol != "MQIsdp" {
+		return "", errors.New("unknown protocol " + protocol)
+	}
+	// protocol level, connect flags and keep alive
+	if len(rest) < 4 {
+		return "", errors.New("malformed connect")
+	}
+	id, _, err := readString(rest[4:])
+	return id, err
+}
+
+func readPacket(r *bufio.Reader) (packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return packet{}, errors.New("malformed remaining length")
+		}
+		digit, err := r.ReadByte()
+		if err != nil {
+			return packet{}, err
+		}
+		length += int(digit&127) * multiplier
+		if digit&128 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+	body := make([]byte, length)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return packet{}, err
+	}
+	return packet{header: header, body: body}, nil
+}
+
+func writePacket(w io.Writer, header byte, body []byte) error {
+	buf := []byte{header}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 128
+		}
+		buf = append(buf, digit)
+		if length == 0 {
+			break
+		}
+	}
+	_, err := w.Write(append(buf, body...))
+	return err
+}
+
+func readString(data []byte) (string, []byte, error) {
+	if len(data) < 2 {
+		return "", nil, errors.New("malformed string")
+	}
+	length := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+length {
+		return "", nil, errors.New("malformed string")
+	}
+	return string(data[2 : 2+length]), data[2+length:], nil
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = append(buf, byte(len(s)>>8), byte(len(s)))
+	return append(buf, s...)
+}
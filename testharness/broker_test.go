@@ -0,0 +1,82 @@
+package testharness
+
+import (
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+)
+
+func receive(t *testing.T, messages chan mqtt.Message) mqtt.Message {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+		return nil
+	}
+}
+
+func TestMatch(t *testing.T) {
+	assert.True(t, match("a/b", "a/b"))
+	assert.False(t, match("a/b", "a/b/c"))
+	assert.True(t, match("a/+/c", "a/b/c"))
+	assert.False(t, match("a/+", "a/b/c"))
+	assert.True(t, match("a/#", "a/b/c"))
+	assert.True(t, match("a/#", "a"))
+	assert.True(t, match("#", "a/b"))
+	assert.False(t, match("#", "$aws/things/id"))
+	assert.True(t, match("$aws/things/+/status", "$aws/things/id/status"))
+}
+
+func TestBroker(t *testing.T) {
+	broker, err := NewBroker()
+	assert.NoError(t, err)
+	defer broker.Close()
+
+	publisher, err := broker.Connect("publisher")
+	assert.NoError(t, err)
+	defer publisher.Disconnect(100)
+	subscriber, err := broker.Connect("subscriber")
+	assert.NoError(t, err)
+	defer subscriber.Disconnect(100)
+
+	// retained messages are delivered to the new subscribers
+	token := publisher.Publish("things/id/status", 1, true, "retained")
+	assert.True(t, token.Wait())
+	assert.NoError(t, token.Error())
+
+	messages := make(chan mqtt.Message, 10)
+	token = subscriber.Subscribe("things/+/#", 1, func(client mqtt.Client, msg mqtt.Message) {
+		messages <- msg
+	})
+	assert.True(t, token.Wait())
+	assert.NoError(t, token.Error())
+
+	msg := receive(t, messages)
+	assert.Equal(t, "things/id/status", msg.Topic())
+	assert.Equal(t, "retained", string(msg.Payload()))
+	assert.True(t, msg.Retained())
+
+	for qos := byte(0); qos <= 2; qos++ {
+		token = publisher.Publish("things/id/upload/post", qos, false, "payload")
+		assert.True(t, token.Wait())
+		assert.NoError(t, token.Error())
+		msg = receive(t, messages)
+		assert.Equal(t, "things/id/upload/post", msg.Topic())
+		assert.Equal(t, "payload", string(msg.Payload()))
+		assert.False(t, msg.Retained())
+	}
+
+	token = subscriber.Unsubscribe("things/+/#")
+	assert.True(t, token.Wait())
+	publisher.Publish("things/id/status", 0, false, "ignored").Wait()
+	publisher.Publish("others", 0, false, "ignored").Wait()
+	select {
+	case msg = <-messages:
+		t.Fatalf("unexpected message on %s", msg.Topic())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
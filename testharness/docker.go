@@ -0,0 +1,1258 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2020  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package testharness
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/registry"
+	timetypes "github.com/docker/docker/api/types/time"
+	volumetypes "github.com/docker/docker/api/types/volume"
+	docker "github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/pkg/errors"
+)
+
+// Docker is a fake docker.APIClient that keeps containers and images in
+// memory. It embeds the interface: only the methods used by the connector are
+// implemented, calling any other one panics.
+type Docker struct {
+	docker.APIClient
+
+	mu         sync.Mutex
+	containers []*types.Container
+	configs    map[string]*container.Config
+	hosts      map[string]*container.HostConfig
+	images     []*types.ImageSummary
+	layers     map[string][]int64
+	pullErrors map[string]string
+	buildCache uint64
+	networks   []*types.NetworkResource
+	volumes    []*types.Volume
+	logs       map[string][]logEntry
+	followers  map[string][]*logFollower
+	execs      map[string]*fakeExec
+	execFunc   ExecFunc
+	calls      []string
+	failures   map[string]error
+	lastID     int
+}
+
+// logEntry is a line of output of a container
+type logEntry struct {
+	stream string
+	line   string
+	at     time.Time
+}
+
+// logFollower is a stream of ContainerLogs with Follow, it gets the lines
+// added after it was opened until the container stops
+type logFollower struct {
+	options types.ContainerLogsOptions
+	tty     bool
+	data    chan []byte
+}
+
+// ExecFunc is the process run by the exec instances: it reads its input
+// from stdin and returns the exit code. Without a tty stdout and stderr are
+// multiplexed, otherwise they are the same stream.
+type ExecFunc func(cmd []string, stdin io.Reader, stdout, stderr io.Writer) int
+
+// fakeExec is an exec instance, created by ContainerExecCreate and started
+// by ContainerExecAttach
+type fakeExec struct {
+	inspect types.ContainerExecInspect
+	config  types.ExecConfig
+	size    types.ResizeOptions
+}
+
+// NewDocker returns a fake docker without containers and images, whose exec
+// instances run Cat
+func NewDocker() *Docker {
+	return &Docker{
+		configs:    map[string]*container.Config{},
+		hosts:      map[string]*container.HostConfig{},
+		layers:     map[string][]int64{},
+		pullErrors: map[string]string{},
+		logs:       map[string][]logEntry{},
+		followers:  map[string][]*logFollower{},
+		execs:      map[string]*fakeExec{},
+		execFunc:   Cat,
+		failures:   map[string]error{},
+	}
+}
+
+// Cat copies stdin to stdout until stdin is closed or it reads a line with
+// "exit N", then it exits with N
+func Cat(cmd []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	scanner := bufio.NewScanner(stdin)
+	for scanner.Scan() {
+		var code int
+		if _, err := fmt.Sscanf(scanner.Text(), "exit %d", &code); err == nil {
+			return code
+		}
+		fmt.Fprintln(stdout, scanner.Text())
+	}
+	return 0
+}
+
+// HandleExec sets the process run by the exec instances
+func (d *Docker) HandleExec(run ExecFunc) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.execFunc = run
+}
+
+// ExecSize returns the size of the tty of an exec instance
+func (d *Docker) ExecSize(execID string) (height, width uint) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e := d.execs[execID]; e != nil {
+		return e.size.Height, e.size.Width
+	}
+	return 0, 0
+}
+
+// Fail makes the method with the given name (eg. "ContainerStart") return
+// err, until Fail is called again with a nil error
+func (d *Docker) Fail(method string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err == nil {
+		delete(d.failures, method)
+		return
+	}
+	d.failures[method] = err
+}
+
+// Calls returns the names of the methods called so far, in order
+func (d *Docker) Calls() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string{}, d.calls...)
+}
+
+// AddImage adds an image, as if it was pulled
+func (d *Docker) AddImage(ref string) types.ImageSummary {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return *d.addImage(ref)
+}
+
+// AddDanglingImage adds an image without tags, like those left behind when
+// a tag moves to a newer image
+func (d *Docker) AddDanglingImage() types.ImageSummary {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	img := &types.ImageSummary{
+		ID:       "sha256:" + d.newID(),
+		RepoTags: []string{"<none>:<none>"},
+		Created:  time.Now().Unix(),
+		Size:     1024,
+	}
+	d.images = append(d.images, img)
+	return *img
+}
+
+// SetBuildCache sets the size of the build cache
+func (d *Docker) SetBuildCache(size uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.buildCache = size
+}
+
+// SetImageLayers sets the sizes of the layers downloaded by ImagePull
+func (d *Docker) SetImageLayers(ref string, sizes ...int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.layers[ref] = sizes
+}
+
+// FailPull makes ImagePull of ref fail after it started, with the error at
+// the end of the stream like docker does
+func (d *Docker) FailPull(ref, message string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pullErrors[ref] = message
+}
+
+// UpdateImage gives a new id to an image, as if a newer version was pulled
+func (d *Docker) UpdateImage(ref string) types.ImageSummary {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	img := d.findImage(ref)
+	if img == nil {
+		img = d.addImage(ref)
+	}
+	img.ID = "sha256:" + d.newID()
+	return *img
+}
+
+// AddContainer adds a container created from the given image, which is added
+// too if missing. state is one of created, running or exited.
+func (d *Docker) AddContainer(name, image, state string) types.Container {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	img := d.findImage(image)
+	if img == nil {
+		img = d.addImage(image)
+	}
+	c := &types.Container{
+		ID:      d.newID(),
+		Names:   []string{"/" + name},
+		Image:   image,
+		ImageID: img.ID,
+		Created: time.Now().Unix(),
+	}
+	setState(c, state)
+	d.containers = append(d.containers, c)
+	return *c
+}
+
+// AddLog adds a line of output to a container, stream is stdout or stderr.
+// It panics if the container doesn't exist.
+func (d *Docker) AddLog(ref, stream, line string, at time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, err := d.findContainer(ref)
+	if err != nil {
+		panic(err)
+	}
+	entry := logEntry{stream: stream, line: line, at: at}
+	d.logs[c.ID] = append(d.logs[c.ID], entry)
+	for _, f := range d.followers[c.ID] {
+		if data := formatLogs(f.options, f.tty, []logEntry{entry}); len(data) > 0 {
+			select {
+			case f.data <- data:
+			default: // the reader is too slow, the line is lost
+			}
+		}
+	}
+}
+
+// Containers returns the containers, in order of creation
+func (d *Docker) Containers() []types.Container {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var containers []types.Container
+	for _, c := range d.containers {
+		containers = append(containers, *c)
+	}
+	return containers
+}
+
+// Networks returns the networks, in order of creation
+func (d *Docker) Networks() []types.NetworkResource {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var networks []types.NetworkResource
+	for _, n := range d.networks {
+		networks = append(networks, *n)
+	}
+	return networks
+}
+
+// Volumes returns the volumes, in order of creation
+func (d *Docker) Volumes() []types.Volume {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var volumes []types.Volume
+	for _, v := range d.volumes {
+		volumes = append(volumes, *v)
+	}
+	return volumes
+}
+
+// Images returns the images, in order of creation
+func (d *Docker) Images() []types.ImageSummary {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var images []types.ImageSummary
+	for _, img := range d.images {
+		images = append(images, *img)
+	}
+	return images
+}
+
+// call records the call of a method and returns its configured failure
+func (d *Docker) call(method string) error {
+	d.calls = append(d.calls, method)
+	return d.failures[method]
+}
+
+func (d *Docker) newID() string {
+	d.lastID++
+	return fmt.Sprintf("%064x", d.lastID)
+}
+
+func (d *Docker) addImage(ref string) *types.ImageSummary {
+	if !strings.Contains(ref[strings.LastIndex(ref, "/")+1:], ":") {
+		ref += ":latest"
+	}
+	img := &types.ImageSummary{
+		ID:       "sha256:" + d.newID(),
+		RepoTags: []string{ref},
+		Created:  time.Now().Unix(),
+		Size:     1024,
+	}
+	d.images = append(d.images, img)
+	return img
+}
+
+// findImage looks for an image by reference, with or without tag, or by id
+func (d *Docker) findImage(ref string) *types.ImageSummary {
+	for _, img := range d.images {
+		if img.ID == ref {
+			return img
+		}
+		for _, tag := range img.RepoTags {
+			if tag == ref || tag == ref+":latest" {
+				return img
+			}
+		}
+	}
+	return nil
+}
+
+// findContainer looks for a container by id, id prefix or name
+func (d *Docker) findContainer(ref string) (*types.Container, error) {
+	for _, c := range d.containers {
+		if c.ID == ref || (len(ref) >= 12 && strings.HasPrefix(c.ID, ref)) {
+			return c, nil
+		}
+		for _, name := range c.Names {
+			if name == "/"+strings.TrimPrefix(ref, "/") {
+				return c, nil
+			}
+		}
+	}
+	return nil, errors.New("Error: No such container: " + ref)
+}
+
+// findNetwork looks for a network by id or name
+func (d *Docker) findNetwork(ref string) *types.NetworkResource {
+	for _, n := range d.networks {
+		if n.ID == ref || n.Name == ref {
+			return n
+		}
+	}
+	return nil
+}
+
+// findVolume looks for a volume by name
+func (d *Docker) findVolume(name string) *types.Volume {
+	for _, v := range d.volumes {
+		if v.Name == name {
+			return v
+		}
+	}
+	return nil
+}
+
+func (d *Docker) addVolume(name, driver string, labels map[string]string) *types.Volume {
+	if driver == "" {
+		driver = "local"
+	}
+	v := &types.Volume{
+		Name:       name,
+		Driver:     driver,
+		Labels:     labels,
+		Mountpoint: "/var/lib/docker/volumes/" + name + "/_data",
+		Scope:      "local",
+		CreatedAt:  time.Now().UTC().Format(time.RFC3339),
+	}
+	d.volumes = append(d.volumes, v)
+	return v
+}
+
+// connect adds a container to a network, the built-in networks always exist
+func (d *Docker) connect(c *types.Container, ref string, settings *network.EndpointSettings) error {
+	name := ref
+	if n := d.findNetwork(ref); n != nil {
+		name = n.Name
+		n.Containers[c.ID] = types.EndpointResource{Name: strings.TrimPrefix(strings.Join(c.Names, ""), "/")}
+	} else if ref != "bridge" && ref != "host" && ref != "none" {
+		return errors.New("Error: No such network: " + ref)
+	}
+	if settings == nil {
+		settings = &network.EndpointSettings{}
+	}
+	if c.NetworkSettings == nil {
+		c.NetworkSettings = &types.SummaryNetworkSettings{Networks: map[string]*network.EndpointSettings{}}
+	}
+	c.NetworkSettings.Networks[name] = settings
+	return nil
+}
+
+// stopFollowers ends the streams following the logs of a container
+func (d *Docker) stopFollowers(id string) {
+	for _, f := range d.followers[id] {
+		close(f.data)
+	}
+	delete(d.followers, id)
+}
+
+// removeFollower forgets a stream whose reader went away
+func (d *Docker) removeFollower(id string, f *logFollower) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	followers := d.followers[id]
+	for i := range followers {
+		if followers[i] == f {
+			d.followers[id] = append(followers[:i], followers[i+1:]...)
+			return
+		}
+	}
+}
+
+func setState(c *types.Container, state string) {
+	c.State = state
+	switch state {
+	case "running":
+		c.Status = "Up"
+	case "exited":
+		c.Status = "Exited (0)"
+	default:
+		c.Status = "Created"
+	}
+}
+
+// ContainerList lists the containers, supporting the id and name filters
+func (d *Docker) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.call("ContainerList"); err != nil {
+		return nil, err
+	}
+	containers := []types.Container{}
+	for _, c := range d.containers {
+		if !options.All && c.State != "running" {
+			continue
+		}
+		if options.Filters.Include("id") && !matchAny(options.Filters.Get("id"), func(id string) bool { return strings.HasPrefix(c.ID, id) }) {
+			continue
+		}
+		if options.Filters.Include("name") && !matchAny(options.Filters.Get("name"), func(name string) bool {
+			return matchAny(c.Names, func(n string) bool { return strings.Contains(n, name) })
+		}) {
+			continue
+		}
+		if !matchLabels(options.Filters, c.Labels) {
+			continue
+		}
+		containers = append(containers, *c)
+	}
+	return containers, nil
+}
+
+// ContainerCreate creates a container from an image that must have been pulled
+func (d *Docker) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, containerName string) (container.ContainerCreateCreatedBody, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.call("ContainerCreate"); err != nil {
+		return container.ContainerCreateCreatedBody{}, err
+	}
+	img := d.findImage(config.Image)
+	if img == nil {
+		return container.ContainerCreateCreatedBody{}, errors.New("Error: No such image: " + config.Image)
+	}
+	if containerName != "" {
+		if _, err := d.findContainer(containerName); err == nil {
+			return container.ContainerCreateCreatedBody{}, fmt.Errorf("Conflict. The container name \"/%s\" is already in use", containerName)
+		}
+	}
+	c := &types.Container{
+		ID:      d.newID(),
+		Image:   config.Image,
+		ImageID: img.ID,
+		Command: strings.Join(config.Cmd, " "),
+		Labels:  config.Labels,
+		Created: time.Now().Unix(),
+	}
+	if containerName != "" {
+		c.Names = []string{"/" + containerName}
+	}
+	if hostConfig == nil {
+		hostConfig = &container.HostConfig{}
+	}
+	c.HostConfig.NetworkMode = string(hostConfig.NetworkMode)
+	if networkingConfig != nil {
+		for ref := range networkingConfig.EndpointsConfig {
+			if d.findNetwork(ref) == nil && ref != "bridge" && ref != "host" && ref != "none" {
+				return container.ContainerCreateCreatedBody{}, errors.New("Error: No such network: " + ref)
+			}
+		}
+	}
+	// named volumes are created when missing, like docker does
+	for _, bind := range hostConfig.Binds {
+		parts := strings.Split(bind, ":")
+		if len(parts) < 2 {
+			return container.ContainerCreateCreatedBody{}, errors.New("invalid volume specification: " + bind)
+		}
+		mp := types.MountPoint{Source: parts[0], Destination: parts[1], RW: len(parts) < 3 || parts[2] != "ro", Type: mount.TypeBind}
+		if !strings.HasPrefix(parts[0], "/") {
+			v := d.findVolume(parts[0])
+			if v == nil {
+				v = d.addVolume(parts[0], "", nil)
+			}
+			mp = types.MountPoint{Name: v.Name, Source: v.Mountpoint, Destination: parts[1], RW: mp.RW, Type: mount.TypeVolume, Driver: v.Driver}
+		}
+		c.Mounts = append(c.Mounts, mp)
+	}
+	if networkingConfig != nil {
+		for ref, settings := range networkingConfig.EndpointsConfig {
+			_ = d.connect(c, ref, settings)
+		}
+	}
+	setState(c, "created")
+	d.containers = append(d.containers, c)
+	d.configs[c.ID] = config
+	d.hosts[c.ID] = hostConfig
+	return container.ContainerCreateCreatedBody{ID: c.ID}, nil
+}
+
+// ContainerStart starts a container
+func (d *Docker) ContainerStart(ctx context.Context, containerID string, options types.ContainerStartOptions) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.call("ContainerStart"); err != nil {
+		return err
+	}
+	c, err := d.findContainer(containerID)
+	if err != nil {
+		return err
+	}
+	setState(c, "running")
+	return nil
+}
+
+// ContainerStop stops a container
+func (d *Docker) ContainerStop(ctx context.Context, containerID string, timeout *time.Duration) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.call("ContainerStop"); err != nil {
+		return err
+	}
+	c, err := d.findContainer(containerID)
+	if err != nil {
+		return err
+	}
+	setState(c, "exited")
+	d.stopFollowers(c.ID)
+	return nil
+}
+
+// ContainerRemove removes a container, running containers require Force
+func (d *Docker) ContainerRemove(ctx context.Context, containerID string, options types.ContainerRemoveOptions) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.call("ContainerRemove"); err != nil {
+		return err
+	}
+	c, err := d.findContainer(containerID)
+	if err != nil {
+		return err
+	}
+	if c.State == "running" && !options.Force {
+		return errors.New("Error: You cannot remove a running container " + c.ID + ". Stop the container before attempting removal or force remove")
+	}
+	for i := range d.containers {
+		if d.containers[i] == c {
+			d.containers = append(d.containers[:i], d.containers[i+1:]...)
+			break
+		}
+	}
+	for _, n := range d.networks {
+		delete(n.Containers, c.ID)
+	}
+	d.stopFollowers(c.ID)
+	delete(d.configs, c.ID)
+	delete(d.hosts, c.ID)
+	delete(d.logs, c.ID)
+	return nil
+}
+
+// ContainerRename renames a container
+func (d *Docker) ContainerRename(ctx context.Context, containerID, newContainerName string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.call("ContainerRename"); err != nil {
+		return err
+	}
+	c, err := d.findContainer(containerID)
+	if err != nil {
+		return err
+	}
+	if other, errFind := d.findContainer(newContainerName); errFind == nil && other != c {
+		return fmt.Errorf("Conflict. The container name \"/%s\" is already in use", newContainerName)
+	}
+	c.Names = []string{"/" + newContainerName}
+	return nil
+}
+
+// ContainerInspect returns the state of a container and the config it was
+// created with
+func (d *Docker) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.call("ContainerInspect"); err != nil {
+		return types.ContainerJSON{}, err
+	}
+	c, err := d.findContainer(containerID)
+	if err != nil {
+		return types.ContainerJSON{}, err
+	}
+	config := d.configs[c.ID]
+	if config == nil {
+		config = &container.Config{Image: c.Image}
+	}
+	host := d.hosts[c.ID]
+	if host == nil {
+		host = &container.HostConfig{NetworkMode: container.NetworkMode(c.HostConfig.NetworkMode)}
+	}
+	name := ""
+	if len(c.Names) > 0 {
+		name = c.Names[0]
+	}
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:      c.ID,
+			Created: time.Unix(c.Created, 0).UTC().Format(time.RFC3339Nano),
+			Name:    name,
+			Image:   c.ImageID,
+			State: &types.ContainerState{
+				Status:  c.State,
+				Running: c.State == "running",
+			},
+			HostConfig: host,
+		},
+		Mounts: c.Mounts,
+		Config: config,
+	}, nil
+}
+
+// ContainerLogs returns the lines added with AddLog, multiplexed like the
+// docker daemon does unless the container has a tty. With Follow the stream
+// stays open, getting the new lines, until ctx is done or the container stops.
+func (d *Docker) ContainerLogs(ctx context.Context, containerID string, options types.ContainerLogsOptions) (io.ReadCloser, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.call("ContainerLogs"); err != nil {
+		return nil, err
+	}
+	c, err := d.findContainer(containerID)
+	if err != nil {
+		return nil, err
+	}
+	entries := d.logs[c.ID]
+	if options.Tail != "" && options.Tail != "all" {
+		tail, err := strconv.Atoi(options.Tail)
+		if err != nil || tail < 0 {
+			return nil, errors.New("invalid value for tail: " + options.Tail)
+		}
+		if tail < len(entries) {
+			entries = entries[len(entries)-tail:]
+		}
+	}
+	if _, err := logTime(options.Since); err != nil {
+		return nil, err
+	}
+	if _, err := logTime(options.Until); err != nil {
+		return nil, err
+	}
+	tty := d.configs[c.ID] != nil && d.configs[c.ID].Tty
+	data := formatLogs(options, tty, entries)
+	if !options.Follow || c.State != "running" {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+
+	f := &logFollower{options: options, tty: tty, data: make(chan []byte, 100)}
+	f.data <- data
+	d.followers[c.ID] = append(d.followers[c.ID], f)
+	r, w := io.Pipe()
+	go func() {
+		defer d.removeFollower(c.ID, f)
+		for {
+			select {
+			case data, ok := <-f.data:
+				if !ok {
+					w.Close()
+					return
+				}
+				if _, err := w.Write(data); err != nil {
+					return
+				}
+			case <-ctx.Done():
+				w.CloseWithError(ctx.Err())
+				return
+			}
+		}
+	}()
+	return r, nil
+}
+
+// logTime parses the since and until options of ContainerLogs, which take
+// the same values of docker logs
+func logTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	ts, err := timetypes.GetTimestamp(value, time.Now())
+	if err != nil {
+		return time.Time{}, err
+	}
+	sec, nsec, err := timetypes.ParseTimestamps(ts, 0)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(sec, nsec), nil
+}
+
+// formatLogs writes the lines selected by the options in the format of the
+// docker daemon
+func formatLogs(options types.ContainerLogsOptions, tty bool, entries []logEntry) []byte {
+	since, _ := logTime(options.Since)
+	until, _ := logTime(options.Until)
+	var buf bytes.Buffer
+	stdout, stderr := io.Writer(&buf), io.Writer(&buf)
+	if !tty {
+		stdout, stderr = stdcopy.NewStdWriter(&buf, stdcopy.Stdout), stdcopy.NewStdWriter(&buf, stdcopy.Stderr)
+	}
+	for _, entry := range entries {
+		if entry.at.Before(since) || (!until.IsZero() && entry.at.After(until)) {
+			continue
+		}
+		line := entry.line + "\n"
+		if options.Timestamps {
+			line = entry.at.UTC().Format(time.RFC3339Nano) + " " + line
+		}
+		switch {
+		case entry.stream == "stdout" && options.ShowStdout:
+			fmt.Fprint(stdout, line)
+		case entry.stream == "stderr" && options.ShowStderr:
+			fmt.Fprint(stderr, line)
+		}
+	}
+	return buf.Bytes()
+}
+
+// ContainerExecCreate creates an exec instance in a running container
+func (d *Docker) ContainerExecCreate(ctx context.Context, containerID string, config types.ExecConfig) (types.IDResponse, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.call("ContainerExecCreate"); err != nil {
+		return types.IDResponse{}, err
+	}
+	c, err := d.findContainer(containerID)
+	if err != nil {
+		return types.IDResponse{}, err
+	}
+	if c.State != "running" {
+		return types.IDResponse{}, fmt.Errorf("Container %s is not running", c.ID)
+	}
+	if len(config.Cmd) == 0 {
+		return types.IDResponse{}, errors.New("No exec command specified")
+	}
+	id := d.newID()
+	d.execs[id] = &fakeExec{
+		inspect: types.ContainerExecInspect{ExecID: id, ContainerID: c.ID},
+		config:  config,
+	}
+	return types.IDResponse{ID: id}, nil
+}
+
+// ContainerExecAttach starts an exec instance, running the ExecFunc until
+// it returns or the connection is closed
+func (d *Docker) ContainerExecAttach(ctx context.Context, execID string, config types.ExecStartCheck) (types.HijackedResponse, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.call("ContainerExecAttach"); err != nil {
+		return types.HijackedResponse{}, err
+	}
+	e := d.execs[execID]
+	if e == nil {
+		return types.HijackedResponse{}, errors.New("No such exec instance: " + execID)
+	}
+	if e.inspect.Running || e.inspect.Pid != 0 {
+		return types.HijackedResponse{}, errors.New("Error: Exec command " + execID + " has already run")
+	}
+	e.inspect.Running = true
+	e.inspect.Pid = 1000 + d.lastID
+
+	client, server := net.Pipe()
+	stdout, stderr := io.Writer(server), io.Writer(server)
+	if !e.config.Tty {
+		stdout, stderr = stdcopy.NewStdWriter(server, stdcopy.Stdout), stdcopy.NewStdWriter(server, stdcopy.Stderr)
+	}
+	run := d.execFunc
+	go func() {
+		code := run(e.config.Cmd, server, stdout, stderr)
+		d.mu.Lock()
+		e.inspect.Running = false
+		e.inspect.ExitCode = code
+		d.mu.Unlock()
+		server.Close()
+	}()
+	return types.HijackedResponse{Conn: client, Reader: bufio.NewReader(client)}, nil
+}
+
+// ContainerExecResize changes the size of the tty of an exec instance
+func (d *Docker) ContainerExecResize(ctx context.Context, execID string, options types.ResizeOptions) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.call("ContainerExecResize"); err != nil {
+		return err
+	}
+	e := d.execs[execID]
+	if e == nil {
+		return errors.New("No such exec instance: " + execID)
+	}
+	if !e.config.Tty {
+		return errors.New("Error: Exec " + execID + " doesn't have a tty")
+	}
+	e.size = options
+	return nil
+}
+
+// ContainerExecInspect returns the state of an exec instance
+func (d *Docker) ContainerExecInspect(ctx context.Context, execID string) (types.ContainerExecInspect, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.call("ContainerExecInspect"); err != nil {
+		return types.ContainerExecInspect{}, err
+	}
+	e := d.execs[execID]
+	if e == nil {
+		return types.ContainerExecInspect{}, errors.New("No such exec instance: " + execID)
+	}
+	return e.inspect, nil
+}
+
+// ImageList lists the images, supporting the reference filter
+func (d *Docker) ImageList(ctx context.Context, options types.ImageListOptions) ([]types.ImageSummary, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.call("ImageList"); err != nil {
+		return nil, err
+	}
+	images := []types.ImageSummary{}
+	for _, img := range d.images {
+		if options.Filters.Include("reference") && !matchAny(options.Filters.Get("reference"), func(ref string) bool {
+			return matchAny(img.RepoTags, func(tag string) bool { return tag == ref || tag == ref+":latest" })
+		}) {
+			continue
+		}
+		images = append(images, *img)
+	}
+	return images, nil
+}
+
+// ImageInspectWithRaw returns an image, the error satisfies
+// docker.IsErrNotFound when it's missing
+func (d *Docker) ImageInspectWithRaw(ctx context.Context, imageID string) (types.ImageInspect, []byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.call("ImageInspectWithRaw"); err != nil {
+		return types.ImageInspect{}, nil, err
+	}
+	img := d.findImage(imageID)
+	if img == nil {
+		return types.ImageInspect{}, nil, notFoundError("Error: No such image: " + imageID)
+	}
+	inspect := types.ImageInspect{
+		ID:       img.ID,
+		RepoTags: img.RepoTags,
+		Created:  time.Unix(img.Created, 0).UTC().Format(time.RFC3339Nano),
+		Size:     img.Size,
+	}
+	raw, err := json.Marshal(inspect)
+	return inspect, raw, err
+}
+
+// ImagePull adds the image. The returned stream has the progress of the
+// download of its layers, set by SetImageLayers, like the one of docker; the
+// images already pulled are up to date.
+func (d *Docker) ImagePull(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.call("ImagePull"); err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	tag := "latest"
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		tag = ref[i+1:]
+	}
+	enc.Encode(jsonmessage.JSONMessage{ID: tag, Status: "Pulling from " + ref})
+	if message, ok := d.pullErrors[ref]; ok {
+		enc.Encode(jsonmessage.JSONMessage{Error: &jsonmessage.JSONError{Message: message}, ErrorMessage: message})
+		return ioutil.NopCloser(&out), nil
+	}
+	if d.findImage(ref) != nil {
+		enc.Encode(jsonmessage.JSONMessage{Status: "Status: Image is up to date for " + ref})
+		return ioutil.NopCloser(&out), nil
+	}
+
+	layers := d.layers[ref]
+	for i := range layers {
+		enc.Encode(jsonmessage.JSONMessage{ID: layerID(i), Status: "Pulling fs layer"})
+	}
+	for i, size := range layers {
+		for _, current := range []int64{size / 2, size} {
+			enc.Encode(jsonmessage.JSONMessage{ID: layerID(i), Status: "Downloading", Progress: &jsonmessage.JSONProgress{Current: current, Total: size}})
+		}
+		enc.Encode(jsonmessage.JSONMessage{ID: layerID(i), Status: "Download complete"})
+		enc.Encode(jsonmessage.JSONMessage{ID: layerID(i), Status: "Extracting", Progress: &jsonmessage.JSONProgress{Current: size, Total: size}})
+		enc.Encode(jsonmessage.JSONMessage{ID: layerID(i), Status: "Pull complete"})
+	}
+	img := d.addImage(ref)
+	enc.Encode(jsonmessage.JSONMessage{Status: "Digest: " + img.ID})
+	enc.Encode(jsonmessage.JSONMessage{Status: "Status: Downloaded newer image for " + ref})
+	return ioutil.NopCloser(&out), nil
+}
+
+// layerID is the short id of the i-th layer of an image
+func layerID(i int) string {
+	return fmt.Sprintf("%012x", i+1)
+}
+
+// ImagesPrune removes the images not used by any container: the untagged
+// ones, all of them with dangling=false. It supports the label and until
+// filters.
+func (d *Docker) ImagesPrune(ctx context.Context, pruneFilter filters.Args) (types.ImagesPruneReport, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	report := types.ImagesPruneReport{}
+	if err := d.call("ImagesPrune"); err != nil {
+		return report, err
+	}
+	until, err := pruneUntil(pruneFilter)
+	if err != nil {
+		return report, err
+	}
+	all := matchAny(pruneFilter.Get("dangling"), func(v string) bool { return v == "false" })
+	used := map[string]bool{}
+	for _, c := range d.containers {
+		used[c.ImageID] = true
+	}
+	images := d.images[:0]
+	for _, img := range d.images {
+		dangling := len(img.RepoTags) == 0 || img.RepoTags[0] == "<none>:<none>"
+		if used[img.ID] || (!dangling && !all) ||
+			!matchLabels(pruneFilter, img.Labels) || (!until.IsZero() && !time.Unix(img.Created, 0).Before(until)) {
+			images = append(images, img)
+			continue
+		}
+		report.ImagesDeleted = append(report.ImagesDeleted, types.ImageDeleteResponseItem{Deleted: img.ID})
+		report.SpaceReclaimed += uint64(img.Size)
+	}
+	d.images = images
+	return report, nil
+}
+
+// VolumesPrune removes the volumes not used by any container, it supports
+// the label filter
+func (d *Docker) VolumesPrune(ctx context.Context, pruneFilter filters.Args) (types.VolumesPruneReport, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	report := types.VolumesPruneReport{}
+	if err := d.call("VolumesPrune"); err != nil {
+		return report, err
+	}
+	if pruneFilter.Include("until") {
+		return report, errors.New("Invalid filter 'until'")
+	}
+	used := map[string]bool{}
+	for _, c := range d.containers {
+		for _, mp := range c.Mounts {
+			used[mp.Name] = true
+		}
+	}
+	volumes := d.volumes[:0]
+	for _, v := range d.volumes {
+		if used[v.Name] || !matchLabels(pruneFilter, v.Labels) {
+			volumes = append(volumes, v)
+			continue
+		}
+		report.VolumesDeleted = append(report.VolumesDeleted, v.Name)
+	}
+	d.volumes = volumes
+	return report, nil
+}
+
+// NetworksPrune removes the networks without containers, it supports the
+// label and until filters
+func (d *Docker) NetworksPrune(ctx context.Context, pruneFilter filters.Args) (types.NetworksPruneReport, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	report := types.NetworksPruneReport{}
+	if err := d.call("NetworksPrune"); err != nil {
+		return report, err
+	}
+	until, err := pruneUntil(pruneFilter)
+	if err != nil {
+		return report, err
+	}
+	networks := d.networks[:0]
+	for _, n := range d.networks {
+		if len(n.Containers) > 0 || !matchLabels(pruneFilter, n.Labels) || (!until.IsZero() && !n.Created.Before(until)) {
+			networks = append(networks, n)
+			continue
+		}
+		report.NetworksDeleted = append(report.NetworksDeleted, n.Name)
+	}
+	d.networks = networks
+	return report, nil
+}
+
+// BuildCachePrune empties the build cache set by SetBuildCache
+func (d *Docker) BuildCachePrune(ctx context.Context) (*types.BuildCachePruneReport, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.call("BuildCachePrune"); err != nil {
+		return nil, err
+	}
+	report := &types.BuildCachePruneReport{SpaceReclaimed: d.buildCache}
+	d.buildCache = 0
+	return report, nil
+}
+
+// pruneUntil returns the time of the until filter, zero if missing
+func pruneUntil(pruneFilter filters.Args) (time.Time, error) {
+	values := pruneFilter.Get("until")
+	if len(values) == 0 {
+		return time.Time{}, nil
+	}
+	return logTime(values[0])
+}
+
+// RegistryLogin accepts any credentials
+func (d *Docker) RegistryLogin(ctx context.Context, auth types.AuthConfig) (registry.AuthenticateOKBody, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.call("RegistryLogin"); err != nil {
+		return registry.AuthenticateOKBody{}, err
+	}
+	return registry.AuthenticateOKBody{Status: "Login Succeeded"}, nil
+}
+
+// NetworkCreate creates a network, names are unique
+func (d *Docker) NetworkCreate(ctx context.Context, name string, options types.NetworkCreate) (types.NetworkCreateResponse, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.call("NetworkCreate"); err != nil {
+		return types.NetworkCreateResponse{}, err
+	}
+	if d.findNetwork(name) != nil {
+		return types.NetworkCreateResponse{}, errors.New("Error: network with name " + name + " already exists")
+	}
+	driver := options.Driver
+	if driver == "" {
+		driver = "bridge"
+	}
+	n := &types.NetworkResource{
+		ID:         d.newID(),
+		Name:       name,
+		Created:    time.Now(),
+		Scope:      "local",
+		Driver:     driver,
+		Labels:     options.Labels,
+		Containers: map[string]types.EndpointResource{},
+	}
+	d.networks = append(d.networks, n)
+	return types.NetworkCreateResponse{ID: n.ID}, nil
+}
+
+// NetworkList lists the networks, supporting the name and label filters
+func (d *Docker) NetworkList(ctx context.Context, options types.NetworkListOptions) ([]types.NetworkResource, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.call("NetworkList"); err != nil {
+		return nil, err
+	}
+	networks := []types.NetworkResource{}
+	for _, n := range d.networks {
+		if options.Filters.Include("name") && !matchAny(options.Filters.Get("name"), func(name string) bool { return strings.Contains(n.Name, name) }) {
+			continue
+		}
+		if !matchLabels(options.Filters, n.Labels) {
+			continue
+		}
+		networks = append(networks, *n)
+	}
+	return networks, nil
+}
+
+// NetworkConnect connects a container to a network
+func (d *Docker) NetworkConnect(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.call("NetworkConnect"); err != nil {
+		return err
+	}
+	c, err := d.findContainer(containerID)
+	if err != nil {
+		return err
+	}
+	return d.connect(c, networkID, config)
+}
+
+// NetworkRemove removes a network without containers
+func (d *Docker) NetworkRemove(ctx context.Context, networkID string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.call("NetworkRemove"); err != nil {
+		return err
+	}
+	n := d.findNetwork(networkID)
+	if n == nil {
+		return errors.New("Error: No such network: " + networkID)
+	}
+	if len(n.Containers) > 0 {
+		return fmt.Errorf("Error response from daemon: error while removing network: network %s id %s has active endpoints", n.Name, n.ID)
+	}
+	for i := range d.networks {
+		if d.networks[i] == n {
+			d.networks = append(d.networks[:i], d.networks[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// VolumeCreate creates a volume, or returns the one with the same name
+func (d *Docker) VolumeCreate(ctx context.Context, options volumetypes.VolumeCreateBody) (types.Volume, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.call("VolumeCreate"); err != nil {
+		return types.Volume{}, err
+	}
+	v := d.findVolume(options.Name)
+	if v == nil {
+		v = d.addVolume(options.Name, options.Driver, options.Labels)
+	}
+	return *v, nil
+}
+
+// VolumeList lists the volumes, supporting the name and label filters
+func (d *Docker) VolumeList(ctx context.Context, filter filters.Args) (volumetypes.VolumeListOKBody, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.call("VolumeList"); err != nil {
+		return volumetypes.VolumeListOKBody{}, err
+	}
+	res := volumetypes.VolumeListOKBody{Volumes: []*types.Volume{}}
+	for _, v := range d.volumes {
+		if filter.Include("name") && !matchAny(filter.Get("name"), func(name string) bool { return strings.Contains(v.Name, name) }) {
+			continue
+		}
+		if !matchLabels(filter, v.Labels) {
+			continue
+		}
+		volume := *v
+		res.Volumes = append(res.Volumes, &volume)
+	}
+	return res, nil
+}
+
+// VolumeRemove removes a volume not used by any container
+func (d *Docker) VolumeRemove(ctx context.Context, volumeID string, force bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.call("VolumeRemove"); err != nil {
+		return err
+	}
+	v := d.findVolume(volumeID)
+	if v == nil {
+		return errors.New("Error: No such volume: " + volumeID)
+	}
+	for _, c := range d.containers {
+		for _, mp := range c.Mounts {
+			if mp.Name == v.Name {
+				return fmt.Errorf("Error response from daemon: remove %s: volume is in use - [%s]", v.Name, c.ID)
+			}
+		}
+	}
+	for i := range d.volumes {
+		if d.volumes[i] == v {
+			d.volumes = append(d.volumes[:i], d.volumes[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// matchLabels tells if the labels match all the label filters, given as
+// key or key=value, and none of the label! filters
+func matchLabels(args filters.Args, labels map[string]string) bool {
+	match := func(filter string) bool {
+		kv := strings.SplitN(filter, "=", 2)
+		value, ok := labels[kv[0]]
+		return ok && (len(kv) == 1 || value == kv[1])
+	}
+	for _, filter := range args.Get("label") {
+		if !match(filter) {
+			return false
+		}
+	}
+	for _, filter := range args.Get("label!") {
+		if match(filter) {
+			return false
+		}
+	}
+	return true
+}
+
+// notFoundError is an error that docker.IsErrNotFound recognizes
+type notFoundError string
+
+func (e notFoundError) Error() string {
+	return string(e)
+}
+
+func (e notFoundError) NotFound() bool {
+	return true
+}
+
+func matchAny(values []string, match func(string) bool) bool {
+	for _, v := range values {
+		if match(v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,199 @@
+package testharness
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDocker(t *testing.T) {
+	ctx := context.Background()
+	d := NewDocker()
+	d.AddContainer("web", "nginx", "running")
+
+	_, err := d.ContainerCreate(ctx, &container.Config{Image: "redis"}, nil, nil, "cache")
+	assert.Error(t, err, "the image must be pulled first")
+
+	out, err := d.ImagePull(ctx, "redis", types.ImagePullOptions{})
+	assert.NoError(t, err)
+	out.Close()
+	created, err := d.ContainerCreate(ctx, &container.Config{Image: "redis"}, nil, nil, "cache")
+	assert.NoError(t, err)
+	_, err = d.ContainerCreate(ctx, &container.Config{Image: "redis"}, nil, nil, "cache")
+	assert.Error(t, err, "names are unique")
+	assert.NoError(t, d.ContainerStart(ctx, created.ID, types.ContainerStartOptions{}))
+
+	running, err := d.ContainerList(ctx, types.ContainerListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, running, 2)
+	filtered, err := d.ContainerList(ctx, types.ContainerListOptions{All: true, Filters: filters.NewArgs(filters.Arg("id", created.ID))})
+	assert.NoError(t, err)
+	if assert.Len(t, filtered, 1) {
+		assert.Equal(t, []string{"/cache"}, filtered[0].Names)
+		assert.Equal(t, "running", filtered[0].State)
+	}
+
+	assert.NoError(t, d.ContainerRename(ctx, "cache", "redis"))
+	assert.NoError(t, d.ContainerStop(ctx, "redis", nil))
+	assert.Error(t, d.ContainerRemove(ctx, "web", types.ContainerRemoveOptions{}), "web is running")
+	assert.NoError(t, d.ContainerRemove(ctx, "redis", types.ContainerRemoveOptions{}))
+
+	images, err := d.ImageList(ctx, types.ImageListOptions{Filters: filters.NewArgs(filters.Arg("reference", "redis"))})
+	assert.NoError(t, err)
+	assert.Len(t, images, 1)
+	report, err := d.ImagesPrune(ctx, filters.NewArgs())
+	assert.NoError(t, err)
+	assert.Empty(t, report.ImagesDeleted, "only the dangling images by default")
+	report, err = d.ImagesPrune(ctx, filters.NewArgs(filters.Arg("dangling", "false")))
+	assert.NoError(t, err)
+	assert.Len(t, report.ImagesDeleted, 1)
+	if assert.Len(t, d.Images(), 1) {
+		assert.Equal(t, []string{"nginx:latest"}, d.Images()[0].RepoTags)
+	}
+
+	d.Fail("ContainerStart", errors.New("boom"))
+	assert.EqualError(t, d.ContainerStart(ctx, "web", types.ContainerStartOptions{}), "boom")
+	d.Fail("ContainerStart", nil)
+	assert.NoError(t, d.ContainerStart(ctx, "web", types.ContainerStartOptions{}))
+	assert.Equal(t, "ContainerStart", d.Calls()[len(d.Calls())-1])
+}
+
+func TestDockerLogs(t *testing.T) {
+	ctx := context.Background()
+	d := NewDocker()
+	d.AddContainer("web", "nginx", "running")
+	d.AddLog("web", "stdout", "ready", time.Now())
+	d.AddLog("web", "stderr", "warning", time.Now())
+
+	out, err := d.ContainerLogs(ctx, "web", types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true})
+	assert.NoError(t, err)
+	var stdout, stderr bytes.Buffer
+	_, err = stdcopy.StdCopy(&stdout, &stderr, out)
+	assert.NoError(t, err)
+	assert.Equal(t, "ready\n", stdout.String())
+	assert.Equal(t, "warning\n", stderr.String())
+
+	follow, err := d.ContainerLogs(ctx, "web", types.ContainerLogsOptions{ShowStdout: true, Follow: true, Tail: "0"})
+	assert.NoError(t, err)
+	d.AddLog("web", "stdout", "done", time.Now())
+	assert.NoError(t, d.ContainerStop(ctx, "web", nil))
+	stdout.Reset()
+	_, err = stdcopy.StdCopy(&stdout, ioutil.Discard, follow)
+	assert.NoError(t, err)
+	assert.Equal(t, "done\n", stdout.String())
+
+	info, err := d.ContainerInspect(ctx, "web")
+	assert.NoError(t, err)
+	assert.Equal(t, "/web", info.Name)
+	assert.False(t, info.State.Running)
+}
+
+func TestDockerExec(t *testing.T) {
+	ctx := context.Background()
+	d := NewDocker()
+	d.AddContainer("web", "nginx", "running")
+
+	exec, err := d.ContainerExecCreate(ctx, "web", types.ExecConfig{Cmd: []string{"cat"}})
+	assert.NoError(t, err)
+	conn, err := d.ContainerExecAttach(ctx, exec.ID, types.ExecStartCheck{})
+	assert.NoError(t, err)
+	go func() {
+		_, _ = conn.Conn.Write([]byte("hello\nexit 2\n"))
+	}()
+	var stdout bytes.Buffer
+	_, err = stdcopy.StdCopy(&stdout, ioutil.Discard, conn.Reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello\n", stdout.String())
+	inspect, err := d.ContainerExecInspect(ctx, exec.ID)
+	assert.NoError(t, err)
+	assert.False(t, inspect.Running)
+	assert.Equal(t, 2, inspect.ExitCode)
+	assert.Error(t, d.ContainerExecResize(ctx, exec.ID, types.ResizeOptions{Height: 24, Width: 80}), "no tty")
+}
+
+func TestDockerNetworksVolumes(t *testing.T) {
+	ctx := context.Background()
+	d := NewDocker()
+	d.AddImage("postgres")
+	labels := filters.NewArgs(filters.Arg("label", "stack=shop"))
+
+	_, err := d.NetworkCreate(ctx, "shop_back", types.NetworkCreate{Labels: map[string]string{"stack": "shop"}})
+	assert.NoError(t, err)
+	_, err = d.NetworkCreate(ctx, "shop_back", types.NetworkCreate{})
+	assert.Error(t, err, "names are unique")
+	_, err = d.ContainerCreate(ctx, &container.Config{Image: "postgres"}, nil, &network.NetworkingConfig{EndpointsConfig: map[string]*network.EndpointSettings{"missing": {}}}, "db")
+	assert.Error(t, err, "the network must exist")
+
+	created, err := d.ContainerCreate(ctx, &container.Config{Image: "postgres"}, &container.HostConfig{Binds: []string{"shop_data:/data"}},
+		&network.NetworkingConfig{EndpointsConfig: map[string]*network.EndpointSettings{"shop_back": {}}}, "db")
+	assert.NoError(t, err)
+	networks, err := d.NetworkList(ctx, types.NetworkListOptions{Filters: labels})
+	assert.NoError(t, err)
+	if assert.Len(t, networks, 1) {
+		assert.Contains(t, networks[0].Containers, created.ID)
+	}
+	if assert.Len(t, d.Volumes(), 1, "named volumes are created with the container") {
+		assert.Equal(t, "shop_data", d.Volumes()[0].Name)
+	}
+	volumes, err := d.VolumeList(ctx, labels)
+	assert.NoError(t, err)
+	assert.Empty(t, volumes.Volumes)
+
+	assert.Error(t, d.NetworkRemove(ctx, "shop_back"), "the network has active endpoints")
+	assert.Error(t, d.VolumeRemove(ctx, "shop_data", false), "the volume is in use")
+	assert.NoError(t, d.ContainerRemove(ctx, created.ID, types.ContainerRemoveOptions{}))
+	assert.NoError(t, d.NetworkRemove(ctx, "shop_back"))
+	assert.NoError(t, d.VolumeRemove(ctx, "shop_data", false))
+	assert.Empty(t, d.Networks())
+	assert.Empty(t, d.Volumes())
+}
+
+func TestDockerPull(t *testing.T) {
+	ctx := context.Background()
+	d := NewDocker()
+	d.SetImageLayers("redis", 100, 50)
+	d.FailPull("private/image", "unauthorized")
+
+	messages := func(ref string) []jsonmessage.JSONMessage {
+		out, err := d.ImagePull(ctx, ref, types.ImagePullOptions{})
+		assert.NoError(t, err)
+		defer out.Close()
+		res := []jsonmessage.JSONMessage{}
+		dec := json.NewDecoder(out)
+		for {
+			var msg jsonmessage.JSONMessage
+			if dec.Decode(&msg) != nil {
+				return res
+			}
+			res = append(res, msg)
+		}
+	}
+
+	pulled := messages("redis")
+	assert.Len(t, pulled, 15, "pulling from, 6 messages for each layer, digest and status")
+	assert.Equal(t, "Downloading", pulled[3].Status)
+	assert.Equal(t, &jsonmessage.JSONProgress{Current: 50, Total: 100}, pulled[3].Progress)
+	assert.Equal(t, "Status: Downloaded newer image for redis", pulled[len(pulled)-1].Status)
+	assert.Len(t, d.Images(), 1)
+
+	upToDate := messages("redis")
+	assert.Equal(t, "Status: Image is up to date for redis", upToDate[len(upToDate)-1].Status)
+
+	failed := messages("private/image")
+	if assert.Len(t, failed, 2) {
+		assert.EqualError(t, failed[1].Error, "unauthorized")
+	}
+	assert.Len(t, d.Images(), 1)
+}
@@ -0,0 +1,485 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2020  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package testharness
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arduino/arduino-connector/packaging"
+	apt "github.com/arduino/go-apt-client"
+	"github.com/pkg/errors"
+)
+
+// availableVersion is a version added with AddVersion
+type availableVersion struct {
+	version string
+	origin  string
+}
+
+// Packages is a fake package manager that keeps the packages and the
+// repositories in memory. It implements the PackageManager interface of the
+// connector.
+type Packages struct {
+	mu           sync.Mutex
+	packages     map[string]*apt.Package
+	upgrades     map[string]string // name -> candidate version
+	available    map[string][]availableVersion
+	held         map[string]bool
+	repositories apt.RepositoryList
+	calls        []string
+	failures     map[string]error
+	hangs        map[string]bool
+}
+
+// NewPackages returns a fake package manager without packages and repositories
+func NewPackages() *Packages {
+	return &Packages{
+		packages:  map[string]*apt.Package{},
+		upgrades:  map[string]string{},
+		available: map[string][]availableVersion{},
+		held:      map[string]bool{},
+		failures:  map[string]error{},
+		hangs:     map[string]bool{},
+	}
+}
+
+// Name returns the name of the package manager
+func (p *Packages) Name() string {
+	return "fake"
+}
+
+// Fail makes the method with the given name (eg. "Install") return err,
+// until Fail is called again with a nil error
+func (p *Packages) Fail(method string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err == nil {
+		delete(p.failures, method)
+		return
+	}
+	p.failures[method] = err
+}
+
+// Calls returns the names of the methods called so far, in order
+func (p *Packages) Calls() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string{}, p.calls...)
+}
+
+// Hang makes the method with the given name (eg. "Install") block until its
+// context is cancelled, or until Hang is called again with false
+func (p *Packages) Hang(method string, hang bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.hangs[method] = hang
+}
+
+// AddPackage adds a package known to the package manager. status is
+// installed, not-installed or config-files, as reported by dpkg.
+func (p *Packages) AddPackage(name, version, status string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.packages[name] = &apt.Package{Name: name, Version: version, Status: status, Architecture: "amd64"}
+}
+
+// AddUpgrade makes version available as an upgrade of an installed package
+func (p *Packages) AddUpgrade(name, version string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.upgrades[name] = version
+}
+
+// AddVersion makes a version of a package available from origin, it can be
+// installed by pinning the package to it
+func (p *Packages) AddVersion(name, version, origin string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.available[name] = append(p.available[name], availableVersion{version, origin})
+}
+
+// Package returns a copy of the package with the given name, nil if unknown
+func (p *Packages) Package(name string) *apt.Package {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pack, ok := p.packages[name]; ok {
+		res := *pack
+		return &res
+	}
+	return nil
+}
+
+// call records the call of a method and returns its configured failure
+func (p *Packages) call(method string) error {
+	p.calls = append(p.calls, method)
+	return p.failures[method]
+}
+
+// Search returns the packages whose name matches the pattern, sorted by name
+func (p *Packages) Search(pattern string) ([]*apt.Package, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.call("Search"); err != nil {
+		return nil, err
+	}
+	res := []*apt.Package{}
+	for name, pack := range p.packages {
+		if ok, _ := path.Match(pattern, name); ok {
+			copied := *pack
+			res = append(res, &copied)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res, nil
+}
+
+// ListUpgradable returns the installed packages with an upgrade available,
+// with the version of the upgrade
+func (p *Packages) ListUpgradable() ([]*apt.Package, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.call("ListUpgradable"); err != nil {
+		return nil, err
+	}
+	res := []*apt.Package{}
+	for name, version := range p.upgrades {
+		if pack, ok := p.packages[name]; ok && pack.Status == "installed" {
+			res = append(res, &apt.Package{Name: name, Version: version, Status: "upgradable", Architecture: pack.Architecture})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res, nil
+}
+
+// command runs a method that changes the packages: it records the call,
+// hangs if asked to, then runs do and reports its output line by line
+func (p *Packages) command(ctx context.Context, progress packaging.ProgressFunc, method string, do func() ([]byte, error)) ([]byte, error) {
+	p.mu.Lock()
+	err := p.call(method)
+	for err == nil && p.hangs[method] && ctx.Err() == nil {
+		p.mu.Unlock()
+		select {
+		case <-ctx.Done():
+		case <-time.After(10 * time.Millisecond):
+		}
+		p.mu.Lock()
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		p.mu.Unlock()
+		return nil, err
+	}
+	out, err := do()
+	p.mu.Unlock()
+
+	if progress != nil {
+		lines := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+		for i, line := range lines {
+			progress(line, method, float64(100*(i+1)/len(lines)))
+		}
+	}
+	return out, err
+}
+
+// CheckForUpdates does nothing, the upgrades are added with AddUpgrade
+func (p *Packages) CheckForUpdates(ctx context.Context, progress packaging.ProgressFunc) ([]byte, error) {
+	return p.command(ctx, progress, "CheckForUpdates", func() ([]byte, error) {
+		return []byte("Reading package lists... Done\n"), nil
+	})
+}
+
+// Install installs known packages, failing on the unknown ones
+func (p *Packages) Install(ctx context.Context, progress packaging.ProgressFunc, packs ...*apt.Package) ([]byte, error) {
+	return p.command(ctx, progress, "Install", func() ([]byte, error) {
+		if out, err := p.lookup(packs); err != nil {
+			return out, err
+		}
+		out := ""
+		for _, pack := range packs {
+			installed := p.packages[pack.Name]
+			installed.Status = "installed"
+			if pack.Version != "" {
+				installed.Version = pack.Version
+			}
+			if p.upgrades[pack.Name] == installed.Version {
+				delete(p.upgrades, pack.Name)
+			}
+			out += fmt.Sprintf("Setting up %s (%s) ...\n", pack.Name, installed.Version)
+		}
+		return []byte(out), nil
+	})
+}
+
+// Upgrade installs the upgrades of the given packages
+func (p *Packages) Upgrade(ctx context.Context, progress packaging.ProgressFunc, packs ...*apt.Package) ([]byte, error) {
+	return p.command(ctx, progress, "Upgrade", func() ([]byte, error) {
+		if out, err := p.lookup(packs); err != nil {
+			return out, err
+		}
+		names := []string{}
+		for _, pack := range packs {
+			if pack.Version != "" && p.packages[pack.Name].Status == "installed" {
+				p.upgrades[pack.Name] = pack.Version
+			}
+			names = append(names, pack.Name)
+		}
+		return p.upgrade(names), nil
+	})
+}
+
+// UpgradeAll installs all the upgrades
+func (p *Packages) UpgradeAll(ctx context.Context, progress packaging.ProgressFunc) ([]byte, error) {
+	return p.command(ctx, progress, "UpgradeAll", func() ([]byte, error) {
+		names := []string{}
+		for name := range p.upgrades {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return p.upgrade(names), nil
+	})
+}
+
+// Remove removes the given packages, leaving their configuration behind
+func (p *Packages) Remove(ctx context.Context, progress packaging.ProgressFunc, packs ...*apt.Package) ([]byte, error) {
+	return p.command(ctx, progress, "Remove", func() ([]byte, error) {
+		if out, err := p.lookup(packs); err != nil {
+			return out, err
+		}
+		out := ""
+		for _, pack := range packs {
+			p.packages[pack.Name].Status = "config-files"
+			out += fmt.Sprintf("Removing %s (%s) ...\n", pack.Name, p.packages[pack.Name].Version)
+		}
+		return []byte(out), nil
+	})
+}
+
+// lookup checks that all the packages, and their versions if pinned, are
+// known, returning the apt-get output and error otherwise
+func (p *Packages) lookup(packs []*apt.Package) ([]byte, error) {
+	for _, pack := range packs {
+		if pack == nil || pack.Name == "" {
+			return nil, errors.New("invalid package with empty name")
+		}
+		if _, ok := p.packages[pack.Name]; !ok {
+			return []byte("E: Unable to locate package " + pack.Name + "\n"), errors.New("exit status 100")
+		}
+		if pack.Version == "" {
+			continue
+		}
+		found := false
+		for _, version := range p.versions(pack.Name) {
+			found = found || version.Version == pack.Version
+		}
+		if !found {
+			return []byte("E: Version '" + pack.Version + "' for '" + pack.Name + "' was not found\n"), errors.New("exit status 100")
+		}
+	}
+	return nil, nil
+}
+
+// Versions returns the installed version of a package, its upgrade and the
+// versions added with AddVersion. The candidate is the upgrade, else the
+// installed version, else the last version added.
+func (p *Packages) Versions(name string) ([]packaging.PackageVersion, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.call("Versions"); err != nil {
+		return nil, err
+	}
+	return p.versions(name), nil
+}
+
+func (p *Packages) versions(name string) []packaging.PackageVersion {
+	res := []packaging.PackageVersion{}
+	add := func(version, origin string) *packaging.PackageVersion {
+		i := 0
+		for i < len(res) && res[i].Version != version {
+			i++
+		}
+		if i == len(res) {
+			res = append(res, packaging.PackageVersion{Version: version, Priority: 500, Origins: []string{}})
+		}
+		if origin != "" {
+			res[i].Origins = append(res[i].Origins, origin)
+		}
+		return &res[i]
+	}
+	for _, available := range p.available[name] {
+		add(available.version, available.origin)
+	}
+	pack := p.packages[name]
+	installed := pack != nil && pack.Status == "installed"
+	if installed {
+		add(pack.Version, "").Installed = true
+	}
+	if upgrade, ok := p.upgrades[name]; ok {
+		add(upgrade, "").Candidate = true
+	} else if installed {
+		add(pack.Version, "").Candidate = true
+	} else if len(res) > 0 {
+		res[len(res)-1].Candidate = true
+	}
+	return res
+}
+
+func (p *Packages) upgrade(names []string) []byte {
+	out := ""
+	for _, name := range names {
+		version, ok := p.upgrades[name]
+		pack := p.packages[name]
+		if !ok || pack == nil || pack.Status != "installed" {
+			continue
+		}
+		if p.held[name] {
+			out += fmt.Sprintf("The following packages have been kept back:\n  %s\n", name)
+			continue
+		}
+		out += fmt.Sprintf("Unpacking %s (%s) over (%s) ...\n", name, version, pack.Version)
+		pack.Version = version
+		delete(p.upgrades, name)
+	}
+	return []byte(out)
+}
+
+// Hold keeps known packages at their version, like apt-mark hold
+func (p *Packages) Hold(packs ...*apt.Package) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.call("Hold"); err != nil {
+		return nil, err
+	}
+	if out, err := p.lookup(packs); err != nil {
+		return out, err
+	}
+	out := ""
+	for _, pack := range packs {
+		p.held[pack.Name] = true
+		out += pack.Name + " set on hold.\n"
+	}
+	return []byte(out), nil
+}
+
+// Unhold lets the packages be upgraded again
+func (p *Packages) Unhold(packs ...*apt.Package) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.call("Unhold"); err != nil {
+		return nil, err
+	}
+	if out, err := p.lookup(packs); err != nil {
+		return out, err
+	}
+	out := ""
+	for _, pack := range packs {
+		if p.held[pack.Name] {
+			out += "Canceled hold on " + pack.Name + ".\n"
+		} else {
+			out += pack.Name + " was already not hold.\n"
+		}
+		delete(p.held, pack.Name)
+	}
+	return []byte(out), nil
+}
+
+// Held returns the names of the held packages, sorted
+func (p *Packages) Held() ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.call("Held"); err != nil {
+		return nil, err
+	}
+	res := []string{}
+	for name := range p.held {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// Repositories returns the configured repositories
+func (p *Packages) Repositories() (apt.RepositoryList, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.call("Repositories"); err != nil {
+		return nil, err
+	}
+	res := apt.RepositoryList{}
+	for _, repo := range p.repositories {
+		copied := *repo
+		res = append(res, &copied)
+	}
+	return res, nil
+}
+
+// AddRepository adds a repository, failing if it's already there
+func (p *Packages) AddRepository(repo *apt.Repository) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.call("AddRepository"); err != nil {
+		return err
+	}
+	if p.repositories.Contains(repo) {
+		return errors.New("The repository is already configured")
+	}
+	copied := *repo
+	p.repositories = append(p.repositories, &copied)
+	return nil
+}
+
+// RemoveRepository removes a repository, failing if it's not there
+func (p *Packages) RemoveRepository(repo *apt.Repository) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.call("RemoveRepository"); err != nil {
+		return err
+	}
+	for i, r := range p.repositories {
+		if r.Equals(repo) {
+			p.repositories = append(p.repositories[:i], p.repositories[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("Repository already removed")
+}
+
+// EditRepository replaces a repository, failing if it's not there
+func (p *Packages) EditRepository(old, new *apt.Repository) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.call("EditRepository"); err != nil {
+		return err
+	}
+	for i, r := range p.repositories {
+		if r.Equals(old) {
+			copied := *new
+			p.repositories[i] = &copied
+			return nil
+		}
+	}
+	return errors.New("Repository doesn't exist")
+}
@@ -70,7 +70,12 @@ func NewMqttTestClient() *MqttTestClient {
 
 // NewMqttTestClientLocal creates mqtt client in localhost:1883
 func NewMqttTestClientLocal() *MqttTestClient {
-	uiOptions := mqtt.NewClientOptions().AddBroker("tcp://localhost:1883").SetClientID("UI")
+	return NewMqttTestClientBroker("tcp://localhost:1883")
+}
+
+// NewMqttTestClientBroker creates mqtt client connected to the given broker
+func NewMqttTestClientBroker(brokerURL string) *MqttTestClient {
+	uiOptions := mqtt.NewClientOptions().AddBroker(brokerURL).SetClientID("UI")
 	ui := mqtt.NewClient(uiOptions)
 	if token := ui.Connect(); token.Wait() && token.Error() != nil {
 		panic(token.Error())